@@ -9,6 +9,8 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Vaayne/aienvoy/internal/pkg/parser"
@@ -56,14 +58,16 @@ var rootCmd = &cobra.Command{
 		files := viper.GetStringSlice("files")
 		urls := viper.GetStringSlice("urls")
 		texts := viper.GetStringSlice("texts")
+		tmpl := viper.GetString("template")
+		vars := viper.GetStringMapString("vars")
 
 		slog.Debug("start to run",
 			"prompt", prompt, "model", model, "system", system,
-			"files", files, "urls", urls, "texts", texts)
+			"files", files, "urls", urls, "texts", texts, "template", tmpl, "vars", vars)
 		ctx := context.Background()
 		ctx, cancelFunc := context.WithTimeout(ctx, 300*time.Second)
 		defer cancelFunc()
-		chatStreaming(ctx, model, system, prompt, files, urls, texts)
+		chatStreaming(ctx, model, system, prompt, files, urls, texts, tmpl, vars)
 	},
 }
 
@@ -89,6 +93,10 @@ func setFlags() {
 	bindFlag("system")
 	rootCmd.Flags().StringP("model", "m", "", "model")
 	bindFlag("model")
+	rootCmd.Flags().StringP("template", "T", "", "prompt template from the config file, name or name@version, the prompt is its Prompt variable")
+	bindFlag("template")
+	rootCmd.Flags().StringToString("vars", map[string]string{}, "variables of the prompt template, like --vars lang=en,tone=formal")
+	bindFlag("vars")
 	rootCmd.Flags().BoolP("help", "h", false, "help")
 }
 
@@ -112,8 +120,9 @@ func initLog(level slog.Level) {
 }
 
 type Config struct {
-	DefaultModel string       `yaml:"default_model" mapstructure:"default_model"`
-	LLMs         []llm.Config `yaml:"llms" mapstructure:"llms"`
+	DefaultModel string               `yaml:"default_model" mapstructure:"default_model"`
+	LLMs         []llm.Config         `yaml:"llms" mapstructure:"llms"`
+	Templates    []llm.PromptTemplate `yaml:"templates" mapstructure:"templates"`
 }
 
 var globalConfig = &Config{}
@@ -213,7 +222,61 @@ func builsMessages(system, prompt string, files, urls, texts []string) ([]llm.Ch
 	return messages, nil
 }
 
-func chatStreaming(ctx context.Context, model, system, prompt string, files, urls, texts []string) {
+// findTemplate returns the prompt template of the config, ref is a name for its latest version or name@version.
+func findTemplate(ref string) (llm.PromptTemplate, error) {
+	name, version, found := strings.Cut(ref, "@")
+	want := 0
+	if found {
+		n, err := strconv.Atoi(version)
+		if err != nil {
+			return llm.PromptTemplate{}, fmt.Errorf("invalid template version %s", version)
+		}
+		want = n
+	}
+
+	var tmpl llm.PromptTemplate
+	for _, t := range globalConfig.Templates {
+		if t.Name != name || (want > 0 && t.Version != want) {
+			continue
+		}
+		if tmpl.Name == "" || t.Version > tmpl.Version {
+			tmpl = t
+		}
+	}
+	if tmpl.Name == "" {
+		return tmpl, fmt.Errorf("template %s not found in config file", ref)
+	}
+	return tmpl, nil
+}
+
+// applyTemplate renders the template with the prompt as its Prompt variable, the rendered system message goes first
+// and the rendered user message replaces the prompt, which is the last message.
+func applyTemplate(messages []llm.ChatCompletionMessage, ref, prompt string, vars map[string]string) ([]llm.ChatCompletionMessage, error) {
+	tmpl, err := findTemplate(ref)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]any, len(vars)+1)
+	for k, v := range vars {
+		values[k] = v
+	}
+	values["Prompt"] = prompt
+	rendered, err := tmpl.Render(values)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range rendered {
+		if m.Role == llm.ChatMessageRoleUser {
+			messages[len(messages)-1] = m
+		} else {
+			messages = append([]llm.ChatCompletionMessage{m}, messages...)
+		}
+	}
+	return messages, nil
+}
+
+func chatStreaming(ctx context.Context, model, system, prompt string, files, urls, texts []string, tmpl string, vars map[string]string) {
 	client, err := llms.New(model, globalConfig.LLMs)
 	if err != nil {
 		slog.Error("create llm service error", "err", err)
@@ -223,6 +286,12 @@ func chatStreaming(ctx context.Context, model, system, prompt string, files, url
 	if err != nil {
 		panic(err)
 	}
+	if tmpl != "" {
+		if messages, err = applyTemplate(messages, tmpl, prompt, vars); err != nil {
+			slog.Error("apply prompt template error", "err", err, "template", tmpl)
+			os.Exit(1)
+		}
+	}
 
 	req := llm.ChatCompletionRequest{
 		Model:       model,
@@ -42,14 +42,14 @@ func main() {
 	}
 	slog.Info("get response from llm success", "model", model, "resp", resp.Choices[0].Message.Content)
 
-	covs, err := svc.ListConversations(ctx)
+	covs, err := svc.ListConversations(ctx, llm.ListOptions{})
 	if err != nil {
 		slog.Error("list conversations error", "err", err)
 		return
 	}
 	slog.Info("list conversations success", "conversations", covs)
 
-	msgs, err := svc.ListMessages(ctx, cov.Id)
+	msgs, err := svc.ListMessages(ctx, cov.Id, llm.ListOptions{})
 	if err != nil {
 		slog.Error("list messages error", "err", err)
 		return
@@ -8,9 +8,10 @@ require (
 	github.com/labstack/echo/v5 v5.0.0-20220201181537-ed2888cfa198
 	github.com/patrickmn/go-cache v2.1.0+incompatible
 	github.com/pocketbase/dbx v1.10.0
+	github.com/pkoukk/tiktoken-go v0.1.8
 	github.com/pocketbase/pocketbase v0.16.8
 	github.com/refraction-networking/utls v1.6.1
-	github.com/sashabaranov/go-openai v1.17.9
+	github.com/sashabaranov/go-openai v1.24.0
 	github.com/spf13/viper v1.18.2
 	github.com/vaayne/gtk v0.0.0-20240115152302-a965f5106ff3
 	golang.org/x/sync v0.5.0
@@ -24,6 +25,7 @@ require (
 	github.com/andybalholm/cascadia v1.3.2 // indirect
 	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/davecgh/go-spew v1.1.2-0.20180830191138-d8f796af33cc // indirect
+	github.com/dlclark/regexp2 v1.10.0 // indirect
 	github.com/go-rod/rod v0.114.5 // indirect
 	github.com/go-shiori/dom v0.0.0-20210627111528-4e4722cd0d65 // indirect
 	github.com/go-shiori/go-readability v0.0.0-20231029095239-6b97d5aba789 // indirect
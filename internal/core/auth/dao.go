@@ -2,7 +2,10 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"path"
+	"strings"
 
 	"github.com/Vaayne/aienvoy/internal/pkg/dtoutils"
 
@@ -15,11 +18,63 @@ const (
 	ColumnApiKey = "api_key"
 )
 
+// ErrModelNotAllowed is matched by the errors of the requests for a model out of the allow-list of their api key.
+var ErrModelNotAllowed = errors.New("model not allowed")
+
 type ApiKey struct {
 	dtoutils.BaseModel
-	ApiKey    string   `json:"api_key,omitempty" mapstructure:"api_key,omitempty"`
-	UserId    string   `json:"user_id,omitempty" mapstructure:"user_id,omitempty"`
+	ApiKey string `json:"api_key,omitempty" mapstructure:"api_key,omitempty"`
+	UserId string `json:"user_id,omitempty" mapstructure:"user_id,omitempty"`
+	// LlmModels are the models the key may use, patterns like gpt-3.5* are supported, all models when empty
 	LlmModels []string `json:"llm_models,omitempty" mapstructure:"llm_models,omitempty"`
+	// RPM, TokensPerDay and MonthlyBudget (USD) limit the key, a limit of zero is unlimited
+	RPM           int     `json:"rpm,omitempty" mapstructure:"rpm,omitempty"`
+	TokensPerDay  int     `json:"tokens_per_day,omitempty" mapstructure:"tokens_per_day,omitempty"`
+	MonthlyBudget float64 `json:"monthly_budget,omitempty" mapstructure:"monthly_budget,omitempty"`
+}
+
+// AllowModel reports whether the key may use the model, the model may be prefixed with a provider like openai/gpt-4.
+func (k ApiKey) AllowModel(model string) bool {
+	if len(k.LlmModels) == 0 {
+		return true
+	}
+	_, modelId, _ := strings.Cut(model, "/")
+	for _, pattern := range k.LlmModels {
+		for _, name := range []string{model, modelId} {
+			if ok, _ := path.Match(pattern, name); ok && name != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckModel returns an ErrModelNotAllowed error when the key may not use the model.
+func (k ApiKey) CheckModel(model string) error {
+	if !k.AllowModel(model) {
+		return fmt.Errorf("%w: the api key is not allowed to use the model %s", ErrModelNotAllowed, model)
+	}
+	return nil
+}
+
+// IsApiKeyRecord reports whether the auth record of a request is an api key, and not a user or an admin.
+func IsApiKeyRecord(record *models.Record) bool {
+	return record != nil && record.Collection().Name == TableApiKeys
+}
+
+func ApiKeyFromRecord(record *models.Record) (ApiKey, error) {
+	var key ApiKey
+	err := dtoutils.FromRecord(record, &key)
+	return key, err
+}
+
+// GetApiKey returns the api key by its record id.
+func GetApiKey(tx *daos.Dao, id string) (ApiKey, error) {
+	record, err := tx.FindRecordById(TableApiKeys, id)
+	if err != nil {
+		return ApiKey{}, err
+	}
+	return ApiKeyFromRecord(record)
 }
 
 func FindAuthRecordByApiKey(ctx context.Context, tx *daos.Dao, apiKey string) (*models.Record, error) {
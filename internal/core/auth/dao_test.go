@@ -0,0 +1,18 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApiKeyCheckModel(t *testing.T) {
+	key := ApiKey{LlmModels: []string{"gpt-4*", "anthropic/*"}}
+	assert.NoError(t, key.CheckModel("gpt-4-turbo"))
+	assert.NoError(t, key.CheckModel("openai/gpt-4"))
+	assert.NoError(t, key.CheckModel("anthropic/claude-2"))
+	assert.ErrorIs(t, key.CheckModel("gpt-3.5-turbo"), ErrModelNotAllowed)
+	assert.ErrorIs(t, key.CheckModel(""), ErrModelNotAllowed)
+
+	assert.NoError(t, ApiKey{}.CheckModel("gpt-3.5-turbo"))
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter counts the requests of each key in a sliding window.
+type RateLimiter struct {
+	mu       sync.Mutex
+	window   time.Duration
+	requests map[string][]time.Time
+}
+
+func NewRateLimiter(window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		window:   window,
+		requests: make(map[string][]time.Time),
+	}
+}
+
+// Allow counts a request of the key unless the limit is reached in the window. It returns the requests
+// left in the window and the time until the oldest request leaves it.
+func (l *RateLimiter) Allow(key string, limit int) (int, time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	requests := l.requests[key]
+	i := 0
+	for i < len(requests) && now.Sub(requests[i]) >= l.window {
+		i++
+	}
+	requests = requests[i:]
+
+	allowed := len(requests) < limit
+	if allowed {
+		requests = append(requests, now)
+	}
+	if len(requests) == 0 {
+		delete(l.requests, key)
+		return limit, 0, allowed
+	}
+	l.requests[key] = requests
+	return max(limit-len(requests), 0), l.window - now.Sub(requests[0]), allowed
+}
@@ -0,0 +1,262 @@
+package batches
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Vaayne/aienvoy/internal/core/auth"
+	"github.com/Vaayne/aienvoy/internal/pkg/ctxutils"
+	"github.com/Vaayne/aienvoy/internal/pkg/dtoutils"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/google/uuid"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+type Dao struct {
+	tx *daos.Dao
+}
+
+func NewDao(tx *daos.Dao) *Dao {
+	return &Dao{tx: tx}
+}
+
+// scope restricts the queries to the rows of the user of ctx, admins which asked for all users are not restricted.
+func (d *Dao) scope(ctx context.Context) dbx.Expression {
+	if ctxutils.IsAllUsers(ctx) {
+		return nil
+	}
+	return dbx.HashExp{"user_id": ctxutils.GetUserId(ctx)}
+}
+
+// one reads the row of the table with the id, rows out of the scope are not found.
+func (d *Dao) one(table, id string, scope dbx.Expression, dto any) error {
+	err := d.tx.DB().Select().From(table).Where(dbx.HashExp{"id": id}).AndWhere(scope).One(dto)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s %s: %w", table, id, llm.ErrNotFound)
+	}
+	return err
+}
+
+func newBaseModel() dtoutils.BaseModel {
+	return dtoutils.BaseModel{
+		Id:      uuid.NewString(),
+		Created: types.NowDateTime(),
+		Updated: types.NowDateTime(),
+	}
+}
+
+// SaveFile saves a new file of the user of ctx.
+func (d *Dao) SaveFile(ctx context.Context, filename, purpose string, content []byte) (llm.File, error) {
+	dto := FileDTO{
+		BaseModel: newBaseModel(),
+		UserId:    ctxutils.GetUserId(ctx),
+		Filename:  filename,
+		Purpose:   purpose,
+		Bytes:     len(content),
+		Content:   string(content),
+	}
+	if err := d.tx.DB().Model(&dto).Insert(); err != nil {
+		return llm.File{}, err
+	}
+	return dto.ToFile(), nil
+}
+
+func (d *Dao) GetFile(ctx context.Context, id string) (llm.File, error) {
+	var dto FileDTO
+	if err := d.one(tableNameBatchFiles, id, d.scope(ctx), &dto); err != nil {
+		return llm.File{}, err
+	}
+	return dto.ToFile(), nil
+}
+
+// GetFileContent returns the file with its content.
+func (d *Dao) GetFileContent(ctx context.Context, id string) (llm.File, []byte, error) {
+	var dto FileDTO
+	if err := d.one(tableNameBatchFiles, id, d.scope(ctx), &dto); err != nil {
+		return llm.File{}, nil, err
+	}
+	return dto.ToFile(), []byte(dto.Content), nil
+}
+
+// CreateBatch saves a new batch of the input file, it is validated by the runner.
+func (d *Dao) CreateBatch(ctx context.Context, inputFileId string, metadata map[string]string) (llm.Batch, error) {
+	file, err := d.GetFile(ctx, inputFileId)
+	if err != nil {
+		return llm.Batch{}, err
+	}
+	if file.Purpose != llm.FilePurposeBatch {
+		return llm.Batch{}, fmt.Errorf("%w: the purpose of file %s is not %s", llm.ErrInvalidBatch, file.Id, llm.FilePurposeBatch)
+	}
+
+	dto := BatchDTO{
+		BaseModel:        newBaseModel(),
+		UserId:           ctxutils.GetUserId(ctx),
+		ApiKeyId:         ctxutils.GetApiKeyId(ctx),
+		Endpoint:         llm.BatchEndpointChatCompletions,
+		InputFileId:      inputFileId,
+		CompletionWindow: llm.BatchCompletionWindow,
+		Status:           string(llm.BatchStatusValidating),
+	}
+	dto.ExpiresAt = mustParseDateTime(dto.Created.Time().Add(completionWindow))
+	if len(metadata) > 0 {
+		dto.Metadata = string(mustMarshal(metadata))
+	}
+	if err := d.tx.DB().Model(&dto).Insert(); err != nil {
+		return llm.Batch{}, err
+	}
+	return dto.ToBatch(), nil
+}
+
+// CheckModels returns an auth.ErrModelNotAllowed error when a request of the input file uses a model the api key
+// may not use. The invalid lines are left to the runner, which fails the batch with them.
+func (d *Dao) CheckModels(ctx context.Context, inputFileId string, key auth.ApiKey) error {
+	_, content, err := d.GetFileContent(ctx, inputFileId)
+	if err != nil {
+		return err
+	}
+	requests, _ := llm.ReadBatchRequests(bytes.NewReader(content))
+	for _, req := range requests {
+		if err := key.CheckModel(req.Body.Model); err != nil {
+			return fmt.Errorf("request %s: %w", req.CustomId, err)
+		}
+	}
+	return nil
+}
+
+func (d *Dao) GetBatch(ctx context.Context, id string) (llm.Batch, error) {
+	var dto BatchDTO
+	if err := d.one(tableNameBatches, id, d.scope(ctx), &dto); err != nil {
+		return llm.Batch{}, err
+	}
+	return dto.ToBatch(), nil
+}
+
+// ListBatches lists the batches newest first, after is the id of the last batch of the previous page.
+func (d *Dao) ListBatches(ctx context.Context, after string, limit int) ([]llm.Batch, error) {
+	query := d.tx.DB().Select().From(tableNameBatches).Where(d.scope(ctx))
+	if after != "" {
+		var dto BatchDTO
+		if err := d.one(tableNameBatches, after, d.scope(ctx), &dto); err != nil {
+			return nil, fmt.Errorf("%w: %v", llm.ErrCursorNotFound, err)
+		}
+		query.AndWhere(dbx.NewExp("created < {:created} OR (created = {:created} AND id < {:id})",
+			dbx.Params{"created": dto.Created.String(), "id": dto.Id}))
+	}
+	var dtos []BatchDTO
+	if err := query.OrderBy("created DESC", "id DESC").Limit(int64(limit)).All(&dtos); err != nil {
+		return nil, err
+	}
+	batches := make([]llm.Batch, 0, len(dtos))
+	for _, dto := range dtos {
+		batches = append(batches, dto.ToBatch())
+	}
+	return batches, nil
+}
+
+// CancelBatch asks the runner to stop the batch, the batch is cancelled once its running requests are done.
+func (d *Dao) CancelBatch(ctx context.Context, id string) (llm.Batch, error) {
+	var dto BatchDTO
+	if err := d.one(tableNameBatches, id, d.scope(ctx), &dto); err != nil {
+		return llm.Batch{}, err
+	}
+	status := llm.BatchStatus(dto.Status)
+	if status.Done() || status == llm.BatchStatusCancelling {
+		return dto.ToBatch(), nil
+	}
+	dto.Status = string(llm.BatchStatusCancelling)
+	dto.CancellingAt = types.NowDateTime()
+	dto.Updated = types.NowDateTime()
+	// only the status is updated, the counts are incremented by the runner meanwhile
+	_, err := d.tx.DB().Update(tableNameBatches, dbx.Params{
+		"status":        dto.Status,
+		"cancelling_at": dto.CancellingAt.String(),
+		"updated":       dto.Updated.String(),
+	}, dbx.HashExp{"id": dto.Id}).Execute()
+	if err != nil {
+		return llm.Batch{}, err
+	}
+	return dto.ToBatch(), nil
+}
+
+// getBatch reads a batch of any user, for the runner.
+func (d *Dao) getBatch(id string) (BatchDTO, error) {
+	var dto BatchDTO
+	err := d.one(tableNameBatches, id, nil, &dto)
+	return dto, err
+}
+
+func (d *Dao) updateBatch(dto *BatchDTO) error {
+	dto.Updated = types.NowDateTime()
+	return d.tx.DB().Model(dto).Update()
+}
+
+// listUnfinished returns the ids of the batches of every user which are not done, oldest first.
+func (d *Dao) listUnfinished() ([]string, error) {
+	var ids []string
+	err := d.tx.DB().Select("id").From(tableNameBatches).
+		Where(dbx.In("status",
+			string(llm.BatchStatusValidating), string(llm.BatchStatusInProgress),
+			string(llm.BatchStatusFinalizing), string(llm.BatchStatusCancelling))).
+		OrderBy("created ASC").
+		Column(&ids)
+	return ids, err
+}
+
+// saveResult saves the result of a request and counts it in its batch.
+func (d *Dao) saveResult(batchId string, position int, result llm.BatchResult) error {
+	dto := RequestDTO{
+		BaseModel: newBaseModel(),
+		BatchId:   batchId,
+		CustomId:  result.CustomId,
+		Position:  position,
+		Succeeded: result.Succeeded(),
+		Result:    string(mustMarshal(result)),
+	}
+	if err := d.tx.DB().Model(&dto).Insert(); err != nil {
+		return err
+	}
+	counter := "failed"
+	if dto.Succeeded {
+		counter = "completed"
+	}
+	_, err := d.tx.DB().NewQuery(fmt.Sprintf("UPDATE batches SET %[1]s = %[1]s + 1, updated = {:updated} WHERE id = {:id}", counter)).
+		Bind(dbx.Params{"updated": types.NowDateTime().String(), "id": batchId}).
+		Execute()
+	return err
+}
+
+// listResults returns the results of the requests of the batch, in the order of the input file.
+func (d *Dao) listResults(batchId string) ([]RequestDTO, error) {
+	var dtos []RequestDTO
+	err := d.tx.DB().Select().From(tableNameBatchRequests).
+		Where(dbx.HashExp{"batch_id": batchId}).
+		OrderBy("position ASC").
+		All(&dtos)
+	return dtos, err
+}
+
+// saveResultFile saves the results as a file of the user of the batch, it returns its id.
+func (d *Dao) saveResultFile(batch BatchDTO, name string, results []llm.BatchResult) (string, error) {
+	var sb strings.Builder
+	if err := llm.WriteBatchResults(&sb, results); err != nil {
+		return "", err
+	}
+	dto := FileDTO{
+		BaseModel: newBaseModel(),
+		UserId:    batch.UserId,
+		Filename:  fmt.Sprintf("batch_%s_%s.jsonl", batch.Id, name),
+		Purpose:   llm.FilePurposeBatchOutput,
+		Bytes:     sb.Len(),
+		Content:   sb.String(),
+	}
+	if err := d.tx.DB().Model(&dto).Insert(); err != nil {
+		return "", err
+	}
+	return dto.Id, nil
+}
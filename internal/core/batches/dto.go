@@ -0,0 +1,159 @@
+package batches
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/Vaayne/aienvoy/internal/pkg/dtoutils"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	tableNameBatchFiles    = "batch_files"
+	tableNameBatches       = "batches"
+	tableNameBatchRequests = "batch_requests"
+)
+
+// FileDTO is an uploaded input file or the results of a batch, the content is kept in the database.
+type FileDTO struct {
+	dtoutils.BaseModel
+	UserId   string `json:"user_id" db:"user_id"`
+	Filename string `json:"filename" db:"filename"`
+	Purpose  string `json:"purpose" db:"purpose"`
+	Bytes    int    `json:"bytes" db:"bytes"`
+	Content  string `json:"content" db:"content"`
+}
+
+func (f FileDTO) TableName() string {
+	return tableNameBatchFiles
+}
+
+func (f FileDTO) ToFile() llm.File {
+	return llm.File{
+		Id:        f.Id,
+		Object:    "file",
+		Bytes:     f.Bytes,
+		CreatedAt: unix(f.Created),
+		Filename:  f.Filename,
+		Purpose:   f.Purpose,
+	}
+}
+
+type BatchDTO struct {
+	dtoutils.BaseModel
+	UserId string `json:"user_id" db:"user_id"`
+	// ApiKeyId is the api key the batch was created with, the usage of its requests is recorded with it
+	ApiKeyId         string         `json:"api_key_id,omitempty" db:"api_key_id"`
+	Endpoint         string         `json:"endpoint" db:"endpoint"`
+	InputFileId      string         `json:"input_file_id" db:"input_file_id"`
+	OutputFileId     string         `json:"output_file_id,omitempty" db:"output_file_id"`
+	ErrorFileId      string         `json:"error_file_id,omitempty" db:"error_file_id"`
+	CompletionWindow string         `json:"completion_window" db:"completion_window"`
+	Status           string         `json:"status" db:"status"`
+	Total            int            `json:"total" db:"total"`
+	Completed        int            `json:"completed" db:"completed"`
+	Failed           int            `json:"failed" db:"failed"`
+	Metadata         string         `json:"metadata,omitempty" db:"metadata"`
+	Errors           string         `json:"errors,omitempty" db:"errors"`
+	InProgressAt     types.DateTime `json:"in_progress_at,omitempty" db:"in_progress_at"`
+	ExpiresAt        types.DateTime `json:"expires_at,omitempty" db:"expires_at"`
+	FinalizingAt     types.DateTime `json:"finalizing_at,omitempty" db:"finalizing_at"`
+	CompletedAt      types.DateTime `json:"completed_at,omitempty" db:"completed_at"`
+	FailedAt         types.DateTime `json:"failed_at,omitempty" db:"failed_at"`
+	ExpiredAt        types.DateTime `json:"expired_at,omitempty" db:"expired_at"`
+	CancellingAt     types.DateTime `json:"cancelling_at,omitempty" db:"cancelling_at"`
+	CancelledAt      types.DateTime `json:"cancelled_at,omitempty" db:"cancelled_at"`
+}
+
+func (b BatchDTO) TableName() string {
+	return tableNameBatches
+}
+
+func (b BatchDTO) ToBatch() llm.Batch {
+	batch := llm.Batch{
+		Id:               b.Id,
+		Object:           "batch",
+		Endpoint:         b.Endpoint,
+		InputFileId:      b.InputFileId,
+		CompletionWindow: b.CompletionWindow,
+		Status:           llm.BatchStatus(b.Status),
+		OutputFileId:     b.OutputFileId,
+		ErrorFileId:      b.ErrorFileId,
+		CreatedAt:        unix(b.Created),
+		InProgressAt:     unix(b.InProgressAt),
+		ExpiresAt:        unix(b.ExpiresAt),
+		FinalizingAt:     unix(b.FinalizingAt),
+		CompletedAt:      unix(b.CompletedAt),
+		FailedAt:         unix(b.FailedAt),
+		ExpiredAt:        unix(b.ExpiredAt),
+		CancellingAt:     unix(b.CancellingAt),
+		CancelledAt:      unix(b.CancelledAt),
+		RequestCounts: llm.BatchRequestCounts{
+			Total:     b.Total,
+			Completed: b.Completed,
+			Failed:    b.Failed,
+		},
+	}
+	if b.Metadata != "" {
+		mustUnMarshal([]byte(b.Metadata), &batch.Metadata)
+	}
+	if b.Errors != "" {
+		batch.Errors = &llm.BatchErrors{Object: "list"}
+		mustUnMarshal([]byte(b.Errors), &batch.Errors.Data)
+	}
+	return batch
+}
+
+// RequestDTO is the result of a request of a batch, the requests without a result are run when the batch resumes.
+type RequestDTO struct {
+	dtoutils.BaseModel
+	BatchId  string `json:"batch_id" db:"batch_id"`
+	CustomId string `json:"custom_id" db:"custom_id"`
+	// Position is the position of the request in the input file, the results are written in the same order
+	Position  int    `json:"position" db:"position"`
+	Succeeded bool   `json:"succeeded" db:"succeeded"`
+	Result    string `json:"result" db:"result"`
+}
+
+func (r RequestDTO) TableName() string {
+	return tableNameBatchRequests
+}
+
+func (r RequestDTO) ToBatchResult() llm.BatchResult {
+	var result llm.BatchResult
+	mustUnMarshal([]byte(r.Result), &result)
+	return result
+}
+
+func unix(dt types.DateTime) int64 {
+	if dt.IsZero() {
+		return 0
+	}
+	return dt.Time().Unix()
+}
+
+func mustParseDateTime(t time.Time) types.DateTime {
+	dt, err := types.ParseDateTime(t)
+	if err != nil {
+		panic(err)
+	}
+	return dt
+}
+
+func mustMarshal(in any) []byte {
+	out, err := json.Marshal(in)
+	if err != nil {
+		slog.Error("must marshal object error", "err", err)
+	}
+	return out
+}
+
+// mustUnMarshal
+// out must be pointer
+func mustUnMarshal(in []byte, out any) {
+	if err := json.Unmarshal(in, out); err != nil {
+		slog.Error("must unmarshal object error", "err", err)
+	}
+}
@@ -0,0 +1,339 @@
+package batches
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Vaayne/aienvoy/internal/core/auth"
+	"github.com/Vaayne/aienvoy/internal/core/llms"
+	"github.com/Vaayne/aienvoy/internal/core/prompts"
+	"github.com/Vaayne/aienvoy/internal/pkg/config"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/google/uuid"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	// completionWindow is how long a batch runs, the requests not done by then expire
+	completionWindow = 24 * time.Hour
+	// defaultConcurrency is the number of requests run at the same time across the batches
+	defaultConcurrency = 4
+)
+
+var errBatchCancelled = errors.New("batch cancelled")
+
+var (
+	defaultRunner   *Runner
+	defaultRunnerMu sync.Mutex
+)
+
+// Runner runs the requests of the batches in the background against the llm router. The results are saved
+// one by one, so the batches left unfinished by a restart resume with the requests which have no result yet.
+type Runner struct {
+	dao *Dao
+	sem *semaphore.Weighted
+	// Resolve returns the client of a model, defaults to the router
+	Resolve func(model string) (*llm.LLM, error)
+
+	mu sync.Mutex
+	// running cancels the batches run by this process
+	running map[string]context.CancelCauseFunc
+}
+
+// NewRunner creates a runner which runs at most concurrency requests at the same time, with the clients of the registry.
+func NewRunner(tx *daos.Dao, registry *llms.Registry, concurrency int) *Runner {
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	return &Runner{
+		dao: NewDao(tx),
+		sem: semaphore.NewWeighted(int64(concurrency)),
+		Resolve: func(model string) (*llm.LLM, error) {
+			return registry.NewWithDao(model, llms.NewDao(tx))
+		},
+		running: make(map[string]context.CancelCauseFunc),
+	}
+}
+
+// Start creates the default runner and resumes the batches which are not done.
+func Start(tx *daos.Dao, registry *llms.Registry) *Runner {
+	defaultRunnerMu.Lock()
+	defer defaultRunnerMu.Unlock()
+	if defaultRunner == nil {
+		defaultRunner = NewRunner(tx, registry, config.GetConfig().LLMBatchConcurrency)
+		defaultRunner.Resume()
+	}
+	return defaultRunner
+}
+
+// Resume runs the batches which are not done, like after a restart.
+func (r *Runner) Resume() {
+	ids, err := r.dao.listUnfinished()
+	if err != nil {
+		slog.Error("list unfinished batches error", "err", err)
+		return
+	}
+	for _, id := range ids {
+		r.Submit(id)
+	}
+	slog.Info("resume batches", "count", len(ids))
+}
+
+// Submit runs the batch in the background, it does nothing when the batch is already running.
+func (r *Runner) Submit(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.running[id]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	r.running[id] = cancel
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			delete(r.running, id)
+			r.mu.Unlock()
+			cancel(nil)
+		}()
+		if err := r.run(ctx, id); err != nil {
+			slog.Error("run batch error", "err", err, "batch_id", id)
+		}
+	}()
+}
+
+// Cancel cancels the batch of the user of ctx, the requests which are running are done first.
+func (r *Runner) Cancel(ctx context.Context, id string) (llm.Batch, error) {
+	batch, err := r.dao.CancelBatch(ctx, id)
+	if err != nil {
+		return batch, err
+	}
+	r.mu.Lock()
+	cancel, ok := r.running[id]
+	r.mu.Unlock()
+	if ok {
+		cancel(errBatchCancelled)
+	} else if batch.Status == llm.BatchStatusCancelling {
+		r.Submit(id)
+	}
+	return batch, nil
+}
+
+// run validates the input file of the batch, runs the requests which have no result and writes the result files.
+func (r *Runner) run(ctx context.Context, id string) error {
+	batch, err := r.dao.getBatch(id)
+	if err != nil {
+		return err
+	}
+	if llm.BatchStatus(batch.Status).Done() {
+		return nil
+	}
+	_, content, err := r.dao.GetFileContent(r.userContext(context.Background(), batch), batch.InputFileId)
+	if err != nil {
+		return r.fail(&batch, []llm.BatchError{{Code: "invalid_file", Message: err.Error()}})
+	}
+	requests, errs := llm.ReadBatchRequests(bytes.NewReader(content))
+	if len(errs) > 0 {
+		return r.fail(&batch, errs)
+	}
+
+	if llm.BatchStatus(batch.Status) == llm.BatchStatusValidating {
+		batch.Status = string(llm.BatchStatusInProgress)
+		batch.Total = len(requests)
+		batch.InProgressAt = types.NowDateTime()
+		if err := r.dao.updateBatch(&batch); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := context.WithDeadline(ctx, batch.ExpiresAt.Time())
+	defer stop()
+	if llm.BatchStatus(batch.Status) == llm.BatchStatusInProgress {
+		// the requests of a batch created with an api key are limited like the requests sent with it
+		var key *auth.ApiKey
+		if batch.ApiKeyId != "" {
+			apiKey, err := auth.GetApiKey(r.dao.tx, batch.ApiKeyId)
+			if err != nil {
+				return r.fail(&batch, []llm.BatchError{{Code: "invalid_api_key", Message: "load the api key of the batch error: " + err.Error()}})
+			}
+			key = &apiKey
+		}
+		if err := r.runRequests(r.userContext(ctx, batch), batch, key, requests); err != nil {
+			return err
+		}
+	}
+	return r.finalize(ctx, id, requests)
+}
+
+// runRequests runs the requests of the batch which have no result, until they are all done or ctx is done.
+// The requests are checked against the limits of the api key of the batch, when it has one.
+func (r *Runner) runRequests(ctx context.Context, batch BatchDTO, key *auth.ApiKey, requests []llm.BatchRequest) error {
+	results, err := r.dao.listResults(batch.Id)
+	if err != nil {
+		return err
+	}
+	done := make(map[string]bool, len(results))
+	for _, result := range results {
+		done[result.CustomId] = true
+	}
+	slog.InfoContext(ctx, "run batch", "batch_id", batch.Id, "total", len(requests), "done", len(done))
+
+	var wg sync.WaitGroup
+	for i, req := range requests {
+		if done[req.CustomId] {
+			continue
+		}
+		if err := r.sem.Acquire(ctx, 1); err != nil {
+			break
+		}
+		wg.Add(1)
+		go func(position int, req llm.BatchRequest) {
+			defer wg.Done()
+			defer r.sem.Release(1)
+			result := r.complete(ctx, key, req)
+			if ctx.Err() != nil {
+				// the request was interrupted, it is run again if the batch resumes
+				return
+			}
+			if err := r.dao.saveResult(batch.Id, position, result); err != nil {
+				slog.ErrorContext(ctx, "save batch result error", "err", err, "batch_id", batch.Id, "custom_id", req.CustomId)
+			}
+		}(i, req)
+	}
+	wg.Wait()
+	return nil
+}
+
+// complete sends a request of a batch, the prompt template of the request is rendered first.
+func (r *Runner) complete(ctx context.Context, key *auth.ApiKey, req llm.BatchRequest) llm.BatchResult {
+	body := req.Body
+	if err := prompts.NewDao(r.dao.tx).Apply(ctx, &body); err != nil {
+		return llm.NewBatchResult(req.CustomId, llm.ChatCompletionResponse{}, err)
+	}
+	if key != nil {
+		if err := r.checkApiKey(ctx, *key, body.Model); err != nil {
+			return llm.NewBatchResult(req.CustomId, llm.ChatCompletionResponse{}, err)
+		}
+	}
+	svc, err := r.Resolve(body.Model)
+	if err != nil {
+		return llm.NewBatchResult(req.CustomId, llm.ChatCompletionResponse{}, llm.NewAPIError(http.StatusBadRequest, err.Error()))
+	}
+	resp, err := svc.CreateChatCompletion(ctx, body)
+	return llm.NewBatchResult(req.CustomId, resp, err)
+}
+
+// checkApiKey returns an error when the api key may not use the model, or used up its tokens of the day or its monthly budget.
+// The usage is read for every request, so the requests after the one which exceeds a limit fail.
+func (r *Runner) checkApiKey(ctx context.Context, key auth.ApiKey, model string) error {
+	if err := key.CheckModel(model); err != nil {
+		return llm.NewAPIError(http.StatusForbidden, err.Error())
+	}
+	quota, err := llms.NewDao(r.dao.tx).ApiKeyQuota(ctx, key, time.Now())
+	if err != nil {
+		slog.ErrorContext(ctx, "get api key quota error", "err", err, "api_key_id", key.Id)
+	}
+	if err := quota.Err(); err != nil {
+		return llm.NewAPIError(http.StatusTooManyRequests, err.Error())
+	}
+	return nil
+}
+
+// finalize writes the output and error files of the batch. A batch stopped by its deadline is expired,
+// its requests without a result are written to the error file.
+func (r *Runner) finalize(ctx context.Context, id string, requests []llm.BatchRequest) error {
+	// the batch is read again for its counts and a cancellation
+	batch, err := r.dao.getBatch(id)
+	if err != nil {
+		return err
+	}
+	status := llm.BatchStatusCompleted
+	switch {
+	case llm.BatchStatus(batch.Status) == llm.BatchStatusCancelling || errors.Is(context.Cause(ctx), errBatchCancelled):
+		status = llm.BatchStatusCancelled
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		status = llm.BatchStatusExpired
+	case ctx.Err() != nil:
+		// the process is stopping, the batch resumes on the next start
+		return ctx.Err()
+	}
+	if status == llm.BatchStatusCompleted && batch.FinalizingAt.IsZero() {
+		batch.Status = string(llm.BatchStatusFinalizing)
+		batch.FinalizingAt = types.NowDateTime()
+		if err := r.dao.updateBatch(&batch); err != nil {
+			return err
+		}
+	}
+
+	dtos, err := r.dao.listResults(id)
+	if err != nil {
+		return err
+	}
+	outputs := make([]llm.BatchResult, 0, len(dtos))
+	errs := make([]llm.BatchResult, 0)
+	done := make(map[string]bool, len(dtos))
+	for _, dto := range dtos {
+		done[dto.CustomId] = true
+		if dto.Succeeded {
+			outputs = append(outputs, dto.ToBatchResult())
+		} else {
+			errs = append(errs, dto.ToBatchResult())
+		}
+	}
+	if status == llm.BatchStatusExpired {
+		for _, req := range requests {
+			if !done[req.CustomId] {
+				errs = append(errs, llm.BatchResult{
+					Id:       "batch_req_" + uuid.NewString(),
+					CustomId: req.CustomId,
+					Error:    &llm.BatchError{Code: "batch_expired", Message: "the request could not be run before the batch expired"},
+				})
+			}
+		}
+	}
+
+	if len(outputs) > 0 {
+		if batch.OutputFileId, err = r.dao.saveResultFile(batch, "output", outputs); err != nil {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		if batch.ErrorFileId, err = r.dao.saveResultFile(batch, "error", errs); err != nil {
+			return err
+		}
+	}
+	batch.Status = string(status)
+	now := types.NowDateTime()
+	switch status {
+	case llm.BatchStatusCancelled:
+		batch.CancelledAt = now
+	case llm.BatchStatusExpired:
+		batch.ExpiredAt = now
+	default:
+		batch.CompletedAt = now
+	}
+	err = r.dao.updateBatch(&batch)
+	slog.Info("batch done", "batch_id", id, "status", status, "completed", batch.Completed, "failed", batch.Failed, "err", err)
+	return err
+}
+
+// fail fails the batch with the errors of its input file.
+func (r *Runner) fail(batch *BatchDTO, errs []llm.BatchError) error {
+	batch.Status = string(llm.BatchStatusFailed)
+	batch.Errors = string(mustMarshal(errs))
+	batch.FailedAt = types.NowDateTime()
+	slog.Warn("batch failed", "batch_id", batch.Id, "errors", len(errs))
+	return r.dao.updateBatch(batch)
+}
+
+// userContext returns a context of the user and the api key of the batch, the usage of the requests is recorded with them.
+func (r *Runner) userContext(ctx context.Context, batch BatchDTO) context.Context {
+	ctx = context.WithValue(ctx, config.ContextKeyUserId, batch.UserId)
+	return context.WithValue(ctx, config.ContextKeyApiKeyId, batch.ApiKeyId)
+}
@@ -0,0 +1,153 @@
+package batches
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/Vaayne/aienvoy/migrations"
+
+	"github.com/Vaayne/aienvoy/internal/core/auth"
+	"github.com/Vaayne/aienvoy/internal/pkg/config"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echoClient replies with the content of the last message, or fails when it is "fail".
+type echoClient struct{}
+
+func (c echoClient) ListModels() []string {
+	return []string{"echo"}
+}
+
+func (c echoClient) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+	content := req.Messages[len(req.Messages)-1].TextContent()
+	if content == "fail" {
+		errChan <- llm.NewAPIError(http.StatusBadRequest, "bad request")
+		return
+	}
+	dataChan <- llm.ChatCompletionStreamResponse{Choices: []llm.ChatCompletionStreamChoice{{Delta: llm.ChatCompletionStreamChoiceDelta{Content: content}}}}
+	errChan <- io.EOF
+}
+
+func newTestRunner(t *testing.T) *Runner {
+	app, err := tests.NewTestApp()
+	require.NoError(t, err)
+	t.Cleanup(app.Cleanup)
+
+	runner, err := migrate.NewRunner(app.DB(), m.AppMigrations)
+	require.NoError(t, err)
+	_, err = runner.Up()
+	require.NoError(t, err)
+
+	r := NewRunner(app.Dao(), nil, 2)
+	r.Resolve = func(model string) (*llm.LLM, error) {
+		return llm.New(llm.NewMemoryDao(), echoClient{}), nil
+	}
+	return r
+}
+
+func batchInput(contents ...string) []byte {
+	var sb strings.Builder
+	for i, content := range contents {
+		sb.WriteString(`{"custom_id":"req-` + string(rune('a'+i)) + `","method":"POST","url":"/v1/chat/completions",`)
+		sb.WriteString(`"body":{"model":"echo","messages":[{"role":"user","content":"` + content + `"}]}}` + "\n")
+	}
+	return []byte(sb.String())
+}
+
+func waitBatch(t *testing.T, r *Runner, id string) llm.Batch {
+	var batch llm.Batch
+	require.Eventually(t, func() bool {
+		var err error
+		batch, err = r.dao.GetBatch(context.Background(), id)
+		require.NoError(t, err)
+		return batch.Status.Done()
+	}, 5*time.Second, 10*time.Millisecond)
+	return batch
+}
+
+func TestRunner(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRunner(t)
+
+	file, err := r.dao.SaveFile(ctx, "input.jsonl", llm.FilePurposeBatch, batchInput("hello", "fail", "world"))
+	require.NoError(t, err)
+	batch, err := r.dao.CreateBatch(ctx, file.Id, map[string]string{"job": "eval"})
+	require.NoError(t, err)
+	assert.Equal(t, llm.BatchStatusValidating, batch.Status)
+
+	r.Submit(batch.Id)
+	batch = waitBatch(t, r, batch.Id)
+	assert.Equal(t, llm.BatchStatusCompleted, batch.Status)
+	assert.Equal(t, llm.BatchRequestCounts{Total: 3, Completed: 2, Failed: 1}, batch.RequestCounts)
+	assert.Equal(t, "eval", batch.Metadata["job"])
+
+	_, output, err := r.dao.GetFileContent(ctx, batch.OutputFileId)
+	require.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(output, []byte("\n")))
+	assert.Contains(t, string(output), `"custom_id":"req-a"`)
+	assert.Contains(t, string(output), `"custom_id":"req-c"`)
+
+	_, errs, err := r.dao.GetFileContent(ctx, batch.ErrorFileId)
+	require.NoError(t, err)
+	assert.Contains(t, string(errs), `"custom_id":"req-b"`)
+	assert.Contains(t, string(errs), `"status_code":400`)
+}
+
+func TestRunnerInvalidFile(t *testing.T) {
+	ctx := context.Background()
+	r := newTestRunner(t)
+
+	file, err := r.dao.SaveFile(ctx, "input.jsonl", llm.FilePurposeBatch, []byte("{\"custom_id\":\"a\"}\nnot json\n"))
+	require.NoError(t, err)
+	batch, err := r.dao.CreateBatch(ctx, file.Id, nil)
+	require.NoError(t, err)
+
+	r.Submit(batch.Id)
+	batch = waitBatch(t, r, batch.Id)
+	assert.Equal(t, llm.BatchStatusFailed, batch.Status)
+	require.NotNil(t, batch.Errors)
+	assert.Len(t, batch.Errors.Data, 2)
+
+	output, err := r.dao.SaveFile(ctx, "output.jsonl", llm.FilePurposeBatchOutput, nil)
+	require.NoError(t, err)
+	_, err = r.dao.CreateBatch(ctx, output.Id, nil)
+	assert.ErrorIs(t, err, llm.ErrInvalidBatch)
+}
+
+func TestRunnerApiKey(t *testing.T) {
+	r := newTestRunner(t)
+	collection, err := r.dao.tx.FindCollectionByNameOrId(auth.TableApiKeys)
+	require.NoError(t, err)
+	record := models.NewRecord(collection)
+	record.Set("api_key", "sk-test")
+	record.Set("llm_models", []string{"gpt-4*"})
+	require.NoError(t, r.dao.tx.SaveRecord(record))
+	ctx := context.WithValue(context.Background(), config.ContextKeyApiKeyId, record.Id)
+
+	file, err := r.dao.SaveFile(ctx, "input.jsonl", llm.FilePurposeBatch, batchInput("hello"))
+	require.NoError(t, err)
+	key, err := auth.GetApiKey(r.dao.tx, record.Id)
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.dao.CheckModels(ctx, file.Id, key), auth.ErrModelNotAllowed)
+
+	// the models are checked again when the requests run
+	batch, err := r.dao.CreateBatch(ctx, file.Id, nil)
+	require.NoError(t, err)
+	r.Submit(batch.Id)
+	batch = waitBatch(t, r, batch.Id)
+	assert.Equal(t, llm.BatchRequestCounts{Total: 1, Failed: 1}, batch.RequestCounts)
+	_, errs, err := r.dao.GetFileContent(ctx, batch.ErrorFileId)
+	require.NoError(t, err)
+	assert.Contains(t, string(errs), `"status_code":403`)
+}
@@ -0,0 +1,72 @@
+package llms
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Vaayne/aienvoy/internal/pkg/dtoutils"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/google/uuid"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// ResponseCacheDTO is a cached chat completion, ExpiresAt is empty for the responses which do not expire.
+type ResponseCacheDTO struct {
+	dtoutils.BaseModel
+	CacheKey  string         `json:"cache_key" db:"cache_key"`
+	Model     string         `json:"model,omitempty" db:"model"`
+	Response  string         `json:"response" db:"response"`
+	ExpiresAt types.DateTime `json:"expires_at,omitempty" db:"expires_at"`
+}
+
+func (r ResponseCacheDTO) TableName() string {
+	return tableNameResponseCache
+}
+
+// GetResponse returns the cached response of the key, the sqlite backend of the response cache.
+func (d *Dao) GetResponse(ctx context.Context, key string) (llm.ChatCompletionResponse, bool, error) {
+	var dto ResponseCacheDTO
+	err := d.tx.DB().Select().From(tableNameResponseCache).
+		Where(dbx.HashExp{"cache_key": key}).
+		AndWhere(dbx.Or(dbx.HashExp{"expires_at": ""}, dbx.NewExp("expires_at > {:now}", dbx.Params{"now": types.NowDateTime().String()}))).
+		One(&dto)
+	if errors.Is(err, sql.ErrNoRows) {
+		return llm.ChatCompletionResponse{}, false, nil
+	}
+	if err != nil {
+		return llm.ChatCompletionResponse{}, false, err
+	}
+	var resp llm.ChatCompletionResponse
+	if err := json.Unmarshal([]byte(dto.Response), &resp); err != nil {
+		return llm.ChatCompletionResponse{}, false, err
+	}
+	return resp, true, nil
+}
+
+// SetResponse replaces the cached response of the key, the expired responses are deleted meanwhile.
+func (d *Dao) SetResponse(ctx context.Context, key string, resp llm.ChatCompletionResponse, ttl time.Duration) error {
+	now := types.NowDateTime()
+	dto := ResponseCacheDTO{
+		BaseModel: dtoutils.BaseModel{
+			Id:      uuid.NewString(),
+			Created: now,
+			Updated: now,
+		},
+		CacheKey: key,
+		Model:    resp.Model,
+		Response: string(mustMarshal(resp)),
+	}
+	if ttl > 0 {
+		dto.ExpiresAt = mustParseDateTime(now.Time().Add(ttl))
+	}
+
+	expired := dbx.NewExp("expires_at != '' AND expires_at <= {:now}", dbx.Params{"now": now.String()})
+	if _, err := d.tx.DB().Delete(tableNameResponseCache, dbx.Or(dbx.HashExp{"cache_key": key}, expired)).Execute(); err != nil {
+		return err
+	}
+	return d.tx.DB().Model(&dto).Insert()
+}
@@ -2,13 +2,20 @@ package llms
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
 
-	"github.com/Vaayne/aienvoy/internal/pkg/config"
+	"github.com/Vaayne/aienvoy/internal/pkg/ctxutils"
 	"github.com/Vaayne/aienvoy/internal/pkg/dtoutils"
+	"github.com/Vaayne/aienvoy/pkg/llms"
 	"github.com/Vaayne/aienvoy/pkg/llms/llm"
 	"github.com/google/uuid"
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/tools/types"
 )
 
 type Dao struct {
@@ -19,16 +26,42 @@ func NewDao(tx *daos.Dao) *Dao {
 	return &Dao{tx: tx}
 }
 
+// scope restricts the queries to the rows of the user of ctx, admins which asked for all users are not restricted.
+func (d *Dao) scope(ctx context.Context) dbx.Expression {
+	if ctxutils.IsAllUsers(ctx) {
+		return nil
+	}
+	return dbx.HashExp{"user_id": ctxutils.GetUserId(ctx)}
+}
+
+// one selects the row with the id from the table, rows of other users are reported as not found.
+func (d *Dao) one(ctx context.Context, table, id string, dto any) error {
+	err := d.tx.DB().Select().From(table).Where(dbx.HashExp{"id": id}).AndWhere(d.scope(ctx)).One(dto)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s %s: %w", table, id, llm.ErrNotFound)
+	}
+	return err
+}
+
 func (d *Dao) SaveConversation(ctx context.Context, conversation llm.Conversation) (llm.Conversation, error) {
 	var cov ConversationDTO
 	cov.FromLLMConversation(conversation)
 
 	if cov.UserId == "" {
-		cov.UserId = ctx.Value(config.ContextKeyUserId).(string)
+		cov.UserId = ctxutils.GetUserId(ctx)
+	}
+	if cov.Created.IsZero() {
+		cov.Created = types.NowDateTime()
 	}
 
 	if cov.Id == "" {
 		cov.Id = uuid.NewString()
+	} else if _, err := d.GetConversation(ctx, cov.Id); err == nil {
+		// the conversation exists, like when its summary is updated
+		if err := d.tx.DB().Model(&cov).Update(); err != nil {
+			return llm.Conversation{}, err
+		}
+		return d.GetConversation(ctx, cov.Id)
 	}
 
 	if err := d.tx.DB().Model(&cov).Insert(); err != nil {
@@ -40,19 +73,26 @@ func (d *Dao) SaveConversation(ctx context.Context, conversation llm.Conversatio
 
 func (d *Dao) GetConversation(ctx context.Context, id string) (llm.Conversation, error) {
 	var dto ConversationDTO
-	if err := d.tx.DB().Select().Model(id, &dto); err != nil {
+	if err := d.one(ctx, tableNameConversations, id, &dto); err != nil {
 		return llm.Conversation{}, err
 	}
 	return dto.ToLLMConversation(), nil
 }
 
-func (d *Dao) ListConversations(ctx context.Context) ([]llm.Conversation, error) {
+func (d *Dao) ListConversations(ctx context.Context, opts llm.ListOptions) ([]llm.Conversation, error) {
+	query, desc, err := d.pageQuery(ctx, tableNameConversations, opts)
+	if err != nil {
+		return nil, err
+	}
 	var dtos []ConversationDTO
-	if err := d.tx.DB().Select().All(&dtos); err != nil {
+	if err := query.All(&dtos); err != nil {
 		return nil, err
 	}
+	if desc {
+		slices.Reverse(dtos)
+	}
 
-	var conversations []llm.Conversation
+	conversations := make([]llm.Conversation, 0, len(dtos))
 	for _, dto := range dtos {
 		conversations = append(conversations, dto.ToLLMConversation())
 	}
@@ -61,14 +101,29 @@ func (d *Dao) ListConversations(ctx context.Context) ([]llm.Conversation, error)
 }
 
 func (d *Dao) DeleteConversation(ctx context.Context, id string) error {
+	if _, err := d.GetConversation(ctx, id); err != nil {
+		return err
+	}
+	// the messages of the conversation are kept, but they are no longer found by search
+	if err := d.unindex(dbx.HashExp{"conversation_id": id}); err != nil {
+		return err
+	}
 	return d.tx.DB().Model(&ConversationDTO{BaseModel: dtoutils.BaseModel{Id: id}}).Delete()
 }
 
 func (d *Dao) SaveMessage(ctx context.Context, message llm.Message) (llm.Message, error) {
+	// messages can only be added to the conversations of the user
+	if _, err := d.GetConversation(ctx, message.ConversationId); err != nil {
+		return llm.Message{}, err
+	}
+
 	var msg MessageDTO
 	msg.FromLLMMessage(message)
 	if msg.UserId == "" {
-		msg.UserId = ctx.Value(config.ContextKeyUserId).(string)
+		msg.UserId = ctxutils.GetUserId(ctx)
+	}
+	if msg.Created.IsZero() {
+		msg.Created = types.NowDateTime()
 	}
 	if msg.Id == "" {
 		msg.Id = uuid.NewString()
@@ -77,25 +132,35 @@ func (d *Dao) SaveMessage(ctx context.Context, message llm.Message) (llm.Message
 	if err := d.tx.DB().Model(&msg).Insert(); err != nil {
 		return llm.Message{}, err
 	}
+	if err := d.indexMessage(msg); err != nil {
+		return llm.Message{}, err
+	}
 
 	return d.GetMessage(ctx, msg.Id)
 }
 
 func (d *Dao) GetMessage(ctx context.Context, id string) (llm.Message, error) {
 	var dto MessageDTO
-	if err := d.tx.DB().Select().Model(id, &dto); err != nil {
+	if err := d.one(ctx, tableNameMessages, id, &dto); err != nil {
 		return llm.Message{}, err
 	}
 	return dto.ToLLMMessage(), nil
 }
 
-func (d *Dao) ListMessages(ctx context.Context, conversationId string) ([]llm.Message, error) {
+func (d *Dao) ListMessages(ctx context.Context, conversationId string, opts llm.ListOptions) ([]llm.Message, error) {
+	query, desc, err := d.pageQuery(ctx, tableNameMessages, opts)
+	if err != nil {
+		return nil, err
+	}
 	var dtos []MessageDTO
-	if err := d.tx.DB().Select().Where(dbx.HashExp{"conversation_id": conversationId}).All(&dtos); err != nil {
+	if err := query.AndWhere(dbx.HashExp{"conversation_id": conversationId}).All(&dtos); err != nil {
 		return nil, err
 	}
+	if desc {
+		slices.Reverse(dtos)
+	}
 
-	var messages []llm.Message
+	messages := make([]llm.Message, 0, len(dtos))
 	for _, dto := range dtos {
 		messages = append(messages, dto.ToLLMMessage())
 	}
@@ -104,13 +169,88 @@ func (d *Dao) ListMessages(ctx context.Context, conversationId string) ([]llm.Me
 }
 
 func (d *Dao) DeleteMessage(ctx context.Context, id string) error {
+	if _, err := d.GetMessage(ctx, id); err != nil {
+		return err
+	}
+	if err := d.unindex(dbx.HashExp{"message_id": id}); err != nil {
+		return err
+	}
 	return d.tx.DB().Model(&MessageDTO{BaseModel: dtoutils.BaseModel{Id: id}}).Delete()
 }
 
 func (d *Dao) GetConversationLastMessage(ctx context.Context, id string) (llm.Message, error) {
 	var dto MessageDTO
-	if err := d.tx.DB().Select().Where(dbx.HashExp{"conversation_id": id}).OrderBy("created DESC").Limit(1).One(&dto); err != nil {
+	err := d.tx.DB().Select().From(tableNameMessages).
+		Where(dbx.HashExp{"conversation_id": id}).
+		AndWhere(d.scope(ctx)).
+		OrderBy("created DESC", "id DESC").
+		Limit(1).
+		One(&dto)
+	if errors.Is(err, sql.ErrNoRows) {
+		return llm.Message{}, fmt.Errorf("last message of conversation %s: %w", id, llm.ErrNotFound)
+	}
+	if err != nil {
 		return llm.Message{}, err
 	}
 	return dto.ToLLMMessage(), nil
 }
+
+// pageQuery selects the page of opts from the rows of the user in the table, ordered by created and id.
+// The query is in descending order when the page is the one before a cursor, then the results have to be reversed.
+func (d *Dao) pageQuery(ctx context.Context, table string, opts llm.ListOptions) (*dbx.SelectQuery, bool, error) {
+	query := d.tx.DB().Select().From(table).Where(d.scope(ctx))
+	cursor := func(id, op string) error {
+		var created string
+		err := d.tx.DB().Select("created").From(table).Where(dbx.HashExp{"id": id}).AndWhere(d.scope(ctx)).Row(&created)
+		if errors.Is(err, sql.ErrNoRows) {
+			return llm.ErrCursorNotFound
+		}
+		if err != nil {
+			return err
+		}
+		query.AndWhere(dbx.NewExp(
+			"(created "+op+" {:created} OR (created = {:created} AND id "+op+" {:id}))",
+			dbx.Params{"created": created, "id": id},
+		))
+		return nil
+	}
+	if opts.After != "" {
+		if err := cursor(opts.After, ">"); err != nil {
+			return nil, false, err
+		}
+	}
+	if opts.Before != "" {
+		if err := cursor(opts.Before, "<"); err != nil {
+			return nil, false, err
+		}
+	}
+
+	desc := opts.Before != "" && opts.After == "" && opts.Limit > 0
+	if desc {
+		query.OrderBy("created DESC", "id DESC")
+	} else {
+		query.OrderBy("created ASC", "id ASC")
+	}
+	if opts.Limit > 0 {
+		query.Limit(int64(opts.Limit))
+	}
+	return query, desc, nil
+}
+
+// RecordUsage saves the usage of a request with the user and api key of the caller,
+// errors are logged as they must not fail the request.
+func (d *Dao) RecordUsage(ctx context.Context, record llms.UsageRecord) {
+	usage := UsageDTO{
+		BaseModel: dtoutils.BaseModel{
+			Id:      uuid.NewString(),
+			Created: types.NowDateTime(),
+			Updated: types.NowDateTime(),
+		},
+		ApiKey: ctxutils.GetApiKeyId(ctx),
+		UserId: ctxutils.GetUserId(ctx),
+	}
+	usage.FromUsageRecord(record)
+	if err := d.tx.DB().Model(&usage).Insert(); err != nil {
+		slog.ErrorContext(ctx, "save llm usage error", "err", err, "provider", record.Provider, "model", record.Model)
+	}
+}
@@ -0,0 +1,132 @@
+package llms
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	_ "github.com/Vaayne/aienvoy/migrations"
+
+	"github.com/Vaayne/aienvoy/internal/pkg/config"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm/llmtest"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDao returns a dao on a new test app, with the migrations of the project applied.
+func newTestDao(t *testing.T) *Dao {
+	app, err := tests.NewTestApp()
+	require.NoError(t, err)
+	t.Cleanup(app.Cleanup)
+
+	runner, err := migrate.NewRunner(app.DB(), m.AppMigrations)
+	require.NoError(t, err)
+	_, err = runner.Up()
+	require.NoError(t, err)
+	return NewDao(app.Dao())
+}
+
+func TestDao(t *testing.T) {
+	ctx := context.WithValue(context.Background(), config.ContextKeyUserId, "user")
+	llmtest.TestDao(t, ctx, func(t *testing.T) llm.Dao {
+		return newTestDao(t)
+	})
+}
+
+func TestDaoUserScope(t *testing.T) {
+	dao := newTestDao(t)
+
+	alice := context.WithValue(context.Background(), config.ContextKeyUserId, "alice")
+	bob := context.WithValue(context.Background(), config.ContextKeyUserId, "bob")
+	admin := context.WithValue(bob, config.ContextKeyAllUsers, true)
+
+	cov, err := dao.SaveConversation(alice, llm.Conversation{Name: "alice"})
+	require.NoError(t, err)
+	msg, err := dao.SaveMessage(alice, llm.Message{ConversationId: cov.Id})
+	require.NoError(t, err)
+
+	_, err = dao.GetConversation(bob, cov.Id)
+	assert.ErrorIs(t, err, llm.ErrNotFound)
+	_, err = dao.GetMessage(bob, msg.Id)
+	assert.ErrorIs(t, err, llm.ErrNotFound)
+	_, err = dao.SaveMessage(bob, llm.Message{ConversationId: cov.Id})
+	assert.ErrorIs(t, err, llm.ErrNotFound)
+	assert.ErrorIs(t, dao.DeleteMessage(bob, msg.Id), llm.ErrNotFound)
+	assert.ErrorIs(t, dao.DeleteConversation(bob, cov.Id), llm.ErrNotFound)
+	covs, err := dao.ListConversations(bob, llm.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, covs)
+	msgs, err := dao.ListMessages(bob, cov.Id, llm.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	covs, err = dao.ListConversations(admin, llm.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, covs, 1)
+	_, err = dao.GetMessage(admin, msg.Id)
+	assert.NoError(t, err)
+}
+
+func TestDaoSearch(t *testing.T) {
+	dao := newTestDao(t)
+
+	alice := context.WithValue(context.Background(), config.ContextKeyUserId, "alice")
+	bob := context.WithValue(context.Background(), config.ContextKeyUserId, "bob")
+
+	cov, err := dao.SaveConversation(alice, llm.Conversation{Name: "travel"})
+	require.NoError(t, err)
+	msg, err := dao.SaveMessage(alice, llm.Message{
+		ConversationId: cov.Id,
+		Request:        llm.ChatCompletionRequest{Messages: []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: "Where should I stay in Paris?"}}},
+		Response:       llm.ChatCompletionResponse{Choices: []llm.ChatCompletionChoice{{Message: llm.ChatCompletionMessage{Role: llm.ChatMessageRoleAssistant, Content: "Le Marais is central."}}}},
+	})
+	require.NoError(t, err)
+
+	results, err := dao.Search(alice, "pari marais", 10)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, msg.Id, results[0].MessageId)
+	assert.Equal(t, "travel", results[0].ConversationName)
+	assert.Contains(t, results[0].Snippet, "<mark>Paris</mark>")
+
+	// the query syntax of fts5 is searched as text
+	_, err = dao.Search(alice, `"paris" AND`, 10)
+	assert.NoError(t, err)
+
+	results, err = dao.Search(bob, "paris", 10)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	require.NoError(t, dao.DeleteMessage(alice, msg.Id))
+	results, err = dao.Search(alice, "paris", 10)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestDaoResponseCache(t *testing.T) {
+	ctx := context.Background()
+	dao := newTestDao(t)
+
+	_, ok, err := dao.GetResponse(ctx, "key")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	resp := llm.ChatCompletionResponse{ID: "1", Model: "gpt-4", Choices: []llm.ChatCompletionChoice{{Message: llm.ChatCompletionMessage{Role: llm.ChatMessageRoleAssistant, Content: "hello"}}}}
+	require.NoError(t, dao.SetResponse(ctx, "key", resp, 0))
+	resp.ID = "2"
+	require.NoError(t, dao.SetResponse(ctx, "key", resp, time.Hour))
+	cached, ok, err := dao.GetResponse(ctx, "key")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, resp, cached)
+
+	require.NoError(t, dao.SetResponse(ctx, "expired", resp, time.Nanosecond))
+	time.Sleep(10 * time.Millisecond)
+	_, ok, err = dao.GetResponse(ctx, "expired")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/Vaayne/aienvoy/internal/pkg/dtoutils"
+	"github.com/Vaayne/aienvoy/pkg/llms"
 	"github.com/Vaayne/aienvoy/pkg/llms/llm"
 	"github.com/pocketbase/pocketbase/tools/types"
 )
@@ -13,15 +14,22 @@ import (
 const (
 	tableNameConversations = "conversations"
 	tableNameMessages      = "conversation_messages"
+	tableNameMessagesFTS   = "conversation_messages_fts"
+	tableNameUsages        = "llm_usages"
+	tableNameResponseCache = "llm_response_cache"
 )
 
 type ConversationDTO struct {
 	dtoutils.BaseModel
-	UserId    string `json:"user_id"  db:"user_id"`
-	Name      string `json:"name,omitempty"  db:"name"`
-	Model     string `json:"model,omitempty" db:"model"`
-	Summary   string `json:"summary,omitempty" db:"summary"`
-	ExtraInfo string `json:"extra_info,omitempty" db:"extra_info"`
+	UserId  string `json:"user_id"  db:"user_id"`
+	Name    string `json:"name,omitempty"  db:"name"`
+	Model   string `json:"model,omitempty" db:"model"`
+	Summary string `json:"summary,omitempty" db:"summary"`
+	// SummaryUntil is the id of the last message folded into the summary
+	SummaryUntil string `json:"summary_until,omitempty" db:"summary_until"`
+	// ActiveLeafId is the last message of the active branch
+	ActiveLeafId string `json:"active_leaf_id,omitempty" db:"active_leaf_id"`
+	ExtraInfo    string `json:"extra_info,omitempty" db:"extra_info"`
 }
 
 func (c ConversationDTO) TableName() string {
@@ -36,19 +44,23 @@ func (c *ConversationDTO) FromLLMConversation(conversation llm.Conversation) {
 	c.Name = conversation.Name
 	c.Model = conversation.Model
 	c.Summary = conversation.Summary
+	c.SummaryUntil = conversation.SummaryUntil
+	c.ActiveLeafId = conversation.ActiveLeafId
 	c.ExtraInfo = conversation.ExtraInfo
 }
 
 func (c ConversationDTO) ToLLMConversation() llm.Conversation {
 	return llm.Conversation{
-		Id:        c.Id,
-		CreatedAt: c.Created.Time(),
-		UpdatedAt: c.Updated.Time(),
-		UserId:    c.UserId,
-		Name:      c.Name,
-		Model:     c.Model,
-		Summary:   c.Summary,
-		ExtraInfo: c.ExtraInfo,
+		Id:           c.Id,
+		CreatedAt:    c.Created.Time(),
+		UpdatedAt:    c.Updated.Time(),
+		UserId:       c.UserId,
+		Name:         c.Name,
+		Model:        c.Model,
+		Summary:      c.Summary,
+		SummaryUntil: c.SummaryUntil,
+		ActiveLeafId: c.ActiveLeafId,
+		ExtraInfo:    c.ExtraInfo,
 	}
 }
 
@@ -56,9 +68,10 @@ type MessageDTO struct {
 	dtoutils.BaseModel
 	UserId          string `json:"user_id"  db:"user_id"`
 	ConversationId  string `json:"conversation_id"  db:"conversation_id"`
+	ParentId        string `json:"parent_id,omitempty" db:"parent_id"`
 	Model           string `json:"model,omitempty" db:"model"`
-	PromptToken     string `json:"prompt_token,omitempty" db:"prompt_token"`
-	CompletionToken string `json:"completion_token,omitempty" db:"completion_token"`
+	PromptToken     int    `json:"prompt_token,omitempty" db:"prompt_token"`
+	CompletionToken int    `json:"completion_token,omitempty" db:"completion_token"`
 	Description     string `json:"description,omitempty" db:"description"`
 	Request         []byte `json:"request,omitempty" db:"request"`
 	Response        []byte `json:"response,omitempty" db:"response"`
@@ -75,9 +88,10 @@ func (m *MessageDTO) FromLLMMessage(message llm.Message) {
 	m.Updated = mustParseDateTime(message.UpdatedAt)
 	m.UserId = message.UserId
 	m.ConversationId = message.ConversationId
+	m.ParentId = message.ParentId
 	m.Model = message.Model
-	// m.PromptToken = message.PromptToken
-	// m.CompletionToken = message.CompletionToken
+	m.PromptToken = message.PromptToken
+	m.CompletionToken = message.CompletionToken
 	m.Description = message.Description
 
 	m.Request = mustMarshal(message.Request)
@@ -91,21 +105,51 @@ func (m MessageDTO) ToLLMMessage() llm.Message {
 	mustUnMarshal(m.Request, &req)
 	mustUnMarshal(m.Response, &resp)
 	return llm.Message{
-		Id:             m.Id,
-		CreatedAt:      m.Created.Time(),
-		UpdatedAt:      m.Updated.Time(),
-		UserId:         m.UserId,
-		ConversationId: m.ConversationId,
-		Model:          m.Model,
-		// PromptToken:     m.PromptToken,
-		// CompletionToken: m.CompletionToken,
-		Description: m.Description,
-		Request:     req,
-		Response:    resp,
-		RawResponse: m.RawResponse,
+		Id:              m.Id,
+		CreatedAt:       m.Created.Time(),
+		UpdatedAt:       m.Updated.Time(),
+		UserId:          m.UserId,
+		ConversationId:  m.ConversationId,
+		ParentId:        m.ParentId,
+		Model:           m.Model,
+		PromptToken:     m.PromptToken,
+		CompletionToken: m.CompletionToken,
+		Description:     m.Description,
+		Request:         req,
+		Response:        resp,
+		RawResponse:     m.RawResponse,
 	}
 }
 
+type UsageDTO struct {
+	dtoutils.BaseModel
+	ApiKey           string  `json:"api_key,omitempty" db:"api_key"`
+	UserId           string  `json:"user_id,omitempty" db:"user_id"`
+	Provider         string  `json:"provider,omitempty" db:"provider"`
+	Model            string  `json:"model,omitempty" db:"model"`
+	PromptTokens     int     `json:"prompt_tokens" db:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens" db:"completion_tokens"`
+	TokenUsage       int     `json:"token_usage" db:"token_usage"`
+	Estimated        bool    `json:"estimated" db:"estimated"`
+	Cost             float64 `json:"cost" db:"cost"`
+	LatencyMs        int64   `json:"latency_ms" db:"latency_ms"`
+}
+
+func (u UsageDTO) TableName() string {
+	return tableNameUsages
+}
+
+func (u *UsageDTO) FromUsageRecord(record llms.UsageRecord) {
+	u.Provider = record.Provider
+	u.Model = record.Model
+	u.PromptTokens = record.Usage.PromptTokens
+	u.CompletionTokens = record.Usage.CompletionTokens
+	u.TokenUsage = record.Usage.TotalTokens
+	u.Estimated = record.Estimated
+	u.Cost = record.Cost
+	u.LatencyMs = record.Latency.Milliseconds()
+}
+
 func mustParseDateTime(t time.Time) types.DateTime {
 	dt, err := types.ParseDateTime(t)
 	if err != nil {
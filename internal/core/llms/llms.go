@@ -1,15 +1,74 @@
 package llms
 
 import (
+	"log/slog"
+
 	"github.com/Vaayne/aienvoy/internal/pkg/config"
 	"github.com/Vaayne/aienvoy/pkg/llms"
 	"github.com/Vaayne/aienvoy/pkg/llms/llm"
 )
 
-func NewWithDao(model string, dao llm.Dao) (*llm.LLM, error) {
-	return llms.NewWithDao(model, config.GetConfig().LLMs, dao)
+func options(cfg *config.Config) llms.Options {
+	return llms.Options{
+		Routes:          cfg.LLMRoutes,
+		Strategy:        llms.Strategy(cfg.LLMBalanceStrategy),
+		Models:          cfg.LLMModels,
+		History:         llm.History(cfg.LLMHistory),
+		AnnotationModel: cfg.LLMAnnotationModel,
+		Cache:           cfg.LLMCache,
+	}
+}
+
+// llmConfigs returns the llm configs of the settings. The claudeweb and bard tokens add a provider when the llms have none
+// of that type, and the web providers without a session cookie read it from the cookiecloud of the settings.
+func llmConfigs(cfg *config.Config) []llm.Config {
+	cfgs := make([]llm.Config, 0, len(cfg.LLMs)+2)
+	types := make(map[llm.LLMType]bool)
+	cookieCloud := llm.CookieCloudConfig{Host: cfg.CookieCloud.Host, UUID: cfg.CookieCloud.UUID, Pass: cfg.CookieCloud.Pass}
+	for _, c := range cfg.LLMs {
+		types[c.LLMType] = true
+		isWeb := c.LLMType == llm.LLMTypeClaudeWeb || c.LLMType == llm.LLMTypeGoogleBard
+		if isWeb && c.ApiKey == "" && c.CookieCloud.Host == "" {
+			c.CookieCloud = cookieCloud
+		}
+		cfgs = append(cfgs, c)
+	}
+	if cfg.ClaudeWeb.Token != "" && !types[llm.LLMTypeClaudeWeb] {
+		cfgs = append(cfgs, llm.Config{LLMType: llm.LLMTypeClaudeWeb, ApiKey: cfg.ClaudeWeb.Token})
+	}
+	if cfg.Bard.Token != "" && !types[llm.LLMTypeGoogleBard] {
+		cfgs = append(cfgs, llm.Config{LLMType: llm.LLMTypeGoogleBard, ApiKey: cfg.Bard.Token})
+	}
+	return cfgs
+}
+
+// Registry serves the llms of the settings, it is reloaded every time the settings change.
+// It is created once by the app and passed to the ports, which bind the dao of each request to its clients.
+type Registry struct {
+	*llms.Registry
+}
+
+// NewRegistry loads the llms of the settings and reloads them when the settings change.
+func NewRegistry() *Registry {
+	// the clients are always bound to the dao of the caller by NewWithDao
+	r := llms.NewRegistry(llm.NewMemoryDao())
+	cfg := config.GetConfig()
+	if err := r.Reload(llmConfigs(cfg), options(cfg)); err != nil {
+		slog.Error("load llm registry error", "err", err)
+	}
+	config.OnChange(func(cfg *config.Config) {
+		if err := r.Reload(llmConfigs(cfg), options(cfg)); err != nil {
+			slog.Error("reload llm registry error, keep the current clients", "err", err)
+		}
+	})
+	return &Registry{Registry: r}
 }
 
-func New(model string) (*llm.LLM, error) {
-	return NewWithDao(model, llm.NewMemoryDao())
+// NewWithDao returns the client of the model, which reads and saves with dao, and records the usage with it.
+func (r *Registry) NewWithDao(model string, dao llm.Dao) (*llm.LLM, error) {
+	cli, err := r.Get(model)
+	if err != nil {
+		return nil, err
+	}
+	return cli.WithDao(dao), nil
 }
@@ -0,0 +1,95 @@
+package llms
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Vaayne/aienvoy/internal/pkg/ctxutils"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// snippetTokens is the number of tokens of the snippets of search results
+const snippetTokens = 16
+
+type searchRow struct {
+	MessageId        string         `db:"message_id"`
+	ConversationId   string         `db:"conversation_id"`
+	ConversationName string         `db:"conversation_name"`
+	Created          types.DateTime `db:"created"`
+	Snippet          string         `db:"snippet"`
+}
+
+// indexMessage adds the text of the message to the full text index, replacing the text indexed before.
+func (d *Dao) indexMessage(dto MessageDTO) error {
+	if err := d.unindex(dbx.HashExp{"message_id": dto.Id}); err != nil {
+		return err
+	}
+	_, err := d.tx.DB().Insert(tableNameMessagesFTS, dbx.Params{
+		"message_id":      dto.Id,
+		"conversation_id": dto.ConversationId,
+		"user_id":         dto.UserId,
+		"content":         llm.MessageText(dto.ToLLMMessage()),
+	}).Execute()
+	return err
+}
+
+func (d *Dao) unindex(where dbx.Expression) error {
+	_, err := d.tx.DB().Delete(tableNameMessagesFTS, where).Execute()
+	return err
+}
+
+// Search matches the messages of the user with the full text index, best matches first.
+// Every word of the query has to match, words match as prefixes.
+func (d *Dao) Search(ctx context.Context, query string, limit int) ([]llm.SearchResult, error) {
+	match := ftsQuery(query)
+	if match == "" {
+		return []llm.SearchResult{}, nil
+	}
+
+	params := dbx.Params{
+		"query":  match,
+		"start":  llm.HighlightStart,
+		"end":    llm.HighlightEnd,
+		"tokens": snippetTokens,
+		"limit":  limit,
+	}
+	sql := `SELECT conversation_messages_fts.message_id, conversation_messages_fts.conversation_id,
+		COALESCE(c.name, '') AS conversation_name, m.created,
+		snippet(conversation_messages_fts, 3, {:start}, {:end}, '…', {:tokens}) AS snippet
+		FROM conversation_messages_fts
+		JOIN conversation_messages m ON m.id = conversation_messages_fts.message_id
+		LEFT JOIN conversations c ON c.id = conversation_messages_fts.conversation_id
+		WHERE conversation_messages_fts MATCH {:query}`
+	if !ctxutils.IsAllUsers(ctx) {
+		sql += " AND conversation_messages_fts.user_id = {:user_id}"
+		params["user_id"] = ctxutils.GetUserId(ctx)
+	}
+	sql += " ORDER BY rank LIMIT {:limit}"
+
+	var rows []searchRow
+	if err := d.tx.DB().NewQuery(sql).Bind(params).All(&rows); err != nil {
+		return nil, err
+	}
+	results := make([]llm.SearchResult, 0, len(rows))
+	for _, row := range rows {
+		results = append(results, llm.SearchResult{
+			ConversationId:   row.ConversationId,
+			ConversationName: row.ConversationName,
+			MessageId:        row.MessageId,
+			Snippet:          row.Snippet,
+			CreatedAt:        row.Created.Time(),
+		})
+	}
+	return results, nil
+}
+
+// ftsQuery quotes the words of the query, so the FTS5 syntax in user input is searched as text.
+func ftsQuery(query string) string {
+	terms := strings.Fields(query)
+	for i, term := range terms {
+		terms[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+	}
+	return strings.Join(terms, " ")
+}
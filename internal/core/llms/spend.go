@@ -0,0 +1,167 @@
+package llms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Vaayne/aienvoy/internal/core/auth"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// spendColumns maps the dimensions spend can be grouped by to their column in llm_usages.
+var spendColumns = map[string]string{
+	"user":     "user_id",
+	"api_key":  "api_key",
+	"provider": "provider",
+	"model":    "model",
+	"day":      "substr(created, 1, 10) AS day",
+}
+
+type SpendQuery struct {
+	// GroupBy are the dimensions of the report: user, api_key, provider, model and day
+	GroupBy []string
+	From    time.Time
+	To      time.Time
+	UserId  string
+	ApiKey  string
+}
+
+type SpendItem struct {
+	UserId           string  `json:"user_id,omitempty" db:"user_id"`
+	ApiKey           string  `json:"api_key,omitempty" db:"api_key"`
+	Provider         string  `json:"provider,omitempty" db:"provider"`
+	Model            string  `json:"model,omitempty" db:"model"`
+	Day              string  `json:"day,omitempty" db:"day"`
+	Requests         int     `json:"requests" db:"requests"`
+	PromptTokens     int     `json:"prompt_tokens" db:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens" db:"completion_tokens"`
+	Cost             float64 `json:"cost" db:"cost"`
+}
+
+// Spend aggregates the recorded usage between From and To, grouped by the dimensions of the query.
+func (d *Dao) Spend(ctx context.Context, query SpendQuery) ([]SpendItem, error) {
+	selects := make([]string, 0, len(query.GroupBy)+4)
+	groups := make([]string, 0, len(query.GroupBy))
+	for _, dimension := range query.GroupBy {
+		column, ok := spendColumns[dimension]
+		if !ok {
+			return nil, fmt.Errorf("invalid spend dimension %s", dimension)
+		}
+		selects = append(selects, column)
+		expr, _, _ := strings.Cut(column, " AS ")
+		groups = append(groups, expr)
+	}
+	selects = append(selects,
+		"COUNT(*) AS requests",
+		"COALESCE(SUM(prompt_tokens), 0) AS prompt_tokens",
+		"COALESCE(SUM(completion_tokens), 0) AS completion_tokens",
+		"TOTAL(cost) AS cost",
+	)
+
+	params := dbx.Params{
+		"from": query.From.UTC().Format(types.DefaultDateLayout),
+		"to":   query.To.UTC().Format(types.DefaultDateLayout),
+	}
+	wheres := []string{"created >= {:from}", "created < {:to}"}
+	if query.UserId != "" {
+		wheres = append(wheres, "user_id = {:user_id}")
+		params["user_id"] = query.UserId
+	}
+	if query.ApiKey != "" {
+		wheres = append(wheres, "api_key = {:api_key}")
+		params["api_key"] = query.ApiKey
+	}
+
+	sql := fmt.Sprintf("SELECT %s FROM %s WHERE %s", strings.Join(selects, ", "), tableNameUsages, strings.Join(wheres, " AND "))
+	if len(groups) > 0 {
+		sql += fmt.Sprintf(" GROUP BY %s ORDER BY %s", strings.Join(groups, ", "), strings.Join(groups, ", "))
+	}
+
+	items := make([]SpendItem, 0)
+	if err := d.tx.DB().NewQuery(sql).Bind(params).All(&items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// ApiKeyUsage returns the tokens and cost recorded for an api key since the given time.
+func (d *Dao) ApiKeyUsage(ctx context.Context, apiKeyId string, since time.Time) (int, float64, error) {
+	var usage struct {
+		Tokens int     `db:"tokens"`
+		Cost   float64 `db:"cost"`
+	}
+	err := d.tx.DB().
+		Select("COALESCE(SUM(token_usage), 0) AS tokens", "TOTAL(cost) AS cost").
+		From(tableNameUsages).
+		Where(dbx.HashExp{"api_key": apiKeyId}).
+		AndWhere(dbx.NewExp("created >= {:since}", dbx.Params{"since": since.UTC().Format(types.DefaultDateLayout)})).
+		One(&usage)
+	return usage.Tokens, usage.Cost, err
+}
+
+// ErrQuotaExceeded is matched by the errors of the requests of an api key which used up its tokens of the day or its monthly budget.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// ApiKeyQuota is what is left of the limits of an api key.
+type ApiKeyQuota struct {
+	Key auth.ApiKey
+	// TokensRemaining are the tokens left today, they reset in TokensReset
+	TokensRemaining int
+	TokensReset     time.Duration
+	// Spent is the cost (USD) of the month
+	Spent float64
+}
+
+// ApiKeyQuota returns the quota left to the api key at now. The usage which could not be read counts as none,
+// it is returned with the error.
+func (d *Dao) ApiKeyQuota(ctx context.Context, key auth.ApiKey, now time.Time) (ApiKeyQuota, error) {
+	now = now.UTC()
+	quota := ApiKeyQuota{Key: key}
+	var errs []error
+	if key.TokensPerDay > 0 {
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		tokens, _, err := d.ApiKeyUsage(ctx, key.Id, day)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("get api key usage error: %w", err))
+		}
+		quota.TokensRemaining = max(key.TokensPerDay-tokens, 0)
+		quota.TokensReset = day.Add(24 * time.Hour).Sub(now)
+	}
+	if key.MonthlyBudget > 0 {
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		_, cost, err := d.ApiKeyUsage(ctx, key.Id, month)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("get api key spend error: %w", err))
+		}
+		quota.Spent = cost
+	}
+	return quota, errors.Join(errs...)
+}
+
+// TokensExceeded reports whether the key used up its tokens of the day.
+func (q ApiKeyQuota) TokensExceeded() bool {
+	return q.Key.TokensPerDay > 0 && q.TokensRemaining == 0
+}
+
+// BudgetExceeded reports whether the key used up its monthly budget.
+func (q ApiKeyQuota) BudgetExceeded() bool {
+	return q.Key.MonthlyBudget > 0 && q.Spent >= q.Key.MonthlyBudget
+}
+
+// Err returns an ErrQuotaExceeded error when the key used up its tokens of the day or its monthly budget.
+func (q ApiKeyQuota) Err() error {
+	switch {
+	case q.TokensExceeded():
+		return fmt.Errorf("%w: the api key used its %d tokens of the day, they reset in %s",
+			ErrQuotaExceeded, q.Key.TokensPerDay, q.TokensReset.Round(time.Second))
+	case q.BudgetExceeded():
+		return fmt.Errorf("%w: the api key exceeded its monthly budget of $%.2f", ErrQuotaExceeded, q.Key.MonthlyBudget)
+	default:
+		return nil
+	}
+}
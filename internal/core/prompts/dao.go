@@ -0,0 +1,180 @@
+package prompts
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Vaayne/aienvoy/internal/pkg/ctxutils"
+	"github.com/Vaayne/aienvoy/internal/pkg/dtoutils"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/google/uuid"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const tableNamePromptTemplates = "prompt_templates"
+
+// TemplateDTO is a version of a prompt template, the versions of a name are never updated.
+type TemplateDTO struct {
+	dtoutils.BaseModel
+	Name        string `json:"name" db:"name"`
+	Version     int    `json:"version" db:"version"`
+	Description string `json:"description,omitempty" db:"description"`
+	System      string `json:"system,omitempty" db:"system"`
+	User        string `json:"user,omitempty" db:"user"`
+	// UserId is the author of the version
+	UserId string `json:"user_id,omitempty" db:"user_id"`
+}
+
+func (t TemplateDTO) TableName() string {
+	return tableNamePromptTemplates
+}
+
+func (t TemplateDTO) ToPromptTemplate() llm.PromptTemplate {
+	return llm.PromptTemplate{
+		Id:          t.Id,
+		Name:        t.Name,
+		Version:     t.Version,
+		Description: t.Description,
+		System:      t.System,
+		User:        t.User,
+		CreatedAt:   t.Created.Time(),
+	}
+}
+
+type Dao struct {
+	tx *daos.Dao
+}
+
+func NewDao(tx *daos.Dao) *Dao {
+	return &Dao{tx: tx}
+}
+
+// Save adds a new version of the template, the first version of a name is 1.
+func (d *Dao) Save(ctx context.Context, t llm.PromptTemplate) (llm.PromptTemplate, error) {
+	if err := t.Validate(); err != nil {
+		return llm.PromptTemplate{}, err
+	}
+	var latest int
+	if err := d.tx.DB().Select("COALESCE(MAX(version), 0)").From(tableNamePromptTemplates).
+		Where(dbx.HashExp{"name": t.Name}).Row(&latest); err != nil {
+		return llm.PromptTemplate{}, err
+	}
+
+	dto := TemplateDTO{
+		BaseModel: dtoutils.BaseModel{
+			Id:      uuid.NewString(),
+			Created: types.NowDateTime(),
+			Updated: types.NowDateTime(),
+		},
+		Name:        t.Name,
+		Version:     latest + 1,
+		Description: t.Description,
+		System:      t.System,
+		User:        t.User,
+		UserId:      ctxutils.GetUserId(ctx),
+	}
+	if err := d.tx.DB().Model(&dto).Insert(); err != nil {
+		return llm.PromptTemplate{}, err
+	}
+	return dto.ToPromptTemplate(), nil
+}
+
+// Get returns a version of the template, the latest one when version is zero.
+// A template which was never saved is its registered default.
+func (d *Dao) Get(ctx context.Context, name string, version int) (llm.PromptTemplate, error) {
+	query := d.tx.DB().Select().From(tableNamePromptTemplates).Where(dbx.HashExp{"name": name})
+	if version > 0 {
+		query.AndWhere(dbx.HashExp{"version": version})
+	}
+	var dto TemplateDTO
+	err := query.OrderBy("version DESC").Limit(1).One(&dto)
+	if errors.Is(err, sql.ErrNoRows) {
+		if t, ok := defaults[name]; ok && version == 0 {
+			return t, nil
+		}
+		return llm.PromptTemplate{}, fmt.Errorf("prompt template %s version %d: %w", name, version, llm.ErrNotFound)
+	}
+	if err != nil {
+		return llm.PromptTemplate{}, err
+	}
+	return dto.ToPromptTemplate(), nil
+}
+
+// List returns the latest version of every template, with the defaults which were never saved, ordered by name.
+func (d *Dao) List(ctx context.Context) ([]llm.PromptTemplate, error) {
+	var dtos []TemplateDTO
+	err := d.tx.DB().Select("t.*").From(tableNamePromptTemplates + " t").
+		Where(dbx.NewExp("t.version = (SELECT MAX(version) FROM prompt_templates WHERE name = t.name)")).
+		OrderBy("t.name").
+		All(&dtos)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := make([]llm.PromptTemplate, 0, len(dtos)+len(defaults))
+	saved := make(map[string]bool, len(dtos))
+	for _, dto := range dtos {
+		saved[dto.Name] = true
+		templates = append(templates, dto.ToPromptTemplate())
+	}
+	for name, t := range defaults {
+		if !saved[name] {
+			templates = append(templates, t)
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates, nil
+}
+
+// Versions returns the versions of the template, the latest first.
+func (d *Dao) Versions(ctx context.Context, name string) ([]llm.PromptTemplate, error) {
+	var dtos []TemplateDTO
+	err := d.tx.DB().Select().From(tableNamePromptTemplates).
+		Where(dbx.HashExp{"name": name}).
+		OrderBy("version DESC").
+		All(&dtos)
+	if err != nil {
+		return nil, err
+	}
+	if len(dtos) == 0 {
+		if t, ok := defaults[name]; ok {
+			return []llm.PromptTemplate{t}, nil
+		}
+		return nil, fmt.Errorf("prompt template %s: %w", name, llm.ErrNotFound)
+	}
+
+	templates := make([]llm.PromptTemplate, 0, len(dtos))
+	for _, dto := range dtos {
+		templates = append(templates, dto.ToPromptTemplate())
+	}
+	return templates, nil
+}
+
+// Delete deletes every version of the template, a template with a default falls back to it.
+func (d *Dao) Delete(ctx context.Context, name string) error {
+	res, err := d.tx.DB().Delete(tableNamePromptTemplates, dbx.HashExp{"name": name}).Execute()
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("prompt template %s: %w", name, llm.ErrNotFound)
+	}
+	return nil
+}
+
+// Apply renders the template referenced by the request before its messages, requests without a template are kept as is.
+func (d *Dao) Apply(ctx context.Context, req *llm.ChatCompletionRequest) error {
+	if req.Template == nil {
+		return nil
+	}
+	t, err := d.Get(ctx, req.Template.Name, req.Template.Version)
+	if err != nil {
+		return err
+	}
+	return req.ApplyTemplate(t)
+}
@@ -0,0 +1,83 @@
+package prompts
+
+import (
+	"context"
+	"testing"
+
+	_ "github.com/Vaayne/aienvoy/migrations"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDao(t *testing.T) *Dao {
+	app, err := tests.NewTestApp()
+	require.NoError(t, err)
+	t.Cleanup(app.Cleanup)
+
+	runner, err := migrate.NewRunner(app.DB(), m.AppMigrations)
+	require.NoError(t, err)
+	_, err = runner.Up()
+	require.NoError(t, err)
+	return NewDao(app.Dao())
+}
+
+func TestDao(t *testing.T) {
+	ctx := context.Background()
+	dao := newTestDao(t)
+	Register(llm.PromptTemplate{Name: "test-default", User: "default {{.Text}}"})
+
+	v1, err := dao.Save(ctx, llm.PromptTemplate{Name: "greet", User: "Hello {{.Name}}"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, v1.Version)
+	v2, err := dao.Save(ctx, llm.PromptTemplate{Name: "greet", System: "Be brief.", User: "Hi {{.Name}}"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, v2.Version)
+	_, err = dao.Save(ctx, llm.PromptTemplate{Name: "greet", User: "{{.Name"})
+	assert.ErrorIs(t, err, llm.ErrInvalidTemplate)
+
+	latest, err := dao.Get(ctx, "greet", 0)
+	require.NoError(t, err)
+	assert.Equal(t, v2.Id, latest.Id)
+	first, err := dao.Get(ctx, "greet", 1)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello {{.Name}}", first.User)
+	_, err = dao.Get(ctx, "greet", 3)
+	assert.ErrorIs(t, err, llm.ErrNotFound)
+
+	versions, err := dao.Versions(ctx, "greet")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, 2, versions[0].Version)
+
+	list, err := dao.List(ctx)
+	require.NoError(t, err)
+	names := make([]string, 0, len(list))
+	for _, t := range list {
+		names = append(names, t.Name)
+	}
+	assert.Contains(t, names, "greet")
+	assert.Contains(t, names, "test-default")
+
+	req := llm.ChatCompletionRequest{
+		Messages: []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: "and you?"}},
+		Template: &llm.TemplateRef{Name: "greet", Variables: map[string]any{"Name": "Ann"}},
+	}
+	require.NoError(t, dao.Apply(ctx, &req))
+	require.Len(t, req.Messages, 3)
+	assert.Equal(t, "Be brief.", req.Messages[0].Content)
+	assert.Equal(t, "Hi Ann", req.Messages[1].Content)
+
+	require.NoError(t, dao.Delete(ctx, "greet"))
+	_, err = dao.Get(ctx, "greet", 0)
+	assert.ErrorIs(t, err, llm.ErrNotFound)
+	assert.ErrorIs(t, dao.Delete(ctx, "greet"), llm.ErrNotFound)
+
+	messages, err := Render(ctx, dao.tx, "test-default", map[string]any{"Text": "text"})
+	require.NoError(t, err)
+	assert.Equal(t, "default text", messages[0].Content)
+}
@@ -0,0 +1,28 @@
+package prompts
+
+import (
+	"context"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/pocketbase/pocketbase/daos"
+)
+
+// defaults are the templates built into the code, they are used until a version with their name is saved.
+var defaults = make(map[string]llm.PromptTemplate)
+
+// Register adds a default template, it is meant to be called from init.
+func Register(t llm.PromptTemplate) {
+	if err := t.Validate(); err != nil {
+		panic(err)
+	}
+	defaults[t.Name] = t
+}
+
+// Render renders the latest version of the template with the variables.
+func Render(ctx context.Context, tx *daos.Dao, name string, vars map[string]any) ([]llm.ChatCompletionMessage, error) {
+	t, err := NewDao(tx).Get(ctx, name, 0)
+	if err != nil {
+		return nil, err
+	}
+	return t.Render(vars)
+}
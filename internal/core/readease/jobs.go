@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"runtime"
 
+	"github.com/Vaayne/aienvoy/internal/core/llms"
 	"github.com/Vaayne/aienvoy/internal/pkg/config"
 	"github.com/Vaayne/aienvoy/pkg/hackernews"
 
@@ -13,7 +14,7 @@ import (
 	"golang.org/x/sync/semaphore"
 )
 
-func PeriodJob(app *pocketbase.PocketBase, model string) ([]string, error) {
+func PeriodJob(app *pocketbase.PocketBase, registry *llms.Registry, model string) ([]string, error) {
 	ctx := context.Background()
 	slog.InfoContext(ctx, "Start readease period job...")
 	topStoiresCnt := config.GetConfig().ReadEase.TopStoriesCnt
@@ -27,7 +28,7 @@ func PeriodJob(app *pocketbase.PocketBase, model string) ([]string, error) {
 	}
 	slog.InfoContext(ctx, "success get hackernews top stories", "count", len(stories))
 
-	reader := NewReader(app)
+	reader := NewReader(app, registry)
 	maxWorkers := runtime.GOMAXPROCS(0)
 	sem := semaphore.NewWeighted(int64(maxWorkers))
 	for _, id := range stories {
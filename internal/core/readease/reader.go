@@ -10,6 +10,8 @@ import (
 	"strings"
 
 	"github.com/Vaayne/aienvoy/internal/core/llms"
+	"github.com/Vaayne/aienvoy/internal/core/prompts"
+	"github.com/Vaayne/aienvoy/internal/pkg/config"
 	"github.com/Vaayne/aienvoy/internal/pkg/parser"
 	"github.com/Vaayne/aienvoy/pkg/llms/llm"
 	"github.com/pocketbase/pocketbase"
@@ -45,13 +47,40 @@ A: ...
 Please ensure that you maintain the XML tags in your responses and avoid adding explanations or extra words.
 `
 
+// summaryPromptName is the prompt template of the summaries, it can be replaced with a new version through the prompts api.
+const summaryPromptName = "readease-summary"
+
+var summaryPrompt = llm.PromptTemplate{
+	Name:        summaryPromptName,
+	Description: "Summarize an article in Chinese, the article is the Content variable.",
+	System:      "You are my reading partner, you will help me summarize the article enclosed within the XML tag <article>.",
+	User:        "Here is my article enclosed within the XML tag <article>.\n<article>{{.Content}}</article>\n" + prompt,
+}
+
+func init() {
+	prompts.Register(summaryPrompt)
+}
+
+// summaryMaxTokens is the output limit of the summaries, the model must be able to write that many tokens.
+const summaryMaxTokens = 8192
+
+// Model returns the model of the summaries, the readease model of the settings or a gemini model which reads long articles.
+func Model() string {
+	if model := config.GetConfig().ReadEase.Model; model != "" {
+		return model
+	}
+	return llm.DefaultGeminiLongModel
+}
+
 type Reader struct {
-	app *pocketbase.PocketBase
+	app      *pocketbase.PocketBase
+	registry *llms.Registry
 }
 
-func NewReader(app *pocketbase.PocketBase) *Reader {
+func NewReader(app *pocketbase.PocketBase, registry *llms.Registry) *Reader {
 	return &Reader{
-		app: app,
+		app:      app,
+		registry: registry,
 	}
 }
 
@@ -107,12 +136,12 @@ func (s *Reader) Read(ctx context.Context, url, model string) (*Article, error)
 	}
 
 	if article != nil && article.Summary != "" {
-		slog.DebugContext(ctx, "article alreay summaried", "url", url, "title", article.Title, "summary", article.Summary[:100])
+		slog.DebugContext(ctx, "article alreay summaried", "url", url, "title", article.Title, "summary", article.Summary[:min(100, len(article.Summary))])
 		return article, nil
 	}
 
 	// summary article
-	llmSvc, err := llms.NewWithDao(model, llms.NewDao(s.app.Dao()))
+	llmSvc, err := s.registry.NewWithDao(model, llms.NewDao(s.app.Dao()))
 	if err != nil || llmSvc == nil {
 		slog.Error("failed to create llm service", "model", model)
 		return nil, fmt.Errorf("failed to create llm service: %w", err)
@@ -120,13 +149,16 @@ func (s *Reader) Read(ctx context.Context, url, model string) (*Article, error)
 
 	req := llm.ChatCompletionRequest{
 		Model:       model,
-		Messages:    buildMessages(article),
-		MaxTokens:   8192,
+		Messages:    s.buildMessages(ctx, article),
+		MaxTokens:   summaryMaxTokens,
 		Temperature: 0.7,
 	}
 	resp, err := llmSvc.CreateChatCompletion(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("summaryArticle create chat message err: %v", err)
+		return nil, fmt.Errorf("summaryArticle create chat message err: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("summaryArticle got no choices from %s", model)
 	}
 
 	summary, err := buildSummaryResponse(url, article.Title, resp.Choices[0].Message.Content)
@@ -137,10 +169,7 @@ func (s *Reader) Read(ctx context.Context, url, model string) (*Article, error)
 	article.Summary = summary
 	article.LlmModel = model
 
-	// save result to cache
-	if err := UpsertArticle(ctx, s.app.Dao(), article); err != nil {
-		slog.Error("upsertArticle err", "err", err)
-	}
+	s.save(ctx, article, resp.Choices[0].FinishReason)
 	return article, nil
 }
 
@@ -152,12 +181,15 @@ func (s *Reader) ReadStream(ctx context.Context, url, model string, respChan cha
 	}
 
 	if article != nil && article.Summary != "" {
-		slog.InfoContext(ctx, "article already summaries", "url", url, "title", article.Title, "summary", article.Summary[:100])
-		respChan <- llm.ChatCompletionStreamResponse{}
+		slog.InfoContext(ctx, "article already summaries", "url", url, "title", article.Title, "summary", article.Summary[:min(100, len(article.Summary))])
+		respChan <- llm.ChatCompletionStreamResponse{
+			Choices: []llm.ChatCompletionStreamChoice{{Delta: llm.ChatCompletionStreamChoiceDelta{Role: llm.ChatMessageRoleAssistant, Content: article.Summary}}},
+		}
+		errChan <- io.EOF
 		return
 	}
 
-	llmSvc, err := llms.NewWithDao(model, llms.NewDao(s.app.Dao()))
+	llmSvc, err := s.registry.NewWithDao(model, llms.NewDao(s.app.Dao()))
 	if err != nil || llmSvc == nil {
 		slog.ErrorContext(ctx, "failed to create llm service", "model", model)
 		errChan <- fmt.Errorf("failed to create llm service: %w", err)
@@ -166,8 +198,8 @@ func (s *Reader) ReadStream(ctx context.Context, url, model string, respChan cha
 
 	req := llm.ChatCompletionRequest{
 		Model:       model,
-		Messages:    buildMessages(article),
-		MaxTokens:   8192,
+		Messages:    s.buildMessages(ctx, article),
+		MaxTokens:   summaryMaxTokens,
 		Temperature: 0.7,
 		Stream:      true,
 	}
@@ -179,10 +211,17 @@ func (s *Reader) ReadStream(ctx context.Context, url, model string, respChan cha
 
 	go llmSvc.CreateChatCompletionStream(ctx, req, dataChan, innerErrChan)
 	sb := strings.Builder{}
+	var finishReason llm.FinishReason
 	for {
 		select {
 		case resp := <-dataChan:
+			if len(resp.Choices) == 0 {
+				continue
+			}
 			sb.WriteString(resp.Choices[0].Delta.Content)
+			if resp.Choices[0].FinishReason != "" {
+				finishReason = resp.Choices[0].FinishReason
+			}
 			respChan <- resp
 		case err := <-innerErrChan:
 			if errors.Is(err, io.EOF) {
@@ -194,10 +233,8 @@ func (s *Reader) ReadStream(ctx context.Context, url, model string, respChan cha
 				article.Summary = summary
 				article.LlmModel = req.Model
 
-				if err := UpsertArticle(ctx, s.app.Dao(), article); err != nil {
-					slog.ErrorContext(ctx, "upsertArticle err", "err", err)
-				}
-				slog.InfoContext(ctx, "success stream summary article", "url", url, "title", article.Title, "summary", article.Summary[:100])
+				s.save(ctx, article, finishReason)
+				slog.InfoContext(ctx, "success stream summary article", "url", url, "title", article.Title, "summary", article.Summary[:min(100, len(article.Summary))])
 			}
 			errChan <- err
 			return
@@ -207,21 +244,31 @@ func (s *Reader) ReadStream(ctx context.Context, url, model string, respChan cha
 	}
 }
 
-func buildMessages(article *Article) []llm.ChatCompletionMessage {
-	return []llm.ChatCompletionMessage{
-		{
-			Role:    llm.ChatMessageRoleSystem,
-			Content: "You are my reading partner, you will help me summarize the article enclosed within the XML tag <article>.",
-		},
-		{
-			Role:    llm.ChatMessageRoleUser,
-			Content: fmt.Sprintf("Here is my article enclosed within the XML tag <article>.\n<article>%s</article>", article.Content),
-		},
-		{
-			Role:    llm.ChatMessageRoleUser,
-			Content: prompt,
-		},
+// save caches the summary of the article, a summary which hit the token limit is not cached so that the article is read again.
+func (s *Reader) save(ctx context.Context, article *Article, finishReason llm.FinishReason) {
+	if finishReason == llm.FinishReasonLength {
+		slog.WarnContext(ctx, "summary is truncated by the token limit, not cached", "url", article.Url, "model", article.LlmModel, "max_tokens", summaryMaxTokens)
+		return
+	}
+	if err := UpsertArticle(ctx, s.app.Dao(), article); err != nil {
+		slog.ErrorContext(ctx, "upsertArticle err", "err", err)
+	}
+}
+
+// buildMessages renders the summary prompt template, the built-in one when the saved version can not be rendered.
+func (s *Reader) buildMessages(ctx context.Context, article *Article) []llm.ChatCompletionMessage {
+	vars := map[string]any{
+		"Title":   article.Title,
+		"Url":     article.OriginalUrl,
+		"Content": article.Content,
+	}
+	messages, err := prompts.Render(ctx, s.app.Dao(), summaryPromptName, vars)
+	if err == nil {
+		return messages
 	}
+	slog.ErrorContext(ctx, "render summary prompt error, use the default prompt", "err", err)
+	messages, _ = summaryPrompt.Render(vars)
+	return messages
 }
 
 func buildSummaryResponse(url, title, summary string) (string, error) {
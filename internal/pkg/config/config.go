@@ -1,15 +1,41 @@
 package config
 
 import (
+	"sync"
+	"sync/atomic"
+
 	"github.com/Vaayne/aienvoy/pkg/config"
 )
 
-var globalConfig = &Config{}
+var (
+	// globalConfig is replaced as a whole on reload, a loaded *Config must be treated as read only
+	globalConfig atomic.Pointer[Config]
+	listenersMu  sync.Mutex
+	listeners    []func(cfg *Config)
+)
 
 func init() {
-	config.Load(globalConfig)
+	cfg := &Config{}
+	config.Load(cfg, notifyChange)
+	globalConfig.Store(cfg)
 }
 
 func GetConfig() *Config {
-	return globalConfig
+	return globalConfig.Load()
+}
+
+// OnChange registers fn to be called with the new config every time the settings file changes.
+func OnChange(fn func(cfg *Config)) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	listeners = append(listeners, fn)
+}
+
+func notifyChange(cfg *Config) {
+	globalConfig.Store(cfg)
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	for _, fn := range listeners {
+		fn(cfg)
+	}
 }
@@ -1,11 +1,16 @@
 package config
 
+import "github.com/Vaayne/aienvoy/pkg/llms/llm"
+
 const (
-	ContextKeyContext    string = "context"
-	ContextKeyApp        string = "app"
-	ContextKeyDao        string = "dao"
-	ContextKeyAuthRecord string = "authRecord"
-	ContextKeyApiKey     string = "api_key"
-	ContextKeyUserId     string = "user_id"
-	ContextKeyRequestId  string = "X-Request-ID"
+	ContextKeyContext     string = "context"
+	ContextKeyApp         string = "app"
+	ContextKeyDao         string = "dao"
+	ContextKeyLLMRegistry string = "llm_registry"
+	ContextKeyAuthRecord  string = "authRecord"
+	ContextKeyApiKey      string = "api_key"
+	ContextKeyApiKeyId    string = "api_key_id"
+	ContextKeyUserId      string = llm.ContextKeyUserId
+	ContextKeyAllUsers    string = llm.ContextKeyAllUsers
+	ContextKeyRequestId   string = "X-Request-ID"
 )
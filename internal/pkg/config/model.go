@@ -3,11 +3,19 @@ package config
 import "github.com/Vaayne/aienvoy/pkg/llms/llm"
 
 type Config struct {
-	Service  ServiceConfig
-	Admins   []Admin
-	LLMs     []llm.Config
-	Axiom    Axiom
-	Telegram struct {
+	Service            ServiceConfig
+	Admins             []Admin
+	LLMs               []llm.Config
+	LLMRoutes          []llm.Route
+	LLMBalanceStrategy string
+	LLMModels          []llm.Model
+	LLMHistory         string
+	LLMAnnotationModel string
+	LLMCache           llm.CacheConfig
+	// LLMBatchConcurrency is the number of requests of the batches run at the same time
+	LLMBatchConcurrency int
+	Axiom               Axiom
+	Telegram            struct {
 		Token string `yaml:"token"`
 	}
 	ClaudeWeb struct {
@@ -44,6 +52,8 @@ type Admin struct {
 type ReadEase struct {
 	TelegramChannel int64 `yaml:"telegramChannel"`
 	TopStoriesCnt   int   `yaml:"topStoriesCnt"`
+	// Model summarizes the articles, defaults to gemini 1.5 flash
+	Model string `yaml:"model"`
 }
 
 type CookieCloud struct {
@@ -20,10 +20,20 @@ func GetUserId(ctx context.Context) string {
 	return getString(ctx, config.ContextKeyUserId)
 }
 
+// IsAllUsers reports whether an admin asked to see the data of all users instead of their own.
+func IsAllUsers(ctx context.Context) bool {
+	val, _ := ctx.Value(config.ContextKeyAllUsers).(bool)
+	return val
+}
+
 func GetApiKey(ctx context.Context) string {
 	return getString(ctx, config.ContextKeyApiKey)
 }
 
+func GetApiKeyId(ctx context.Context) string {
+	return getString(ctx, config.ContextKeyApiKeyId)
+}
+
 func GetRequestId(ctx context.Context) string {
 	return getString(ctx, config.ContextKeyRequestId)
 }
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/Vaayne/aienvoy/internal/core/batches"
+	"github.com/Vaayne/aienvoy/internal/pkg/config"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/daos"
+)
+
+// maxBatchFileSize bounds the uploaded batch input files
+const maxBatchFileSize = 64 << 20
+
+type BatchHandler struct {
+	runner *batches.Runner
+}
+
+func NewBatchHandler(runner *batches.Runner) *BatchHandler {
+	return &BatchHandler{runner: runner}
+}
+
+// UploadFile saves a batch input file, sent as the file field of a multipart form with its purpose.
+func (b *BatchHandler) UploadFile(c echo.Context) error {
+	ctx := c.Request().Context()
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxBatchFileSize)
+	purpose := c.FormValue("purpose")
+	if purpose != llm.FilePurposeBatch {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("unsupported purpose %s, only %s is supported", purpose, llm.FilePurposeBatch))
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		slog.ErrorContext(ctx, "read batch file error", "err", err.Error())
+		return c.String(http.StatusBadRequest, "file is required")
+	}
+	f, err := header.Open()
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+
+	file, err := newBatchDao(c).SaveFile(ctx, header.Filename, purpose, content)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, file)
+}
+
+func (b *BatchHandler) GetFile(c echo.Context) error {
+	file, err := newBatchDao(c).GetFile(c.Request().Context(), c.PathParam("id"))
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, file)
+}
+
+// GetFileContent downloads a file, like the output or error file of a batch.
+func (b *BatchHandler) GetFileContent(c echo.Context) error {
+	file, content, err := newBatchDao(c).GetFileContent(c.Request().Context(), c.PathParam("id"))
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", file.Filename))
+	return c.Blob(http.StatusOK, llm.ExportJSONL.ContentType(), content)
+}
+
+type CreateBatchRequest struct {
+	InputFileId      string            `json:"input_file_id"`
+	Endpoint         string            `json:"endpoint"`
+	CompletionWindow string            `json:"completion_window"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+}
+
+// CreateBatch creates a batch of the requests of an uploaded file, they are run in the background.
+func (b *BatchHandler) CreateBatch(c echo.Context) error {
+	ctx := c.Request().Context()
+	req := new(CreateBatchRequest)
+	if err := c.Bind(req); err != nil {
+		slog.ErrorContext(ctx, "bind create batch request body error", "err", err.Error())
+		return c.String(http.StatusBadRequest, "bad request")
+	}
+	if req.Endpoint != llm.BatchEndpointChatCompletions {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("unsupported endpoint %s, only %s is supported", req.Endpoint, llm.BatchEndpointChatCompletions))
+	}
+	if req.CompletionWindow != llm.BatchCompletionWindow {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("unsupported completion_window %s, only %s is supported", req.CompletionWindow, llm.BatchCompletionWindow))
+	}
+
+	// the requests of a batch created with an api key must use the models it is allowed to
+	key, err := requestApiKey(c)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	if key != nil {
+		if err := newBatchDao(c).CheckModels(ctx, req.InputFileId, *key); err != nil {
+			return c.String(errorStatus(err), err.Error())
+		}
+	}
+
+	batch, err := newBatchDao(c).CreateBatch(ctx, req.InputFileId, req.Metadata)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	b.runner.Submit(batch.Id)
+	return c.JSON(http.StatusOK, batch)
+}
+
+type ListBatchesResponse struct {
+	Object  string      `json:"object"`
+	Data    []llm.Batch `json:"data"`
+	FirstId string      `json:"first_id,omitempty"`
+	LastId  string      `json:"last_id,omitempty"`
+	HasMore bool        `json:"has_more"`
+}
+
+// ListBatches lists the batches of the user newest first, paginated with after and limit.
+func (b *BatchHandler) ListBatches(c echo.Context) error {
+	opts, err := listOptions(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	// one more batch is read to know whether there is another page
+	list, err := newBatchDao(c).ListBatches(c.Request().Context(), opts.After, opts.Limit+1)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	resp := ListBatchesResponse{Object: "list", Data: list}
+	if len(list) > opts.Limit {
+		resp.Data, resp.HasMore = list[:opts.Limit], true
+	}
+	if len(resp.Data) > 0 {
+		resp.FirstId, resp.LastId = resp.Data[0].Id, resp.Data[len(resp.Data)-1].Id
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+func (b *BatchHandler) GetBatch(c echo.Context) error {
+	batch, err := newBatchDao(c).GetBatch(c.Request().Context(), c.PathParam("id"))
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, batch)
+}
+
+// CancelBatch cancels the batch, it is cancelling until its running requests are done.
+func (b *BatchHandler) CancelBatch(c echo.Context) error {
+	batch, err := b.runner.Cancel(c.Request().Context(), c.PathParam("id"))
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, batch)
+}
+
+func newBatchDao(c echo.Context) *batches.Dao {
+	return batches.NewDao(c.Get(config.ContextKeyDao).(*daos.Dao))
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/labstack/echo/v5"
+)
+
+// maxImportSize bounds the size of an imported file, ChatGPT exports of long time users are large.
+const maxImportSize = 64 << 20
+
+// ExportConversation exports a conversation in the format of the format query param, markdown by default.
+func (l *LLMHandler) ExportConversation(c echo.Context) error {
+	ctx := c.Request().Context()
+	svc, err := l.newStoreService(c)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	export, err := svc.ExportConversation(ctx, c.PathParam("conversationId"))
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return writeExport(c, "conversation-"+export.Id, []llm.ConversationExport{export})
+}
+
+// ExportConversations exports every conversation of the user, admins can export all users with all_users.
+func (l *LLMHandler) ExportConversations(c echo.Context) error {
+	ctx := c.Request().Context()
+	svc, err := l.newStoreService(c)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	exports, err := svc.ExportConversations(ctx)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return writeExport(c, "conversations", exports)
+}
+
+func writeExport(c echo.Context, name string, exports []llm.ConversationExport) error {
+	format := llm.ExportFormat(c.QueryParam("format"))
+	if format == "" {
+		format = llm.ExportMarkdown
+	}
+	switch format {
+	case llm.ExportMarkdown, llm.ExportJSON, llm.ExportJSONL:
+	default:
+		return c.String(http.StatusBadRequest, fmt.Sprintf("unsupported format %s", format))
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, format.ContentType())
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", name+"."+format.Ext()))
+	c.Response().WriteHeader(http.StatusOK)
+	if err := llm.WriteExport(c.Response(), format, exports); err != nil {
+		slog.ErrorContext(c.Request().Context(), "write export error", "err", err)
+		return err
+	}
+	return nil
+}
+
+// ImportConversations imports the conversations of the body, or of the file field of a multipart form.
+// The format query param is json for our own export, chatgpt for conversations.json of a ChatGPT export
+// and jsonl for OpenAI fine-tuning files.
+func (l *LLMHandler) ImportConversations(c echo.Context) error {
+	ctx := c.Request().Context()
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxImportSize)
+	var body io.Reader = c.Request().Body
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		file, err := c.FormFile("file")
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		f, err := file.Open()
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		defer f.Close()
+		body = f
+	}
+
+	exports, err := llm.ReadImport(body, llm.ImportFormat(c.QueryParam("format")))
+	if err != nil {
+		slog.ErrorContext(ctx, "read import error", "err", err)
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	svc, err := l.newStoreService(c)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	covs, err := svc.ImportConversations(ctx, exports)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusCreated, covs)
+}
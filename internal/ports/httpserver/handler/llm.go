@@ -7,18 +7,25 @@ import (
 	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Vaayne/aienvoy/internal/core/auth"
 	"github.com/Vaayne/aienvoy/internal/core/llms"
 	"github.com/Vaayne/aienvoy/internal/pkg/config"
 	"github.com/Vaayne/aienvoy/pkg/llms/llm"
 	"github.com/labstack/echo/v5"
 	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
 )
 
-type LLMHandler struct{}
+type LLMHandler struct {
+	registry *llms.Registry
+}
 
-func NewLLMHandler() *LLMHandler {
-	return &LLMHandler{}
+func NewLLMHandler(registry *llms.Registry) *LLMHandler {
+	return &LLMHandler{registry: registry}
 }
 
 type CreateConversationRequest struct {
@@ -33,9 +40,9 @@ func (l *LLMHandler) CreateConversation(c echo.Context) error {
 		slog.ErrorContext(ctx, "bind create conversation request body error", "err", err.Error())
 		return c.String(http.StatusBadRequest, "bad request")
 	}
-	svc, err := newLlmService(c, req.Model)
+	svc, err := l.newLlmService(c, req.Model)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(errorStatus(err), err.Error())
 	}
 
 	cov, err := svc.CreateConversation(ctx, req.Name)
@@ -45,29 +52,34 @@ func (l *LLMHandler) CreateConversation(c echo.Context) error {
 	return c.JSON(http.StatusCreated, cov)
 }
 
+// ListConversations lists the conversations oldest first, paginated with the limit, before and after query params.
 func (l *LLMHandler) ListConversations(c echo.Context) error {
 	ctx := c.Request().Context()
-	svc, err := newLlmService(c, llm.OAIModelGPT3Dot5Turbo)
+	opts, err := listOptions(c)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(http.StatusBadRequest, err.Error())
 	}
-	covs, err := svc.ListConversations(ctx)
+	svc, err := l.newStoreService(c)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
+	covs, err := svc.ListConversations(ctx, opts)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
 	return c.JSON(http.StatusOK, covs)
 }
 
 func (l *LLMHandler) GetConversation(c echo.Context) error {
 	ctx := c.Request().Context()
 	id := c.PathParam("id")
-	svc, err := newLlmService(c, llm.OAIModelGPT3Dot5Turbo)
+	svc, err := l.newStoreService(c)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
 	cov, err := svc.GetConversation(ctx, id)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(errorStatus(err), err.Error())
 	}
 	return c.JSON(http.StatusOK, cov)
 }
@@ -75,18 +87,19 @@ func (l *LLMHandler) GetConversation(c echo.Context) error {
 func (l *LLMHandler) DeleteConversation(c echo.Context) error {
 	ctx := c.Request().Context()
 	id := c.PathParam("id")
-	svc, err := newLlmService(c, llm.OAIModelGPT3Dot5Turbo)
+	svc, err := l.newStoreService(c)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
 	err = svc.DeleteConversation(ctx, id)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(errorStatus(err), err.Error())
 	}
 	return c.JSON(http.StatusOK, nil)
 }
 
 func (l *LLMHandler) CreateMessage(c echo.Context) error {
+	withCacheStatus(c)
 	ctx := c.Request().Context()
 	conversationId := c.PathParam("conversationId")
 	req := new(llm.ChatCompletionRequest)
@@ -95,44 +108,58 @@ func (l *LLMHandler) CreateMessage(c echo.Context) error {
 		slog.ErrorContext(ctx, "bind chat request body error", "err", err.Error())
 		return c.String(http.StatusBadRequest, "bad request")
 	}
+	if err := applyTemplate(c, req); err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
 
 	if req.Stream {
 		return l.createMessageStream(c, conversationId, req)
 	}
 
-	svc, err := newLlmService(c, req.Model)
+	svc, err := l.newLlmService(c, req.Model)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(errorStatus(err), err.Error())
 	}
 	msg, err := svc.CreateMessage(ctx, conversationId, *req)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(errorStatus(err), err.Error())
 	}
+	setCacheHeader(c)
 	return c.JSON(http.StatusOK, msg)
 }
 
 func (l *LLMHandler) createMessageStream(c echo.Context, conversationId string, req *llm.ChatCompletionRequest) error {
-	svc, err := newLlmService(c, req.Model)
+	svc, err := l.newLlmService(c, req.Model)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(errorStatus(err), err.Error())
+	}
+	// the stream can not change the status code once started
+	if _, err := svc.GetConversation(c.Request().Context(), conversationId); err != nil {
+		return c.String(errorStatus(err), err.Error())
 	}
+	return messageStream(c, func(dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+		svc.CreateMessageStream(c.Request().Context(), conversationId, *req, dataChan, errChan)
+	})
+}
+
+// messageStream writes the responses of stream as server sent events.
+func messageStream(c echo.Context, stream func(dataChan chan llm.ChatCompletionStreamResponse, errChan chan error)) error {
 	dataChan := make(chan llm.ChatCompletionStreamResponse)
 	defer close(dataChan)
 	errChan := make(chan error)
 	defer close(errChan)
 
-	go svc.CreateMessageStream(c.Request().Context(), conversationId, *req, dataChan, errChan)
-
-	// sse stream response
-	c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
-	c.Response().Header().Set("Cache-Control", "no-cache")
-	c.Response().Header().Set("Connection", "keep-alive")
-
-	c.Response().WriteHeader(http.StatusOK)
+	go stream(dataChan, errChan)
 
+	// the sse headers are written with the first event, once the cache status is known
+	started := false
 	for {
 		select {
 		case data := <-dataChan:
+			if !started {
+				started = true
+				writeStreamHeader(c)
+			}
 			msg, err := json.Marshal(data)
 			if err != nil {
 				slog.ErrorContext(c.Request().Context(), "chat stream marshal response error", "err", err.Error())
@@ -146,6 +173,9 @@ func (l *LLMHandler) createMessageStream(c echo.Context, conversationId string,
 			c.Response().Flush()
 		case err := <-errChan:
 			if errors.Is(err, io.EOF) {
+				if !started {
+					writeStreamHeader(c)
+				}
 				return c.String(http.StatusOK, "data: [DONE]\n\n")
 			}
 			return c.String(http.StatusInternalServerError, err.Error())
@@ -153,51 +183,211 @@ func (l *LLMHandler) createMessageStream(c echo.Context, conversationId string,
 	}
 }
 
+// ListMessages lists the messages of a conversation oldest first, paginated like ListConversations.
 func (l *LLMHandler) ListMessages(c echo.Context) error {
 	ctx := c.Request().Context()
 	id := c.PathParam("conversationId")
-	svc, err := newLlmService(c, llm.OAIModelGPT3Dot5Turbo)
+	opts, err := listOptions(c)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(http.StatusBadRequest, err.Error())
 	}
-	msgs, err := svc.ListMessages(ctx, id)
+	svc, err := l.newStoreService(c)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
+	// the messages of the conversations of other users are not found
+	if _, err := svc.GetConversation(ctx, id); err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	msgs, err := svc.ListMessages(ctx, id, opts)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
 	return c.JSON(http.StatusOK, msgs)
 }
 
 func (l *LLMHandler) GetMessage(c echo.Context) error {
-	ctx := c.Request().Context()
-	// conversationId := c.PathParam("conversationId")
-	messageId := c.PathParam("messageId")
-	svc, err := newLlmService(c, llm.OAIModelGPT3Dot5Turbo)
+	svc, err := l.newStoreService(c)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
-	msg, err := svc.GetMessage(ctx, messageId)
+	msg, err := getConversationMessage(c, svc)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(errorStatus(err), err.Error())
 	}
 	return c.JSON(http.StatusOK, msg)
 }
 
 func (l *LLMHandler) DeleteMessage(c echo.Context) error {
 	ctx := c.Request().Context()
-	// conversationId := c.PathParam("conversationId")
-	messageId := c.PathParam("messageId")
-	svc, err := newLlmService(c, llm.OAIModelGPT3Dot5Turbo)
+	svc, err := l.newStoreService(c)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
-	err = svc.DeleteMessage(ctx, messageId)
+	msg, err := getConversationMessage(c, svc)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(errorStatus(err), err.Error())
+	}
+	err = svc.DeleteMessage(ctx, msg.Id)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
 	}
 	return c.JSON(http.StatusOK, nil)
 }
 
+// EditMessage creates a sibling of the message with the new request, the new message becomes the active leaf.
+func (l *LLMHandler) EditMessage(c echo.Context) error {
+	withCacheStatus(c)
+	ctx := c.Request().Context()
+	req := new(llm.ChatCompletionRequest)
+	if err := c.Bind(req); err != nil {
+		slog.ErrorContext(ctx, "bind chat request body error", "err", err.Error())
+		return c.String(http.StatusBadRequest, "bad request")
+	}
+	if err := applyTemplate(c, req); err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	svc, err := l.newLlmService(c, req.Model)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	msg, err := getConversationMessage(c, svc)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+
+	if req.Stream {
+		return messageStream(c, func(dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+			svc.EditMessageStream(ctx, msg.Id, *req, dataChan, errChan)
+		})
+	}
+	edited, err := svc.EditMessage(ctx, msg.Id, *req)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	setCacheHeader(c)
+	return c.JSON(http.StatusOK, edited)
+}
+
+type RegenerateMessageRequest struct {
+	Stream bool `json:"stream,omitempty"`
+}
+
+// RegenerateMessage sends the request of the message again, the new answer is a sibling of the message.
+func (l *LLMHandler) RegenerateMessage(c echo.Context) error {
+	withCacheStatus(c)
+	ctx := c.Request().Context()
+	req := new(RegenerateMessageRequest)
+	if err := c.Bind(req); err != nil {
+		slog.ErrorContext(ctx, "bind regenerate message request body error", "err", err.Error())
+		return c.String(http.StatusBadRequest, "bad request")
+	}
+	svc, err := l.newStoreService(c)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	msg, err := getConversationMessage(c, svc)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	// the message is answered again by the model of its request
+	svc, err = l.newLlmService(c, msg.Request.Model)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+
+	if req.Stream {
+		return messageStream(c, func(dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+			svc.RegenerateMessageStream(ctx, msg.Id, dataChan, errChan)
+		})
+	}
+	regenerated, err := svc.RegenerateMessage(ctx, msg.Id)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	setCacheHeader(c)
+	return c.JSON(http.StatusOK, regenerated)
+}
+
+// ListBranches lists the branches of a conversation, one for every leaf message.
+func (l *LLMHandler) ListBranches(c echo.Context) error {
+	ctx := c.Request().Context()
+	svc, err := l.newStoreService(c)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	branches, err := svc.ListBranches(ctx, c.PathParam("conversationId"))
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, branches)
+}
+
+type SwitchBranchRequest struct {
+	MessageId string `json:"message_id"`
+}
+
+// SwitchBranch sets the active leaf of a conversation to the latest leaf under the message.
+func (l *LLMHandler) SwitchBranch(c echo.Context) error {
+	ctx := c.Request().Context()
+	req := new(SwitchBranchRequest)
+	if err := c.Bind(req); err != nil || req.MessageId == "" {
+		slog.ErrorContext(ctx, "bind switch branch request body error", "err", err)
+		return c.String(http.StatusBadRequest, "bad request")
+	}
+	svc, err := l.newStoreService(c)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	cov, err := svc.SwitchBranch(ctx, c.PathParam("conversationId"), req.MessageId)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, cov)
+}
+
+// Search searches the messages of the user, the q query param is the text and limit the number of results.
+func (l *LLMHandler) Search(c echo.Context) error {
+	ctx := c.Request().Context()
+	query := strings.TrimSpace(c.QueryParam("q"))
+	if query == "" {
+		return c.String(http.StatusBadRequest, "q is required")
+	}
+	limit := 0
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return c.String(http.StatusBadRequest, "invalid limit")
+		}
+		limit = min(n, maxListLimit)
+	}
+	svc, err := l.newStoreService(c)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	results, err := svc.Search(ctx, query, limit)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, results)
+}
+
+// getConversationMessage returns the message of the path, it is not found when it belongs to another conversation.
+func getConversationMessage(c echo.Context, svc *llm.LLM) (llm.Message, error) {
+	conversationId := c.PathParam("conversationId")
+	messageId := c.PathParam("messageId")
+	msg, err := svc.GetMessage(c.Request().Context(), messageId)
+	if err != nil {
+		return llm.Message{}, err
+	}
+	if msg.ConversationId != conversationId {
+		return llm.Message{}, fmt.Errorf("message %s of conversation %s: %w", messageId, conversationId, llm.ErrNotFound)
+	}
+	return msg, nil
+}
+
 func (l *LLMHandler) CreateChatCompletion(c echo.Context) error {
+	withCacheStatus(c)
 	ctx := c.Request().Context()
 	req := new(llm.ChatCompletionRequest)
 	err := c.Bind(req)
@@ -205,10 +395,13 @@ func (l *LLMHandler) CreateChatCompletion(c echo.Context) error {
 		slog.ErrorContext(ctx, "bind chat request body error", "err", err.Error())
 		return c.String(http.StatusBadRequest, "bad request")
 	}
+	if err := applyTemplate(c, req); err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
 
-	svc, err := newLlmService(c, req.Model)
+	svc, err := l.newLlmService(c, req.Model)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(errorStatus(err), err.Error())
 	}
 	if svc == nil {
 		return c.String(http.StatusBadRequest, "unknown model")
@@ -220,8 +413,9 @@ func (l *LLMHandler) CreateChatCompletion(c echo.Context) error {
 
 	resp, err := svc.CreateChatCompletion(ctx, *req)
 	if err != nil {
-		return c.String(http.StatusInternalServerError, err.Error())
+		return c.String(errorStatus(err), err.Error())
 	}
+	setCacheHeader(c)
 	return c.JSON(http.StatusOK, resp)
 }
 
@@ -233,16 +427,15 @@ func (l *LLMHandler) chatStream(c echo.Context, svc *llm.LLM, req llm.ChatComple
 
 	go svc.CreateChatCompletionStream(c.Request().Context(), req, dataChan, errChan)
 
-	// sse stream response
-	c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
-	c.Response().Header().Set("Cache-Control", "no-cache")
-	c.Response().Header().Set("Connection", "keep-alive")
-
-	c.Response().WriteHeader(http.StatusOK)
-
+	// the sse headers are written with the first event, once the cache status is known
+	started := false
 	for {
 		select {
 		case data := <-dataChan:
+			if !started {
+				started = true
+				writeStreamHeader(c)
+			}
 			msg, err := json.Marshal(data)
 			if err != nil {
 				slog.ErrorContext(c.Request().Context(), "chat stream marshal response error", "err", err.Error())
@@ -256,14 +449,260 @@ func (l *LLMHandler) chatStream(c echo.Context, svc *llm.LLM, req llm.ChatComple
 			c.Response().Flush()
 		case err := <-errChan:
 			if errors.Is(err, io.EOF) {
+				if !started {
+					writeStreamHeader(c)
+				}
 				_, err = c.Response().Write([]byte("data: [DONE]\n\n"))
 				return err
 			}
-			return c.String(http.StatusInternalServerError, err.Error())
+			return c.String(errorStatus(err), err.Error())
+		}
+	}
+}
+
+// base64Embedding is an embedding in the base64 encoding format of the openai api.
+type base64Embedding struct {
+	Object    string `json:"object"`
+	Embedding string `json:"embedding"`
+	Index     int    `json:"index"`
+}
+
+// CreateEmbeddings creates the embeddings of the input, a string or a list of strings,
+// in the format of the openai api.
+func (l *LLMHandler) CreateEmbeddings(c echo.Context) error {
+	ctx := c.Request().Context()
+	req := new(llm.EmbeddingRequest)
+	if err := c.Bind(req); err != nil {
+		slog.ErrorContext(ctx, "bind embeddings request body error", "err", err.Error())
+		return c.String(http.StatusBadRequest, "bad request")
+	}
+
+	svc, err := l.newLlmService(c, req.Model)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	if svc == nil {
+		return c.String(http.StatusBadRequest, "unknown model")
+	}
+
+	resp, err := svc.CreateEmbeddings(ctx, *req)
+	if errors.Is(err, llm.ErrInvalidEmbeddingInput) || errors.Is(err, llm.ErrEmbeddingsNotSupported) {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	if req.EncodingFormat != llm.EmbeddingEncodingFormatBase64 {
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	data := make([]base64Embedding, 0, len(resp.Data))
+	for _, e := range resp.Data {
+		data = append(data, base64Embedding{Object: e.Object, Embedding: llm.EncodeEmbeddingBase64(e.Embedding), Index: e.Index})
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"object": resp.Object,
+		"data":   data,
+		"model":  resp.Model,
+		"usage":  resp.Usage,
+	})
+}
+
+// GetHealth returns the state of the keys of the models served by several configs.
+func (l *LLMHandler) GetHealth(c echo.Context) error {
+	return c.JSON(http.StatusOK, l.registry.Health())
+}
+
+// GetSpend aggregates the cost and tokens of the recorded usage, by default grouped by user for the current month.
+// The query params are group_by, a comma separated list of user, api_key, provider, model and day,
+// from and to as 2006-01-02 with to exclusive, and the user_id and api_key filters.
+func (l *LLMHandler) GetSpend(c echo.Context) error {
+	ctx := c.Request().Context()
+	now := time.Now().UTC()
+	query := llms.SpendQuery{
+		GroupBy: []string{"user"},
+		From:    time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC),
+		To:      now,
+		UserId:  c.QueryParam("user_id"),
+		ApiKey:  c.QueryParam("api_key"),
+	}
+	if groupBy := c.QueryParam("group_by"); groupBy != "" {
+		query.GroupBy = strings.Split(groupBy, ",")
+	}
+	for param, t := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		val := c.QueryParam(param)
+		if val == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.DateOnly, val)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("invalid %s date %s", param, val))
+		}
+		*t = parsed
+	}
+
+	items, err := llms.NewDao(c.Get(config.ContextKeyDao).(*daos.Dao)).Spend(ctx, query)
+	if err != nil {
+		slog.ErrorContext(ctx, "get llm spend error", "err", err, "query", query)
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, items)
+}
+
+// ModelResponse is a model in the format of the openai api, with the catalogue details.
+type ModelResponse struct {
+	ID            string           `json:"id"`
+	Object        string           `json:"object"`
+	Created       int64            `json:"created"`
+	OwnedBy       string           `json:"owned_by"`
+	ContextLength int              `json:"context_length,omitempty"`
+	Capabilities  llm.Capabilities `json:"capabilities"`
+	Pricing       llm.Pricing      `json:"pricing"`
+}
+
+type ListModelsResponse struct {
+	Object string          `json:"object"`
+	Data   []ModelResponse `json:"data"`
+}
+
+// GetModels lists the models the caller may use, in provider/model form and as bare ids.
+func (l *LLMHandler) GetModels(c echo.Context) error {
+	return c.JSON(http.StatusOK, ListModelsResponse{
+		Object: "list",
+		Data:   l.listModels(c),
+	})
+}
+
+// GetModel returns one model, the id may contain slashes like openai/gpt-4.
+func (l *LLMHandler) GetModel(c echo.Context) error {
+	id := c.PathParam("*")
+	for _, m := range l.listModels(c) {
+		if m.ID == id {
+			return c.JSON(http.StatusOK, m)
+		}
+	}
+	return c.String(http.StatusNotFound, fmt.Sprintf("model %s not found", id))
+}
+
+// listModels returns the models of the router, filtered by the allow-list when the caller uses an api key.
+func (l *LLMHandler) listModels(c echo.Context) []ModelResponse {
+	key, err := requestApiKey(c)
+	if err != nil {
+		slog.ErrorContext(c.Request().Context(), "get api key error", "err", err)
+	}
+
+	resp := make([]ModelResponse, 0)
+	for _, m := range l.registry.Models() {
+		if key != nil && !key.AllowModel(m.ID) {
+			continue
 		}
+		resp = append(resp, ModelResponse{
+			ID:            m.ID,
+			Object:        "model",
+			OwnedBy:       m.Provider,
+			ContextLength: m.ContextLength,
+			Capabilities:  m.Capabilities,
+			Pricing:       m.Pricing,
+		})
+	}
+	return resp
+}
+
+// maxListLimit bounds the page size of conversations and messages, it is also the default
+const maxListLimit = 100
+
+// headerXCache tells whether the chat completion was served from the response cache
+const headerXCache = "X-Cache"
+
+// withCacheStatus records in the context of the request whether its response is served from the cache,
+// requests with a Cache-Control: no-cache header skip the cached responses.
+func withCacheStatus(c echo.Context) {
+	ctx, _ := llm.WithCacheStatus(c.Request().Context())
+	if strings.Contains(c.Request().Header.Get("Cache-Control"), "no-cache") {
+		ctx = llm.WithCacheBypass(ctx)
+	}
+	c.SetRequest(c.Request().WithContext(ctx))
+}
+
+// setCacheHeader sets the X-Cache header to HIT or MISS, it is left out when the request was not cacheable.
+func setCacheHeader(c echo.Context) {
+	if status := llm.CacheStatusFrom(c.Request().Context()).String(); status != "" {
+		c.Response().Header().Set(headerXCache, status)
 	}
 }
 
-func newLlmService(c echo.Context, model string) (*llm.LLM, error) {
-	return llms.NewWithDao(model, llms.NewDao(c.Get(config.ContextKeyDao).(*daos.Dao)))
+// writeStreamHeader starts the sse stream response.
+func writeStreamHeader(c echo.Context) {
+	setCacheHeader(c)
+	c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().Header().Set("Connection", "keep-alive")
+	c.Response().WriteHeader(http.StatusOK)
+}
+
+// listOptions reads the limit, before and after query params, the cursors are ids of the listed items.
+func listOptions(c echo.Context) (llm.ListOptions, error) {
+	opts := llm.ListOptions{
+		Limit:  maxListLimit,
+		Before: c.QueryParam("before"),
+		After:  c.QueryParam("after"),
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return opts, fmt.Errorf("invalid limit %s", limit)
+		}
+		opts.Limit = min(n, maxListLimit)
+	}
+	return opts, nil
+}
+
+// errorStatus maps the errors of the conversations and messages to a status code,
+// the resources of other users are not found.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, llm.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, auth.ErrModelNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, llm.ErrCursorNotFound), errors.Is(err, llm.ErrUnsupportedFormat), errors.Is(err, llm.ErrInvalidTemplate),
+		errors.Is(err, llm.ErrInvalidBatch), errors.Is(err, llm.ErrContentFilter), errors.Is(err, llm.ErrImageURLNotAllowed):
+		return http.StatusBadRequest
+	case errors.Is(err, llm.ErrSearchNotSupported):
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// newLlmService returns the client of the model, the requests with an api key must be allowed to use the model.
+func (l *LLMHandler) newLlmService(c echo.Context, model string) (*llm.LLM, error) {
+	key, err := requestApiKey(c)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		if err := key.CheckModel(model); err != nil {
+			return nil, err
+		}
+	}
+	return l.registry.NewWithDao(model, llms.NewDao(c.Get(config.ContextKeyDao).(*daos.Dao)))
+}
+
+// newStoreService returns a client to read and edit the stored conversations, it sends no request to a model.
+func (l *LLMHandler) newStoreService(c echo.Context) (*llm.LLM, error) {
+	return l.registry.NewWithDao(llm.OAIModelGPT3Dot5Turbo, llms.NewDao(c.Get(config.ContextKeyDao).(*daos.Dao)))
+}
+
+// requestApiKey returns the api key of the request, nil when it is authenticated as a user or an admin.
+func requestApiKey(c echo.Context) (*auth.ApiKey, error) {
+	record, _ := c.Get(config.ContextKeyAuthRecord).(*models.Record)
+	if !auth.IsApiKeyRecord(record) {
+		return nil, nil
+	}
+	key, err := auth.ApiKeyFromRecord(record)
+	if err != nil {
+		return nil, fmt.Errorf("decode api key record error: %w", err)
+	}
+	return &key, nil
 }
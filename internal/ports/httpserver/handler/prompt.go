@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/Vaayne/aienvoy/internal/core/prompts"
+	"github.com/Vaayne/aienvoy/internal/pkg/config"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/daos"
+)
+
+type PromptHandler struct{}
+
+func NewPromptHandler() *PromptHandler {
+	return &PromptHandler{}
+}
+
+// ListPrompts lists the latest version of every prompt template.
+func (p *PromptHandler) ListPrompts(c echo.Context) error {
+	templates, err := newPromptDao(c).List(c.Request().Context())
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, templates)
+}
+
+// GetPrompt returns a version of the prompt template, the latest one without the version query param.
+func (p *PromptHandler) GetPrompt(c echo.Context) error {
+	version, err := versionParam(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	t, err := newPromptDao(c).Get(c.Request().Context(), c.PathParam("name"), version)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, t)
+}
+
+// ListPromptVersions lists the versions of the prompt template, the latest first.
+func (p *PromptHandler) ListPromptVersions(c echo.Context) error {
+	templates, err := newPromptDao(c).Versions(c.Request().Context(), c.PathParam("name"))
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, templates)
+}
+
+// CreatePrompt saves a new version of the prompt template named in the body.
+func (p *PromptHandler) CreatePrompt(c echo.Context) error {
+	ctx := c.Request().Context()
+	req := new(llm.PromptTemplate)
+	if err := c.Bind(req); err != nil {
+		slog.ErrorContext(ctx, "bind prompt template request body error", "err", err.Error())
+		return c.String(http.StatusBadRequest, "bad request")
+	}
+	if name := c.PathParam("name"); name != "" {
+		req.Name = name
+	}
+	t, err := newPromptDao(c).Save(ctx, *req)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusCreated, t)
+}
+
+// DeletePrompt deletes every version of the prompt template.
+func (p *PromptHandler) DeletePrompt(c echo.Context) error {
+	if err := newPromptDao(c).Delete(c.Request().Context(), c.PathParam("name")); err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, nil)
+}
+
+type RenderPromptRequest struct {
+	Version   int            `json:"version,omitempty"`
+	Variables map[string]any `json:"variables,omitempty"`
+}
+
+// RenderPrompt renders the prompt template with the variables of the body, without sending it to a model.
+func (p *PromptHandler) RenderPrompt(c echo.Context) error {
+	ctx := c.Request().Context()
+	req := new(RenderPromptRequest)
+	if err := c.Bind(req); err != nil {
+		slog.ErrorContext(ctx, "bind render prompt request body error", "err", err.Error())
+		return c.String(http.StatusBadRequest, "bad request")
+	}
+	t, err := newPromptDao(c).Get(ctx, c.PathParam("name"), req.Version)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	messages, err := t.Render(req.Variables)
+	if err != nil {
+		return c.String(errorStatus(err), err.Error())
+	}
+	return c.JSON(http.StatusOK, messages)
+}
+
+// applyTemplate renders the prompt template referenced by the chat request before its messages.
+func applyTemplate(c echo.Context, req *llm.ChatCompletionRequest) error {
+	return newPromptDao(c).Apply(c.Request().Context(), req)
+}
+
+func versionParam(c echo.Context) (int, error) {
+	version := c.QueryParam("version")
+	if version == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(version)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid version %s", version)
+	}
+	return n, nil
+}
+
+func newPromptDao(c echo.Context) *prompts.Dao {
+	return prompts.NewDao(c.Get(config.ContextKeyDao).(*daos.Dao))
+}
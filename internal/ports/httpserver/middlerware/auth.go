@@ -3,6 +3,7 @@ package middlerware
 import (
 	"context"
 	"log/slog"
+	"strconv"
 	"strings"
 
 	"github.com/Vaayne/aienvoy/internal/core/auth"
@@ -11,6 +12,7 @@ import (
 	"github.com/labstack/echo/v5"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
 )
 
 // AuthByApiKeyMiddleware is a middleware to auth user by api key
@@ -33,6 +35,7 @@ func AuthByApiKeyMiddleware(d *daos.Dao) echo.MiddlewareFunc {
 						c.Set(config.ContextKeyAuthRecord, authRecord)
 						c.Set(config.ContextKeyUserId, authRecord.GetString("user_id"))
 						c.Set(config.ContextKeyApiKey, apiKeyStr)
+						c.Set(config.ContextKeyApiKeyId, authRecord.Id)
 					}
 				}
 			}
@@ -40,3 +43,28 @@ func AuthByApiKeyMiddleware(d *daos.Dao) echo.MiddlewareFunc {
 		}
 	}
 }
+
+// UserMiddleware sets the user of the requests authenticated by pocketbase, an admin or a user record,
+// the user of an api key is set by AuthByApiKeyMiddleware.
+// Admins can ask for the data of all users with the all_users query param.
+func UserMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			admin, _ := c.Get(apis.ContextAdminKey).(*models.Admin)
+			if c.Get(config.ContextKeyUserId) == nil {
+				if admin != nil {
+					c.Set(config.ContextKeyUserId, admin.Id)
+				} else if record, _ := c.Get(config.ContextKeyAuthRecord).(*models.Record); record != nil {
+					c.Set(config.ContextKeyUserId, record.Id)
+				}
+			}
+			if allUsers, _ := strconv.ParseBool(c.QueryParam("all_users")); allUsers {
+				if admin == nil {
+					return apis.NewForbiddenError("only admins can access the data of all users", nil)
+				}
+				c.Set(config.ContextKeyAllUsers, true)
+			}
+			return next(c)
+		}
+	}
+}
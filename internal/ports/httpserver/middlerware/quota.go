@@ -0,0 +1,89 @@
+package middlerware
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Vaayne/aienvoy/internal/core/auth"
+	"github.com/Vaayne/aienvoy/internal/core/llms"
+	"github.com/Vaayne/aienvoy/internal/pkg/config"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// QuotaMiddleware enforces the limits of the api key of the request, it is used on the routes which send requests
+// to a model. Requests authenticated as a user or an admin are not limited. Limited requests get an openai style
+// error and the x-ratelimit-* headers. The model allow-list is checked by the handlers, where the model is resolved.
+func QuotaMiddleware(d *daos.Dao) echo.MiddlewareFunc {
+	limiter := auth.NewRateLimiter(time.Minute)
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			record, _ := c.Get(config.ContextKeyAuthRecord).(*models.Record)
+			if !auth.IsApiKeyRecord(record) {
+				return next(c)
+			}
+			ctx := c.Request().Context()
+			key, err := auth.ApiKeyFromRecord(record)
+			if err != nil {
+				slog.ErrorContext(ctx, "decode api key record error", "err", err)
+				return openAIError(c, http.StatusInternalServerError, "server_error", "", "failed to load the api key")
+			}
+
+			header := c.Response().Header()
+			if key.RPM > 0 {
+				remaining, reset, ok := limiter.Allow(key.Id, key.RPM)
+				header.Set("x-ratelimit-limit-requests", strconv.Itoa(key.RPM))
+				header.Set("x-ratelimit-remaining-requests", strconv.Itoa(remaining))
+				header.Set("x-ratelimit-reset-requests", formatReset(reset))
+				if !ok {
+					return openAIError(c, http.StatusTooManyRequests, "requests", "rate_limit_exceeded",
+						fmt.Sprintf("Rate limit reached for requests: limit %d per minute. Please try again in %s.", key.RPM, formatReset(reset)))
+				}
+			}
+
+			quota, err := llms.NewDao(d).ApiKeyQuota(ctx, key, time.Now())
+			if err != nil {
+				slog.ErrorContext(ctx, "get api key quota error", "err", err)
+			}
+			if key.TokensPerDay > 0 {
+				header.Set("x-ratelimit-limit-tokens", strconv.Itoa(key.TokensPerDay))
+				header.Set("x-ratelimit-remaining-tokens", strconv.Itoa(quota.TokensRemaining))
+				header.Set("x-ratelimit-reset-tokens", formatReset(quota.TokensReset))
+			}
+			if quota.TokensExceeded() {
+				return openAIError(c, http.StatusTooManyRequests, "tokens", "rate_limit_exceeded",
+					fmt.Sprintf("Rate limit reached for tokens: limit %d per day. Please try again in %s.", key.TokensPerDay, formatReset(quota.TokensReset)))
+			}
+			if quota.BudgetExceeded() {
+				return openAIError(c, http.StatusTooManyRequests, "insufficient_quota", "insufficient_quota",
+					fmt.Sprintf("You exceeded the monthly budget of $%.2f of the api key.", key.MonthlyBudget))
+			}
+			return next(c)
+		}
+	}
+}
+
+func formatReset(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+// openAIError writes an error in the format of the openai api, so openai clients can handle it.
+func openAIError(c echo.Context, status int, errType, code, message string) error {
+	var errCode any
+	if code != "" {
+		errCode = code
+	}
+	return c.JSON(status, map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    errType,
+			"param":   nil,
+			"code":    errCode,
+		},
+	})
+}
@@ -4,6 +4,8 @@ import (
 	"embed"
 	"net/http"
 
+	"github.com/Vaayne/aienvoy/internal/core/batches"
+	"github.com/Vaayne/aienvoy/internal/core/llms"
 	"github.com/Vaayne/aienvoy/internal/ports/httpserver/handler"
 	"github.com/Vaayne/aienvoy/internal/ports/httpserver/middlerware"
 
@@ -13,7 +15,7 @@ import (
 	"github.com/pocketbase/pocketbase/apis"
 )
 
-func RegisterRoutes(e *echo.Echo, app *pocketbase.PocketBase, staticFiles embed.FS) {
+func RegisterRoutes(e *echo.Echo, app *pocketbase.PocketBase, registry *llms.Registry, staticFiles embed.FS) {
 	mds := []echo.MiddlewareFunc{
 		middlerware.ContextMiddleware(),
 		middlerware.RequestIDMiddleware(),
@@ -31,26 +33,63 @@ func RegisterRoutes(e *echo.Echo, app *pocketbase.PocketBase, staticFiles embed.
 	e.Add(http.MethodGet, "/web/*", echo.WrapHandler(http.FileServer(http.FS(staticFiles))))
 
 	// v1 apis
-	v1 := e.Group("/v1", middlerware.AuthByApiKeyMiddleware(app.Dao()), apis.RequireAdminOrRecordAuth())
-	llmHandler := handler.NewLLMHandler()
-	v1.POST("/chat/completions", llmHandler.CreateChatCompletion)
-	// v1.POST("/embeddings", llmHandler.CreateEmbeddings)
-	// v1.GET("/models", llmHandler.GetModels)
+	v1 := e.Group("/v1", middlerware.AuthByApiKeyMiddleware(app.Dao()), apis.RequireAdminOrRecordAuth(), middlerware.UserMiddleware())
+	// the limits of the api keys apply to the routes which send requests to a model
+	quota := middlerware.QuotaMiddleware(app.Dao())
+	llmHandler := handler.NewLLMHandler(registry)
+	v1.POST("/chat/completions", llmHandler.CreateChatCompletion, quota)
+	v1.POST("/embeddings", llmHandler.CreateEmbeddings, quota)
+	v1.GET("/models", llmHandler.GetModels)
+	v1.GET("/models/*", llmHandler.GetModel)
 	v1.GET("/status", func(c echo.Context) error {
 		return c.String(http.StatusOK, "OK")
 	})
+	v1.GET("/llms/health", llmHandler.GetHealth, apis.RequireAdminAuth())
+	v1.GET("/llms/spend", llmHandler.GetSpend, apis.RequireAdminAuth())
 
 	// conversation
 	v1.POST("/conversations", llmHandler.CreateConversation)
 	v1.GET("/conversations", llmHandler.ListConversations)
+	v1.GET("/conversations/export", llmHandler.ExportConversations)
+	v1.POST("/conversations/import", llmHandler.ImportConversations)
+	v1.GET("/conversations/:conversationId/export", llmHandler.ExportConversation)
 	v1.GET("/conversations/:id", llmHandler.GetConversation)
 	v1.DELETE("/conversations/:id", llmHandler.DeleteConversation)
 
 	// converation message
-	v1.POST("/conversations/:id/messages", llmHandler.CreateMessage)
+	v1.POST("/conversations/:conversationId/messages", llmHandler.CreateMessage, quota)
 	v1.GET("/conversations/:conversationId/messages", llmHandler.ListMessages)
 	v1.GET("/conversations/:conversationId/messages/:messageId", llmHandler.GetMessage)
 	v1.DELETE("/conversations/:conversationId/messages/:messageId", llmHandler.DeleteMessage)
+	v1.POST("/conversations/:conversationId/messages/:messageId/edit", llmHandler.EditMessage, quota)
+	v1.POST("/conversations/:conversationId/messages/:messageId/regenerate", llmHandler.RegenerateMessage, quota)
+
+	// conversation branch
+	v1.GET("/conversations/:conversationId/branches", llmHandler.ListBranches)
+	v1.PUT("/conversations/:conversationId/active", llmHandler.SwitchBranch)
+
+	// search conversation history
+	v1.GET("/search", llmHandler.Search)
+
+	// prompt templates, every save is a new version
+	promptHandler := handler.NewPromptHandler()
+	v1.GET("/prompts", promptHandler.ListPrompts)
+	v1.POST("/prompts", promptHandler.CreatePrompt, apis.RequireAdminAuth())
+	v1.GET("/prompts/:name", promptHandler.GetPrompt)
+	v1.PUT("/prompts/:name", promptHandler.CreatePrompt, apis.RequireAdminAuth())
+	v1.DELETE("/prompts/:name", promptHandler.DeletePrompt, apis.RequireAdminAuth())
+	v1.GET("/prompts/:name/versions", promptHandler.ListPromptVersions)
+	v1.POST("/prompts/:name/render", promptHandler.RenderPrompt)
+
+	// batches of chat completions run in the background, like the OpenAI batch api
+	batchHandler := handler.NewBatchHandler(batches.Start(app.Dao(), registry))
+	v1.POST("/files", batchHandler.UploadFile)
+	v1.GET("/files/:id", batchHandler.GetFile)
+	v1.GET("/files/:id/content", batchHandler.GetFileContent)
+	v1.POST("/batches", batchHandler.CreateBatch, quota)
+	v1.GET("/batches", batchHandler.ListBatches)
+	v1.GET("/batches/:id", batchHandler.GetBatch)
+	v1.POST("/batches/:id/cancel", batchHandler.CancelBatch)
 
 	// read article using readability
 	e.GET("/readability", handler.Readability)
@@ -8,6 +8,7 @@ import (
 
 	"github.com/google/uuid"
 
+	"github.com/Vaayne/aienvoy/internal/core/llms"
 	"github.com/Vaayne/aienvoy/internal/pkg/config"
 	"github.com/Vaayne/aienvoy/internal/ports/tgbot/handler"
 
@@ -19,6 +20,8 @@ type TeleBot struct {
 	*tb.Bot
 	// app is use for db usage
 	app *pocketbase.PocketBase
+	// registry serves the llms of the handlers
+	registry *llms.Registry
 }
 
 var (
@@ -26,7 +29,7 @@ var (
 	once sync.Once
 )
 
-func New(token string, app *pocketbase.PocketBase) *TeleBot {
+func New(token string, app *pocketbase.PocketBase, registry *llms.Registry) *TeleBot {
 	b, err := tb.NewBot(tb.Settings{
 		Token: token, // Poller:  WebHook,
 		// Verbose: false,
@@ -37,15 +40,16 @@ func New(token string, app *pocketbase.PocketBase) *TeleBot {
 	}
 
 	return &TeleBot{
-		Bot: b,
-		app: app,
+		Bot:      b,
+		app:      app,
+		registry: registry,
 	}
 }
 
-func DefaultBot(app *pocketbase.PocketBase) *TeleBot {
+func DefaultBot(app *pocketbase.PocketBase, registry *llms.Registry) *TeleBot {
 	if bot == nil {
 		once.Do(func() {
-			bot = New(config.GetConfig().Telegram.Token, app)
+			bot = New(config.GetConfig().Telegram.Token, app, registry)
 		})
 	}
 	return bot
@@ -57,6 +61,7 @@ func contextMiddleware(next tb.HandlerFunc) tb.HandlerFunc {
 		ctx := context.Background()
 		ctx = context.WithValue(ctx, config.ContextKeyApp, bot.app)
 		ctx = context.WithValue(ctx, config.ContextKeyDao, bot.app.Dao())
+		ctx = context.WithValue(ctx, config.ContextKeyLLMRegistry, bot.registry)
 		ctx = context.WithValue(ctx, config.ContextKeyUserId, fmt.Sprintf("%d", c.Sender().ID))
 		ctx = context.WithValue(ctx, config.ContextKeyRequestId, uuid.NewString())
 		c.Set(config.ContextKeyContext, ctx)
@@ -90,6 +95,18 @@ func registerCommands(b *TeleBot) {
 			Text:        handler.CommandImagine,
 			Description: "Generate image using midjourney",
 		},
+		{
+			Text:        handler.CommandRegenerate,
+			Description: "Regenerate the last answer of the conversation",
+		},
+		{
+			Text:        handler.CommandEdit,
+			Description: "Edit the last prompt of the conversation",
+		},
+		{
+			Text:        handler.CommandSearch,
+			Description: "Search your previous conversations",
+		},
 	}
 	if err := b.SetCommands(cmds); err != nil {
 		slog.Error("set telegram bot commands error", "err", err)
@@ -100,10 +117,11 @@ func registerCommands(b *TeleBot) {
 
 func registerHandlers(b *TeleBot) {
 	b.Handle(tb.OnText, handler.OnText)
+	b.Handle(tb.OnPhoto, handler.OnPhoto)
 }
 
-func Serve(app *pocketbase.PocketBase) {
-	b := DefaultBot(app)
+func Serve(app *pocketbase.PocketBase, registry *llms.Registry) {
+	b := DefaultBot(app, registry)
 	b.Use(contextMiddleware)
 	registerHandlers(b)
 	registerCommands(b)
@@ -13,9 +13,22 @@ import (
 	tb "gopkg.in/telebot.v3"
 )
 
+// newLlmService returns the client of the model from the llm registry of the bot, it saves with the dao of ctx.
+func newLlmService(ctx context.Context, model string) (*llm.LLM, error) {
+	registry := ctx.Value(config.ContextKeyLLMRegistry).(*llms.Registry)
+	return registry.NewWithDao(model, llms.NewDao(ctx.Value(config.ContextKeyDao).(*daos.Dao)))
+}
+
 func onLLMChat(c tb.Context, conversationId, model, prompt string) error {
+	return onLLMChatMessage(c, conversationId, model, llm.ChatCompletionMessage{
+		Role:    llm.ChatMessageRoleUser,
+		Content: prompt,
+	})
+}
+
+func onLLMChatMessage(c tb.Context, conversationId, model string, message llm.ChatCompletionMessage) error {
 	ctx := c.Get(config.ContextKeyContext).(context.Context)
-	svc, err := llms.NewWithDao(model, llms.NewDao(ctx.Value(config.ContextKeyDao).(*daos.Dao)))
+	svc, err := newLlmService(ctx, model)
 	if err != nil {
 		return fmt.Errorf("init llm service err: %v", err)
 	}
@@ -27,16 +40,55 @@ func onLLMChat(c tb.Context, conversationId, model, prompt string) error {
 		conversationId = cov.Id
 	}
 	req := llm.ChatCompletionRequest{
-		Model: model,
-		Messages: []llm.ChatCompletionMessage{
-			{
-				Role:    llm.ChatMessageRoleUser,
-				Content: prompt,
-			},
-		},
-		Stream: true,
+		Model:    model,
+		Messages: []llm.ChatCompletionMessage{message},
+		Stream:   true,
 	}
 
+	return streamLLMMessage(c, ctx, conversationId, model, func(respChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+		svc.CreateMessageStream(ctx, conversationId, req, respChan, errChan)
+	})
+}
+
+// onLLMRegenerate answers the last message of the conversation again, the previous answer is kept in its own branch.
+func onLLMRegenerate(c tb.Context, conversationId, model string) error {
+	ctx := c.Get(config.ContextKeyContext).(context.Context)
+	svc, err := newLlmService(ctx, model)
+	if err != nil {
+		return fmt.Errorf("init llm service err: %v", err)
+	}
+	last, err := svc.ActiveMessage(ctx, conversationId)
+	if err != nil {
+		return fmt.Errorf("get last message err: %v", err)
+	}
+	return streamLLMMessage(c, ctx, conversationId, model, func(respChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+		svc.RegenerateMessageStream(ctx, last.Id, respChan, errChan)
+	})
+}
+
+// onLLMEdit replaces the last prompt of the conversation, the previous prompt is kept in its own branch.
+func onLLMEdit(c tb.Context, conversationId, model, prompt string) error {
+	ctx := c.Get(config.ContextKeyContext).(context.Context)
+	svc, err := newLlmService(ctx, model)
+	if err != nil {
+		return fmt.Errorf("init llm service err: %v", err)
+	}
+	last, err := svc.ActiveMessage(ctx, conversationId)
+	if err != nil {
+		return fmt.Errorf("get last message err: %v", err)
+	}
+	req := llm.ChatCompletionRequest{
+		Model:    model,
+		Messages: []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: prompt}},
+		Stream:   true,
+	}
+	return streamLLMMessage(c, ctx, conversationId, model, func(respChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+		svc.EditMessageStream(ctx, last.Id, req, respChan, errChan)
+	})
+}
+
+// streamLLMMessage sends the streamed answer to the chat, the conversation is cached to continue it.
+func streamLLMMessage(c tb.Context, ctx context.Context, conversationId, model string, stream func(respChan chan llm.ChatCompletionStreamResponse, errChan chan error)) error {
 	respChan := make(chan llm.ChatCompletionStreamResponse)
 	defer close(respChan)
 	errChan := make(chan error)
@@ -45,13 +97,16 @@ func onLLMChat(c tb.Context, conversationId, model, prompt string) error {
 	if err != nil {
 		return fmt.Errorf("chat with ChatGPT err: %v", err)
 	}
-	go svc.CreateMessageStream(ctx, conversationId, req, respChan, errChan)
+	go stream(respChan, errChan)
 	text := ""
 	chunk := ""
 
 	for {
 		select {
 		case resp := <-respChan:
+			if len(resp.Choices) == 0 {
+				continue
+			}
 			text, chunk = processResponse(c, ctx, msg, resp.Choices[0].Delta.Content, text, chunk)
 		case err := <-errChan:
 			newErr := processError(c, ctx, msg, text, err)
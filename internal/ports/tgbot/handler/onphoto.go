@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+
+	tb "gopkg.in/telebot.v3"
+)
+
+// OnPhoto sends the photo, with the caption as prompt, to a vision model.
+// The caption may start with /gpt4 or /gemini to choose the model, gemini is used by default.
+func OnPhoto(c tb.Context) error {
+	photo := c.Message().Photo
+	if photo == nil {
+		return c.Reply("empty photo")
+	}
+
+	model := llm.DefaultGeminiVisionModel
+	prompt := strings.TrimSpace(c.Message().Caption)
+	if prompt != "" && prompt[0] == '/' {
+		command, text, _ := strings.Cut(prompt, " ")
+		prompt = strings.TrimSpace(text)
+		switch command[1:] {
+		case CommandGemini:
+			model = llm.DefaultGeminiVisionModel
+		case CommandChatGPT4:
+			model = fmt.Sprintf("%s-%s/%s", llm.LLMTypeAiGateway, llm.AiGatewayProviderAzureOpenAI, llm.OAIModelGPT4V)
+		default:
+			return c.Reply("Unsupported command for photo!")
+		}
+	}
+	if prompt == "" {
+		prompt = "Describe this image."
+	}
+
+	reader, err := c.Bot().File(&photo.File)
+	if err != nil {
+		return fmt.Errorf("download photo err: %v", err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("read photo err: %v", err)
+	}
+
+	// telegram always compresses photos to jpeg
+	return onLLMChatMessage(c, "", model, llm.ChatCompletionMessage{
+		Role: llm.ChatMessageRoleUser,
+		MultiContent: []llm.ChatMessagePart{
+			llm.NewTextPart(prompt),
+			llm.NewImageBase64Part("image/jpeg", data),
+		},
+	})
+}
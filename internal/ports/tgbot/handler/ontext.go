@@ -16,6 +16,12 @@ const (
 	CommandClaudeV2  = "claude_v2"
 	CommandGemini    = "gemini"
 	CommandImagine   = "imagine"
+	// CommandRegenerate answers the last message of the current conversation again
+	CommandRegenerate = "regenerate"
+	// CommandEdit replaces the last prompt of the current conversation
+	CommandEdit = "edit"
+	// CommandSearch searches the previous conversations
+	CommandSearch = "search"
 )
 
 func OnText(c tb.Context) error {
@@ -48,6 +54,23 @@ func OnText(c tb.Context) error {
 			model = fmt.Sprintf("%s/%s", llm.LLMTypeAWSBedrock, llm.BedrockModelClaudeV2)
 		case CommandImagine:
 			return OnMidJourneyImagine(c)
+		case CommandSearch:
+			if len(texts) == 1 {
+				return c.Reply("Usage: /search <words>")
+			}
+			return OnSearch(c, prompt)
+		case CommandRegenerate, CommandEdit:
+			llmCache, ok := getLLMConversationFromCache()
+			if !ok {
+				return c.Reply("No conversation to continue")
+			}
+			if model == CommandRegenerate {
+				return onLLMRegenerate(c, llmCache.ConversationId, llmCache.Model)
+			}
+			if len(texts) == 1 {
+				return c.Reply("Usage: /edit <new prompt>")
+			}
+			return onLLMEdit(c, llmCache.ConversationId, llmCache.Model, prompt)
 		default:
 			return c.Reply("Unsupported command!")
 		}
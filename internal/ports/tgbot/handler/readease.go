@@ -11,6 +11,7 @@ import (
 	"github.com/Vaayne/aienvoy/internal/pkg/config"
 	"github.com/Vaayne/aienvoy/pkg/llms/llm"
 
+	"github.com/Vaayne/aienvoy/internal/core/llms"
 	"github.com/Vaayne/aienvoy/internal/core/readease"
 	"github.com/pocketbase/pocketbase"
 	tb "gopkg.in/telebot.v3"
@@ -33,14 +34,14 @@ func OnReadEase(c tb.Context) error {
 		return fmt.Errorf("summary article err: %v", err)
 	}
 
-	reader := readease.NewReader(ctx.Value(config.ContextKeyApp).(*pocketbase.PocketBase))
+	reader := readease.NewReader(ctx.Value(config.ContextKeyApp).(*pocketbase.PocketBase), ctx.Value(config.ContextKeyLLMRegistry).(*llms.Registry))
 
 	respChan := make(chan llm.ChatCompletionStreamResponse)
 	errChan := make(chan error)
 	defer close(respChan)
 	defer close(errChan)
 
-	go reader.ReadStream(ctx, urlStr, llm.DefaultGeminiModel, respChan, errChan)
+	go reader.ReadStream(ctx, urlStr, readease.Model(), respChan, errChan)
 
 	text := ""
 	chunk := ""
@@ -48,6 +49,9 @@ func OnReadEase(c tb.Context) error {
 	for {
 		select {
 		case resp := <-respChan:
+			if len(resp.Choices) == 0 {
+				continue
+			}
 			text, chunk = processResponse(c, ctx, msg, resp.Choices[0].Delta.Content, text, chunk)
 		case err := <-errChan:
 			return processError(c, ctx, msg, text, err)
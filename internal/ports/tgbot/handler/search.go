@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Vaayne/aienvoy/internal/pkg/config"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	tb "gopkg.in/telebot.v3"
+)
+
+const searchResultsLimit = 5
+
+// highlighter marks the matched words in plain text, the snippets are not valid telegram html.
+var highlighter = strings.NewReplacer(llm.HighlightStart, "«", llm.HighlightEnd, "»")
+
+// OnSearch searches the conversations of the sender.
+func OnSearch(c tb.Context, query string) error {
+	ctx := c.Get(config.ContextKeyContext).(context.Context)
+	svc, err := newLlmService(ctx, llm.DefaultGeminiModel)
+	if err != nil {
+		return fmt.Errorf("init llm service err: %v", err)
+	}
+	results, err := svc.Search(ctx, query, searchResultsLimit)
+	if err != nil {
+		return fmt.Errorf("search conversations err: %v", err)
+	}
+	if len(results) == 0 {
+		return c.Reply(fmt.Sprintf("Nothing found for %q", query))
+	}
+
+	var sb strings.Builder
+	for i, result := range results {
+		name := result.ConversationName
+		if name == "" {
+			name = "Untitled conversation"
+		}
+		sb.WriteString(fmt.Sprintf("%d. %s, %s\n%s\n\n", i+1, name, result.CreatedAt.Format("2006-01-02 15:04"), highlighter.Replace(result.Snippet)))
+	}
+	return c.Reply(strings.TrimSpace(sb.String()))
+}
@@ -6,6 +6,8 @@ import (
 	"os/exec"
 	"runtime"
 
+	"github.com/Vaayne/aienvoy/internal/core/batches"
+	"github.com/Vaayne/aienvoy/internal/core/llms"
 	"github.com/Vaayne/aienvoy/internal/core/midjourney"
 	"github.com/Vaayne/aienvoy/internal/core/readease"
 	"github.com/Vaayne/aienvoy/internal/pkg/config"
@@ -13,7 +15,6 @@ import (
 	"github.com/Vaayne/aienvoy/internal/ports/httpserver"
 	"github.com/Vaayne/aienvoy/internal/ports/tgbot"
 	_ "github.com/Vaayne/aienvoy/migrations"
-	"github.com/Vaayne/aienvoy/pkg/llms/llm"
 	"github.com/pocketbase/pocketbase/tools/cron"
 	tb "gopkg.in/telebot.v3"
 
@@ -26,25 +27,25 @@ import (
 var staticFiles embed.FS
 
 // RegisterRoutes registers the HTTP routes for the application.
-func RegisterRoutes(app *pocketbase.PocketBase) {
+func RegisterRoutes(app *pocketbase.PocketBase, registry *llms.Registry) {
 	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
-		httpserver.RegisterRoutes(e.Router, app, staticFiles)
+		httpserver.RegisterRoutes(e.Router, app, registry, staticFiles)
 		return nil
 	})
 }
 
 // SetScheduledJobs sets up the scheduled jobs for the application.
-func SetScheduledJobs(app *pocketbase.PocketBase) {
+func SetScheduledJobs(app *pocketbase.PocketBase, registry *llms.Registry) {
 	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
 		scheduler := cron.New()
 		// hourly readease job
 		if config.GetConfig().ReadEase.TelegramChannel != 0 {
 			scheduler.MustAdd("readease", "0 * * * *", func() {
-				summaries, err := readease.PeriodJob(app, llm.DefaultGeminiModel)
+				summaries, err := readease.PeriodJob(app, registry, readease.Model())
 				if err != nil {
 					slog.Error("run period readease job error", "err", err)
 				}
-				bot := tgbot.DefaultBot(app)
+				bot := tgbot.DefaultBot(app, registry)
 				channel := tb.ChatID(config.GetConfig().ReadEase.TelegramChannel)
 				for _, summary := range summaries {
 					msg, err := bot.Send(channel, summary)
@@ -60,10 +61,10 @@ func SetScheduledJobs(app *pocketbase.PocketBase) {
 }
 
 // StartTelegramBot starts the Telegram bot for the application.
-func StartTelegramBot(app *pocketbase.PocketBase) {
+func StartTelegramBot(app *pocketbase.PocketBase, registry *llms.Registry) {
 	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
 		if config.GetConfig().Telegram.Token != "" {
-			go tgbot.Serve(app)
+			go tgbot.Serve(app, registry)
 		}
 		return nil
 	})
@@ -80,6 +81,24 @@ func StartMidjourneyServer(app *pocketbase.PocketBase) {
 	})
 }
 
+// StartBatchRunner resumes the batches left unfinished by the last run and runs the new ones.
+func StartBatchRunner(app *pocketbase.PocketBase, registry *llms.Registry) {
+	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
+		batches.Start(app.Dao(), registry)
+		return nil
+	})
+}
+
+// NewLLMRegistry loads the llms of the settings, their clients are closed when the app terminates.
+func NewLLMRegistry(app *pocketbase.PocketBase) *llms.Registry {
+	registry := llms.NewRegistry()
+	app.OnTerminate().Add(func(e *core.TerminateEvent) error {
+		registry.Close()
+		return nil
+	})
+	return registry
+}
+
 // OpenBrowser opens the default web browser with the specified URL.
 func OpenBrowser(url string) {
 	var cmd string
@@ -110,10 +129,12 @@ func main() {
 	})
 
 	// before serve hooks
-	RegisterRoutes(app)
-	StartTelegramBot(app)
+	registry := NewLLMRegistry(app)
+	RegisterRoutes(app, registry)
+	StartTelegramBot(app, registry)
 	StartMidjourneyServer(app)
-	// SetScheduledJobs(app)
+	StartBatchRunner(app, registry)
+	// SetScheduledJobs(app, registry)
 	// OpenBrowser(config.GetConfig().Service.URL)
 
 	// start app
@@ -0,0 +1,94 @@
+package migrations
+
+import (
+	"log/slog"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+const tableNameLLMUsages = "llm_usages"
+
+// llm_usages records the usage of every request sent to a provider,
+// user_id becomes a text field as telegram users are not pocketbase users.
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+		collection, err := dao.FindCollectionByNameOrId(tableNameLLMUsages)
+		if err != nil {
+			return err
+		}
+
+		collection.Schema.AddField(&schema.SchemaField{
+			Id:   "rs9ypj3h",
+			Name: "user_id",
+			Type: schema.FieldTypeText,
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name: "provider",
+			Type: schema.FieldTypeText,
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name: "prompt_tokens",
+			Type: schema.FieldTypeNumber,
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name: "completion_tokens",
+			Type: schema.FieldTypeNumber,
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name: "estimated",
+			Type: schema.FieldTypeBool,
+		})
+		collection.Schema.AddField(&schema.SchemaField{
+			Name: "latency_ms",
+			Type: schema.FieldTypeNumber,
+		})
+		collection.Indexes = append(collection.Indexes, "CREATE INDEX idx_llm_usages_created ON llm_usages (created)")
+
+		if err := dao.SaveCollection(collection); err != nil {
+			slog.Error("update table error", "err", err, "table", tableNameLLMUsages)
+			return err
+		}
+		slog.Info("update table success", "table", tableNameLLMUsages)
+		return nil
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+		collection, err := dao.FindCollectionByNameOrId(tableNameLLMUsages)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range []string{"provider", "prompt_tokens", "completion_tokens", "estimated", "latency_ms"} {
+			if field := collection.Schema.GetFieldByName(name); field != nil {
+				collection.Schema.RemoveField(field.Id)
+			}
+		}
+		maxSelect := 1
+		collection.Schema.AddField(&schema.SchemaField{
+			Id:   "rs9ypj3h",
+			Name: "user_id",
+			Type: schema.FieldTypeRelation,
+			Options: &schema.RelationOptions{
+				CollectionId: "_pb_users_auth_",
+				MaxSelect:    &maxSelect,
+			},
+		})
+		indexes := collection.Indexes[:0]
+		for _, index := range collection.Indexes {
+			if index != "CREATE INDEX idx_llm_usages_created ON llm_usages (created)" {
+				indexes = append(indexes, index)
+			}
+		}
+		collection.Indexes = indexes
+
+		if err := dao.SaveCollection(collection); err != nil {
+			slog.Error("revert table error", "err", err, "table", tableNameLLMUsages)
+			return err
+		}
+		slog.Info("revert table success", "table", tableNameLLMUsages)
+		return nil
+	})
+}
@@ -0,0 +1,50 @@
+package migrations
+
+import (
+	"log/slog"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+// cost is the price in USD of the usage, computed from the model catalogue when the usage is recorded.
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+		collection, err := dao.FindCollectionByNameOrId(tableNameLLMUsages)
+		if err != nil {
+			return err
+		}
+
+		collection.Schema.AddField(&schema.SchemaField{
+			Name: "cost",
+			Type: schema.FieldTypeNumber,
+		})
+
+		if err := dao.SaveCollection(collection); err != nil {
+			slog.Error("update table error", "err", err, "table", tableNameLLMUsages)
+			return err
+		}
+		slog.Info("update table success", "table", tableNameLLMUsages)
+		return nil
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+		collection, err := dao.FindCollectionByNameOrId(tableNameLLMUsages)
+		if err != nil {
+			return err
+		}
+
+		if field := collection.Schema.GetFieldByName("cost"); field != nil {
+			collection.Schema.RemoveField(field.Id)
+		}
+
+		if err := dao.SaveCollection(collection); err != nil {
+			slog.Error("revert table error", "err", err, "table", tableNameLLMUsages)
+			return err
+		}
+		slog.Info("revert table success", "table", tableNameLLMUsages)
+		return nil
+	})
+}
@@ -0,0 +1,58 @@
+package migrations
+
+import (
+	"log/slog"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+const tableNameApiKeys = "api_keys"
+
+var apiKeyLimitFields = []string{"rpm", "tokens_per_day", "monthly_budget"}
+
+// rpm, tokens_per_day and monthly_budget (USD) limit an api key, a limit of zero is unlimited.
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+		collection, err := dao.FindCollectionByNameOrId(tableNameApiKeys)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range apiKeyLimitFields {
+			collection.Schema.AddField(&schema.SchemaField{
+				Name: name,
+				Type: schema.FieldTypeNumber,
+			})
+		}
+
+		if err := dao.SaveCollection(collection); err != nil {
+			slog.Error("update table error", "err", err, "table", tableNameApiKeys)
+			return err
+		}
+		slog.Info("update table success", "table", tableNameApiKeys)
+		return nil
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+		collection, err := dao.FindCollectionByNameOrId(tableNameApiKeys)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range apiKeyLimitFields {
+			if field := collection.Schema.GetFieldByName(name); field != nil {
+				collection.Schema.RemoveField(field.Id)
+			}
+		}
+
+		if err := dao.SaveCollection(collection); err != nil {
+			slog.Error("revert table error", "err", err, "table", tableNameApiKeys)
+			return err
+		}
+		slog.Info("revert table success", "table", tableNameApiKeys)
+		return nil
+	})
+}
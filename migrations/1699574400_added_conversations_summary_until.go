@@ -0,0 +1,59 @@
+package migrations
+
+import (
+	"log/slog"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+// summary_until is the id of the last message folded into the rolling summary of the conversation,
+// the summary itself is text, it was created as a number field.
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+		collection, err := dao.FindCollectionByNameOrId(tableNameConversations)
+		if err != nil {
+			return err
+		}
+
+		if field := collection.Schema.GetFieldByName("summary"); field != nil {
+			field.Type = schema.FieldTypeText
+			field.Options = &schema.TextOptions{}
+		}
+		collection.Schema.AddField(&schema.SchemaField{
+			Name: "summary_until",
+			Type: schema.FieldTypeText,
+		})
+
+		if err := dao.SaveCollection(collection); err != nil {
+			slog.Error("update table error", "err", err, "table", tableNameConversations)
+			return err
+		}
+		slog.Info("update table success", "table", tableNameConversations)
+		return nil
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+		collection, err := dao.FindCollectionByNameOrId(tableNameConversations)
+		if err != nil {
+			return err
+		}
+
+		if field := collection.Schema.GetFieldByName("summary_until"); field != nil {
+			collection.Schema.RemoveField(field.Id)
+		}
+		if field := collection.Schema.GetFieldByName("summary"); field != nil {
+			field.Type = schema.FieldTypeNumber
+			field.Options = &schema.NumberOptions{}
+		}
+
+		if err := dao.SaveCollection(collection); err != nil {
+			slog.Error("revert table error", "err", err, "table", tableNameConversations)
+			return err
+		}
+		slog.Info("revert table success", "table", tableNameConversations)
+		return nil
+	})
+}
@@ -0,0 +1,78 @@
+package migrations
+
+import (
+	"log/slog"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+// parent_id links a message to the previous message of its branch, existing conversations are linear,
+// so their messages get the previous message by creation as parent.
+// active_leaf_id is the last message of the branch the conversation continues from.
+const backfillMessagesParentId = `UPDATE conversation_messages SET parent_id = COALESCE((
+	SELECT p.id FROM conversation_messages p
+	WHERE p.conversation_id = conversation_messages.conversation_id
+	AND (p.created < conversation_messages.created OR (p.created = conversation_messages.created AND p.id < conversation_messages.id))
+	ORDER BY p.created DESC, p.id DESC LIMIT 1
+), '')`
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+		messages, err := dao.FindCollectionByNameOrId(tableNameMessages)
+		if err != nil {
+			return err
+		}
+		messages.Schema.AddField(&schema.SchemaField{
+			Name: "parent_id",
+			Type: schema.FieldTypeText,
+		})
+		if err := dao.SaveCollection(messages); err != nil {
+			slog.Error("update table error", "err", err, "table", tableNameMessages)
+			return err
+		}
+		if _, err := db.NewQuery(backfillMessagesParentId).Execute(); err != nil {
+			slog.Error("backfill parent id error", "err", err, "table", tableNameMessages)
+			return err
+		}
+		slog.Info("update table success", "table", tableNameMessages)
+
+		conversations, err := dao.FindCollectionByNameOrId(tableNameConversations)
+		if err != nil {
+			return err
+		}
+		conversations.Schema.AddField(&schema.SchemaField{
+			Name: "active_leaf_id",
+			Type: schema.FieldTypeText,
+		})
+		if err := dao.SaveCollection(conversations); err != nil {
+			slog.Error("update table error", "err", err, "table", tableNameConversations)
+			return err
+		}
+		slog.Info("update table success", "table", tableNameConversations)
+		return nil
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+		for table, name := range map[string]string{
+			tableNameMessages:      "parent_id",
+			tableNameConversations: "active_leaf_id",
+		} {
+			collection, err := dao.FindCollectionByNameOrId(table)
+			if err != nil {
+				return err
+			}
+			if field := collection.Schema.GetFieldByName(name); field != nil {
+				collection.Schema.RemoveField(field.Id)
+			}
+			if err := dao.SaveCollection(collection); err != nil {
+				slog.Error("revert table error", "err", err, "table", table)
+				return err
+			}
+			slog.Info("revert table success", "table", table)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,67 @@
+package migrations
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/pocketbase/dbx"
+	m "github.com/pocketbase/pocketbase/migrations"
+)
+
+// conversation_messages_fts is the full text index of the messages, the request and response of the messages
+// are stored as json which can not be searched. The existing messages are indexed when it is created.
+const tableNameMessagesFTS = "conversation_messages_fts"
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		_, err := db.NewQuery(`CREATE VIRTUAL TABLE conversation_messages_fts USING fts5(
+			message_id UNINDEXED,
+			conversation_id UNINDEXED,
+			user_id UNINDEXED,
+			content,
+			tokenize = 'unicode61 remove_diacritics 2'
+		)`).Execute()
+		if err != nil {
+			slog.Error("create table error", "err", err, "table", tableNameMessagesFTS)
+			return err
+		}
+
+		var rows []struct {
+			Id             string `db:"id"`
+			ConversationId string `db:"conversation_id"`
+			UserId         string `db:"user_id"`
+			Request        string `db:"request"`
+			Response       string `db:"response"`
+		}
+		if err := db.Select("id", "conversation_id", "user_id", "request", "response").From(tableNameMessages).All(&rows); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			var msg llm.Message
+			if err := json.Unmarshal([]byte(row.Request), &msg.Request); err != nil {
+				slog.Warn("skip indexing message with invalid request", "err", err, "message_id", row.Id)
+				continue
+			}
+			_ = json.Unmarshal([]byte(row.Response), &msg.Response)
+			_, err := db.Insert(tableNameMessagesFTS, dbx.Params{
+				"message_id":      row.Id,
+				"conversation_id": row.ConversationId,
+				"user_id":         row.UserId,
+				"content":         llm.MessageText(msg),
+			}).Execute()
+			if err != nil {
+				return err
+			}
+		}
+		slog.Info("create table success", "table", tableNameMessagesFTS, "indexed", len(rows))
+		return nil
+	}, func(db dbx.Builder) error {
+		if _, err := db.NewQuery("DROP TABLE IF EXISTS conversation_messages_fts").Execute(); err != nil {
+			slog.Error("drop table error", "err", err, "table", tableNameMessagesFTS)
+			return err
+		}
+		slog.Info("drop table success", "table", tableNameMessagesFTS)
+		return nil
+	})
+}
@@ -0,0 +1,70 @@
+package migrations
+
+import (
+	"log/slog"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const tableNamePromptTemplates = "prompt_templates"
+
+// id, created, updated, name, version, description, system, user, user_id
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		collection := &models.Collection{
+			Name: tableNamePromptTemplates,
+			Type: models.CollectionTypeBase,
+			Indexes: types.JsonArray[string]{
+				"CREATE UNIQUE INDEX idx_prompt_templates_name_version ON prompt_templates (name, version)",
+			},
+			Schema: schema.NewSchema(&schema.SchemaField{
+				Name:     "name",
+				Type:     schema.FieldTypeText,
+				Required: true,
+			}, &schema.SchemaField{
+				Name:     "version",
+				Type:     schema.FieldTypeNumber,
+				Required: true,
+			}, &schema.SchemaField{
+				Name:     "description",
+				Type:     schema.FieldTypeText,
+				Required: false,
+			}, &schema.SchemaField{
+				Name:     "system",
+				Type:     schema.FieldTypeText,
+				Required: false,
+			}, &schema.SchemaField{
+				Name:     "user",
+				Type:     schema.FieldTypeText,
+				Required: false,
+			}, &schema.SchemaField{
+				Name:     "user_id",
+				Type:     schema.FieldTypeText,
+				Required: false,
+			}),
+		}
+		if err := daos.New(db).SaveCollection(collection); err != nil {
+			slog.Error("create table error", "err", err, "table", tableNamePromptTemplates)
+			return err
+		}
+		slog.Info("create table success", "table", tableNamePromptTemplates)
+		return nil
+	}, func(db dbx.Builder) error {
+		collection, err := daos.New(db).FindCollectionByNameOrId(tableNamePromptTemplates)
+		if err != nil {
+			return err
+		}
+		if err := daos.New(db).DeleteCollection(collection); err != nil {
+			slog.Error("drop table error", "err", err, "table", tableNamePromptTemplates)
+			return err
+		}
+		slog.Info("drop table success", "table", tableNamePromptTemplates)
+		return nil
+	})
+}
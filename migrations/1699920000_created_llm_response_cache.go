@@ -0,0 +1,62 @@
+package migrations
+
+import (
+	"log/slog"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// llm_response_cache is the sqlite backend of the response cache of identical chat completions.
+const tableNameResponseCache = "llm_response_cache"
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		collection := &models.Collection{
+			Name: tableNameResponseCache,
+			Type: models.CollectionTypeBase,
+			Indexes: types.JsonArray[string]{
+				"CREATE UNIQUE INDEX idx_llm_response_cache_key ON llm_response_cache (cache_key)",
+				"CREATE INDEX idx_llm_response_cache_expires_at ON llm_response_cache (expires_at)",
+			},
+			Schema: schema.NewSchema(&schema.SchemaField{
+				Name:     "cache_key",
+				Type:     schema.FieldTypeText,
+				Required: true,
+			}, &schema.SchemaField{
+				Name:     "model",
+				Type:     schema.FieldTypeText,
+				Required: false,
+			}, &schema.SchemaField{
+				Name:     "response",
+				Type:     schema.FieldTypeText,
+				Required: true,
+			}, &schema.SchemaField{
+				Name:     "expires_at",
+				Type:     schema.FieldTypeDate,
+				Required: false,
+			}),
+		}
+		if err := daos.New(db).SaveCollection(collection); err != nil {
+			slog.Error("create table error", "err", err, "table", tableNameResponseCache)
+			return err
+		}
+		slog.Info("create table success", "table", tableNameResponseCache)
+		return nil
+	}, func(db dbx.Builder) error {
+		collection, err := daos.New(db).FindCollectionByNameOrId(tableNameResponseCache)
+		if err != nil {
+			return err
+		}
+		if err := daos.New(db).DeleteCollection(collection); err != nil {
+			slog.Error("drop table error", "err", err, "table", tableNameResponseCache)
+			return err
+		}
+		slog.Info("drop table success", "table", tableNameResponseCache)
+		return nil
+	})
+}
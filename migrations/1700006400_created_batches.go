@@ -0,0 +1,104 @@
+package migrations
+
+import (
+	"log/slog"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// batch_files are the input and result files of the batches, batches track their progress
+// and batch_requests keep the result of every request so a batch resumes after a restart.
+const (
+	tableNameBatchFiles    = "batch_files"
+	tableNameBatches       = "batches"
+	tableNameBatchRequests = "batch_requests"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		collections := []*models.Collection{{
+			Name: tableNameBatchFiles,
+			Type: models.CollectionTypeBase,
+			Indexes: types.JsonArray[string]{
+				"CREATE INDEX idx_batch_files_user_id ON batch_files (user_id)",
+			},
+			Schema: schema.NewSchema(
+				&schema.SchemaField{Name: "user_id", Type: schema.FieldTypeText},
+				&schema.SchemaField{Name: "filename", Type: schema.FieldTypeText},
+				&schema.SchemaField{Name: "purpose", Type: schema.FieldTypeText, Required: true},
+				&schema.SchemaField{Name: "bytes", Type: schema.FieldTypeNumber},
+				&schema.SchemaField{Name: "content", Type: schema.FieldTypeText},
+			),
+		}, {
+			Name: tableNameBatches,
+			Type: models.CollectionTypeBase,
+			Indexes: types.JsonArray[string]{
+				"CREATE INDEX idx_batches_user_id ON batches (user_id, created)",
+				"CREATE INDEX idx_batches_status ON batches (status)",
+			},
+			Schema: schema.NewSchema(
+				&schema.SchemaField{Name: "user_id", Type: schema.FieldTypeText},
+				&schema.SchemaField{Name: "api_key_id", Type: schema.FieldTypeText},
+				&schema.SchemaField{Name: "endpoint", Type: schema.FieldTypeText, Required: true},
+				&schema.SchemaField{Name: "input_file_id", Type: schema.FieldTypeText, Required: true},
+				&schema.SchemaField{Name: "output_file_id", Type: schema.FieldTypeText},
+				&schema.SchemaField{Name: "error_file_id", Type: schema.FieldTypeText},
+				&schema.SchemaField{Name: "completion_window", Type: schema.FieldTypeText},
+				&schema.SchemaField{Name: "status", Type: schema.FieldTypeText, Required: true},
+				&schema.SchemaField{Name: "total", Type: schema.FieldTypeNumber},
+				&schema.SchemaField{Name: "completed", Type: schema.FieldTypeNumber},
+				&schema.SchemaField{Name: "failed", Type: schema.FieldTypeNumber},
+				&schema.SchemaField{Name: "metadata", Type: schema.FieldTypeText},
+				&schema.SchemaField{Name: "errors", Type: schema.FieldTypeText},
+				&schema.SchemaField{Name: "in_progress_at", Type: schema.FieldTypeDate},
+				&schema.SchemaField{Name: "expires_at", Type: schema.FieldTypeDate},
+				&schema.SchemaField{Name: "finalizing_at", Type: schema.FieldTypeDate},
+				&schema.SchemaField{Name: "completed_at", Type: schema.FieldTypeDate},
+				&schema.SchemaField{Name: "failed_at", Type: schema.FieldTypeDate},
+				&schema.SchemaField{Name: "expired_at", Type: schema.FieldTypeDate},
+				&schema.SchemaField{Name: "cancelling_at", Type: schema.FieldTypeDate},
+				&schema.SchemaField{Name: "cancelled_at", Type: schema.FieldTypeDate},
+			),
+		}, {
+			Name: tableNameBatchRequests,
+			Type: models.CollectionTypeBase,
+			Indexes: types.JsonArray[string]{
+				"CREATE UNIQUE INDEX idx_batch_requests_custom_id ON batch_requests (batch_id, custom_id)",
+				"CREATE INDEX idx_batch_requests_position ON batch_requests (batch_id, position)",
+			},
+			Schema: schema.NewSchema(
+				&schema.SchemaField{Name: "batch_id", Type: schema.FieldTypeText, Required: true},
+				&schema.SchemaField{Name: "custom_id", Type: schema.FieldTypeText, Required: true},
+				&schema.SchemaField{Name: "position", Type: schema.FieldTypeNumber},
+				&schema.SchemaField{Name: "succeeded", Type: schema.FieldTypeBool},
+				&schema.SchemaField{Name: "result", Type: schema.FieldTypeText},
+			),
+		}}
+		for _, collection := range collections {
+			if err := daos.New(db).SaveCollection(collection); err != nil {
+				slog.Error("create table error", "err", err, "table", collection.Name)
+				return err
+			}
+			slog.Info("create table success", "table", collection.Name)
+		}
+		return nil
+	}, func(db dbx.Builder) error {
+		for _, name := range []string{tableNameBatchRequests, tableNameBatches, tableNameBatchFiles} {
+			collection, err := daos.New(db).FindCollectionByNameOrId(name)
+			if err != nil {
+				return err
+			}
+			if err := daos.New(db).DeleteCollection(collection); err != nil {
+				slog.Error("drop table error", "err", err, "table", name)
+				return err
+			}
+			slog.Info("drop table success", "table", name)
+		}
+		return nil
+	})
+}
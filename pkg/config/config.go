@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"log/slog"
 	"path"
 	"runtime"
 	"strings"
@@ -24,7 +25,9 @@ const (
 // auto read config from env with prefix 'APP_' and will auto convert "_" to "."
 // for example APP_TELEGRAM_TOKEN will map to telegram.token
 // avoid to use "_" in config name for better env reading
-func Load(cfg interface{}, onChanges ...func(e fsnotify.Event)) {
+// on reload the changed settings are decoded into a new value which is passed to onChanges,
+// cfg is never written after Load returns, and a reload which fails to decode keeps the old config
+func Load[T any](cfg *T, onChanges ...func(cfg *T)) {
 	// read configs from seetings in root directory
 
 	viper.AddConfigPath(getConfigDir())
@@ -46,20 +49,22 @@ func Load(cfg interface{}, onChanges ...func(e fsnotify.Event)) {
 	viper.SetEnvPrefix(SettingsEnvPrefix)
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
-	loadConfig := func() {
-		if err := viper.Unmarshal(cfg); err != nil {
-			panic(fmt.Errorf("unable to decode into struct: %v", err))
-		}
+	if err := viper.Unmarshal(cfg); err != nil {
+		panic(fmt.Errorf("unable to decode into struct: %v", err))
 	}
 	// autoreload watch config change
 	viper.OnConfigChange(func(e fsnotify.Event) {
 		fmt.Println("Reload config since file changed:", e.Name)
-		loadConfig()
+		// decode into a fresh value, so removed list items do not survive a reload
+		fresh := new(T)
+		if err := viper.Unmarshal(fresh); err != nil {
+			slog.Error("unable to decode reloaded config, keep the old one", "file", e.Name, "err", err)
+			return
+		}
 		for _, chnage := range onChanges {
-			chnage(e)
+			chnage(fresh)
 		}
 	})
-	loadConfig()
 	viper.WatchConfig()
 }
 
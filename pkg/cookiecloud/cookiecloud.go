@@ -105,6 +105,21 @@ func (c *CookieCloud) GetCookie(domain, key string) (Cookie, error) {
 	return ck, nil
 }
 
+// GetCookieValue returns the value of the cookie in the first domain which has it, the domains of a site
+// are synced both with and without the leading dot.
+func (c *CookieCloud) GetCookieValue(key string, domains ...string) (string, error) {
+	for _, domain := range domains {
+		cookie, err := c.GetCookie(domain, key)
+		if err != nil {
+			return "", err
+		}
+		if cookie.Value != "" {
+			return cookie.Value, nil
+		}
+	}
+	return "", fmt.Errorf("cookie %s not found in %v", key, domains)
+}
+
 func (c *CookieCloud) fetchData() (*CookieData, error) {
 	resp, err := http.DefaultClient.Get(c.Host + "/get/" + c.UUID)
 	if err != nil {
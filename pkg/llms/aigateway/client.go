@@ -47,7 +47,7 @@ func (c *Client) ListModels() []string {
 func (c *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
 	req.Stream = true
 	config := c.config.AiGateway
-	payload, err := buildRequestPayload(req, config)
+	payload, err := buildRequestPayload(ctx, req, config)
 	if err != nil {
 		errChan <- fmt.Errorf("build request payload error: %w", err)
 		return
@@ -78,7 +78,7 @@ func (c *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCom
 			errChan <- fmt.Errorf("decode response error: %w", err)
 			return
 		}
-		errChan <- fmt.Errorf("chat error, status: %s, body: %s, headers: %v", resp.Status, string(respBody), resp.Header)
+		errChan <- llm.NewAPIError(resp.StatusCode, fmt.Sprintf("chat error, status: %s, body: %s, headers: %v", resp.Status, string(respBody), resp.Header))
 		return
 	}
 
@@ -86,6 +86,7 @@ func (c *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCom
 	innerErrChan := make(chan error)
 
 	go llm.ParseSSE[any](resp.Body, innerDataChan, innerErrChan)
+	decoder := awsbedrock.NewChunkDecoder(req.ModelId())
 	for {
 		select {
 		case <-ctx.Done():
@@ -93,17 +94,27 @@ func (c *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCom
 		case data := <-innerDataChan:
 			switch config.Provider.Type {
 			case llm.AiGatewayProviderAWSBedrock:
-				var val awsbedrock.BedrockResponse
-				if err := mapstructure.Decode(data, &val); err != nil {
+				// the chunk is decoded again from json by the codec of the model family
+				chunk, err := json.Marshal(data)
+				if err != nil {
 					errChan <- fmt.Errorf("parse response error: %w", err)
 					return
 				}
-				dataChan <- val.ToChatCompletionStreamResponse()
+				chunks, err := decoder.Decode(chunk)
+				if err != nil {
+					errChan <- fmt.Errorf("parse response error: %w", err)
+					return
+				}
+				for _, val := range chunks {
+					if len(val.Choices) > 0 || req.IncludeUsage() {
+						dataChan <- val
+					}
+				}
 			case llm.AiGatewayProviderOpenAI, llm.AiGatewayProviderAzureOpenAI:
 				// convert any to ChatCompletionStreamResponse
 				// the any may response as map[string]interface{}, so we have to convert it manually
 				var val llm.ChatCompletionStreamResponse
-				if err := mapstructure.Decode(data, &val); err != nil {
+				if err := decode(data, &val); err != nil {
 					errChan <- fmt.Errorf("parse response error: %w", err)
 					return
 				}
@@ -118,15 +129,27 @@ func (c *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCom
 	}
 }
 
-func buildRequestPayload(req llm.ChatCompletionRequest, config llm.AiGatewayConfig) ([]byte, error) {
+// decode converts the generic SSE payload into out, matching fields by their json tags
+// so snake_case keys like stop_reason and tool_calls are not dropped.
+func decode(data any, out any) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		TagName:          "json",
+		WeaklyTypedInput: true,
+		Result:           out,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(data)
+}
+
+func buildRequestPayload(ctx context.Context, req llm.ChatCompletionRequest, config llm.AiGatewayConfig) ([]byte, error) {
 	var payload []byte
 	var err error
 
 	switch config.Provider.Type {
 	case llm.AiGatewayProviderAWSBedrock:
-		bedrockRequest := &awsbedrock.BedrockRequest{}
-		bedrockRequest.FromChatCompletionRequest(req)
-		payload = bedrockRequest.Marshal()
+		payload, err = awsbedrock.BuildRequestBody(ctx, req)
 	default:
 		payload, _ = json.Marshal(req)
 	}
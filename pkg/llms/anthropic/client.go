@@ -0,0 +1,172 @@
+package anthropic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+const (
+	defaultBaseUrl = "https://api.anthropic.com"
+	apiVersion     = "2023-06-01"
+	// maxEventSize bounds an event of the stream, a tool call may carry long arguments
+	maxEventSize = 4 << 20
+)
+
+type Client struct {
+	sess    *http.Client
+	config  llm.Config
+	baseUrl string
+}
+
+func NewClient(cfg llm.Config) (*Client, error) {
+	if cfg.LLMType != llm.LLMTypeAnthropic {
+		return nil, fmt.Errorf("invalid config for anthropic, llmtype: %s", cfg.LLMType)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	baseUrl := defaultBaseUrl
+	if cfg.BaseUrl != "" {
+		baseUrl = strings.TrimSuffix(cfg.BaseUrl, "/")
+	}
+	return &Client{
+		sess:    http.DefaultClient,
+		config:  cfg,
+		baseUrl: baseUrl,
+	}, nil
+}
+
+func (c *Client) ListModels() []string {
+	if models := c.config.ListModels(); len(models) > 0 {
+		return models
+	}
+	return llm.DefaultAnthropicModels
+}
+
+func (c *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+	slog.DebugContext(ctx, "chat start", "model", req.ModelId(), "is_stream", true)
+	req, err := llm.InlineImages(ctx, req)
+	if err != nil {
+		errChan <- fmt.Errorf("inline images error: %w", err)
+		return
+	}
+	body := &MessagesRequest{}
+	body.FromChatCompletionRequest(req)
+
+	resp, err := c.post(ctx, body)
+	if err != nil {
+		slog.InfoContext(ctx, "chat error", "model", req.ModelId(), "is_stream", true, "err", err)
+		errChan <- err
+		return
+	}
+	defer resp.Body.Close()
+
+	decoder := NewStreamDecoder()
+	err = readEvents(resp.Body, func(event StreamEvent) error {
+		if event.Type == "error" && event.Error != nil {
+			return toAPIError(*event.Error)
+		}
+		if chunk, ok := decoder.Decode(event); ok {
+			dataChan <- chunk
+		}
+		return nil
+	})
+	if err != nil {
+		slog.InfoContext(ctx, "chat error", "model", req.ModelId(), "is_stream", true, "err", err)
+		errChan <- err
+		return
+	}
+	if req.IncludeUsage() {
+		dataChan <- decoder.Usage()
+	}
+	slog.DebugContext(ctx, "chat success", "model", req.ModelId(), "is_stream", true)
+	errChan <- io.EOF
+}
+
+// post sends the request to the messages api, the response is the event stream.
+func (c *Client) post(ctx context.Context, body *MessagesRequest) (*http.Response, error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request body error: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseUrl+"/v1/messages", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("create request error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("X-Api-Key", c.config.ApiKey)
+	req.Header.Set("Anthropic-Version", apiVersion)
+
+	resp, err := c.sess.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request error: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		var errResp ErrorResponse
+		if err := json.Unmarshal(data, &errResp); err == nil && errResp.Error.Message != "" {
+			return nil, llm.NewAPIError(resp.StatusCode, fmt.Sprintf("%s: %s", errResp.Error.Type, errResp.Error.Message))
+		}
+		return nil, llm.NewAPIError(resp.StatusCode, string(data))
+	}
+	return resp, nil
+}
+
+// readEvents reads a server sent events stream, and calls fn with the data of every event until the message stops.
+func readEvents(body io.Reader, fn func(event StreamEvent) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			// the event type is repeated in the data, the event lines are skipped
+			continue
+		}
+		var event StreamEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+			return fmt.Errorf("unmarshal anthropic event error: %w, data: %s", err, data)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+		if event.Type == "message_stop" {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read anthropic stream error: %w", err)
+	}
+	return fmt.Errorf("%w: anthropic stream ended before message_stop", llm.ErrStreamInterrupted)
+}
+
+// toAPIError maps an error event to the status code of the same error returned before the stream started.
+func toAPIError(e Error) *llm.APIError {
+	status := http.StatusInternalServerError
+	switch e.Type {
+	case "invalid_request_error":
+		status = http.StatusBadRequest
+	case "authentication_error":
+		status = http.StatusUnauthorized
+	case "permission_error":
+		status = http.StatusForbidden
+	case "not_found_error":
+		status = http.StatusNotFound
+	case "rate_limit_error":
+		status = http.StatusTooManyRequests
+	case "overloaded_error":
+		// anthropic answers 529 when it is overloaded
+		status = 529
+	}
+	return llm.NewAPIError(status, fmt.Sprintf("%s: %s", e.Type, e.Message))
+}
@@ -0,0 +1,176 @@
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient returns a client of a stand-in of the messages api, which checks the request and replies with the events.
+func newTestClient(t *testing.T, check func(req MessagesRequest), events ...string) *llm.LLM {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/messages", r.URL.Path)
+		assert.Equal(t, "test-key", r.Header.Get("X-Api-Key"))
+		assert.Equal(t, apiVersion, r.Header.Get("Anthropic-Version"))
+		var req MessagesRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if check != nil {
+			check(req)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			var e struct {
+				Type string `json:"type"`
+			}
+			require.NoError(t, json.Unmarshal([]byte(event), &e))
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, event)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := NewClient(llm.Config{LLMType: llm.LLMTypeAnthropic, ApiKey: "test-key", BaseUrl: server.URL})
+	require.NoError(t, err)
+	return llm.New(llm.NewMemoryDao(), client)
+}
+
+func TestCreateChatCompletion(t *testing.T) {
+	l := newTestClient(t, func(req MessagesRequest) {
+		assert.Equal(t, llm.AnthropicModelClaude3Haiku, req.Model)
+		assert.Equal(t, "Be brief.", req.System)
+		assert.Equal(t, defaultMaxTokens, req.MaxTokens)
+		assert.True(t, req.Stream)
+		require.Len(t, req.Messages, 1)
+		require.Len(t, req.Messages[0].Content, 2)
+		assert.Equal(t, "image", req.Messages[0].Content[1].Type)
+		assert.Equal(t, "image/png", req.Messages[0].Content[1].Source.MediaType)
+	},
+		`{"type":"message_start","message":{"id":"msg_1","model":"claude-3-haiku-20240307","usage":{"input_tokens":12,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"ping"}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" world"}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":5}}`,
+		`{"type":"message_stop"}`,
+	)
+
+	resp, err := l.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{
+		Model: "anthropic/" + llm.AnthropicModelClaude3Haiku,
+		Messages: []llm.ChatCompletionMessage{
+			{Role: llm.ChatMessageRoleSystem, Content: "Be brief."},
+			{Role: llm.ChatMessageRoleUser, MultiContent: []llm.ChatMessagePart{
+				{Type: llm.ChatMessagePartTypeText, Text: "What is this?"},
+				{Type: llm.ChatMessagePartTypeImageURL, ImageURL: &llm.ChatMessageImageURL{URL: "data:image/png;base64,aGVsbG8="}},
+			}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "msg_1", resp.ID)
+	assert.Equal(t, "Hello world", resp.Choices[0].Message.Content)
+	assert.Equal(t, llm.FinishReasonStop, resp.Choices[0].FinishReason)
+	assert.Equal(t, llm.NewUsage(12, 5), resp.Usage)
+}
+
+func TestCreateChatCompletionTools(t *testing.T) {
+	l := newTestClient(t, func(req MessagesRequest) {
+		require.Len(t, req.Tools, 1)
+		assert.Equal(t, "get_weather", req.Tools[0].Name)
+		assert.Equal(t, &ToolChoice{Type: "tool", Name: "get_weather"}, req.ToolChoice)
+		// the earlier call and its result are sent as tool_use and tool_result blocks
+		require.Len(t, req.Messages, 3)
+		assert.Equal(t, "tool_use", req.Messages[1].Content[0].Type)
+		assert.JSONEq(t, `{"city":"Paris"}`, string(req.Messages[1].Content[0].Input))
+		assert.Equal(t, ContentBlock{Type: "tool_result", ToolUseId: "toolu_1", Content: "sunny"}, req.Messages[2].Content[0])
+		assert.Equal(t, "text", req.Messages[2].Content[1].Type)
+	},
+		`{"type":"message_start","message":{"id":"msg_2","model":"claude-3-opus-20240229","usage":{"input_tokens":20,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Checking."}}`,
+		`{"type":"content_block_stop","index":0}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_2","name":"get_weather","input":{}}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"London\"}"}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":30}}`,
+		`{"type":"message_stop"}`,
+	)
+
+	resp, err := l.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{
+		Model: llm.AnthropicModelClaude3Opus,
+		Tools: []llm.Tool{{Type: llm.ToolTypeFunction, Function: &llm.FunctionDefinition{
+			Name:       "get_weather",
+			Parameters: map[string]any{"type": "object", "properties": map[string]any{"city": map[string]any{"type": "string"}}},
+		}}},
+		ToolChoice: llm.ToolChoice{Type: llm.ToolTypeFunction, Function: llm.ToolFunction{Name: "get_weather"}},
+		Messages: []llm.ChatCompletionMessage{
+			{Role: llm.ChatMessageRoleUser, Content: "Weather in Paris?"},
+			{Role: llm.ChatMessageRoleAssistant, ToolCalls: []llm.ToolCall{{ID: "toolu_1", Type: llm.ToolTypeFunction, Function: llm.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}}}},
+			{Role: llm.ChatMessageRoleTool, ToolCallID: "toolu_1", Content: "sunny"},
+			{Role: llm.ChatMessageRoleUser, Content: "And in London?"},
+		},
+	})
+	require.NoError(t, err)
+	choice := resp.Choices[0]
+	assert.Equal(t, "Checking.", choice.Message.Content)
+	assert.Equal(t, llm.FinishReasonToolCalls, choice.FinishReason)
+	require.Len(t, choice.Message.ToolCalls, 1)
+	assert.Equal(t, "toolu_2", choice.Message.ToolCalls[0].ID)
+	assert.Equal(t, "get_weather", choice.Message.ToolCalls[0].Function.Name)
+	assert.Equal(t, `{"city":"London"}`, choice.Message.ToolCalls[0].Function.Arguments)
+	assert.Equal(t, llm.NewUsage(20, 30), resp.Usage)
+}
+
+func TestMessagesRequestTemperature(t *testing.T) {
+	var r MessagesRequest
+	r.FromChatCompletionRequest(llm.ChatCompletionRequest{Model: llm.AnthropicModelClaude3Haiku, TemperatureSet: true})
+	body, err := json.Marshal(r)
+	require.NoError(t, err)
+	// an explicit 0 is sent, the api defaults to 1
+	assert.Contains(t, string(body), `"temperature":0`)
+
+	r = MessagesRequest{}
+	r.FromChatCompletionRequest(llm.ChatCompletionRequest{Model: llm.AnthropicModelClaude3Haiku})
+	body, err = json.Marshal(r)
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "temperature")
+}
+
+func TestCreateChatCompletionError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"type":"error","error":{"type":"rate_limit_error","message":"slow down"}}`)
+	}))
+	defer server.Close()
+	client, err := NewClient(llm.Config{LLMType: llm.LLMTypeAnthropic, ApiKey: "test-key", BaseUrl: server.URL})
+	require.NoError(t, err)
+
+	_, err = llm.New(llm.NewMemoryDao(), client).CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{
+		Model:    llm.AnthropicModelClaude3Sonnet,
+		Messages: []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: "hi"}},
+	})
+	var apiErr *llm.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+	assert.True(t, apiErr.Retryable())
+	assert.True(t, strings.Contains(apiErr.Message, "slow down"))
+
+	// an error event after the stream started is an overloaded error
+	l := newTestClient(t, nil,
+		`{"type":"message_start","message":{"id":"msg_3","model":"claude-3-sonnet-20240229","usage":{"input_tokens":3,"output_tokens":1}}}`,
+		`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`,
+	)
+	_, err = l.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{
+		Model:    llm.AnthropicModelClaude3Sonnet,
+		Messages: []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: "hi"}},
+	})
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, 529, apiErr.StatusCode)
+}
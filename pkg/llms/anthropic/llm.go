@@ -0,0 +1,15 @@
+package anthropic
+
+import (
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+type Anthropic *llm.LLM
+
+func New(config llm.Config, dao llm.Dao) (Anthropic, error) {
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return llm.New(dao, client), nil
+}
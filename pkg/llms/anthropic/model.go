@@ -0,0 +1,340 @@
+package anthropic
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/google/uuid"
+)
+
+// defaultMaxTokens is sent when the request has no max_tokens, the messages api requires it
+const defaultMaxTokens = 4096
+
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+// ContentBlock is a part of a message, its fields depend on the type: text, image, tool_use or tool_result.
+type ContentBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	Source    *ImageSource    `json:"source,omitempty"`
+	Id        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseId string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+}
+
+type Message struct {
+	Role    string         `json:"role"`
+	Content []ContentBlock `json:"content"`
+}
+
+type Tool struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	InputSchema any    `json:"input_schema"`
+}
+
+// ToolChoice is auto, any to call one of the tools, or tool to call the named one.
+type ToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type Metadata struct {
+	UserId string `json:"user_id,omitempty"`
+}
+
+type MessagesRequest struct {
+	Model         string      `json:"model"`
+	MaxTokens     int         `json:"max_tokens"`
+	System        string      `json:"system,omitempty"`
+	Messages      []Message   `json:"messages"`
+	Temperature   *float32    `json:"temperature,omitempty"`
+	TopP          float32     `json:"top_p,omitempty"`
+	StopSequences []string    `json:"stop_sequences,omitempty"`
+	Tools         []Tool      `json:"tools,omitempty"`
+	ToolChoice    *ToolChoice `json:"tool_choice,omitempty"`
+	Metadata      *Metadata   `json:"metadata,omitempty"`
+	Stream        bool        `json:"stream"`
+}
+
+func (r *MessagesRequest) FromChatCompletionRequest(req llm.ChatCompletionRequest) {
+	r.Model = req.ModelId()
+	r.MaxTokens = req.MaxTokens
+	if r.MaxTokens == 0 {
+		r.MaxTokens = defaultMaxTokens
+	}
+	r.Temperature = req.TemperatureParam()
+	r.TopP = req.TopP
+	r.StopSequences = req.Stop
+	r.Stream = true
+	if req.User != "" {
+		r.Metadata = &Metadata{UserId: req.User}
+	}
+
+	// the messages api has no way to disable the tools, they are left out instead
+	if mode, name := req.GetToolChoice(); mode != llm.ToolChoiceNone {
+		for _, tool := range req.GetTools() {
+			if tool.Function == nil {
+				continue
+			}
+			schema := tool.Function.Parameters
+			if schema == nil {
+				schema = map[string]any{"type": "object", "properties": map[string]any{}}
+			}
+			r.Tools = append(r.Tools, Tool{Name: tool.Function.Name, Description: tool.Function.Description, InputSchema: schema})
+		}
+		switch {
+		case len(r.Tools) == 0:
+		case name != "":
+			r.ToolChoice = &ToolChoice{Type: "tool", Name: name}
+		case mode == llm.ToolChoiceRequired:
+			r.ToolChoice = &ToolChoice{Type: "any"}
+		}
+	}
+
+	system := make([]string, 0)
+	// function name to the id of its last call, the results of legacy function calls only carry the name
+	callIds := make(map[string]string)
+	for _, m := range req.Messages {
+		switch m.Role {
+		case llm.ChatMessageRoleSystem:
+			system = append(system, m.TextContent())
+		case llm.ChatMessageRoleUser:
+			r.append(llm.ChatMessageRoleUser, toContentBlocks(m)...)
+		case llm.ChatMessageRoleAssistant:
+			blocks := make([]ContentBlock, 0, len(m.ToolCalls)+1)
+			if text := m.TextContent(); text != "" {
+				blocks = append(blocks, ContentBlock{Type: "text", Text: text})
+			}
+			toolCalls := m.ToolCalls
+			if m.FunctionCall != nil {
+				toolCalls = append(toolCalls, llm.ToolCall{Type: llm.ToolTypeFunction, Function: *m.FunctionCall})
+			}
+			for _, call := range toolCalls {
+				if call.ID == "" {
+					call.ID = "toolu_" + uuid.NewString()
+				}
+				callIds[call.Function.Name] = call.ID
+				blocks = append(blocks, ContentBlock{Type: "tool_use", Id: call.ID, Name: call.Function.Name, Input: toInput(call.Function.Arguments)})
+			}
+			r.append(llm.ChatMessageRoleAssistant, blocks...)
+		case llm.ChatMessageRoleTool, llm.ChatMessageRoleFunction:
+			id := m.ToolCallID
+			if id == "" {
+				id = callIds[m.Name]
+			}
+			// tool results are sent back in a user message, parallel results end up in the same one
+			r.append(llm.ChatMessageRoleUser, ContentBlock{Type: "tool_result", ToolUseId: id, Content: m.TextContent()})
+		}
+	}
+	r.System = strings.Join(system, "\n\n")
+}
+
+// append adds the blocks to the last message if it has the same role,
+// the messages api requires user and assistant messages to alternate.
+func (r *MessagesRequest) append(role string, blocks ...ContentBlock) {
+	if len(blocks) == 0 {
+		return
+	}
+	if n := len(r.Messages); n > 0 && r.Messages[n-1].Role == role {
+		r.Messages[n-1].Content = append(r.Messages[n-1].Content, blocks...)
+		return
+	}
+	r.Messages = append(r.Messages, Message{Role: role, Content: blocks})
+}
+
+func toContentBlocks(m llm.ChatCompletionMessage) []ContentBlock {
+	if len(m.MultiContent) == 0 {
+		return []ContentBlock{{Type: "text", Text: m.Content}}
+	}
+	blocks := make([]ContentBlock, 0, len(m.MultiContent))
+	for _, part := range m.MultiContent {
+		switch part.Type {
+		case llm.ChatMessagePartTypeText:
+			blocks = append(blocks, ContentBlock{Type: "text", Text: part.Text})
+		case llm.ChatMessagePartTypeImageURL:
+			mediaType, data, ok := llm.ImagePart(part)
+			if !ok {
+				continue
+			}
+			blocks = append(blocks, ContentBlock{Type: "image", Source: &ImageSource{Type: "base64", MediaType: mediaType, Data: data}})
+		}
+	}
+	return blocks
+}
+
+// toInput returns the arguments of a tool call as the input object of a tool_use block.
+func toInput(arguments string) json.RawMessage {
+	if !json.Valid([]byte(arguments)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type Error struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// ErrorResponse is the body of the error responses, and of the error events of a stream.
+type ErrorResponse struct {
+	Type  string `json:"type"`
+	Error Error  `json:"error"`
+}
+
+// StreamEvent is one event of a messages stream, the fields set depend on its type.
+type StreamEvent struct {
+	Type    string `json:"type"`
+	Message *struct {
+		Id    string `json:"id"`
+		Model string `json:"model"`
+		Usage Usage  `json:"usage"`
+	} `json:"message,omitempty"`
+	Index        int           `json:"index"`
+	ContentBlock *ContentBlock `json:"content_block,omitempty"`
+	Delta        *struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJson string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta,omitempty"`
+	Usage *Usage `json:"usage,omitempty"`
+	Error *Error `json:"error,omitempty"`
+}
+
+// StreamDecoder converts the events of a messages stream into chat completion chunks.
+// The tool_use blocks become tool calls, numbered in the order they start.
+type StreamDecoder struct {
+	id      string
+	model   string
+	created int64
+	usage   Usage
+	// toolCalls maps the index of a tool_use block to the index of its tool call
+	toolCalls map[int]int
+}
+
+func NewStreamDecoder() *StreamDecoder {
+	return &StreamDecoder{
+		id:        fmt.Sprintf("chatcmpl-%s", uuid.NewString()),
+		created:   time.Now().Unix(),
+		toolCalls: make(map[int]int),
+	}
+}
+
+// Decode returns the chunk of the event, false when the event carries no content.
+func (d *StreamDecoder) Decode(event StreamEvent) (llm.ChatCompletionStreamResponse, bool) {
+	delta := llm.ChatCompletionStreamChoiceDelta{Role: llm.ChatMessageRoleAssistant}
+	var finishReason llm.FinishReason
+
+	switch event.Type {
+	case "message_start":
+		if event.Message != nil {
+			if event.Message.Id != "" {
+				d.id = event.Message.Id
+			}
+			d.model = event.Message.Model
+			d.usage = event.Message.Usage
+		}
+		return llm.ChatCompletionStreamResponse{}, false
+	case "content_block_start":
+		if event.ContentBlock == nil {
+			return llm.ChatCompletionStreamResponse{}, false
+		}
+		switch event.ContentBlock.Type {
+		case "text":
+			if event.ContentBlock.Text == "" {
+				return llm.ChatCompletionStreamResponse{}, false
+			}
+			delta.Content = event.ContentBlock.Text
+		case "tool_use":
+			index := len(d.toolCalls)
+			d.toolCalls[event.Index] = index
+			delta.ToolCalls = []llm.ToolCall{{
+				Index:    &index,
+				ID:       event.ContentBlock.Id,
+				Type:     llm.ToolTypeFunction,
+				Function: llm.FunctionCall{Name: event.ContentBlock.Name},
+			}}
+		default:
+			return llm.ChatCompletionStreamResponse{}, false
+		}
+	case "content_block_delta":
+		if event.Delta == nil {
+			return llm.ChatCompletionStreamResponse{}, false
+		}
+		switch event.Delta.Type {
+		case "text_delta":
+			delta.Content = event.Delta.Text
+		case "input_json_delta":
+			index, ok := d.toolCalls[event.Index]
+			if !ok || event.Delta.PartialJson == "" {
+				return llm.ChatCompletionStreamResponse{}, false
+			}
+			delta.ToolCalls = []llm.ToolCall{{Index: &index, Function: llm.FunctionCall{Arguments: event.Delta.PartialJson}}}
+		default:
+			return llm.ChatCompletionStreamResponse{}, false
+		}
+	case "message_delta":
+		if event.Usage != nil {
+			d.usage.OutputTokens = event.Usage.OutputTokens
+		}
+		if event.Delta == nil || event.Delta.StopReason == "" {
+			return llm.ChatCompletionStreamResponse{}, false
+		}
+		finishReason = toFinishReason(event.Delta.StopReason)
+	default:
+		return llm.ChatCompletionStreamResponse{}, false
+	}
+
+	return llm.ChatCompletionStreamResponse{
+		ID:      d.id,
+		Object:  "chat.completion.chunk",
+		Created: d.created,
+		Model:   d.model,
+		Choices: []llm.ChatCompletionStreamChoice{
+			{
+				Index:        0,
+				Delta:        delta,
+				FinishReason: finishReason,
+			},
+		},
+	}, true
+}
+
+// Usage returns the chunk with the usage of the whole request, to be sent after the last event.
+func (d *StreamDecoder) Usage() llm.ChatCompletionStreamResponse {
+	usage := llm.NewUsage(d.usage.InputTokens, d.usage.OutputTokens)
+	return llm.ChatCompletionStreamResponse{
+		ID:      d.id,
+		Object:  "chat.completion.chunk",
+		Created: d.created,
+		Model:   d.model,
+		Choices: []llm.ChatCompletionStreamChoice{},
+		Usage:   &usage,
+	}
+}
+
+func toFinishReason(stopReason string) llm.FinishReason {
+	switch stopReason {
+	case "max_tokens":
+		return llm.FinishReasonLength
+	case "tool_use":
+		return llm.FinishReasonToolCalls
+	default:
+		return llm.FinishReasonStop
+	}
+}
@@ -1,17 +1,19 @@
 package awsbedrock
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"strings"
 
+	"github.com/Vaayne/aienvoy/pkg/llms/anthropic"
 	"github.com/Vaayne/aienvoy/pkg/llms/llm"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
@@ -52,35 +54,102 @@ func (c *Client) ListModels() []string {
 	return c.config.ListModels()
 }
 
+// BuildRequestBody builds the invoke body for the model. Claude 3 models use the messages api and get their images
+// inlined, the other models get the conversation as text in the format of their family.
+func BuildRequestBody(ctx context.Context, req llm.ChatCompletionRequest) ([]byte, error) {
+	modelId := req.ModelId()
+	switch {
+	case IsMessagesModel(modelId):
+		req, err := llm.InlineImages(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("inline images error: %w", err)
+		}
+		messagesRequest := &MessagesRequest{}
+		messagesRequest.FromChatCompletionRequest(req)
+		return messagesRequest.Marshal()
+	case strings.HasPrefix(modelId, "anthropic."):
+		bedrockRequest := &BedrockRequest{}
+		bedrockRequest.FromChatCompletionRequest(req)
+		return bedrockRequest.Marshal(), nil
+	}
+	f := familyOf(modelId)
+	if f == nil {
+		return nil, fmt.Errorf("unsupported bedrock model: %s", modelId)
+	}
+	body, err := json.Marshal(f.encode(req, newConversation(req)))
+	if err != nil {
+		return nil, fmt.Errorf("marshal bedrock request error: %w", err)
+	}
+	return body, nil
+}
+
+// ChunkDecoder converts the chunks of a model stream into chat completion chunks, a chunk may carry no content.
+type ChunkDecoder interface {
+	Decode(chunk []byte) ([]llm.ChatCompletionStreamResponse, error)
+}
+
+// NewChunkDecoder returns the decoder of the stream of the model.
+func NewChunkDecoder(modelId string) ChunkDecoder {
+	if IsMessagesModel(modelId) {
+		return &messagesDecoder{decoder: anthropic.NewStreamDecoder()}
+	}
+	decode := decodeClaude
+	if f := familyOf(modelId); f != nil {
+		decode = f.decode
+	}
+	return &textDecoder{decode: decode, stream: NewStreamDecoder()}
+}
+
+// decodeClaude decodes the chunks of the claude text completion models.
+func decodeClaude(chunk []byte) (BedrockResponse, bool, error) {
+	var resp BedrockResponse
+	if err := unmarshalChunk(chunk, &resp); err != nil {
+		return resp, false, err
+	}
+	return resp, true, nil
+}
+
 func (c *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
 	slog.DebugContext(ctx, "chat start", "model", req.ModelId(), "is_stream", true)
-	bedrockRequest := &BedrockRequest{}
-	bedrockRequest.FromChatCompletionRequest(req)
+	body, err := BuildRequestBody(ctx, req)
+	if err != nil {
+		errChan <- err
+		return
+	}
 
 	output, err := c.InvokeModelWithResponseStream(ctx, &bedrockruntime.InvokeModelWithResponseStreamInput{
 		ModelId:     aws.String(req.ModelId()),
-		Body:        bedrockRequest.Marshal(),
+		Body:        body,
 		ContentType: aws.String("application/json"),
 	})
 	if err != nil {
+		var respErr *awshttp.ResponseError
+		if errors.As(err, &respErr) {
+			err = &llm.APIError{StatusCode: respErr.HTTPStatusCode(), Message: respErr.Error(), Err: err}
+		}
 		errChan <- err
 		return
 	}
 
-	sb := &strings.Builder{}
+	decoder := NewChunkDecoder(req.ModelId())
 
-	for event := range output.GetStream().Events() {
+	stream := output.GetStream()
+	defer stream.Close()
+	for event := range stream.Events() {
 		switch v := event.(type) {
 		case *types.ResponseStreamMemberChunk:
-			var resp BedrockResponse
-			err := json.NewDecoder(bytes.NewReader(v.Value.Bytes)).Decode(&resp)
+			chunks, err := decoder.Decode(v.Value.Bytes)
 			if err != nil {
 				slog.ErrorContext(ctx, "chat start", "model", req.ModelId(), "is_stream", true, "err", err)
 				errChan <- err
 				return
 			}
-			sb.WriteString(resp.Completion)
-			dataChan <- resp.ToChatCompletionStreamResponse()
+			for _, chunk := range chunks {
+				// the usage of the messages api comes in a chunk without choices
+				if len(chunk.Choices) > 0 || req.IncludeUsage() {
+					dataChan <- chunk
+				}
+			}
 		case *types.UnknownUnionMember:
 			err = fmt.Errorf("unknown event type: %T", v)
 			slog.ErrorContext(ctx, "chat start", "model", req.ModelId(), "is_stream", true, "err", err)
@@ -93,6 +162,12 @@ func (c *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCom
 			return
 		}
 	}
+	// the events are closed on a read error too, the stream is closed before it is reported as finished
+	if err := stream.Close(); err != nil {
+		slog.ErrorContext(ctx, "read stream error", "model", req.ModelId(), "is_stream", true, "err", err)
+		errChan <- err
+		return
+	}
 	slog.DebugContext(ctx, "chat success", "model", req.ModelId(), "is_stream", true)
 	errChan <- io.EOF
 }
@@ -28,16 +28,49 @@ func (b *BedrockRequest) FromChatCompletionRequest(req llm.ChatCompletionRequest
 	}
 	b.Temperature = float64(req.Temperature)
 	b.TopP = float64(req.TopP)
-	b.StopSequences = req.Stop
+	b.StopSequences = append([]string{}, req.Stop...)
 
 	sb := strings.Builder{}
-	for _, m := range req.Messages {
+	if tools := req.GetTools(); len(tools) > 0 {
+		mode, name := req.GetToolChoice()
+		if mode != llm.ToolChoiceNone {
+			sb.WriteString(buildToolsPrompt(tools, name))
+			b.StopSequences = append(b.StopSequences, functionCallsEndTag)
+		}
+	}
+
+	// tool call id to function name, tool results only carry the id
+	toolNames := make(map[string]string)
+	for i, m := range req.Messages {
 		switch m.Role {
-		case "user":
-			sb.WriteString(fmt.Sprintf("\n\nHuman: %s", m.Content))
-		case "assistant":
+		case llm.ChatMessageRoleUser:
+			sb.WriteString(fmt.Sprintf("\n\nHuman: %s", m.TextContent()))
+		case llm.ChatMessageRoleAssistant:
 			sb.WriteString(fmt.Sprintf("\n\nAssistant: %s", m.Content))
-		case "system":
+			toolCalls := m.ToolCalls
+			if m.FunctionCall != nil {
+				toolCalls = append(toolCalls, llm.ToolCall{Type: llm.ToolTypeFunction, Function: *m.FunctionCall})
+			}
+			if len(toolCalls) > 0 {
+				sb.WriteString(buildFunctionCalls(toolCalls))
+			}
+			for _, call := range toolCalls {
+				toolNames[call.ID] = call.Function.Name
+			}
+		case llm.ChatMessageRoleTool, llm.ChatMessageRoleFunction:
+			// consecutive tool results are grouped into one function_results block
+			if i == 0 || !isToolResult(req.Messages[i-1]) {
+				sb.WriteString("\n\nHuman: <function_results>\n")
+			}
+			name := m.Name
+			if name == "" {
+				name = toolNames[m.ToolCallID]
+			}
+			sb.WriteString(buildFunctionResult(name, m.Content))
+			if i == len(req.Messages)-1 || !isToolResult(req.Messages[i+1]) {
+				sb.WriteString("</function_results>")
+			}
+		case llm.ChatMessageRoleSystem:
 			sb.WriteString(fmt.Sprintf("\n\nSystem: %s", m.Content))
 		}
 	}
@@ -45,6 +78,10 @@ func (b *BedrockRequest) FromChatCompletionRequest(req llm.ChatCompletionRequest
 	b.Prompt = sb.String()
 }
 
+func isToolResult(m llm.ChatCompletionMessage) bool {
+	return m.Role == llm.ChatMessageRoleTool || m.Role == llm.ChatMessageRoleFunction
+}
+
 func (b *BedrockRequest) Marshal() []byte {
 	resp, err := json.Marshal(b)
 	if err != nil {
@@ -55,9 +92,26 @@ func (b *BedrockRequest) Marshal() []byte {
 }
 
 type BedrockResponse struct {
-	Completion string `json:"completion"`
-	Stop       string `json:"stop"`
-	StopReason string `json:"stop_reason"`
+	Completion        string             `json:"completion"`
+	Stop              string             `json:"stop"`
+	StopReason        string             `json:"stop_reason"`
+	InvocationMetrics *InvocationMetrics `json:"amazon-bedrock-invocationMetrics,omitempty"`
+}
+
+// InvocationMetrics is added by bedrock to the last chunk of a stream.
+type InvocationMetrics struct {
+	InputTokenCount   int `json:"inputTokenCount"`
+	OutputTokenCount  int `json:"outputTokenCount"`
+	InvocationLatency int `json:"invocationLatency"`
+	FirstByteLatency  int `json:"firstByteLatency"`
+}
+
+func (m *InvocationMetrics) ToUsage() *llm.Usage {
+	if m == nil {
+		return nil
+	}
+	usage := llm.NewUsage(m.InputTokenCount, m.OutputTokenCount)
+	return &usage
 }
 
 func getUUID() string {
@@ -104,7 +158,7 @@ func (b *BedrockResponse) ToChatCompletionStreamResponse() llm.ChatCompletionStr
 
 func (b *BedrockResponse) stopReasonMapping() string {
 	switch b.StopReason {
-	case "stop_sequence":
+	case "stop_sequence", "end_turn":
 		return "stop"
 	case "max_tokens":
 		return "length"
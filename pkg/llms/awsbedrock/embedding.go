@@ -0,0 +1,98 @@
+package awsbedrock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+)
+
+// maxCohereEmbeddingInputs is the limit of texts of one cohere embed request,
+// titan embeds one text per request.
+const maxCohereEmbeddingInputs = 96
+
+type titanEmbeddingRequest struct {
+	InputText  string `json:"inputText"`
+	Dimensions int    `json:"dimensions,omitempty"`
+}
+
+type titanEmbeddingResponse struct {
+	Embedding           []float32 `json:"embedding"`
+	InputTextTokenCount int       `json:"inputTextTokenCount"`
+}
+
+type cohereEmbeddingRequest struct {
+	Texts     []string `json:"texts"`
+	InputType string   `json:"input_type"`
+}
+
+type cohereEmbeddingResponse struct {
+	Embeddings [][]float32 `json:"embeddings"`
+}
+
+// CreateEmbeddings embeds the inputs with the amazon titan or cohere embed models.
+func (c *Client) CreateEmbeddings(ctx context.Context, req llm.EmbeddingRequest) (llm.EmbeddingResponse, error) {
+	switch modelId := req.ModelId(); {
+	case strings.HasPrefix(modelId, "amazon.titan-embed"):
+		return llm.CreateEmbeddingsInBatches(ctx, req, 1, c.embedTitan)
+	case strings.HasPrefix(modelId, "cohere.embed"):
+		return llm.CreateEmbeddingsInBatches(ctx, req, maxCohereEmbeddingInputs, c.embedCohere)
+	default:
+		return llm.EmbeddingResponse{}, fmt.Errorf("model %s: %w", modelId, llm.ErrEmbeddingsNotSupported)
+	}
+}
+
+func (c *Client) embedTitan(ctx context.Context, req llm.EmbeddingRequest, inputs []string) (llm.EmbeddingResponse, error) {
+	var resp titanEmbeddingResponse
+	if err := c.invoke(ctx, req.ModelId(), titanEmbeddingRequest{InputText: inputs[0], Dimensions: req.Dimensions}, &resp); err != nil {
+		return llm.EmbeddingResponse{}, err
+	}
+	return llm.EmbeddingResponse{
+		Data:  []llm.Embedding{{Embedding: resp.Embedding}},
+		Usage: llm.NewUsage(resp.InputTextTokenCount, 0),
+	}, nil
+}
+
+func (c *Client) embedCohere(ctx context.Context, req llm.EmbeddingRequest, inputs []string) (llm.EmbeddingResponse, error) {
+	var resp cohereEmbeddingResponse
+	if err := c.invoke(ctx, req.ModelId(), cohereEmbeddingRequest{Texts: inputs, InputType: "search_document"}, &resp); err != nil {
+		return llm.EmbeddingResponse{}, err
+	}
+	embeddings := make([]llm.Embedding, 0, len(resp.Embeddings))
+	for i, embedding := range resp.Embeddings {
+		embeddings = append(embeddings, llm.Embedding{Embedding: embedding, Index: i})
+	}
+	// cohere does not report the usage, it is estimated by the caller
+	return llm.EmbeddingResponse{Data: embeddings}, nil
+}
+
+// invoke sends a request which is not streamed to the model and decodes its response into out.
+func (c *Client) invoke(ctx context.Context, modelId string, body, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal bedrock request error: %w", err)
+	}
+	output, err := c.InvokeModel(ctx, &bedrockruntime.InvokeModelInput{
+		ModelId:     aws.String(modelId),
+		Body:        payload,
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		var respErr *awshttp.ResponseError
+		if errors.As(err, &respErr) {
+			err = &llm.APIError{StatusCode: respErr.HTTPStatusCode(), Message: respErr.Error(), Err: err}
+		}
+		return err
+	}
+	if err := json.Unmarshal(output.Body, out); err != nil {
+		return fmt.Errorf("unmarshal bedrock response error: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,417 @@
+package awsbedrock
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+// family is the request and response format of a family of text models on bedrock. They have no native tools,
+// the tools are described in the system prompt and the calls are parsed from the text by the StreamDecoder.
+type family interface {
+	// encode builds the invoke body from the sampling parameters of the request and the conversation
+	encode(req llm.ChatCompletionRequest, conv conversation) any
+	// decode converts a chunk of the stream into a text completion chunk, false when it carries no content
+	decode(chunk []byte) (BedrockResponse, bool, error)
+}
+
+// familyOf returns the family of the model, nil for the claude models and the unknown ones.
+func familyOf(modelId string) family {
+	switch {
+	case strings.HasPrefix(modelId, "meta.llama3"):
+		return llama3{}
+	case strings.HasPrefix(modelId, "meta.llama"):
+		return llama2{}
+	case strings.HasPrefix(modelId, "mistral."):
+		return mistral{}
+	case strings.HasPrefix(modelId, "amazon.titan-text"):
+		return titan{}
+	case strings.HasPrefix(modelId, "cohere.command-r"):
+		return commandR{}
+	case strings.HasPrefix(modelId, "cohere.command"):
+		return command{}
+	default:
+		return nil
+	}
+}
+
+// turn is a user or assistant message of the conversation as text.
+type turn struct {
+	role string
+	text string
+}
+
+// conversation is the request flattened into a system prompt and alternating user and assistant turns,
+// with the stop sequences of the tools prompt.
+type conversation struct {
+	system string
+	turns  []turn
+	stop   []string
+}
+
+// newConversation writes the tool calls in the <function_calls> format of the tools prompt, and their results in a user turn.
+func newConversation(req llm.ChatCompletionRequest) conversation {
+	system := make([]string, 0)
+	conv := conversation{stop: append([]string{}, req.Stop...)}
+	if tools := req.GetTools(); len(tools) > 0 {
+		if mode, name := req.GetToolChoice(); mode != llm.ToolChoiceNone {
+			system = append(system, buildToolsPrompt(tools, name))
+			conv.stop = append(conv.stop, functionCallsEndTag)
+		}
+	}
+
+	add := func(role, text string) {
+		if n := len(conv.turns); n > 0 && conv.turns[n-1].role == role {
+			conv.turns[n-1].text += "\n\n" + text
+			return
+		}
+		conv.turns = append(conv.turns, turn{role: role, text: text})
+	}
+	// tool call id to function name, tool results only carry the id
+	toolNames := make(map[string]string)
+	for i, m := range req.Messages {
+		switch m.Role {
+		case llm.ChatMessageRoleSystem:
+			system = append(system, m.TextContent())
+		case llm.ChatMessageRoleUser:
+			add(llm.ChatMessageRoleUser, m.TextContent())
+		case llm.ChatMessageRoleAssistant:
+			text := m.TextContent()
+			toolCalls := m.ToolCalls
+			if m.FunctionCall != nil {
+				toolCalls = append(toolCalls, llm.ToolCall{Type: llm.ToolTypeFunction, Function: *m.FunctionCall})
+			}
+			if len(toolCalls) > 0 {
+				text += buildFunctionCalls(toolCalls)
+			}
+			for _, call := range toolCalls {
+				toolNames[call.ID] = call.Function.Name
+			}
+			add(llm.ChatMessageRoleAssistant, text)
+		case llm.ChatMessageRoleTool, llm.ChatMessageRoleFunction:
+			name := m.Name
+			if name == "" {
+				name = toolNames[m.ToolCallID]
+			}
+			// consecutive tool results are grouped into one function_results block
+			result := buildFunctionResult(name, m.Content)
+			if i > 0 && isToolResult(req.Messages[i-1]) {
+				conv.turns[len(conv.turns)-1].text += result
+			} else {
+				add(llm.ChatMessageRoleUser, "<function_results>\n"+result)
+			}
+			if i == len(req.Messages)-1 || !isToolResult(req.Messages[i+1]) {
+				conv.turns[len(conv.turns)-1].text += "</function_results>"
+			}
+		}
+	}
+	conv.system = strings.Join(system, "\n\n")
+	return conv
+}
+
+// textChunk has the fields every chunk of a text model may carry, bedrock adds the metrics to the last one.
+type textChunk struct {
+	InvocationMetrics *InvocationMetrics `json:"amazon-bedrock-invocationMetrics,omitempty"`
+}
+
+func unmarshalChunk(chunk []byte, v any) error {
+	if err := json.Unmarshal(chunk, v); err != nil {
+		return fmt.Errorf("unmarshal bedrock chunk error: %w, data: %s", err, chunk)
+	}
+	return nil
+}
+
+// stopReason maps the stop reason of a model to the one of claude, which the StreamDecoder maps to a finish reason.
+func stopReason(reason string, length ...string) string {
+	if reason == "" {
+		return ""
+	}
+	for _, l := range length {
+		if strings.EqualFold(reason, l) {
+			return "max_tokens"
+		}
+	}
+	return "end_turn"
+}
+
+type llamaRequest struct {
+	Prompt      string   `json:"prompt"`
+	MaxGenLen   int      `json:"max_gen_len,omitempty"`
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        float32  `json:"top_p,omitempty"`
+}
+
+type llamaChunk struct {
+	textChunk
+	Generation string `json:"generation"`
+	StopReason string `json:"stop_reason"`
+}
+
+func decodeLlama(chunk []byte) (BedrockResponse, bool, error) {
+	var c llamaChunk
+	if err := unmarshalChunk(chunk, &c); err != nil {
+		return BedrockResponse{}, false, err
+	}
+	return BedrockResponse{Completion: c.Generation, StopReason: stopReason(c.StopReason, "length"), InvocationMetrics: c.InvocationMetrics}, true, nil
+}
+
+// llama2 is the format of the llama 2 chat models, the system prompt goes in the first instruction.
+type llama2 struct{}
+
+func (llama2) encode(req llm.ChatCompletionRequest, conv conversation) any {
+	sb := strings.Builder{}
+	for i, t := range conv.turns {
+		if t.role == llm.ChatMessageRoleAssistant {
+			sb.WriteString(fmt.Sprintf(" %s </s>", t.text))
+			continue
+		}
+		text := t.text
+		if i == 0 && conv.system != "" {
+			text = fmt.Sprintf("<<SYS>>\n%s\n<</SYS>>\n\n%s", conv.system, text)
+		}
+		sb.WriteString(fmt.Sprintf("<s>[INST] %s [/INST]", text))
+	}
+	return llamaRequest{Prompt: sb.String(), MaxGenLen: req.MaxTokens, Temperature: req.TemperatureParam(), TopP: req.TopP}
+}
+
+func (llama2) decode(chunk []byte) (BedrockResponse, bool, error) {
+	return decodeLlama(chunk)
+}
+
+// llama3 is the format of the llama 3 instruct models, with a header per message.
+type llama3 struct{}
+
+func (llama3) encode(req llm.ChatCompletionRequest, conv conversation) any {
+	sb := strings.Builder{}
+	sb.WriteString("<|begin_of_text|>")
+	if conv.system != "" {
+		conv.turns = append([]turn{{role: llm.ChatMessageRoleSystem, text: conv.system}}, conv.turns...)
+	}
+	for _, t := range conv.turns {
+		sb.WriteString(fmt.Sprintf("<|start_header_id|>%s<|end_header_id|>\n\n%s<|eot_id|>", t.role, t.text))
+	}
+	sb.WriteString("<|start_header_id|>assistant<|end_header_id|>\n\n")
+	return llamaRequest{Prompt: sb.String(), MaxGenLen: req.MaxTokens, Temperature: req.TemperatureParam(), TopP: req.TopP}
+}
+
+func (llama3) decode(chunk []byte) (BedrockResponse, bool, error) {
+	return decodeLlama(chunk)
+}
+
+// mistral is the format of the mistral and mixtral instruct models, which have no system role.
+type mistral struct{}
+
+type mistralRequest struct {
+	Prompt      string   `json:"prompt"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        float32  `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+type mistralChunk struct {
+	textChunk
+	Outputs []struct {
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"outputs"`
+}
+
+func (mistral) encode(req llm.ChatCompletionRequest, conv conversation) any {
+	sb := strings.Builder{}
+	sb.WriteString("<s>")
+	for i, t := range conv.turns {
+		if t.role == llm.ChatMessageRoleAssistant {
+			sb.WriteString(fmt.Sprintf(" %s</s>", t.text))
+			continue
+		}
+		text := t.text
+		if i == 0 && conv.system != "" {
+			text = conv.system + "\n\n" + text
+		}
+		sb.WriteString(fmt.Sprintf("[INST] %s [/INST]", text))
+	}
+	return mistralRequest{Prompt: sb.String(), MaxTokens: req.MaxTokens, Temperature: req.TemperatureParam(), TopP: req.TopP, Stop: conv.stop}
+}
+
+func (mistral) decode(chunk []byte) (BedrockResponse, bool, error) {
+	var c mistralChunk
+	if err := unmarshalChunk(chunk, &c); err != nil {
+		return BedrockResponse{}, false, err
+	}
+	resp := BedrockResponse{InvocationMetrics: c.InvocationMetrics}
+	for _, output := range c.Outputs {
+		resp.Completion += output.Text
+		if output.StopReason != "" {
+			resp.StopReason = stopReason(output.StopReason, "length")
+		}
+	}
+	return resp, true, nil
+}
+
+// titan is the format of the amazon titan text models, a transcript of user and bot lines.
+type titan struct{}
+
+type titanRequest struct {
+	InputText            string `json:"inputText"`
+	TextGenerationConfig struct {
+		MaxTokenCount int      `json:"maxTokenCount,omitempty"`
+		Temperature   *float32 `json:"temperature,omitempty"`
+		TopP          float32  `json:"topP,omitempty"`
+		StopSequences []string `json:"stopSequences,omitempty"`
+	} `json:"textGenerationConfig"`
+}
+
+type titanChunk struct {
+	textChunk
+	OutputText       string `json:"outputText"`
+	CompletionReason string `json:"completionReason"`
+}
+
+func (titan) encode(req llm.ChatCompletionRequest, conv conversation) any {
+	sb := strings.Builder{}
+	if conv.system != "" {
+		sb.WriteString(conv.system + "\n\n")
+	}
+	for _, t := range conv.turns {
+		role := "User"
+		if t.role == llm.ChatMessageRoleAssistant {
+			role = "Bot"
+		}
+		sb.WriteString(fmt.Sprintf("%s: %s\n", role, t.text))
+	}
+	sb.WriteString("Bot:")
+	r := titanRequest{InputText: sb.String()}
+	r.TextGenerationConfig.MaxTokenCount = req.MaxTokens
+	r.TextGenerationConfig.Temperature = req.TemperatureParam()
+	r.TextGenerationConfig.TopP = req.TopP
+	// titan only accepts a few stop sequences, the tool calls are parsed without their closing tag
+	r.TextGenerationConfig.StopSequences = req.Stop
+	return r
+}
+
+func (titan) decode(chunk []byte) (BedrockResponse, bool, error) {
+	var c titanChunk
+	if err := unmarshalChunk(chunk, &c); err != nil {
+		return BedrockResponse{}, false, err
+	}
+	return BedrockResponse{Completion: c.OutputText, StopReason: stopReason(c.CompletionReason, "LENGTH"), InvocationMetrics: c.InvocationMetrics}, true, nil
+}
+
+// cohereChunk is a chunk of both the command and the command r streams, the last one is finished.
+type cohereChunk struct {
+	textChunk
+	Text         string `json:"text"`
+	IsFinished   bool   `json:"is_finished"`
+	FinishReason string `json:"finish_reason"`
+	Generations  []struct {
+		Text         string `json:"text"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"generations"`
+}
+
+func decodeCohere(chunk []byte) (BedrockResponse, bool, error) {
+	var c cohereChunk
+	if err := unmarshalChunk(chunk, &c); err != nil {
+		return BedrockResponse{}, false, err
+	}
+	resp := BedrockResponse{Completion: c.Text, InvocationMetrics: c.InvocationMetrics}
+	reason := c.FinishReason
+	for _, g := range c.Generations {
+		resp.Completion += g.Text
+		if g.FinishReason != "" {
+			reason = g.FinishReason
+		}
+	}
+	if c.IsFinished && reason == "" {
+		reason = "COMPLETE"
+	}
+	resp.StopReason = stopReason(reason, "MAX_TOKENS")
+	return resp, true, nil
+}
+
+// command is the format of the cohere command text models, a transcript of user and chatbot lines.
+type command struct{}
+
+type commandRequest struct {
+	Prompt        string   `json:"prompt"`
+	MaxTokens     int      `json:"max_tokens,omitempty"`
+	Temperature   *float32 `json:"temperature,omitempty"`
+	P             float32  `json:"p,omitempty"`
+	StopSequences []string `json:"stop_sequences,omitempty"`
+	Stream        bool     `json:"stream"`
+}
+
+func (command) encode(req llm.ChatCompletionRequest, conv conversation) any {
+	sb := strings.Builder{}
+	if conv.system != "" {
+		sb.WriteString(conv.system + "\n\n")
+	}
+	for _, t := range conv.turns {
+		role := "User"
+		if t.role == llm.ChatMessageRoleAssistant {
+			role = "Chatbot"
+		}
+		sb.WriteString(fmt.Sprintf("%s: %s\n", role, t.text))
+	}
+	sb.WriteString("Chatbot:")
+	return commandRequest{Prompt: sb.String(), MaxTokens: req.MaxTokens, Temperature: req.TemperatureParam(), P: req.TopP, StopSequences: conv.stop, Stream: true}
+}
+
+func (command) decode(chunk []byte) (BedrockResponse, bool, error) {
+	return decodeCohere(chunk)
+}
+
+// commandR is the chat format of the cohere command r models, the last turn is the message and the others its history.
+type commandR struct{}
+
+type commandRMessage struct {
+	Role    string `json:"role"`
+	Message string `json:"message"`
+}
+
+type commandRRequest struct {
+	Message       string            `json:"message"`
+	ChatHistory   []commandRMessage `json:"chat_history,omitempty"`
+	Preamble      string            `json:"preamble,omitempty"`
+	MaxTokens     int               `json:"max_tokens,omitempty"`
+	Temperature   *float32          `json:"temperature,omitempty"`
+	P             float32           `json:"p,omitempty"`
+	StopSequences []string          `json:"stop_sequences,omitempty"`
+}
+
+func (commandR) encode(req llm.ChatCompletionRequest, conv conversation) any {
+	r := commandRRequest{Preamble: conv.system, MaxTokens: req.MaxTokens, Temperature: req.TemperatureParam(), P: req.TopP, StopSequences: conv.stop}
+	if len(conv.turns) == 0 {
+		return r
+	}
+	r.Message = conv.turns[len(conv.turns)-1].text
+	for _, t := range conv.turns[:len(conv.turns)-1] {
+		role := "USER"
+		if t.role == llm.ChatMessageRoleAssistant {
+			role = "CHATBOT"
+		}
+		r.ChatHistory = append(r.ChatHistory, commandRMessage{Role: role, Message: t.text})
+	}
+	return r
+}
+
+func (commandR) decode(chunk []byte) (BedrockResponse, bool, error) {
+	return decodeCohere(chunk)
+}
+
+// textDecoder decodes the chunks of a text model with the StreamDecoder, which conv.turns the tool calls of the text into tool calls.
+type textDecoder struct {
+	decode func(chunk []byte) (BedrockResponse, bool, error)
+	stream *StreamDecoder
+}
+
+func (d *textDecoder) Decode(chunk []byte) ([]llm.ChatCompletionStreamResponse, error) {
+	resp, ok, err := d.decode(chunk)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return []llm.ChatCompletionStreamResponse{d.stream.Decode(resp)}, nil
+}
@@ -0,0 +1,194 @@
+package awsbedrock
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFamilyRequest(model string) llm.ChatCompletionRequest {
+	return llm.ChatCompletionRequest{
+		Model:     model,
+		MaxTokens: 256,
+		Messages: []llm.ChatCompletionMessage{
+			{Role: llm.ChatMessageRoleSystem, Content: "Be brief."},
+			{Role: llm.ChatMessageRoleUser, Content: "Hi"},
+			{Role: llm.ChatMessageRoleAssistant, Content: "Hello!"},
+			{Role: llm.ChatMessageRoleUser, Content: "Weather in Paris?"},
+		},
+	}
+}
+
+func buildBody(t *testing.T, req llm.ChatCompletionRequest) map[string]any {
+	body, err := BuildRequestBody(context.Background(), req)
+	require.NoError(t, err)
+	var m map[string]any
+	require.NoError(t, json.Unmarshal(body, &m))
+	return m
+}
+
+// decodeAll decodes the chunks of a stream and accumulates them into a response.
+func decodeAll(t *testing.T, model string, chunks ...string) llm.ChatCompletionResponse {
+	decoder := NewChunkDecoder(model)
+	acc := llm.NewStreamAccumulator()
+	for _, chunk := range chunks {
+		resps, err := decoder.Decode([]byte(chunk))
+		require.NoError(t, err)
+		for _, resp := range resps {
+			acc.Add(resp)
+		}
+	}
+	return acc.Response()
+}
+
+func TestBuildRequestBodyFamilies(t *testing.T) {
+	body := buildBody(t, newFamilyRequest(llm.BedrockModelLlama2Chat13B))
+	assert.Equal(t, "<s>[INST] <<SYS>>\nBe brief.\n<</SYS>>\n\nHi [/INST] Hello! </s><s>[INST] Weather in Paris? [/INST]", body["prompt"])
+	assert.Equal(t, float64(256), body["max_gen_len"])
+
+	body = buildBody(t, newFamilyRequest(llm.BedrockModelLlama3Instruct8B))
+	assert.Equal(t, "<|begin_of_text|><|start_header_id|>system<|end_header_id|>\n\nBe brief.<|eot_id|>"+
+		"<|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\nHello!<|eot_id|>"+
+		"<|start_header_id|>user<|end_header_id|>\n\nWeather in Paris?<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n", body["prompt"])
+
+	body = buildBody(t, newFamilyRequest(llm.BedrockModelMixtral8x7B))
+	assert.Equal(t, "<s>[INST] Be brief.\n\nHi [/INST] Hello!</s>[INST] Weather in Paris? [/INST]", body["prompt"])
+	assert.Equal(t, float64(256), body["max_tokens"])
+
+	body = buildBody(t, newFamilyRequest(llm.BedrockModelTitanTextExpress))
+	assert.Equal(t, "Be brief.\n\nUser: Hi\nBot: Hello!\nUser: Weather in Paris?\nBot:", body["inputText"])
+	assert.Equal(t, float64(256), body["textGenerationConfig"].(map[string]any)["maxTokenCount"])
+
+	body = buildBody(t, newFamilyRequest(llm.BedrockModelCohereCommand))
+	assert.Equal(t, "Be brief.\n\nUser: Hi\nChatbot: Hello!\nUser: Weather in Paris?\nChatbot:", body["prompt"])
+	assert.Equal(t, true, body["stream"])
+
+	body = buildBody(t, newFamilyRequest(llm.BedrockModelCohereCommandR))
+	assert.Equal(t, "Weather in Paris?", body["message"])
+	assert.Equal(t, "Be brief.", body["preamble"])
+	assert.Equal(t, []any{
+		map[string]any{"role": "USER", "message": "Hi"},
+		map[string]any{"role": "CHATBOT", "message": "Hello!"},
+	}, body["chat_history"])
+
+	_, err := BuildRequestBody(context.Background(), newFamilyRequest("ai21.j2-ultra-v1"))
+	assert.Error(t, err)
+}
+
+func TestBuildRequestBodyTemperature(t *testing.T) {
+	models := []string{llm.BedrockModelLlama2Chat13B, llm.BedrockModelMixtral8x7B, llm.BedrockModelCohereCommand, llm.BedrockModelCohereCommandR, llm.BedrockModelClaude3Haiku}
+	for _, model := range models {
+		// an explicit 0 is sent, the models default to a higher temperature
+		req := newFamilyRequest(model)
+		req.TemperatureSet = true
+		assert.Equal(t, float64(0), buildBody(t, req)["temperature"], model)
+		assert.NotContains(t, buildBody(t, newFamilyRequest(model)), "temperature", model)
+	}
+
+	req := newFamilyRequest(llm.BedrockModelTitanTextExpress)
+	req.TemperatureSet = true
+	assert.Equal(t, float64(0), buildBody(t, req)["textGenerationConfig"].(map[string]any)["temperature"])
+}
+
+func TestBuildRequestBodyFamilyTools(t *testing.T) {
+	req := newFamilyRequest(llm.BedrockModelCohereCommandR)
+	req.Tools = []llm.Tool{{Type: llm.ToolTypeFunction, Function: &llm.FunctionDefinition{Name: "get_weather"}}}
+	req.Messages = append(req.Messages,
+		llm.ChatCompletionMessage{Role: llm.ChatMessageRoleAssistant, ToolCalls: []llm.ToolCall{
+			{ID: "call_1", Type: llm.ToolTypeFunction, Function: llm.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		}},
+		llm.ChatCompletionMessage{Role: llm.ChatMessageRoleTool, ToolCallID: "call_1", Content: "sunny"},
+	)
+
+	body := buildBody(t, req)
+	assert.Contains(t, body["preamble"], "<tool_name>get_weather</tool_name>")
+	assert.Equal(t, []any{functionCallsEndTag}, body["stop_sequences"])
+	assert.Equal(t, "<function_results>\n<result>\n<tool_name>get_weather</tool_name>\n<stdout>\nsunny\n</stdout>\n</result>\n</function_results>", body["message"])
+	history := body["chat_history"].([]any)
+	assert.True(t, strings.HasPrefix(history[len(history)-1].(map[string]any)["message"].(string), functionCallsStartTag))
+}
+
+func TestBuildRequestBodyMessages(t *testing.T) {
+	req := newFamilyRequest(llm.BedrockModelClaude3Haiku)
+	req.Tools = []llm.Tool{{Type: llm.ToolTypeFunction, Function: &llm.FunctionDefinition{Name: "get_weather"}}}
+
+	body := buildBody(t, req)
+	assert.Equal(t, anthropicVersion, body["anthropic_version"])
+	assert.Equal(t, "Be brief.", body["system"])
+	assert.NotContains(t, body, "model")
+	assert.NotContains(t, body, "stream")
+	assert.Len(t, body["messages"], 3)
+	assert.Equal(t, "get_weather", body["tools"].([]any)[0].(map[string]any)["name"])
+}
+
+func TestDecodeFamilies(t *testing.T) {
+	metrics := `"amazon-bedrock-invocationMetrics":{"inputTokenCount":12,"outputTokenCount":3}`
+	cases := []struct {
+		model  string
+		chunks []string
+	}{
+		{llm.BedrockModelLlama3Instruct8B, []string{
+			`{"generation":"Sunny ","stop_reason":null}`,
+			`{"generation":"today.","stop_reason":"stop",` + metrics + `}`,
+		}},
+		{llm.BedrockModelMistral7B, []string{
+			`{"outputs":[{"text":"Sunny ","stop_reason":null}]}`,
+			`{"outputs":[{"text":"today.","stop_reason":"stop"}],` + metrics + `}`,
+		}},
+		{llm.BedrockModelTitanTextLite, []string{
+			`{"outputText":"Sunny ","completionReason":null}`,
+			`{"outputText":"today.","completionReason":"FINISH",` + metrics + `}`,
+		}},
+		{llm.BedrockModelCohereCommandR, []string{
+			`{"event_type":"stream-start","is_finished":false}`,
+			`{"event_type":"text-generation","text":"Sunny ","is_finished":false}`,
+			`{"event_type":"text-generation","text":"today.","is_finished":false}`,
+			`{"event_type":"stream-end","is_finished":true,"finish_reason":"COMPLETE",` + metrics + `}`,
+		}},
+	}
+	for _, c := range cases {
+		resp := decodeAll(t, c.model, c.chunks...)
+		assert.Equal(t, "Sunny today.", resp.Choices[0].Message.Content, c.model)
+		assert.Equal(t, llm.FinishReasonStop, resp.Choices[0].FinishReason, c.model)
+		assert.Equal(t, llm.NewUsage(12, 3), resp.Usage, c.model)
+	}
+
+	resp := decodeAll(t, llm.BedrockModelMistral7B, `{"outputs":[{"text":"Sunny","stop_reason":"length"}]}`)
+	assert.Equal(t, llm.FinishReasonLength, resp.Choices[0].FinishReason)
+}
+
+func TestDecodeFamilyToolCalls(t *testing.T) {
+	resp := decodeAll(t, llm.BedrockModelLlama3Instruct70B,
+		`{"generation":"<function_calls>\n<invoke>\n<tool_name>get_weather</tool_name>\n","stop_reason":null}`,
+		`{"generation":"<parameters>{\"city\": \"Paris\"}</parameters>\n</invoke>\n","stop_reason":"stop"}`,
+	)
+	assert.Equal(t, llm.FinishReasonToolCalls, resp.Choices[0].FinishReason)
+	require.Len(t, resp.Choices[0].Message.ToolCalls, 1)
+	assert.Equal(t, "get_weather", resp.Choices[0].Message.ToolCalls[0].Function.Name)
+	assert.Equal(t, `{"city": "Paris"}`, resp.Choices[0].Message.ToolCalls[0].Function.Arguments)
+}
+
+func TestDecodeMessages(t *testing.T) {
+	resp := decodeAll(t, llm.BedrockModelClaude3Sonnet,
+		`{"type":"message_start","message":{"id":"msg_1","model":"claude-3-sonnet-20240229","usage":{"input_tokens":20,"output_tokens":1}}}`,
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Let me check."}}`,
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\":"}}`,
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}`,
+		`{"type":"content_block_stop","index":1}`,
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":15}}`,
+		`{"type":"message_stop","amazon-bedrock-invocationMetrics":{"inputTokenCount":20,"outputTokenCount":15}}`,
+	)
+	assert.Equal(t, "Let me check.", resp.Choices[0].Message.Content)
+	assert.Equal(t, llm.FinishReasonToolCalls, resp.Choices[0].FinishReason)
+	require.Len(t, resp.Choices[0].Message.ToolCalls, 1)
+	assert.Equal(t, "toolu_1", resp.Choices[0].Message.ToolCalls[0].ID)
+	assert.Equal(t, `{"city":"Paris"}`, resp.Choices[0].Message.ToolCalls[0].Function.Arguments)
+	assert.Equal(t, llm.NewUsage(20, 15), resp.Usage)
+}
@@ -0,0 +1,61 @@
+package awsbedrock
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/anthropic"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+// Claude 3 models only support the messages api, which is also the only one accepting images and tools.
+const anthropicVersion = "bedrock-2023-05-31"
+
+func IsMessagesModel(modelId string) bool {
+	return strings.HasPrefix(modelId, "anthropic.claude-3")
+}
+
+// MessagesRequest is the anthropic messages request, without the model and the stream flag
+// which bedrock takes from the invoke call.
+type MessagesRequest struct {
+	AnthropicVersion string `json:"anthropic_version"`
+	*anthropic.MessagesRequest
+	Model    string              `json:"model,omitempty"`
+	Stream   bool                `json:"stream,omitempty"`
+	Metadata *anthropic.Metadata `json:"metadata,omitempty"`
+}
+
+func (b *MessagesRequest) FromChatCompletionRequest(req llm.ChatCompletionRequest) {
+	b.AnthropicVersion = anthropicVersion
+	b.MessagesRequest = &anthropic.MessagesRequest{}
+	b.MessagesRequest.FromChatCompletionRequest(req)
+}
+
+func (b *MessagesRequest) Marshal() ([]byte, error) {
+	body, err := json.Marshal(b)
+	if err != nil {
+		return nil, fmt.Errorf("marshal bedrock messages request error: %w", err)
+	}
+	return body, nil
+}
+
+// messagesDecoder decodes the events of the messages api, the tool_use blocks are native tool calls.
+// The usage is sent in its own chunk once the message stops.
+type messagesDecoder struct {
+	decoder *anthropic.StreamDecoder
+}
+
+func (d *messagesDecoder) Decode(chunk []byte) ([]llm.ChatCompletionStreamResponse, error) {
+	var event anthropic.StreamEvent
+	if err := json.Unmarshal(chunk, &event); err != nil {
+		return nil, fmt.Errorf("unmarshal bedrock messages event error: %w", err)
+	}
+	if event.Type == "message_stop" {
+		return []llm.ChatCompletionStreamResponse{d.decoder.Usage()}, nil
+	}
+	if resp, ok := d.decoder.Decode(event); ok {
+		return []llm.ChatCompletionStreamResponse{resp}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,164 @@
+package awsbedrock
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+// Claude text completion models have no native tool support, so tools are described in the prompt
+// and the model answers with a <function_calls> block, which is converted back to tool calls.
+const (
+	functionCallsStartTag = "<function_calls>"
+	functionCallsEndTag   = "</function_calls>"
+)
+
+const toolsPrompt = `In this environment you have access to a set of tools you can use to answer the user's question.
+
+You may call them like this:
+<function_calls>
+<invoke>
+<tool_name>$TOOL_NAME</tool_name>
+<parameters>$PARAMETERS_AS_ONE_JSON_OBJECT</parameters>
+</invoke>
+</function_calls>
+
+You may put several <invoke> blocks in one <function_calls> block to call tools in parallel.
+The results will be returned to you in a <function_results> block.
+
+Here are the tools available:
+<tools>
+%s
+</tools>`
+
+var invokeRegexp = regexp.MustCompile(`(?s)<invoke>\s*<tool_name>(.*?)</tool_name>\s*<parameters>(.*?)</parameters>\s*</invoke>`)
+
+func buildToolsPrompt(tools []llm.Tool, toolChoice string) string {
+	sb := strings.Builder{}
+	for _, tool := range tools {
+		if tool.Function == nil {
+			continue
+		}
+		params, _ := json.Marshal(tool.Function.Parameters)
+		sb.WriteString(fmt.Sprintf("<tool_description>\n<tool_name>%s</tool_name>\n<description>%s</description>\n<parameters>%s</parameters>\n</tool_description>\n",
+			tool.Function.Name, tool.Function.Description, params))
+	}
+	prompt := fmt.Sprintf(toolsPrompt, strings.TrimSpace(sb.String()))
+	if toolChoice != "" {
+		prompt += fmt.Sprintf("\n\nYou must call the tool %s.", toolChoice)
+	}
+	return prompt
+}
+
+func buildFunctionCalls(toolCalls []llm.ToolCall) string {
+	sb := strings.Builder{}
+	sb.WriteString(functionCallsStartTag + "\n")
+	for _, call := range toolCalls {
+		sb.WriteString(fmt.Sprintf("<invoke>\n<tool_name>%s</tool_name>\n<parameters>%s</parameters>\n</invoke>\n", call.Function.Name, call.Function.Arguments))
+	}
+	sb.WriteString(functionCallsEndTag)
+	return sb.String()
+}
+
+func buildFunctionResult(name, content string) string {
+	return fmt.Sprintf("<result>\n<tool_name>%s</tool_name>\n<stdout>\n%s\n</stdout>\n</result>\n", name, content)
+}
+
+// parseFunctionCalls extracts the tool calls from a <function_calls> block, the closing tag is optional
+// because it is used as stop sequence.
+func parseFunctionCalls(text string) []llm.ToolCall {
+	matches := invokeRegexp.FindAllStringSubmatch(text, -1)
+	toolCalls := make([]llm.ToolCall, 0, len(matches))
+	for i, match := range matches {
+		index := i
+		toolCalls = append(toolCalls, llm.ToolCall{
+			Index: &index,
+			ID:    fmt.Sprintf("call_%s", getUUID()),
+			Type:  llm.ToolTypeFunction,
+			Function: llm.FunctionCall{
+				Name:      strings.TrimSpace(match[1]),
+				Arguments: strings.TrimSpace(match[2]),
+			},
+		})
+	}
+	return toolCalls
+}
+
+// StreamDecoder converts Claude completion chunks into chat completion stream responses.
+// Text is passed through as it arrives until the model opens a <function_calls> block,
+// the block is then held back and emitted as tool calls with the last chunk.
+type StreamDecoder struct {
+	id      string
+	created int64
+	// pending holds the end of the text which may be the beginning of the start tag
+	pending string
+	calls   strings.Builder
+	inCalls bool
+}
+
+func NewStreamDecoder() *StreamDecoder {
+	return &StreamDecoder{
+		id:      fmt.Sprintf("chatcmpl-%s", getUUID()),
+		created: time.Now().Unix(),
+	}
+}
+
+func (d *StreamDecoder) Decode(resp BedrockResponse) llm.ChatCompletionStreamResponse {
+	delta := llm.ChatCompletionStreamChoiceDelta{Role: llm.ChatMessageRoleAssistant}
+	finishReason := llm.FinishReason(resp.stopReasonMapping())
+
+	if d.inCalls {
+		d.calls.WriteString(resp.Completion)
+	} else {
+		text := d.pending + resp.Completion
+		d.pending = ""
+		if idx := strings.Index(text, functionCallsStartTag); idx >= 0 {
+			delta.Content = text[:idx]
+			d.calls.WriteString(text[idx:])
+			d.inCalls = true
+		} else {
+			keep := partialTagSuffix(text, functionCallsStartTag)
+			delta.Content = text[:len(text)-keep]
+			d.pending = text[len(text)-keep:]
+		}
+	}
+
+	if resp.StopReason != "" {
+		delta.Content += d.pending
+		d.pending = ""
+		if d.inCalls {
+			delta.ToolCalls = parseFunctionCalls(d.calls.String())
+			if len(delta.ToolCalls) > 0 {
+				finishReason = llm.FinishReasonToolCalls
+			}
+		}
+	}
+
+	return llm.ChatCompletionStreamResponse{
+		ID:      d.id,
+		Object:  "chat.completion.chunk",
+		Created: d.created,
+		Choices: []llm.ChatCompletionStreamChoice{
+			{
+				Index:        0,
+				Delta:        delta,
+				FinishReason: finishReason,
+			},
+		},
+		Usage: resp.InvocationMetrics.ToUsage(),
+	}
+}
+
+// partialTagSuffix returns the length of the longest suffix of text which is a prefix of tag.
+func partialTagSuffix(text, tag string) int {
+	for n := min(len(text), len(tag)-1); n > 0; n-- {
+		if strings.HasSuffix(text, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
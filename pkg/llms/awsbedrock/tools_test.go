@@ -0,0 +1,58 @@
+package awsbedrock
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamDecoderToolCalls(t *testing.T) {
+	chunks := []BedrockResponse{
+		{Completion: "Checking the weather.<func"},
+		{Completion: "tion_calls>\n<invoke>\n<tool_name>get_weather</tool_name>\n"},
+		{Completion: `<parameters>{"city": "Paris"}</parameters>` + "\n</invoke>\n"},
+		{StopReason: "stop_sequence", Stop: functionCallsEndTag},
+	}
+
+	decoder := NewStreamDecoder()
+	acc := llm.NewStreamAccumulator()
+	for _, chunk := range chunks {
+		resp := decoder.Decode(chunk)
+		assert.False(t, strings.Contains(resp.Choices[0].Delta.Content, "<"))
+		acc.Add(resp)
+	}
+	resp := acc.Response()
+
+	assert.Equal(t, "Checking the weather.", resp.Choices[0].Message.Content)
+	assert.Equal(t, llm.FinishReasonToolCalls, resp.Choices[0].FinishReason)
+	assert.Len(t, resp.Choices[0].Message.ToolCalls, 1)
+	call := resp.Choices[0].Message.ToolCalls[0]
+	assert.Equal(t, "get_weather", call.Function.Name)
+	assert.Equal(t, `{"city": "Paris"}`, call.Function.Arguments)
+}
+
+func TestFromChatCompletionRequestTools(t *testing.T) {
+	req := llm.ChatCompletionRequest{
+		Tools: []llm.Tool{{Type: llm.ToolTypeFunction, Function: &llm.FunctionDefinition{Name: "get_weather"}}},
+		Messages: []llm.ChatCompletionMessage{
+			{Role: llm.ChatMessageRoleUser, Content: "Weather in Paris and Rome?"},
+			{Role: llm.ChatMessageRoleAssistant, ToolCalls: []llm.ToolCall{
+				{ID: "call_1", Type: llm.ToolTypeFunction, Function: llm.FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+				{ID: "call_2", Type: llm.ToolTypeFunction, Function: llm.FunctionCall{Name: "get_weather", Arguments: `{"city":"Rome"}`}},
+			}},
+			{Role: llm.ChatMessageRoleTool, ToolCallID: "call_1", Content: "sunny"},
+			{Role: llm.ChatMessageRoleTool, ToolCallID: "call_2", Content: "rainy"},
+		},
+	}
+
+	b := &BedrockRequest{}
+	b.FromChatCompletionRequest(req)
+
+	assert.Contains(t, b.StopSequences, functionCallsEndTag)
+	assert.Contains(t, b.Prompt, "<tool_name>get_weather</tool_name>")
+	assert.Equal(t, 1, strings.Count(b.Prompt, "Human: <function_results>"))
+	assert.Contains(t, b.Prompt, "<result>\n<tool_name>get_weather</tool_name>\n<stdout>\nrainy\n</stdout>\n</result>\n</function_results>")
+	assert.True(t, strings.HasSuffix(b.Prompt, "\n\nAssistant: "))
+}
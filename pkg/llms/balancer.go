@@ -0,0 +1,321 @@
+package llms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+// Strategy decides which key serves a request when several configs serve the same model.
+type Strategy string
+
+const (
+	StrategyWeightedRoundRobin Strategy = "weighted-round-robin"
+	StrategyLeastInFlight      Strategy = "least-in-flight"
+)
+
+const budgetWindow = time.Minute
+
+type usageEntry struct {
+	at     time.Time
+	tokens int
+}
+
+// member is one config behind a balancer, it is shared by all balancers of the config,
+// so in-flight requests, budgets and health are tracked per key. Its fields are guarded by mu.
+type member struct {
+	mu      sync.Mutex
+	name    string
+	llm     *llm.LLM
+	weight  int
+	rpm     int
+	tpm     int
+	breaker *circuitBreaker
+
+	inFlight    int
+	requests    int64
+	failures    int64
+	lastError   string
+	lastErrorAt time.Time
+	// usage is the sliding window of the last minute, for the rpm and tpm budgets
+	usage []*usageEntry
+}
+
+func newMember(name string, cfg llm.Config, cli *llm.LLM) *member {
+	return &member{
+		name:    name,
+		llm:     cli,
+		weight:  max(cfg.Weight, 1),
+		rpm:     cfg.RPM,
+		tpm:     cfg.TPM,
+		breaker: newCircuitBreaker(),
+	}
+}
+
+func (m *member) prune(now time.Time) {
+	i := 0
+	for i < len(m.usage) && now.Sub(m.usage[i].at) >= budgetWindow {
+		i++
+	}
+	m.usage = m.usage[i:]
+}
+
+// withinBudget reports whether a request with the given prompt tokens fits the budgets of the key.
+func (m *member) withinBudget(now time.Time, tokens int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune(now)
+	if m.rpm > 0 && len(m.usage) >= m.rpm {
+		return false
+	}
+	if m.tpm > 0 {
+		used := 0
+		for _, u := range m.usage {
+			used += u.tokens
+		}
+		if used+tokens > m.tpm {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *member) start(tokens int) *usageEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight++
+	m.requests++
+	entry := &usageEntry{at: time.Now(), tokens: tokens}
+	m.usage = append(m.usage, entry)
+	return entry
+}
+
+func (m *member) finish(entry *usageEntry, completionTokens int, err error, failed bool) {
+	m.mu.Lock()
+	m.inFlight--
+	// the completion tokens are only known at the end, they are booked on the request entry
+	entry.tokens += completionTokens
+	if failed {
+		m.failures++
+		m.lastError = err.Error()
+		m.lastErrorAt = time.Now()
+	}
+	m.mu.Unlock()
+
+	if failed {
+		m.breaker.Failure()
+	} else {
+		m.breaker.Success()
+	}
+}
+
+// KeyHealth is a snapshot of the state of one key of a balanced model.
+type KeyHealth struct {
+	Model              string       `json:"model"`
+	Name               string       `json:"name"`
+	Weight             int          `json:"weight"`
+	InFlight           int          `json:"in_flight"`
+	Requests           int64        `json:"requests"`
+	Failures           int64        `json:"failures"`
+	LastError          string       `json:"last_error,omitempty"`
+	LastErrorAt        *time.Time   `json:"last_error_at,omitempty"`
+	Breaker            BreakerState `json:"breaker"`
+	RequestsLastMinute int          `json:"requests_last_minute"`
+	TokensLastMinute   int          `json:"tokens_last_minute"`
+	RPM                int          `json:"rpm,omitempty"`
+	TPM                int          `json:"tpm,omitempty"`
+}
+
+func (m *member) health(model string) KeyHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune(time.Now())
+	tokens := 0
+	for _, u := range m.usage {
+		tokens += u.tokens
+	}
+	h := KeyHealth{
+		Model:              model,
+		Name:               m.name,
+		Weight:             m.weight,
+		InFlight:           m.inFlight,
+		Requests:           m.requests,
+		Failures:           m.failures,
+		LastError:          m.lastError,
+		Breaker:            m.breaker.State(),
+		RequestsLastMinute: len(m.usage),
+		TokensLastMinute:   tokens,
+		RPM:                m.rpm,
+		TPM:                m.tpm,
+	}
+	if !m.lastErrorAt.IsZero() {
+		lastErrorAt := m.lastErrorAt
+		h.LastErrorAt = &lastErrorAt
+	}
+	return h
+}
+
+// balancer implements llm.Client for a model served by several configs.
+// Keys over their budget or with an open circuit breaker are skipped, and a request which fails
+// with a retryable error before the first token is sent to the next key.
+type balancer struct {
+	mu       sync.Mutex
+	model    string
+	strategy Strategy
+	members  []*member
+	// current is the smooth weighted round-robin state, per member
+	current []int
+}
+
+func newBalancer(model string, strategy Strategy, members []*member) *balancer {
+	if strategy == "" {
+		strategy = StrategyWeightedRoundRobin
+	}
+	return &balancer{
+		model:    model,
+		strategy: strategy,
+		members:  members,
+		current:  make([]int, len(members)),
+	}
+}
+
+func (b *balancer) ListModels() []string {
+	return []string{b.model}
+}
+
+// pick returns the next member to use, excluding the members already tried.
+func (b *balancer) pick(tokens int, tried map[*member]bool) *member {
+	now := time.Now()
+	candidates := make([]int, 0, len(b.members))
+	for i, m := range b.members {
+		if tried[m] || m.breaker.State() == BreakerStateOpen || !m.withinBudget(now, tokens) {
+			continue
+		}
+		candidates = append(candidates, i)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	best := candidates[0]
+	switch b.strategy {
+	case StrategyLeastInFlight:
+		// the fewest requests in flight relative to the weight
+		bestInFlight := b.members[best].inFlightCount()
+		for _, i := range candidates[1:] {
+			inFlight := b.members[i].inFlightCount()
+			if inFlight*b.members[best].weight < bestInFlight*b.members[i].weight {
+				best, bestInFlight = i, inFlight
+			}
+		}
+	default:
+		// smooth weighted round-robin, like nginx
+		total := 0
+		for _, i := range candidates {
+			b.current[i] += b.members[i].weight
+			total += b.members[i].weight
+			if b.current[i] > b.current[best] {
+				best = i
+			}
+		}
+		b.current[best] -= total
+	}
+	return b.members[best]
+}
+
+func (m *member) inFlightCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.inFlight
+}
+
+func (b *balancer) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+	tokens := req.EstimatePromptTokens()
+	tried := make(map[*member]bool)
+	var lastErr error
+	for {
+		m := b.pick(tokens, tried)
+		if m == nil {
+			break
+		}
+		tried[m] = true
+		if !m.breaker.Allow() {
+			continue
+		}
+
+		entry := m.start(tokens)
+		started, completionTokens, err := streamAttempt(ctx, m.llm, req, dataChan, 0)
+		success := err == nil || errors.Is(err, io.EOF)
+		retryable := !success && !started && isRetryable(ctx, err)
+		// bad requests and requests canceled by the caller say nothing about the key
+		failed := !success && ctx.Err() == nil && (started || retryable)
+		m.finish(entry, completionTokens, err, failed)
+		if success {
+			errChan <- io.EOF
+			return
+		}
+		if !retryable {
+			errChan <- err
+			return
+		}
+		lastErr = err
+		slog.WarnContext(ctx, "balanced key failed", "model", b.model, "key", m.name, "err", err)
+	}
+
+	if lastErr != nil {
+		errChan <- fmt.Errorf("all keys of model %s failed: %w", b.model, lastErr)
+		return
+	}
+	// reported as throttling, so that a route can fall back to another provider
+	errChan <- llm.NewAPIError(http.StatusTooManyRequests, fmt.Sprintf("all keys of model %s are over budget or unhealthy", b.model))
+}
+
+// CreateEmbeddings sends the request to the next key, like CreateChatCompletionStream it moves on
+// to the next key when a key fails with a retryable error.
+func (b *balancer) CreateEmbeddings(ctx context.Context, req llm.EmbeddingRequest) (llm.EmbeddingResponse, error) {
+	tokens := req.EstimateTokens()
+	tried := make(map[*member]bool)
+	var lastErr error
+	for {
+		m := b.pick(tokens, tried)
+		if m == nil {
+			break
+		}
+		tried[m] = true
+		if !m.breaker.Allow() {
+			continue
+		}
+
+		entry := m.start(tokens)
+		resp, err := m.llm.CreateEmbeddings(ctx, req)
+		retryable := err != nil && !errors.Is(err, llm.ErrEmbeddingsNotSupported) && isRetryable(ctx, err)
+		m.finish(entry, 0, err, retryable)
+		if !retryable {
+			return resp, err
+		}
+		lastErr = err
+		slog.WarnContext(ctx, "balanced key failed", "model", b.model, "key", m.name, "err", err)
+	}
+
+	if lastErr != nil {
+		return llm.EmbeddingResponse{}, fmt.Errorf("all keys of model %s failed: %w", b.model, lastErr)
+	}
+	return llm.EmbeddingResponse{}, llm.NewAPIError(http.StatusTooManyRequests, fmt.Sprintf("all keys of model %s are over budget or unhealthy", b.model))
+}
+
+func (b *balancer) health() []KeyHealth {
+	healths := make([]KeyHealth, 0, len(b.members))
+	for _, m := range b.members {
+		healths = append(healths, m.health(b.model))
+	}
+	return healths
+}
@@ -0,0 +1,54 @@
+package llms
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBalancer(strategy Strategy, cfgs []llm.Config, clients []*fakeClient) *balancer {
+	members := make([]*member, 0, len(clients))
+	for i, cli := range clients {
+		members = append(members, newMember(cli.content, cfgs[i], llm.New(llm.NewMemoryDao(), cli)))
+	}
+	return newBalancer("gpt-4", strategy, members)
+}
+
+func TestBalancerWeightedRoundRobin(t *testing.T) {
+	a := &fakeClient{content: "a"}
+	b := &fakeClient{content: "b"}
+	bal := newTestBalancer(StrategyWeightedRoundRobin, []llm.Config{{Weight: 2}, {}}, []*fakeClient{a, b})
+	svc := llm.New(llm.NewMemoryDao(), bal)
+
+	contents := ""
+	for i := 0; i < 6; i++ {
+		resp, err := svc.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{Model: "gpt-4"})
+		assert.NoError(t, err)
+		contents += resp.Choices[0].Message.Content
+	}
+	assert.Equal(t, "abaaba", contents)
+}
+
+func TestBalancerBudgetAndFailover(t *testing.T) {
+	a := &fakeClient{content: "a", err: llm.NewAPIError(http.StatusTooManyRequests, "throttled")}
+	b := &fakeClient{content: "b"}
+	bal := newTestBalancer(StrategyLeastInFlight, []llm.Config{{}, {RPM: 1}}, []*fakeClient{a, b})
+	svc := llm.New(llm.NewMemoryDao(), bal)
+
+	resp, err := svc.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{Model: "gpt-4"})
+	assert.NoError(t, err)
+	assert.Equal(t, "b", resp.Choices[0].Message.Content)
+
+	// a is throttled and b has used its budget for this minute
+	_, err = svc.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{Model: "gpt-4"})
+	assert.Error(t, err)
+	assert.Equal(t, 1, b.calls)
+
+	healths := bal.health()
+	assert.Equal(t, int64(2), healths[0].Failures)
+	assert.Equal(t, "api error, status code: 429, message: throttled", healths[0].LastError)
+	assert.Equal(t, 1, healths[1].RequestsLastMinute)
+}
@@ -94,6 +94,11 @@ func WithCookies(cookies map[string]string) ClientOption {
 	}
 }
 
+// Close releases the connections of the session, the registry calls it when the client is replaced.
+func (c *Client) Close() error {
+	return c.session.Close()
+}
+
 func (c *Client) initMeta() error {
 	req, err := http.NewRequest(http.MethodGet, "https://bard.google.com/", nil)
 	if err != nil {
@@ -120,7 +125,7 @@ func (c *Client) initMeta() error {
 		re := regexp.MustCompile(fmt.Sprintf(`%s":"(.*?)"`, name))
 		matches := re.FindStringSubmatch(string(body))
 		if len(matches) != 2 {
-			return "", fmt.Errorf(name + " value not found in response. Check __Secure-1PSID value.")
+			return "", fmt.Errorf("%s value not found in response. Check __Secure-1PSID value.", name)
 		}
 		return matches[1], nil
 	}
@@ -0,0 +1,48 @@
+package bard
+
+import (
+	"fmt"
+
+	"github.com/Vaayne/aienvoy/pkg/cookiecloud"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+type Bard *llm.LLM
+
+func New(config llm.Config, dao llm.Dao) (Bard, error) {
+	client, err := NewClientWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return llm.New(dao, client), nil
+}
+
+// NewClientWithConfig creates the client with the __Secure-1PSID cookie of the api_key,
+// or with the google cookies synced to cookiecloud.
+func NewClientWithConfig(cfg llm.Config) (*Client, error) {
+	if cfg.LLMType != llm.LLMTypeGoogleBard {
+		return nil, fmt.Errorf("invalid config for bard, llmtype: %s", cfg.LLMType)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.ApiKey != "" {
+		return NewClient(cfg.ApiKey)
+	}
+
+	cc := cookiecloud.New(cfg.CookieCloud.Host, cfg.CookieCloud.UUID, cfg.CookieCloud.Pass)
+	cookies, err := cc.GetCookies(".google.com")
+	if err != nil {
+		return nil, fmt.Errorf("get bard cookies from cookiecloud error: %w", err)
+	}
+	var token string
+	others := make(map[string]string)
+	for _, cookie := range cookies {
+		if cookie.Name == cookieTokenKey {
+			token = cookie.Value
+		} else {
+			others[cookie.Name] = cookie.Value
+		}
+	}
+	return NewClient(token, WithCookies(others))
+}
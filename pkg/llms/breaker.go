@@ -0,0 +1,90 @@
+package llms
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+type BreakerState string
+
+const (
+	BreakerStateClosed   BreakerState = "closed"
+	BreakerStateOpen     BreakerState = "open"
+	BreakerStateHalfOpen BreakerState = "half-open"
+)
+
+// circuitBreaker stops sending requests to a provider after consecutive failures.
+// Once the cooldown has passed, one probe request is let through, it closes the breaker on success
+// and opens it again on failure.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{
+		threshold: breakerThreshold,
+		cooldown:  breakerCooldown,
+	}
+}
+
+// Allow reports whether a request may be sent.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// Release ends a request which says nothing about the provider, like one canceled by the caller,
+// it lets another probe through without counting a success or a failure.
+func (b *circuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *circuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.failures < b.threshold:
+		return BreakerStateClosed
+	case b.probing || time.Since(b.openedAt) >= b.cooldown:
+		return BreakerStateHalfOpen
+	default:
+		return BreakerStateOpen
+	}
+}
@@ -0,0 +1,89 @@
+package llms
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+// cachedClient serves identical cacheable requests from the cache, the streams of cache hits are replayed.
+// It wraps the provider clients, so the hits are neither metered nor counted as in flight.
+type cachedClient struct {
+	llm.Client
+	cache llm.ResponseCache
+	cfg   llm.CacheConfig
+}
+
+func (c *cachedClient) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+	if !c.cfg.Cacheable(req) {
+		c.Client.CreateChatCompletionStream(ctx, req, dataChan, errChan)
+		return
+	}
+	status := llm.CacheStatusFrom(ctx)
+	key := llm.CacheKey(req)
+	var resp llm.ChatCompletionResponse
+	var ok bool
+	var err error
+	if !llm.CacheBypassed(ctx) {
+		if resp, ok, err = c.cache.GetResponse(ctx, key); err != nil {
+			slog.WarnContext(ctx, "get cached response error", "err", err, "model", req.ModelId())
+		}
+	}
+	if ok {
+		slog.DebugContext(ctx, "cache hit", "key", key, "model", req.ModelId())
+		status.Set(llm.CacheHit)
+		llm.ReplayStream(resp, req.IncludeUsage(), dataChan)
+		errChan <- io.EOF
+		return
+	}
+	status.Set(llm.CacheMiss)
+
+	// the usage is requested so it is cached with the response
+	innerReq := req
+	innerReq.StreamOptions = &llm.StreamOptions{IncludeUsage: true}
+	innerDataChan := make(chan llm.ChatCompletionStreamResponse)
+	// buffered so the provider can always hand over its final error
+	innerErrChan := make(chan error, 1)
+	go c.Client.CreateChatCompletionStream(ctx, innerReq, innerDataChan, innerErrChan)
+
+	acc := llm.NewStreamAccumulator()
+	for {
+		select {
+		case data := <-innerDataChan:
+			acc.Add(data)
+			if len(data.Choices) == 0 && !req.IncludeUsage() {
+				continue
+			}
+			select {
+			case dataChan <- data:
+			case <-ctx.Done():
+				go drain(innerDataChan, innerErrChan)
+				errChan <- ctx.Err()
+				return
+			}
+		case err := <-innerErrChan:
+			if errors.Is(err, io.EOF) {
+				if err := c.cache.SetResponse(ctx, key, acc.Response(), c.cfg.TTL); err != nil {
+					slog.WarnContext(ctx, "set cached response error", "err", err, "model", req.ModelId())
+				}
+			}
+			errChan <- err
+			return
+		case <-ctx.Done():
+			go drain(innerDataChan, innerErrChan)
+			errChan <- ctx.Err()
+			return
+		}
+	}
+}
+
+func (c *cachedClient) CreateEmbeddings(ctx context.Context, req llm.EmbeddingRequest) (llm.EmbeddingResponse, error) {
+	embedder, ok := c.Client.(llm.Embedder)
+	if !ok {
+		return llm.EmbeddingResponse{}, llm.ErrEmbeddingsNotSupported
+	}
+	return embedder.CreateEmbeddings(ctx, req)
+}
@@ -0,0 +1,117 @@
+package llms
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedClient(t *testing.T) {
+	fake := &fakeClient{content: "hello"}
+	cli := llm.New(llm.NewMemoryDao(), &cachedClient{
+		Client: fake,
+		cache:  llm.NewMemoryResponseCache(),
+		cfg:    llm.CacheConfig{Backend: llm.CacheBackendMemory},
+	})
+	req := llm.ChatCompletionRequest{
+		Model:          "openai/gpt-4",
+		Messages:       []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: "hi"}},
+		TemperatureSet: true,
+	}
+
+	ctx, status := llm.WithCacheStatus(context.Background())
+	first, err := cli.CreateChatCompletion(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, llm.CacheMiss, status.String())
+
+	// the same request with another provider prefix and extra whitespace is a hit
+	ctx, status = llm.WithCacheStatus(context.Background())
+	req.Model = "gpt-4"
+	req.Messages[0].Content = " hi\n"
+	second, err := cli.CreateChatCompletion(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, llm.CacheHit, status.String())
+	assert.Equal(t, 1, fake.calls)
+	assert.Equal(t, "hello", second.Choices[0].Message.Content)
+	assert.Equal(t, first.Usage, second.Usage)
+	assert.NotEqual(t, first.ID, second.ID)
+
+	// requests which are not deterministic are not cached, unless the cache is forced
+	ctx, status = llm.WithCacheStatus(context.Background())
+	req.Temperature = 0.7
+	_, err = cli.CreateChatCompletion(ctx, req)
+	require.NoError(t, err)
+	_, err = cli.CreateChatCompletion(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, 3, fake.calls)
+	assert.Empty(t, status.String())
+
+	// an omitted temperature defaults to 1
+	req.Temperature, req.TemperatureSet = 0, false
+	_, err = cli.CreateChatCompletion(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, 4, fake.calls)
+	assert.Empty(t, status.String())
+
+	req.Temperature, req.TemperatureSet = 0.7, true
+	cli.Client.(*cachedClient).cfg.Force = true
+	_, err = cli.CreateChatCompletion(ctx, req)
+	require.NoError(t, err)
+	_, err = cli.CreateChatCompletion(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, 5, fake.calls)
+	assert.Equal(t, llm.CacheHit, status.String())
+}
+
+func TestCachedClientBypass(t *testing.T) {
+	fake := &fakeClient{content: "hello"}
+	cli := llm.New(llm.NewMemoryDao(), &cachedClient{
+		Client: fake,
+		cache:  llm.NewMemoryResponseCache(),
+		cfg:    llm.CacheConfig{Backend: llm.CacheBackendMemory},
+	})
+	req := llm.ChatCompletionRequest{Messages: []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: "hi"}}, TemperatureSet: true}
+
+	_, err := cli.CreateChatCompletion(context.Background(), req)
+	require.NoError(t, err)
+	ctx, status := llm.WithCacheStatus(llm.WithCacheBypass(context.Background()))
+	_, err = cli.CreateChatCompletion(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fake.calls)
+	assert.Equal(t, llm.CacheMiss, status.String())
+
+	// a regenerated message is answered by the model again
+	cov, err := cli.CreateConversation(context.Background(), "")
+	require.NoError(t, err)
+	msg, err := cli.CreateMessage(context.Background(), cov.Id, req)
+	require.NoError(t, err)
+	assert.Equal(t, 2, fake.calls)
+	_, err = cli.RegenerateMessage(context.Background(), msg.Id)
+	require.NoError(t, err)
+	assert.Equal(t, 3, fake.calls)
+}
+
+func TestCachedClientStreamCanceled(t *testing.T) {
+	cli := &cachedClient{
+		Client: &fakeClient{content: "hello"},
+		cache:  llm.NewMemoryResponseCache(),
+		cfg:    llm.CacheConfig{Backend: llm.CacheBackendMemory},
+	}
+	req := llm.ChatCompletionRequest{Messages: []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: "hi"}}, TemperatureSet: true}
+
+	// nobody reads the data channel, the stream must still stop once the context is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go cli.CreateChatCompletionStream(ctx, req, make(chan llm.ChatCompletionStreamResponse), errChan)
+	cancel()
+	select {
+	case err := <-errChan:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("stream did not stop after the context was canceled")
+	}
+}
@@ -55,6 +55,11 @@ func NewClient(sessionKey string) *Client {
 	return claudeWeb
 }
 
+// Close releases the connections of the session, the registry calls it when the client is replaced.
+func (cw *Client) Close() error {
+	return cw.session.Close()
+}
+
 func (cw *Client) GetOrganizations() ([]*Organization, error) {
 	uri := fmt.Sprintf("%s/api/organizations", defaultHost)
 	req, _ := http.NewRequest(http.MethodGet, uri, nil)
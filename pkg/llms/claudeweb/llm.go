@@ -0,0 +1,42 @@
+package claudeweb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Vaayne/aienvoy/pkg/cookiecloud"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+type ClaudeWeb *llm.LLM
+
+func New(config llm.Config, dao llm.Dao) (ClaudeWeb, error) {
+	client, err := NewClientWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return llm.New(dao, client), nil
+}
+
+// NewClientWithConfig creates the client with the sessionKey cookie of the api_key, or with the one synced to cookiecloud.
+func NewClientWithConfig(cfg llm.Config) (*Client, error) {
+	if cfg.LLMType != llm.LLMTypeClaudeWeb {
+		return nil, fmt.Errorf("invalid config for claude web, llmtype: %s", cfg.LLMType)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	sessionKey := cfg.ApiKey
+	if sessionKey == "" {
+		cc := cookiecloud.New(cfg.CookieCloud.Host, cfg.CookieCloud.UUID, cfg.CookieCloud.Pass)
+		var err error
+		if sessionKey, err = cc.GetCookieValue("sessionKey", "claude.ai", ".claude.ai"); err != nil {
+			return nil, fmt.Errorf("get claude web session key from cookiecloud error: %w", err)
+		}
+	}
+	client := NewClient(sessionKey)
+	if client == nil {
+		return nil, errors.New("init claude web client error, check the session key")
+	}
+	return client, nil
+}
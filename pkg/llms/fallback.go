@@ -0,0 +1,241 @@
+package llms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+const (
+	defaultBackoff = 500 * time.Millisecond
+	// drainTimeout bounds how long an abandoned attempt is drained, so its goroutine can exit
+	drainTimeout = 30 * time.Second
+)
+
+var (
+	ErrFirstTokenTimeout = errors.New("timeout waiting for the first token")
+	ErrNoHealthyTarget   = errors.New("no healthy target")
+)
+
+type target struct {
+	name    string
+	model   string
+	llm     *llm.LLM
+	breaker *circuitBreaker
+}
+
+// fallbackClient implements llm.Client for a route, it tries the targets of the route in order.
+// Once the first token has been streamed the request sticks to its target, errors after that
+// point are returned to the caller as is.
+type fallbackClient struct {
+	route   llm.Route
+	targets []target
+}
+
+func newFallbackClient(route llm.Route, clients map[string]*llm.LLM, breakers map[string]*circuitBreaker) (*fallbackClient, error) {
+	c := &fallbackClient{route: route}
+	for _, name := range route.Targets {
+		provider, model, ok := strings.Cut(name, "/")
+		if !ok {
+			model = route.Model
+		}
+		cli, ok := clients[provider]
+		if !ok {
+			return nil, fmt.Errorf("target %s of route %s not found", name, route.Model)
+		}
+		c.targets = append(c.targets, target{
+			name:    provider,
+			model:   model,
+			llm:     cli,
+			breaker: breakers[provider],
+		})
+	}
+	if len(c.targets) == 0 {
+		return nil, fmt.Errorf("route %s has no targets", route.Model)
+	}
+	return c, nil
+}
+
+func (c *fallbackClient) ListModels() []string {
+	return []string{c.route.Model}
+}
+
+func (c *fallbackClient) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+	maxAttempts := max(c.route.MaxAttempts, 1)
+	backoff := c.route.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+
+	lastErr := ErrNoHealthyTarget
+	for _, t := range c.targets {
+		delay := backoff
+		for attempt := 1; attempt <= maxAttempts; attempt++ {
+			if !t.breaker.Allow() {
+				slog.WarnContext(ctx, "skip target, circuit breaker is open", "route", c.route.Model, "target", t.name)
+				break
+			}
+			targetReq := req
+			targetReq.Model = t.model
+			started, _, err := streamAttempt(ctx, t.llm, targetReq, dataChan, c.route.FirstTokenTimeout)
+			if err == nil || errors.Is(err, io.EOF) {
+				t.breaker.Success()
+				errChan <- io.EOF
+				return
+			}
+			if started || !isRetryable(ctx, err) {
+				// a started stream can not be retried, the breaker is resolved in any case,
+				// so that a failed probe does not keep the target half-open forever
+				switch {
+				case ctx.Err() != nil:
+					t.breaker.Release()
+				case started:
+					t.breaker.Failure()
+				default:
+					// the error is caused by the request, the provider itself is considered healthy
+					t.breaker.Success()
+				}
+				errChan <- err
+				return
+			}
+			t.breaker.Failure()
+			lastErr = err
+			slog.WarnContext(ctx, "route target failed", "route", c.route.Model, "target", t.name, "attempt", attempt, "err", err)
+
+			if attempt < maxAttempts {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					errChan <- ctx.Err()
+					return
+				}
+				delay *= 2
+			}
+		}
+	}
+	errChan <- fmt.Errorf("all targets of route %s failed: %w", c.route.Model, lastErr)
+}
+
+// CreateEmbeddings tries the targets of the route in order, like CreateChatCompletionStream.
+func (c *fallbackClient) CreateEmbeddings(ctx context.Context, req llm.EmbeddingRequest) (llm.EmbeddingResponse, error) {
+	maxAttempts := max(c.route.MaxAttempts, 1)
+	backoff := c.route.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+
+	lastErr := ErrNoHealthyTarget
+	for _, t := range c.targets {
+		delay := backoff
+		for attempt := 1; attempt <= maxAttempts; attempt++ {
+			if !t.breaker.Allow() {
+				slog.WarnContext(ctx, "skip target, circuit breaker is open", "route", c.route.Model, "target", t.name)
+				break
+			}
+			targetReq := req
+			targetReq.Model = t.model
+			resp, err := t.llm.CreateEmbeddings(ctx, targetReq)
+			if err == nil || errors.Is(err, llm.ErrEmbeddingsNotSupported) || !isRetryable(ctx, err) {
+				if ctx.Err() != nil {
+					t.breaker.Release()
+				} else {
+					t.breaker.Success()
+				}
+				return resp, err
+			}
+			t.breaker.Failure()
+			lastErr = err
+			slog.WarnContext(ctx, "route target failed", "route", c.route.Model, "target", t.name, "attempt", attempt, "err", err)
+
+			if attempt < maxAttempts {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return llm.EmbeddingResponse{}, ctx.Err()
+				}
+				delay *= 2
+			}
+		}
+	}
+	return llm.EmbeddingResponse{}, fmt.Errorf("all targets of route %s failed: %w", c.route.Model, lastErr)
+}
+
+// streamAttempt streams the request from one client, it returns whether any chunk has been forwarded,
+// the estimated completion tokens and the final error of the stream, which is io.EOF on success.
+func streamAttempt(ctx context.Context, cli *llm.LLM, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, firstTokenTimeout time.Duration) (bool, int, error) {
+	attemptCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	innerDataChan := make(chan llm.ChatCompletionStreamResponse)
+	// buffered so the provider can always hand over its final error
+	innerErrChan := make(chan error, 1)
+	go cli.CreateChatCompletionStream(attemptCtx, req, innerDataChan, innerErrChan)
+
+	var timeout <-chan time.Time
+	if firstTokenTimeout > 0 {
+		timer := time.NewTimer(firstTokenTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	started := false
+	tokens := 0
+	for {
+		select {
+		case data := <-innerDataChan:
+			started = true
+			timeout = nil
+			for _, choice := range data.Choices {
+				tokens += llm.CountTokens(req.Model, choice.Delta.Content)
+				for _, call := range choice.Delta.ToolCalls {
+					tokens += llm.CountTokens(req.Model, call.Function.Arguments)
+				}
+			}
+			dataChan <- data
+		case err := <-innerErrChan:
+			return started, tokens, err
+		case <-timeout:
+			go drain(innerDataChan, innerErrChan)
+			return false, tokens, ErrFirstTokenTimeout
+		case <-ctx.Done():
+			go drain(innerDataChan, innerErrChan)
+			return started, tokens, ctx.Err()
+		}
+	}
+}
+
+func drain(dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+	timeout := time.After(drainTimeout)
+	for {
+		select {
+		case <-dataChan:
+		case <-errChan:
+			return
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// isRetryable reports whether a failed request should be sent to the next attempt.
+// Throttling, server errors, network errors, timeouts and interrupted streams are retried. The other errors,
+// like bad requests, blocked prompts or requests which can not be built, would fail on every target.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, llm.ErrContentFilter) {
+		return false
+	}
+	var apiErr *llm.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, ErrFirstTokenTimeout) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, llm.ErrStreamInterrupted)
+}
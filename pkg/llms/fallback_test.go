@@ -0,0 +1,182 @@
+package llms
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClient streams content, or fails with err before the first token, or with streamErr after it.
+type fakeClient struct {
+	content   string
+	err       error
+	streamErr error
+	calls     int
+	models    []string
+}
+
+func (c *fakeClient) ListModels() []string {
+	return nil
+}
+
+func (c *fakeClient) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+	c.calls++
+	c.models = append(c.models, req.Model)
+	if c.err != nil {
+		errChan <- c.err
+		return
+	}
+	dataChan <- llm.ChatCompletionStreamResponse{
+		Choices: []llm.ChatCompletionStreamChoice{{Delta: llm.ChatCompletionStreamChoiceDelta{Content: c.content}}},
+	}
+	if c.streamErr != nil {
+		errChan <- c.streamErr
+		return
+	}
+	errChan <- io.EOF
+}
+
+func newTestFallback(t *testing.T, route llm.Route, clients map[string]*fakeClient) *llm.LLM {
+	providers := make(map[string]*llm.LLM)
+	breakers := make(map[string]*circuitBreaker)
+	for name, cli := range clients {
+		providers[name] = llm.New(llm.NewMemoryDao(), cli)
+		breakers[name] = newCircuitBreaker()
+	}
+	cli, err := newFallbackClient(route, providers, breakers)
+	assert.NoError(t, err)
+	return llm.New(llm.NewMemoryDao(), cli)
+}
+
+func TestFallbackClient(t *testing.T) {
+	azure := &fakeClient{err: llm.NewAPIError(http.StatusTooManyRequests, "throttled")}
+	openai := &fakeClient{content: "hello"}
+	route := llm.Route{Model: "gpt-4", Targets: []string{"azure", "openai/gpt-4-turbo"}, MaxAttempts: 2, Backoff: time.Millisecond}
+	svc := newTestFallback(t, route, map[string]*fakeClient{"azure": azure, "openai": openai})
+
+	resp, err := svc.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{Model: "gpt-4"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", resp.Choices[0].Message.Content)
+	assert.Equal(t, 2, azure.calls)
+	assert.Equal(t, []string{"gpt-4-turbo"}, openai.models)
+}
+
+func TestFallbackClientNotRetryable(t *testing.T) {
+	azure := &fakeClient{err: llm.NewAPIError(http.StatusBadRequest, "bad request")}
+	openai := &fakeClient{content: "hello"}
+	route := llm.Route{Model: "gpt-4", Targets: []string{"azure", "openai"}}
+	svc := newTestFallback(t, route, map[string]*fakeClient{"azure": azure, "openai": openai})
+
+	_, err := svc.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{Model: "gpt-4"})
+	var apiErr *llm.APIError
+	assert.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, 0, openai.calls)
+}
+
+func TestFallbackClientInvalidRequest(t *testing.T) {
+	azure := &fakeClient{err: llm.ErrImageURLNotAllowed}
+	openai := &fakeClient{content: "hello"}
+	route := llm.Route{Model: "gpt-4", Targets: []string{"azure", "openai"}, MaxAttempts: 2}
+	svc := newTestFallback(t, route, map[string]*fakeClient{"azure": azure, "openai": openai})
+
+	_, err := svc.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{Model: "gpt-4"})
+	assert.ErrorIs(t, err, llm.ErrImageURLNotAllowed)
+	assert.Equal(t, 1, azure.calls)
+	assert.Equal(t, 0, openai.calls)
+}
+
+func TestFallbackClientCircuitBreaker(t *testing.T) {
+	azure := &fakeClient{err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}
+	openai := &fakeClient{content: "hello"}
+	route := llm.Route{Model: "gpt-4", Targets: []string{"azure", "openai"}}
+	svc := newTestFallback(t, route, map[string]*fakeClient{"azure": azure, "openai": openai})
+
+	for i := 0; i < breakerThreshold+3; i++ {
+		_, err := svc.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{Model: "gpt-4"})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, breakerThreshold, azure.calls)
+	assert.Equal(t, breakerThreshold+3, openai.calls)
+}
+
+// stallClient streams one chunk, then cancels the request like a client which disconnects.
+type stallClient struct {
+	cancel context.CancelFunc
+}
+
+func (c *stallClient) ListModels() []string {
+	return nil
+}
+
+func (c *stallClient) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+	dataChan <- llm.ChatCompletionStreamResponse{
+		Choices: []llm.ChatCompletionStreamChoice{{Delta: llm.ChatCompletionStreamChoiceDelta{Content: "partial"}}},
+	}
+	c.cancel()
+	<-ctx.Done()
+	errChan <- ctx.Err()
+}
+
+// halfOpen returns a breaker whose cooldown has passed, the next request is its probe.
+func halfOpen() *circuitBreaker {
+	breaker := newCircuitBreaker()
+	breaker.failures = breaker.threshold
+	breaker.openedAt = time.Now().Add(-breaker.cooldown - time.Second)
+	return breaker
+}
+
+func TestFallbackClientProbeFailsMidStream(t *testing.T) {
+	azure := &fakeClient{content: "partial", streamErr: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}
+	breaker := halfOpen()
+	route := llm.Route{Model: "gpt-4", Targets: []string{"azure"}}
+	cli, err := newFallbackClient(route, map[string]*llm.LLM{"azure": llm.New(llm.NewMemoryDao(), azure)}, map[string]*circuitBreaker{"azure": breaker})
+	assert.NoError(t, err)
+	svc := llm.New(llm.NewMemoryDao(), cli)
+
+	_, err = svc.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{Model: "gpt-4"})
+	assert.Error(t, err)
+	// the failed probe opens the breaker again, instead of leaving it half-open with the probe in flight
+	assert.Equal(t, BreakerStateOpen, breaker.State())
+	assert.False(t, breaker.probing)
+
+	// after the next cooldown a new probe is let through, and closes the breaker
+	breaker.openedAt = time.Now().Add(-breaker.cooldown - time.Second)
+	azure.streamErr = nil
+	resp, err := svc.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{Model: "gpt-4"})
+	assert.NoError(t, err)
+	assert.Equal(t, "partial", resp.Choices[0].Message.Content)
+	assert.Equal(t, BreakerStateClosed, breaker.State())
+}
+
+func TestFallbackClientProbeCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	breaker := halfOpen()
+	route := llm.Route{Model: "gpt-4", Targets: []string{"azure"}}
+	cli, err := newFallbackClient(route, map[string]*llm.LLM{"azure": llm.New(llm.NewMemoryDao(), &stallClient{cancel: cancel})}, map[string]*circuitBreaker{"azure": breaker})
+	assert.NoError(t, err)
+
+	dataChan := make(chan llm.ChatCompletionStreamResponse)
+	errChan := make(chan error)
+	go cli.CreateChatCompletionStream(ctx, llm.ChatCompletionRequest{Model: "gpt-4"}, dataChan, errChan)
+	for done := false; !done; {
+		select {
+		case <-dataChan:
+		case err := <-errChan:
+			assert.ErrorIs(t, err, context.Canceled)
+			done = true
+		}
+	}
+	// a canceled probe counts neither way, the next request probes again
+	assert.False(t, breaker.probing)
+	assert.Equal(t, BreakerStateHalfOpen, breaker.State())
+	assert.True(t, breaker.Allow())
+}
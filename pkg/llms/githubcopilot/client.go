@@ -35,6 +35,11 @@ func NewClient(apiKey string) *Client {
 	}
 }
 
+// Close releases the connections of the session, the registry calls it when the client is replaced.
+func (c *Client) Close() error {
+	return c.session.Close()
+}
+
 func (c *Client) ListModels() []string {
 	return []string{"gpt-3.5-turbo", "gpt-4"}
 }
@@ -63,7 +68,7 @@ func (c *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCom
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		errChan <- fmt.Errorf("copilot response error: %s", resp.Status)
+		errChan <- llm.NewAPIError(resp.StatusCode, fmt.Sprintf("copilot response error: %s", resp.Status))
 		return
 	}
 
@@ -12,6 +12,8 @@ type Request struct {
 	Intent        bool                        `json:"intent"`
 	OneTimeReturn bool                        `json:"one_time_return"`
 	MaxTokens     int                         `json:"max_tokens,omitempty"`
+	Tools         []llm.Tool                  `json:"tools,omitempty"`
+	ToolChoice    any                         `json:"tool_choice,omitempty"`
 }
 
 func (r *Request) FromChatCompletionRequest(req llm.ChatCompletionRequest) {
@@ -24,4 +26,8 @@ func (r *Request) FromChatCompletionRequest(req llm.ChatCompletionRequest) {
 	r.Intent = true
 	r.OneTimeReturn = true
 	r.MaxTokens = 2048
+	if tools := req.GetTools(); len(tools) > 0 {
+		r.Tools = tools
+		r.ToolChoice = req.ToolChoice
+	}
 }
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"sort"
 
 	"github.com/Vaayne/aienvoy/pkg/llms/llm"
 )
@@ -15,67 +17,152 @@ import (
 const defaultHost = "https://generativelanguage.googleapis.com"
 
 type Client struct {
-	sess   *http.Client
-	apiKey string
+	sess           *http.Client
+	host           string
+	apiKey         string
+	safetySettings []SafetySetting
 }
 
-func NewClient(apiKey string) *Client {
-	return &Client{
+type ClientOption func(*Client)
+
+// WithSafetySettings sets the block threshold of the harm categories, by their full name like HARM_CATEGORY_DANGEROUS_CONTENT.
+func WithSafetySettings(thresholds map[string]string) ClientOption {
+	return func(c *Client) {
+		c.safetySettings = make([]SafetySetting, 0, len(thresholds))
+		for category, threshold := range thresholds {
+			c.safetySettings = append(c.safetySettings, SafetySetting{Category: category, Threshold: threshold})
+		}
+		sort.Slice(c.safetySettings, func(i, j int) bool {
+			return c.safetySettings[i].Category < c.safetySettings[j].Category
+		})
+	}
+}
+
+func NewClient(apiKey string, opts ...ClientOption) *Client {
+	c := &Client{
 		sess:   http.DefaultClient,
+		host:   defaultHost,
 		apiKey: apiKey,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 func (c *Client) ListModels() []string {
-	return []string{llm.GoogleAIModelGeminiPro, llm.GoogleAIModelGeminiProV}
+	return []string{
+		llm.GoogleAIModelGeminiPro, llm.GoogleAIModelGeminiProV,
+		llm.GoogleAIModelGemini15Pro, llm.GoogleAIModelGemini15Flash,
+		llm.GoogleAIModelEmbedding001,
+	}
 }
 
-func (p *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+// CreateChatCompletionStream streams the answer with streamGenerateContent, a blocked prompt fails with a llm.ContentFilterError.
+func (c *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+	req, err := llm.InlineImages(ctx, req)
+	if err != nil {
+		errChan <- fmt.Errorf("inline images error: %w", err)
+		return
+	}
 	reqBody := ChatRequest{}.FromChatCompletionRequest(req)
-	slog.Info("request body", "model", req.Model, "modelId", req.ModelId())
-	chatResp, err := p.post(req.ModelId(), reqBody, true)
+	reqBody.SafetySettings = c.safetySettings
+	slog.InfoContext(ctx, "chat with google ai stream start", "model", req.Model, "modelId", req.ModelId())
+
+	resp, err := c.request(ctx, req.ModelId(), "streamGenerateContent", "&alt=sse", reqBody)
 	if err != nil {
 		errChan <- fmt.Errorf("chat with %s error: %w", req.ModelId(), err)
 		return
 	}
-	dataChan <- chatResp.ToChatCompletionStreamResponse()
-	errChan <- io.EOF
+	defer resp.Body.Close()
+
+	innerDataChan := make(chan ChatResponse)
+	innerErrChan := make(chan error)
+	go llm.ParseSSE(resp.Body, innerDataChan, innerErrChan)
+
+	decoder := NewStreamDecoder()
+	for {
+		select {
+		case chunk := <-innerDataChan:
+			data, err := decoder.Decode(chunk)
+			if err != nil {
+				slog.WarnContext(ctx, "google ai blocked the prompt", "model", req.ModelId(), "err", err)
+				errChan <- err
+				// drain the parser, which is blocked on the next chunk otherwise
+				go drain(innerDataChan, innerErrChan)
+				return
+			}
+			if len(data.Choices) > 0 {
+				dataChan <- data
+			}
+		case err := <-innerErrChan:
+			if !errors.Is(err, io.EOF) {
+				errChan <- fmt.Errorf("chat with %s error: %w", req.ModelId(), err)
+				return
+			}
+			if req.IncludeUsage() {
+				dataChan <- decoder.Usage()
+			}
+			errChan <- io.EOF
+			return
+		case <-ctx.Done():
+			errChan <- ctx.Err()
+			go drain(innerDataChan, innerErrChan)
+			return
+		}
+	}
 }
 
-func (c *Client) post(model string, body ChatRequest, stream bool) (ChatResponse, error) {
-	respBody := ChatResponse{}
+// drain discards the chunks of a stream which is no longer read, until it ends.
+func drain(dataChan chan ChatResponse, errChan chan error) {
+	for {
+		select {
+		case <-dataChan:
+		case <-errChan:
+			return
+		}
+	}
+}
 
+// do calls an action of the model, and decodes the response into out.
+func (c *Client) do(ctx context.Context, model, action string, body, out any) error {
+	resp, err := c.request(ctx, model, action, "", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response error: %w", err)
+	}
+	return nil
+}
+
+// request posts the body to an action of the model, the response is returned only when its status is ok.
+func (c *Client) request(ctx context.Context, model, action, query string, body any) (*http.Response, error) {
 	reqBody, err := json.Marshal(body)
 	if err != nil {
-		return respBody, fmt.Errorf("marshal request body error: %w", err)
+		return nil, fmt.Errorf("marshal request body error: %w", err)
 	}
 	slog.Debug("request body", "body", string(reqBody))
-	action := "generateContent"
-	// if stream {
-	// 	action = "streamGenerateContent"
-	// }
-	url := fmt.Sprintf("%s/v1beta/models/%s:%s?key=%s", defaultHost, model, action, c.apiKey)
-	req, err := http.NewRequest("POST", url, bytes.NewReader(reqBody))
+	url := fmt.Sprintf("%s/v1beta/models/%s:%s?key=%s%s", c.host, model, action, c.apiKey, query)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
 	if err != nil {
-		return respBody, fmt.Errorf("create request error: %w", err)
+		return nil, fmt.Errorf("create request error: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := c.sess.Do(req)
 	if err != nil {
-		return respBody, fmt.Errorf("send request error: %w", err)
+		return nil, fmt.Errorf("send request error: %w", err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
 		var data any
 		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-			return respBody, fmt.Errorf("decode response error: %w", err)
+			return nil, llm.NewAPIError(resp.StatusCode, resp.Status)
 		}
-		return respBody, fmt.Errorf("response status code %d, error: %s", resp.StatusCode, data)
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
-		return respBody, fmt.Errorf("decode response error: %w", err)
+		return nil, llm.NewAPIError(resp.StatusCode, fmt.Sprintf("%v", data))
 	}
-	return respBody, nil
+	return resp, nil
 }
@@ -0,0 +1,100 @@
+package googleai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient returns a client of a stand-in of streamGenerateContent, which checks the request and replies with the chunks.
+func newTestClient(t *testing.T, cfg llm.GoogleAIConfig, check func(req ChatRequest), chunks ...string) *llm.LLM {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1beta/models/gemini-1.5-flash-latest:streamGenerateContent", r.URL.Path)
+		assert.Equal(t, "sse", r.URL.Query().Get("alt"))
+		assert.Equal(t, "test-key", r.URL.Query().Get("key"))
+		var req ChatRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if check != nil {
+			check(req)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range chunks {
+			fmt.Fprintf(w, "data: %s\r\n\r\n", chunk)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient("test-key", WithSafetySettings(cfg.HarmThresholds()))
+	client.host = server.URL
+	return llm.New(llm.NewMemoryDao(), client)
+}
+
+func TestCreateChatCompletion(t *testing.T) {
+	cfg := llm.GoogleAIConfig{SafetySettings: map[string]string{"harassment": "block_none", "HARM_CATEGORY_DANGEROUS_CONTENT": "BLOCK_ONLY_HIGH"}}
+	l := newTestClient(t, cfg, func(req ChatRequest) {
+		assert.Equal(t, []SafetySetting{
+			{Category: "HARM_CATEGORY_DANGEROUS_CONTENT", Threshold: "BLOCK_ONLY_HIGH"},
+			{Category: "HARM_CATEGORY_HARASSMENT", Threshold: "BLOCK_NONE"},
+		}, req.SafetySettings)
+		require.NotNil(t, req.SystemInstruction)
+		assert.Equal(t, "Be brief.", req.SystemInstruction.Parts[0].Text)
+	},
+		`{"candidates":[{"content":{"parts":[{"text":"Hello"}],"role":"model"},"index":0}],"usageMetadata":{"promptTokenCount":8,"candidatesTokenCount":1,"totalTokenCount":9}}`,
+		`{"candidates":[{"content":{"parts":[{"text":" world"}],"role":"model"},"finishReason":"STOP","index":0}],"usageMetadata":{"promptTokenCount":8,"candidatesTokenCount":2,"totalTokenCount":10}}`,
+	)
+
+	resp, err := l.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{
+		Model: "google-ai/" + llm.GoogleAIModelGemini15Flash,
+		Messages: []llm.ChatCompletionMessage{
+			{Role: llm.ChatMessageRoleSystem, Content: "Be brief."},
+			{Role: llm.ChatMessageRoleUser, Content: "hi"},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Hello world", resp.Choices[0].Message.Content)
+	assert.Equal(t, llm.FinishReasonStop, resp.Choices[0].FinishReason)
+	assert.Equal(t, llm.NewUsage(8, 2), resp.Usage)
+}
+
+func TestCreateChatCompletionBlocked(t *testing.T) {
+	l := newTestClient(t, llm.GoogleAIConfig{}, func(req ChatRequest) {
+		assert.Empty(t, req.SafetySettings)
+	},
+		`{"promptFeedback":{"blockReason":"SAFETY","safetyRatings":[{"category":"HARM_CATEGORY_HARASSMENT","probability":"NEGLIGIBLE"},{"category":"HARM_CATEGORY_DANGEROUS_CONTENT","probability":"HIGH"}]}}`,
+	)
+
+	_, err := l.CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{
+		Model:    llm.GoogleAIModelGemini15Flash,
+		Messages: []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: "something dangerous"}},
+	})
+	require.ErrorIs(t, err, llm.ErrContentFilter)
+	var filterErr *llm.ContentFilterError
+	require.ErrorAs(t, err, &filterErr)
+	assert.Equal(t, "SAFETY", filterErr.Reason)
+	assert.Equal(t, []string{"HARM_CATEGORY_DANGEROUS_CONTENT"}, filterErr.Categories)
+}
+
+func TestCreateEmbeddingsCanceled(t *testing.T) {
+	// the server answers only after the test ends, the client must give up on its own
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+	client := NewClient("test-key")
+	client.host = server.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := client.CreateEmbeddings(ctx, llm.EmbeddingRequest{Model: "text-embedding-004", Input: []string{"hi"}})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
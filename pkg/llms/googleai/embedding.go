@@ -0,0 +1,59 @@
+package googleai
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+// maxEmbeddingInputs is the limit of requests of one batchEmbedContents call
+const maxEmbeddingInputs = 100
+
+// EmbedContent is the content to embed, unlike a chat message it has no role.
+type EmbedContent struct {
+	Parts []ChatMessagePart `json:"parts"`
+}
+
+type EmbedContentRequest struct {
+	Model                string       `json:"model"`
+	Content              EmbedContent `json:"content"`
+	OutputDimensionality int          `json:"outputDimensionality,omitempty"`
+}
+
+type BatchEmbedContentsRequest struct {
+	Requests []EmbedContentRequest `json:"requests"`
+}
+
+type ContentEmbedding struct {
+	Values []float32 `json:"values"`
+}
+
+type BatchEmbedContentsResponse struct {
+	Embeddings []ContentEmbedding `json:"embeddings"`
+}
+
+// CreateEmbeddings embeds the inputs with embedContent, in batches of batchEmbedContents.
+func (c *Client) CreateEmbeddings(ctx context.Context, req llm.EmbeddingRequest) (llm.EmbeddingResponse, error) {
+	return llm.CreateEmbeddingsInBatches(ctx, req, maxEmbeddingInputs, func(ctx context.Context, req llm.EmbeddingRequest, inputs []string) (llm.EmbeddingResponse, error) {
+		model := fmt.Sprintf("models/%s", req.ModelId())
+		body := BatchEmbedContentsRequest{Requests: make([]EmbedContentRequest, 0, len(inputs))}
+		for _, input := range inputs {
+			body.Requests = append(body.Requests, EmbedContentRequest{
+				Model:                model,
+				Content:              EmbedContent{Parts: []ChatMessagePart{{Text: input}}},
+				OutputDimensionality: req.Dimensions,
+			})
+		}
+		var resp BatchEmbedContentsResponse
+		if err := c.do(ctx, req.ModelId(), "batchEmbedContents", body, &resp); err != nil {
+			return llm.EmbeddingResponse{}, fmt.Errorf("embed with %s error: %w", req.ModelId(), err)
+		}
+		embeddings := make([]llm.Embedding, 0, len(resp.Embeddings))
+		for i, embedding := range resp.Embeddings {
+			embeddings = append(embeddings, llm.Embedding{Embedding: embedding.Values, Index: i})
+		}
+		// gemini does not report the usage, it is estimated by the caller
+		return llm.EmbeddingResponse{Data: embeddings}, nil
+	})
+}
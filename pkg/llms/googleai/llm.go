@@ -10,5 +10,5 @@ func New(cfg llm.Config, dao llm.Dao) (GoogleAI, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
-	return llm.New(dao, NewClient(cfg.ApiKey)), nil
+	return llm.New(dao, NewClient(cfg.ApiKey, WithSafetySettings(cfg.GoogleAI.HarmThresholds()))), nil
 }
@@ -1,7 +1,9 @@
 package googleai
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/Vaayne/aienvoy/pkg/llms/llm"
@@ -9,11 +11,63 @@ import (
 )
 
 type ChatMessagePart struct {
-	Text string `json:"text"`
+	Text             string            `json:"text"`
+	InlineData       *InlineData       `json:"inline_data,omitempty"`
+	FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+}
+
+// MarshalJSON omits the text of data parts, gemini only accepts one kind of data per part.
+func (p ChatMessagePart) MarshalJSON() ([]byte, error) {
+	type part ChatMessagePart
+	if p.InlineData == nil && p.FunctionCall == nil && p.FunctionResponse == nil {
+		return json.Marshal(part(p))
+	}
+	return json.Marshal(struct {
+		InlineData       *InlineData       `json:"inline_data,omitempty"`
+		FunctionCall     *FunctionCall     `json:"functionCall,omitempty"`
+		FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+	}{p.InlineData, p.FunctionCall, p.FunctionResponse})
+}
+
+// InlineData is an image embedded in the request, Data is base64 encoded.
+type InlineData struct {
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data"`
+}
+
+type FunctionCall struct {
+	Name string         `json:"name"`
+	Args map[string]any `json:"args"`
+}
+
+type FunctionResponse struct {
+	Name     string         `json:"name"`
+	Response map[string]any `json:"response"`
+}
+
+type FunctionDeclaration struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Parameters  any    `json:"parameters,omitempty"`
+}
+
+type Tool struct {
+	FunctionDeclarations []FunctionDeclaration `json:"functionDeclarations"`
+}
+
+type FunctionCallingConfig struct {
+	Mode                 string   `json:"mode"`
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+type ToolConfig struct {
+	FunctionCallingConfig FunctionCallingConfig `json:"functionCallingConfig"`
 }
 
 type ChatMessage struct {
-	Role  string            `json:"role"`
+	// Role is user, model or function, the system instruction has none
+	Role  string            `json:"role,omitempty"`
 	Parts []ChatMessagePart `json:"parts"`
 }
 
@@ -22,135 +76,363 @@ type SafetySetting struct {
 	Threshold string `json:"threshold"`
 }
 
+// SafetyRating is the probability of harm of a category in the prompt or in a candidate.
+type SafetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability"`
+	Blocked     bool   `json:"blocked,omitempty"`
+}
+
 type GenerationConfig struct {
-	Stop        []string `json:"stopSequences"`
-	Temperature float32  `json:"temperature"`
-	MaxTokens   int      `json:"maxOutputTokens"`
-	TopP        float32  `json:"topP"`
-	TopK        int      `json:"topK"`
+	Stop        []string `json:"stopSequences,omitempty"`
+	Temperature *float32 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"maxOutputTokens,omitempty"`
+	TopP        float32  `json:"topP,omitempty"`
+	// CandidateCount is the number of choices, the n of the request
+	CandidateCount int `json:"candidateCount,omitempty"`
 }
 
 type ChatRequest struct {
-	Contents         []ChatMessage    `json:"contents"`
-	SafetySettings   []SafetySetting  `json:"safetySettings"`
-	GenerationConfig GenerationConfig `json:"generationConfig"`
+	Contents          []ChatMessage    `json:"contents"`
+	SystemInstruction *ChatMessage     `json:"systemInstruction,omitempty"`
+	SafetySettings    []SafetySetting  `json:"safetySettings,omitempty"`
+	GenerationConfig  GenerationConfig `json:"generationConfig"`
+	Tools             []Tool           `json:"tools,omitempty"`
+	ToolConfig        *ToolConfig      `json:"toolConfig,omitempty"`
+}
+
+// supportsSystemInstruction reports whether the model takes a system instruction, the gemini 1.0 models do not.
+func supportsSystemInstruction(model string) bool {
+	return !strings.HasPrefix(model, "gemini-1.0") && !strings.HasPrefix(model, "gemini-pro")
 }
 
 func (r ChatRequest) FromChatCompletionRequest(req llm.ChatCompletionRequest) ChatRequest {
 	contents := make([]ChatMessage, 0, len(req.Messages))
-	lastRole := ""
+	system := make([]ChatMessagePart, 0)
+	// add appends the parts to the last message when it has the same role, gemini wants the roles to alternate
+	add := func(role string, parts ...ChatMessagePart) {
+		if n := len(contents); n > 0 && contents[n-1].Role == role {
+			contents[n-1].Parts = append(contents[n-1].Parts, parts...)
+			return
+		}
+		contents = append(contents, ChatMessage{Role: role, Parts: parts})
+	}
+	// tool call id to function name, tool results only carry the id
+	toolNames := make(map[string]string)
 	for _, message := range req.Messages {
-		role := message.Role
-		if role == llm.ChatMessageRoleAssistant {
-			role = "model"
-		} else if role == llm.ChatMessageRoleSystem {
-			role = "user"
+		switch message.Role {
+		case llm.ChatMessageRoleSystem:
+			system = append(system, toParts(message)...)
+		case llm.ChatMessageRoleTool, llm.ChatMessageRoleFunction:
+			name := message.Name
+			if name == "" {
+				name = toolNames[message.ToolCallID]
+			}
+			// parallel tool results are sent back in one function turn
+			add("function", ChatMessagePart{FunctionResponse: &FunctionResponse{Name: name, Response: toFunctionResponse(message.Content)}})
+		case llm.ChatMessageRoleAssistant:
+			parts := make([]ChatMessagePart, 0, len(message.ToolCalls)+1)
+			toolCalls := message.ToolCalls
+			if message.FunctionCall != nil {
+				toolCalls = append(toolCalls, llm.ToolCall{Type: llm.ToolTypeFunction, Function: *message.FunctionCall})
+			}
+			if message.Content != "" || len(toolCalls) == 0 {
+				parts = append(parts, ChatMessagePart{Text: message.Content})
+			}
+			for _, call := range toolCalls {
+				toolNames[call.ID] = call.Function.Name
+				parts = append(parts, ChatMessagePart{FunctionCall: &FunctionCall{Name: call.Function.Name, Args: toFunctionArgs(call.Function.Arguments)}})
+			}
+			add("model", parts...)
+		default:
+			add("user", toParts(message)...)
 		}
+	}
 
-		if lastRole == "user" && role == "user" {
-			contents = append(contents, ChatMessage{
-				Role:  "model",
-				Parts: []ChatMessagePart{{Text: ""}},
-			})
+	var systemInstruction *ChatMessage
+	if len(system) > 0 {
+		if supportsSystemInstruction(req.ModelId()) {
+			systemInstruction = &ChatMessage{Parts: system}
+		} else if len(contents) > 0 && contents[0].Role == "user" {
+			// the older models get the system prompt at the beginning of the first user turn
+			contents[0].Parts = append(system, contents[0].Parts...)
+		} else {
+			contents = append([]ChatMessage{{Role: "user", Parts: system}}, contents...)
 		}
+	}
+
+	generationConfig := GenerationConfig{
+		Stop:        req.Stop,
+		Temperature: req.TemperatureParam(),
+		TopP:        req.TopP,
+		MaxTokens:   req.MaxTokens,
+		// the candidates are returned as the choices, by their index
+		CandidateCount: req.N,
+	}
+
+	tools, toolConfig := toTools(req)
+
+	return ChatRequest{
+		Contents:          contents,
+		SystemInstruction: systemInstruction,
+		GenerationConfig:  generationConfig,
+		Tools:             tools,
+		ToolConfig:        toolConfig,
+	}
+}
 
-		contents = append(contents, ChatMessage{
-			Role:  role,
-			Parts: []ChatMessagePart{{Text: message.Content}},
+func toTools(req llm.ChatCompletionRequest) ([]Tool, *ToolConfig) {
+	reqTools := req.GetTools()
+	if len(reqTools) == 0 {
+		return nil, nil
+	}
+	declarations := make([]FunctionDeclaration, 0, len(reqTools))
+	for _, tool := range reqTools {
+		if tool.Function == nil {
+			continue
+		}
+		declarations = append(declarations, FunctionDeclaration{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  tool.Function.Parameters,
 		})
-		lastRole = role
 	}
 
-	safetySettings := []SafetySetting{
-		{
-			Category:  "HARM_CATEGORY_DANGEROUS_CONTENT",
-			Threshold: "BLOCK_ONLY_HIGH",
-		},
+	mode, name := req.GetToolChoice()
+	config := FunctionCallingConfig{}
+	switch mode {
+	case llm.ToolChoiceNone:
+		config.Mode = "NONE"
+	case llm.ToolChoiceRequired:
+		config.Mode = "ANY"
+		if name != "" {
+			config.AllowedFunctionNames = []string{name}
+		}
+	default:
+		config.Mode = "AUTO"
 	}
+	return []Tool{{FunctionDeclarations: declarations}}, &ToolConfig{FunctionCallingConfig: config}
+}
 
-	topK := req.N
-	if topK <= 0 {
-		topK = 10
+func toParts(message llm.ChatCompletionMessage) []ChatMessagePart {
+	if len(message.MultiContent) == 0 {
+		return []ChatMessagePart{{Text: message.Content}}
 	}
+	parts := make([]ChatMessagePart, 0, len(message.MultiContent))
+	for _, part := range message.MultiContent {
+		switch part.Type {
+		case llm.ChatMessagePartTypeText:
+			parts = append(parts, ChatMessagePart{Text: part.Text})
+		case llm.ChatMessagePartTypeImageURL:
+			mimeType, data, ok := llm.ImagePart(part)
+			if !ok {
+				continue
+			}
+			parts = append(parts, ChatMessagePart{InlineData: &InlineData{MimeType: mimeType, Data: data}})
+		}
+	}
+	return parts
+}
 
-	if req.MaxTokens == 0 {
-		req.MaxTokens = 1024
-	} else if req.MaxTokens > 2048 {
-		req.MaxTokens = 2048
+func toFunctionArgs(arguments string) map[string]any {
+	args := make(map[string]any)
+	if arguments != "" {
+		_ = json.Unmarshal([]byte(arguments), &args)
 	}
+	return args
+}
 
-	generationConfig := GenerationConfig{
-		Stop:        req.Stop,
-		Temperature: req.Temperature,
-		TopP:        req.TopP,
-		TopK:        topK,
-		MaxTokens:   req.MaxTokens,
+// toFunctionResponse wraps tool results which are not a json object, gemini requires an object.
+func toFunctionResponse(content string) map[string]any {
+	var resp map[string]any
+	if err := json.Unmarshal([]byte(content), &resp); err != nil || resp == nil {
+		return map[string]any{"content": content}
 	}
+	return resp
+}
 
-	return ChatRequest{
-		Contents:         contents,
-		SafetySettings:   safetySettings,
-		GenerationConfig: generationConfig,
+// toToolCalls returns the function calls of the parts, numbered from offset.
+func toToolCalls(parts []ChatMessagePart, offset int) []llm.ToolCall {
+	var toolCalls []llm.ToolCall
+	for _, part := range parts {
+		if part.FunctionCall == nil {
+			continue
+		}
+		args, _ := json.Marshal(part.FunctionCall.Args)
+		index := offset + len(toolCalls)
+		toolCalls = append(toolCalls, llm.ToolCall{
+			Index: &index,
+			ID:    fmt.Sprintf("call_%s", uuid.New().String()),
+			Type:  llm.ToolTypeFunction,
+			Function: llm.FunctionCall{
+				Name:      part.FunctionCall.Name,
+				Arguments: string(args),
+			},
+		})
 	}
+	return toolCalls
 }
 
+func toText(parts []ChatMessagePart) string {
+	text := ""
+	for _, part := range parts {
+		text += part.Text
+	}
+	return text
+}
+
+func toFinishReason(reason string, hasToolCalls bool) llm.FinishReason {
+	if hasToolCalls {
+		return llm.FinishReasonToolCalls
+	}
+	switch reason {
+	case "STOP":
+		return llm.FinishReasonStop
+	case "MAX_TOKENS":
+		return llm.FinishReasonLength
+	case "SAFETY", "RECITATION":
+		return llm.FinishReasonContentFilter
+	default:
+		return llm.FinishReason(reason)
+	}
+}
+
+// PromptFeedback tells why the prompt was blocked, the response has no candidates then.
 type PromptFeedback struct {
-	SafetySettings []SafetySetting `json:"safetySettings"`
+	BlockReason   string         `json:"blockReason,omitempty"`
+	SafetyRatings []SafetyRating `json:"safetyRatings,omitempty"`
+}
+
+// Err returns the content filter error of a blocked prompt, nil when the prompt was not blocked.
+func (f PromptFeedback) Err() error {
+	if f.BlockReason == "" {
+		return nil
+	}
+	categories := make([]string, 0)
+	for _, rating := range f.SafetyRatings {
+		if rating.Blocked || rating.Probability == "HIGH" || rating.Probability == "MEDIUM" {
+			categories = append(categories, rating.Category)
+		}
+	}
+	return &llm.ContentFilterError{Reason: f.BlockReason, Categories: categories}
+}
+
+type UsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+func (m *UsageMetadata) ToUsage() *llm.Usage {
+	if m == nil {
+		return nil
+	}
+	usage := llm.NewUsage(m.PromptTokenCount, m.CandidatesTokenCount)
+	return &usage
 }
 
 type ChatResponseCandidate struct {
-	Index          int             `json:"index"`
-	Content        ChatMessage     `json:"content"`
-	FinishReason   string          `json:"finishReason"`
-	SafetySettings []SafetySetting `json:"safetySettings"`
+	Index         int            `json:"index"`
+	Content       ChatMessage    `json:"content"`
+	FinishReason  string         `json:"finishReason"`
+	SafetyRatings []SafetyRating `json:"safetyRatings"`
 }
 
 type ChatResponse struct {
 	Candidates     []ChatResponseCandidate `json:"candidates"`
 	PromptFeedback PromptFeedback          `json:"promptFeedback"`
+	UsageMetadata  *UsageMetadata          `json:"usageMetadata,omitempty"`
 }
 
 func (r ChatResponse) ToChatCompletionResponse() llm.ChatCompletionResponse {
 	choices := make([]llm.ChatCompletionChoice, 0, len(r.Candidates))
 	for _, candidate := range r.Candidates {
+		toolCalls := toToolCalls(candidate.Content.Parts, 0)
+		for i := range toolCalls {
+			toolCalls[i].Index = nil
+		}
 		choices = append(choices, llm.ChatCompletionChoice{
 			Index: candidate.Index,
 			Message: llm.ChatCompletionMessage{
-				Role:    llm.ChatMessageRoleAssistant,
-				Content: candidate.Content.Parts[0].Text,
+				Role:      llm.ChatMessageRoleAssistant,
+				Content:   toText(candidate.Content.Parts),
+				ToolCalls: toolCalls,
 			},
-			FinishReason: llm.FinishReason(candidate.FinishReason),
+			FinishReason: toFinishReason(candidate.FinishReason, len(toolCalls) > 0),
 		})
 	}
 
-	return llm.ChatCompletionResponse{
+	resp := llm.ChatCompletionResponse{
 		ID:      fmt.Sprintf("chatcmpl-%s", uuid.New().String()),
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
 		Choices: choices,
 	}
+	if usage := r.UsageMetadata.ToUsage(); usage != nil {
+		resp.Usage = *usage
+	}
+	return resp
 }
 
-func (r ChatResponse) ToChatCompletionStreamResponse() llm.ChatCompletionStreamResponse {
+// StreamDecoder converts the chunks of streamGenerateContent into chat completion chunks of one response.
+// Each chunk has the usage so far, the last one is sent in its own chunk once the stream ends.
+type StreamDecoder struct {
+	id      string
+	created int64
+	usage   *llm.Usage
+	// toolCalls counts the tool calls of each candidate, the calls of later chunks are numbered after them
+	toolCalls map[int]int
+}
+
+func NewStreamDecoder() *StreamDecoder {
+	return &StreamDecoder{
+		id:        fmt.Sprintf("chatcmpl-%s", uuid.New().String()),
+		created:   time.Now().Unix(),
+		toolCalls: make(map[int]int),
+	}
+}
+
+// Decode returns the chunk of the response, or the content filter error when the prompt was blocked.
+func (d *StreamDecoder) Decode(r ChatResponse) (llm.ChatCompletionStreamResponse, error) {
+	if err := r.PromptFeedback.Err(); err != nil {
+		return llm.ChatCompletionStreamResponse{}, err
+	}
+	if usage := r.UsageMetadata.ToUsage(); usage != nil {
+		d.usage = usage
+	}
 	choices := make([]llm.ChatCompletionStreamChoice, 0, len(r.Candidates))
 	for _, candidate := range r.Candidates {
-		if len(candidate.Content.Parts) == 0 {
+		if len(candidate.Content.Parts) == 0 && candidate.FinishReason == "" {
 			continue
 		}
+		toolCalls := toToolCalls(candidate.Content.Parts, d.toolCalls[candidate.Index])
+		d.toolCalls[candidate.Index] += len(toolCalls)
 		choices = append(choices, llm.ChatCompletionStreamChoice{
 			Index: candidate.Index,
 			Delta: llm.ChatCompletionStreamChoiceDelta{
-				Role:    llm.ChatMessageRoleAssistant,
-				Content: candidate.Content.Parts[0].Text,
+				Role:      llm.ChatMessageRoleAssistant,
+				Content:   toText(candidate.Content.Parts),
+				ToolCalls: toolCalls,
 			},
-			FinishReason: llm.FinishReason(candidate.FinishReason),
+			FinishReason: toFinishReason(candidate.FinishReason, d.toolCalls[candidate.Index] > 0),
 		})
 	}
 
 	return llm.ChatCompletionStreamResponse{
-		ID:      fmt.Sprintf("chatcmpl-%s", uuid.New().String()),
-		Object:  "chat.completion",
-		Created: time.Now().Unix(),
+		ID:      d.id,
+		Object:  "chat.completion.chunk",
+		Created: d.created,
 		Choices: choices,
+	}, nil
+}
+
+// Usage returns the last chunk of the stream, which has the usage and no choices.
+func (d *StreamDecoder) Usage() llm.ChatCompletionStreamResponse {
+	return llm.ChatCompletionStreamResponse{
+		ID:      d.id,
+		Object:  "chat.completion.chunk",
+		Created: d.created,
+		Choices: []llm.ChatCompletionStreamChoice{},
+		Usage:   d.usage,
 	}
 }
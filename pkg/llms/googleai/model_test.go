@@ -9,39 +9,35 @@ import (
 
 func TestFromChatCompletionRequest(t *testing.T) {
 	req := llm.ChatCompletionRequest{
+		Model: "google-ai/" + llm.GoogleAIModelGemini15Flash,
 		Messages: []llm.ChatCompletionMessage{
 			{Role: llm.ChatMessageRoleSystem, Content: "System message"},
 			{Role: llm.ChatMessageRoleUser, Content: "How are you?"},
 			{Role: llm.ChatMessageRoleAssistant, Content: "I'm fine, thank you."},
 			{Role: llm.ChatMessageRoleUser, Content: "Hello"},
+			{Role: llm.ChatMessageRoleUser, Content: "Anyone there?"},
 		},
 		N:           5,
 		Stop:        []string{"stop"},
 		Temperature: 0.5,
 		TopP:        0.9,
-		MaxTokens:   100,
+		MaxTokens:   4096,
 	}
 
 	expected := ChatRequest{
 		Contents: []ChatMessage{
-			{Role: "user", Parts: []ChatMessagePart{{Text: "System message"}}},
-			{Role: "model", Parts: []ChatMessagePart{{Text: ""}}},
 			{Role: "user", Parts: []ChatMessagePart{{Text: "How are you?"}}},
 			{Role: "model", Parts: []ChatMessagePart{{Text: "I'm fine, thank you."}}},
-			{Role: "user", Parts: []ChatMessagePart{{Text: "Hello"}}},
-		},
-		SafetySettings: []SafetySetting{
-			{
-				Category:  "HARM_CATEGORY_DANGEROUS_CONTENT",
-				Threshold: "BLOCK_ONLY_HIGH",
-			},
+			{Role: "user", Parts: []ChatMessagePart{{Text: "Hello"}, {Text: "Anyone there?"}}},
 		},
+		SystemInstruction: &ChatMessage{Parts: []ChatMessagePart{{Text: "System message"}}},
 		GenerationConfig: GenerationConfig{
 			Stop:        req.Stop,
-			Temperature: req.Temperature,
+			Temperature: req.TemperatureParam(),
 			TopP:        req.TopP,
-			TopK:        5,
 			MaxTokens:   req.MaxTokens,
+			// n is sent as the candidate count
+			CandidateCount: 5,
 		},
 	}
 
@@ -51,4 +47,21 @@ func TestFromChatCompletionRequest(t *testing.T) {
 	if !reflect.DeepEqual(result, expected) {
 		t.Errorf("FromChatCompletionRequest() = %v, want %v", result, expected)
 	}
+
+	// gemini-pro takes no system instruction, the system prompt starts the first user turn
+	req.Model = llm.DefaultGeminiModel
+	expected.Contents[0].Parts = []ChatMessagePart{{Text: "System message"}, {Text: "How are you?"}}
+	expected.SystemInstruction = nil
+	result = r.FromChatCompletionRequest(req)
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("FromChatCompletionRequest() = %v, want %v", result, expected)
+	}
+
+	// an explicit 0 is sent, gemini defaults to a higher temperature
+	req.Temperature, req.TemperatureSet = 0, true
+	result = r.FromChatCompletionRequest(req)
+	if result.GenerationConfig.Temperature == nil || *result.GenerationConfig.Temperature != 0 {
+		t.Errorf("FromChatCompletionRequest() temperature = %v, want 0", result.GenerationConfig.Temperature)
+	}
 }
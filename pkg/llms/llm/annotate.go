@@ -0,0 +1,159 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	titlePrompt = `Write a short title of at most six words for the conversation between a user and an assistant,
+in the language of the conversation. Reply with the title only, without quotes.`
+	// titleInputRunes bounds the part of the first turn sent to title the conversation
+	titleInputRunes = 2000
+	maxTitleRunes   = 80
+)
+
+// Annotator titles the conversations and keeps their running summary, after every new message in the background.
+// A cheap model is enough, the summary is the one used by the RollingSummary history strategy.
+type Annotator struct {
+	// LLM answers the annotation requests
+	LLM *LLM
+	// Model is the model of the annotation requests
+	Model string
+
+	// running has the conversations being annotated, a conversation is annotated once at a time
+	running sync.Map
+}
+
+// annotate annotates the conversation in the background, it keeps the values of ctx like the user but not its deadline,
+// nor its cache status which is the one of the message.
+func (l *LLM) annotate(ctx context.Context, conversationId string) {
+	if l.Annotator == nil {
+		return
+	}
+	go func() {
+		if err := l.Annotate(withoutCacheStatus(context.WithoutCancel(ctx)), conversationId); err != nil {
+			slog.ErrorContext(ctx, "annotate conversation error", "err", err, "conversation_id", conversationId)
+		}
+	}()
+}
+
+// Annotate titles a conversation without a name and folds the turns of its active branch which are not
+// in the summary yet into the summary. It does nothing without an annotator.
+func (l *LLM) Annotate(ctx context.Context, conversationId string) error {
+	a := l.Annotator
+	if a == nil || a.LLM == nil {
+		return nil
+	}
+	if _, running := a.running.LoadOrStore(conversationId, true); running {
+		return nil
+	}
+	defer a.running.Delete(conversationId)
+
+	cov, err := l.dao.GetConversation(ctx, conversationId)
+	if err != nil {
+		return err
+	}
+	messages, err := l.dao.ListMessages(ctx, conversationId, ListOptions{})
+	if err != nil {
+		return err
+	}
+	leaf, err := l.activeLeaf(ctx, cov)
+	if err != nil {
+		return err
+	}
+	_, turns := splitHistory(messagePath(messages, leaf), ChatCompletionRequest{})
+	if len(turns) == 0 {
+		return nil
+	}
+
+	name := cov.Name
+	if name == "" {
+		if name, err = a.title(ctx, turns[0]); err != nil {
+			return err
+		}
+	}
+
+	summary, until := cov.Summary, cov.SummaryUntil
+	from := -1
+	for i, t := range turns {
+		if t.id == until {
+			from = i + 1
+			break
+		}
+	}
+	if from < 0 {
+		// the summary is of another branch, or there is none yet
+		from, summary, until = 0, "", ""
+	}
+	if from < len(turns) {
+		budget := a.LLM.contextBudget(ChatCompletionRequest{Model: a.Model}) - CountTokens(a.Model, summaryPrompt)
+		newSummary, last, err := a.LLM.summarize(ctx, a.Model, summary, turns[from:], budget)
+		if err != nil {
+			return err
+		}
+		if last >= 0 {
+			summary, until = newSummary, turns[from+last].id
+		}
+	}
+
+	// the conversation is read again, it may have changed while the model answered
+	read := cov
+	if cov, err = l.dao.GetConversation(ctx, conversationId); err != nil {
+		return err
+	}
+	if cov.Name == "" {
+		cov.Name = name
+	}
+	// the summary is kept when the history strategy updated it meanwhile
+	if cov.Summary == read.Summary && cov.SummaryUntil == read.SummaryUntil {
+		cov.Summary, cov.SummaryUntil = summary, until
+	}
+	cov.UpdatedAt = time.Now()
+	_, err = l.dao.SaveConversation(ctx, cov)
+	slog.InfoContext(ctx, "annotate conversation", "conversation_id", conversationId, "name", cov.Name, "summary_until", cov.SummaryUntil, "err", err)
+	return err
+}
+
+// title asks for the title of the conversation from its first turn.
+func (a *Annotator) title(ctx context.Context, turn historyTurn) (string, error) {
+	var sb strings.Builder
+	for _, m := range turn.messages {
+		sb.WriteString(fmt.Sprintf("%s: %s\n", m.Role, m.TextContent()))
+	}
+	input := sb.String()
+	if utf8.RuneCountInString(input) > titleInputRunes {
+		input = string([]rune(input)[:titleInputRunes])
+	}
+
+	resp, err := a.LLM.CreateChatCompletion(ctx, ChatCompletionRequest{
+		Model: a.Model,
+		Messages: []ChatCompletionMessage{
+			{Role: ChatMessageRoleSystem, Content: titlePrompt},
+			{Role: ChatMessageRoleUser, Content: input},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("title conversation: empty response")
+	}
+	return cleanTitle(resp.Choices[0].Message.Content), nil
+}
+
+// cleanTitle keeps the first line of the answer, without the quotes and trailing punctuation models like to add.
+func cleanTitle(title string) string {
+	title, _, _ = strings.Cut(strings.TrimSpace(title), "\n")
+	title = strings.TrimPrefix(title, "Title:")
+	title = strings.Trim(strings.TrimSpace(title), `"'“”*#. `)
+	if utf8.RuneCountInString(title) > maxTitleRunes {
+		title = string([]rune(title)[:maxTitleRunes])
+	}
+	return title
+}
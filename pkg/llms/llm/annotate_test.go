@@ -0,0 +1,55 @@
+package llm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnotate(t *testing.T) {
+	ctx := context.Background()
+	cli := &echoClient{}
+	l := New(NewMemoryDao(), cli)
+	cov, err := l.CreateConversation(ctx, "")
+	require.NoError(t, err)
+	ask := func(content string) Message {
+		msg, err := l.CreateMessage(ctx, cov.Id, ChatCompletionRequest{Model: "echo", Messages: []ChatCompletionMessage{{Role: ChatMessageRoleUser, Content: content}}})
+		require.NoError(t, err)
+		return msg
+	}
+	ask("one")
+
+	// without an annotator nothing happens
+	require.NoError(t, l.Annotate(ctx, cov.Id))
+	assert.Len(t, cli.requests, 1)
+
+	// the annotator is only set to annotate, so no annotation runs in the background
+	annotator := &Annotator{LLM: New(NewMemoryDao(), cli), Model: "echo"}
+	msg := ask("two")
+	l.Annotator = annotator
+	require.NoError(t, l.Annotate(ctx, cov.Id))
+	l.Annotator = nil
+	cov, err = l.GetConversation(ctx, cov.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "The title", cov.Name)
+	assert.Equal(t, "the summary", cov.Summary)
+	assert.Equal(t, msg.Id, cov.SummaryUntil)
+
+	// the title is kept, only the new turn is folded into the summary
+	msg = ask("three")
+	cli.requests = nil
+	l.Annotator = annotator
+	require.NoError(t, l.Annotate(ctx, cov.Id))
+	require.Len(t, cli.requests, 1)
+	assert.Equal(t, "Previous summary:\nthe summary\n\nNew messages:\nuser: three\nassistant: three\n", cli.requests[0].Messages[1].Content)
+	cov, err = l.GetConversation(ctx, cov.Id)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Id, cov.SummaryUntil)
+}
+
+func TestCleanTitle(t *testing.T) {
+	assert.Equal(t, "Trip to Paris", cleanTitle("Title: \"Trip to Paris.\"\nAnother line"))
+	assert.Equal(t, "巴黎旅行", cleanTitle("**巴黎旅行**"))
+}
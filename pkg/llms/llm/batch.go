@@ -0,0 +1,232 @@
+package llm
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidBatch = errors.New("invalid batch")
+
+const (
+	// BatchEndpointChatCompletions is the only endpoint the requests of a batch can be sent to
+	BatchEndpointChatCompletions = "/v1/chat/completions"
+	// BatchCompletionWindow is the only completion window, the requests not done in time expire
+	BatchCompletionWindow = "24h"
+
+	// FilePurposeBatch is the purpose of the input files of batches, FilePurposeBatchOutput of their results
+	FilePurposeBatch       = "batch"
+	FilePurposeBatchOutput = "batch_output"
+
+	// maxBatchLineSize bounds a line of a batch input file, the requests may carry long documents
+	maxBatchLineSize = 16 << 20
+)
+
+// BatchStatus is the state of a batch, like in the OpenAI batch api.
+type BatchStatus string
+
+const (
+	BatchStatusValidating BatchStatus = "validating"
+	BatchStatusFailed     BatchStatus = "failed"
+	BatchStatusInProgress BatchStatus = "in_progress"
+	BatchStatusFinalizing BatchStatus = "finalizing"
+	BatchStatusCompleted  BatchStatus = "completed"
+	BatchStatusExpired    BatchStatus = "expired"
+	BatchStatusCancelling BatchStatus = "cancelling"
+	BatchStatusCancelled  BatchStatus = "cancelled"
+)
+
+// Done reports whether the batch has stopped, its status does not change anymore.
+func (s BatchStatus) Done() bool {
+	switch s {
+	case BatchStatusFailed, BatchStatusCompleted, BatchStatusExpired, BatchStatusCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// File is an uploaded batch input file or the results of a batch.
+type File struct {
+	Id        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int    `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+}
+
+// Batch is a batch of chat completions run in the background, the timestamps are unix seconds.
+type Batch struct {
+	Id               string             `json:"id"`
+	Object           string             `json:"object"`
+	Endpoint         string             `json:"endpoint"`
+	Errors           *BatchErrors       `json:"errors,omitempty"`
+	InputFileId      string             `json:"input_file_id"`
+	CompletionWindow string             `json:"completion_window"`
+	Status           BatchStatus        `json:"status"`
+	OutputFileId     string             `json:"output_file_id,omitempty"`
+	ErrorFileId      string             `json:"error_file_id,omitempty"`
+	CreatedAt        int64              `json:"created_at"`
+	InProgressAt     int64              `json:"in_progress_at,omitempty"`
+	ExpiresAt        int64              `json:"expires_at,omitempty"`
+	FinalizingAt     int64              `json:"finalizing_at,omitempty"`
+	CompletedAt      int64              `json:"completed_at,omitempty"`
+	FailedAt         int64              `json:"failed_at,omitempty"`
+	ExpiredAt        int64              `json:"expired_at,omitempty"`
+	CancellingAt     int64              `json:"cancelling_at,omitempty"`
+	CancelledAt      int64              `json:"cancelled_at,omitempty"`
+	RequestCounts    BatchRequestCounts `json:"request_counts"`
+	Metadata         map[string]string  `json:"metadata,omitempty"`
+}
+
+type BatchRequestCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// BatchErrors are the reasons a batch failed, like the invalid lines of its input file.
+type BatchErrors struct {
+	Object string       `json:"object"`
+	Data   []BatchError `json:"data"`
+}
+
+// BatchError is an error of a batch or of one of its requests, Line is the line of the input file, from 1.
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+}
+
+func (e BatchError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// BatchRequest is a line of a batch input file.
+type BatchRequest struct {
+	CustomId string                `json:"custom_id"`
+	Method   string                `json:"method"`
+	Url      string                `json:"url"`
+	Body     ChatCompletionRequest `json:"body"`
+}
+
+// BatchResult is a line of the output or error file of a batch, a request either has a response or an error.
+type BatchResult struct {
+	Id       string         `json:"id"`
+	CustomId string         `json:"custom_id"`
+	Response *BatchResponse `json:"response"`
+	Error    *BatchError    `json:"error"`
+}
+
+// BatchResponse is the response to a request of a batch, the body is a chat completion or an error object.
+type BatchResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestId  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// Succeeded reports whether the request was answered, the results of the other requests go to the error file.
+func (r BatchResult) Succeeded() bool {
+	return r.Error == nil && r.Response != nil && r.Response.StatusCode == http.StatusOK
+}
+
+// ReadBatchRequests reads a batch input file, every invalid line is reported as an error.
+// The custom ids must be unique and every request must be a POST to the chat completions endpoint.
+func ReadBatchRequests(r io.Reader) ([]BatchRequest, []BatchError) {
+	requests := make([]BatchRequest, 0)
+	errs := make([]BatchError, 0)
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxBatchLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		invalid := func(format string, args ...any) {
+			errs = append(errs, BatchError{Code: "invalid_request", Message: fmt.Sprintf(format, args...), Line: line})
+		}
+
+		var req BatchRequest
+		if err := json.Unmarshal([]byte(text), &req); err != nil {
+			invalid("invalid json: %v", err)
+			continue
+		}
+		switch {
+		case req.CustomId == "":
+			invalid("custom_id is required")
+		case seen[req.CustomId]:
+			invalid("duplicate custom_id %s", req.CustomId)
+		case req.Method != http.MethodPost:
+			invalid("unsupported method %s, only POST is supported", req.Method)
+		case req.Url != BatchEndpointChatCompletions:
+			invalid("unsupported url %s, only %s is supported", req.Url, BatchEndpointChatCompletions)
+		case req.Body.Model == "":
+			invalid("body.model is required")
+		case req.Body.Stream:
+			invalid("body.stream is not supported")
+		default:
+			seen[req.CustomId] = true
+			requests = append(requests, req)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, BatchError{Code: "invalid_file", Message: err.Error()})
+	}
+	if len(requests) == 0 && len(errs) == 0 {
+		errs = append(errs, BatchError{Code: "empty_file", Message: "the input file has no request"})
+	}
+	return requests, errs
+}
+
+// NewBatchResult is the result of a request from its response or its error, a failed request gets the status code
+// of its APIError, 400 for an invalid template and 500 otherwise.
+func NewBatchResult(customId string, resp ChatCompletionResponse, err error) BatchResult {
+	result := BatchResult{
+		Id:       "batch_req_" + uuid.NewString(),
+		CustomId: customId,
+		Response: &BatchResponse{
+			StatusCode: http.StatusOK,
+			RequestId:  resp.ID,
+		},
+	}
+	if err == nil {
+		result.Response.Body, _ = json.Marshal(resp)
+		return result
+	}
+
+	result.Response.StatusCode = http.StatusInternalServerError
+	var apiErr *APIError
+	switch {
+	case errors.As(err, &apiErr):
+		result.Response.StatusCode = apiErr.StatusCode
+	case errors.Is(err, ErrInvalidTemplate):
+		result.Response.StatusCode = http.StatusBadRequest
+	}
+	result.Response.Body, _ = json.Marshal(map[string]any{
+		"error": map[string]any{"message": err.Error(), "code": result.Response.StatusCode},
+	})
+	return result
+}
+
+// WriteBatchResults writes the results as JSON lines.
+func WriteBatchResults(w io.Writer, results []BatchResult) error {
+	enc := json.NewEncoder(w)
+	for _, result := range results {
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadBatchRequests(t *testing.T) {
+	input := strings.Join([]string{
+		`{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "gpt-4", "messages": [{"role": "user", "content": "hi"}]}}`,
+		``,
+		`{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "gpt-4"}}`,
+		`{"custom_id": "b", "method": "GET", "url": "/v1/chat/completions", "body": {"model": "gpt-4"}}`,
+		`{"custom_id": "c", "method": "POST", "url": "/v1/embeddings", "body": {"model": "gpt-4"}}`,
+		`not json`,
+		`{"custom_id": "d", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "gpt-4", "messages": [{"role": "user", "content": "hello"}]}}`,
+	}, "\n")
+
+	requests, errs := ReadBatchRequests(strings.NewReader(input))
+	require.Len(t, requests, 2)
+	assert.Equal(t, "a", requests[0].CustomId)
+	assert.Equal(t, "hi", requests[0].Body.Messages[0].Content)
+	assert.Equal(t, "d", requests[1].CustomId)
+	require.Len(t, errs, 4)
+	lines := make([]int, 0, len(errs))
+	for _, err := range errs {
+		lines = append(lines, err.Line)
+	}
+	assert.Equal(t, []int{3, 4, 5, 6}, lines)
+
+	_, errs = ReadBatchRequests(strings.NewReader("\n"))
+	require.Len(t, errs, 1)
+	assert.Equal(t, "empty_file", errs[0].Code)
+}
+
+func TestBatchResults(t *testing.T) {
+	ok := NewBatchResult("a", ChatCompletionResponse{ID: "resp", Choices: []ChatCompletionChoice{{Message: ChatCompletionMessage{Content: "hello"}}}}, nil)
+	assert.True(t, ok.Succeeded())
+	assert.Equal(t, "resp", ok.Response.RequestId)
+
+	throttled := NewBatchResult("b", ChatCompletionResponse{}, NewAPIError(http.StatusTooManyRequests, "slow down"))
+	assert.False(t, throttled.Succeeded())
+	assert.Equal(t, http.StatusTooManyRequests, throttled.Response.StatusCode)
+	invalid := NewBatchResult("c", ChatCompletionResponse{}, ErrInvalidTemplate)
+	assert.Equal(t, http.StatusBadRequest, invalid.Response.StatusCode)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteBatchResults(&buf, []BatchResult{ok, throttled}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var result BatchResult
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &result))
+	var resp ChatCompletionResponse
+	require.NoError(t, json.Unmarshal(result.Response.Body, &resp))
+	assert.Equal(t, "hello", resp.Choices[0].Message.Content)
+	assert.Nil(t, result.Error)
+}
@@ -0,0 +1,218 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// Branch is a path of messages from the first message of a conversation to a leaf.
+type Branch struct {
+	LeafId     string    `json:"leaf_id"`
+	MessageIds []string  `json:"message_ids"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// EditMessage replaces the prompt of a message, the new message is a sibling of the edited one
+// and becomes the active leaf of the conversation.
+func (l *LLM) EditMessage(ctx context.Context, messageId string, req ChatCompletionRequest) (Message, error) {
+	msg, cov, err := l.messageConversation(ctx, messageId)
+	if err != nil {
+		return Message{}, err
+	}
+	return l.createMessage(ctx, cov, msg.ParentId, req)
+}
+
+// EditMessageStream is like EditMessage, the response is streamed.
+func (l *LLM) EditMessageStream(ctx context.Context, messageId string, req ChatCompletionRequest, respChan chan ChatCompletionStreamResponse, errChan chan error) {
+	msg, cov, err := l.messageConversation(ctx, messageId)
+	if err != nil {
+		errChan <- err
+		return
+	}
+	l.createMessageStream(ctx, cov, msg.ParentId, req, respChan, errChan)
+}
+
+// RegenerateMessage sends the request of a message again, the new answer is a sibling of the message.
+// The request is sent to the model even when its response is cached.
+func (l *LLM) RegenerateMessage(ctx context.Context, messageId string) (Message, error) {
+	msg, cov, err := l.messageConversation(ctx, messageId)
+	if err != nil {
+		return Message{}, err
+	}
+	return l.createMessage(WithCacheBypass(ctx), cov, msg.ParentId, msg.Request)
+}
+
+// RegenerateMessageStream is like RegenerateMessage, the response is streamed.
+func (l *LLM) RegenerateMessageStream(ctx context.Context, messageId string, respChan chan ChatCompletionStreamResponse, errChan chan error) {
+	msg, cov, err := l.messageConversation(ctx, messageId)
+	if err != nil {
+		errChan <- err
+		return
+	}
+	l.createMessageStream(WithCacheBypass(ctx), cov, msg.ParentId, msg.Request, respChan, errChan)
+}
+
+// ActiveMessage returns the active leaf of the conversation, the message new messages are added after.
+func (l *LLM) ActiveMessage(ctx context.Context, conversationId string) (Message, error) {
+	cov, err := l.dao.GetConversation(ctx, conversationId)
+	if err != nil {
+		return Message{}, err
+	}
+	id, err := l.activeLeaf(ctx, cov)
+	if err != nil {
+		return Message{}, err
+	}
+	if id == "" {
+		return Message{}, fmt.Errorf("active message of conversation %s: %w", conversationId, ErrNotFound)
+	}
+	return l.dao.GetMessage(ctx, id)
+}
+
+// ListBranches returns the branches of the conversation, ordered by the creation of their leaf.
+func (l *LLM) ListBranches(ctx context.Context, conversationId string) ([]Branch, error) {
+	cov, err := l.dao.GetConversation(ctx, conversationId)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := l.dao.ListMessages(ctx, conversationId, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	active, err := l.activeLeaf(ctx, cov)
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make(map[string]bool, len(messages))
+	for _, m := range messages {
+		parents[m.ParentId] = true
+	}
+	branches := make([]Branch, 0)
+	for _, m := range messages {
+		if parents[m.Id] {
+			continue
+		}
+		path := messagePath(messages, m.Id)
+		ids := make([]string, 0, len(path))
+		for _, p := range path {
+			ids = append(ids, p.Id)
+		}
+		branches = append(branches, Branch{
+			LeafId:     m.Id,
+			MessageIds: ids,
+			Active:     m.Id == active,
+			CreatedAt:  m.CreatedAt,
+		})
+	}
+	return branches, nil
+}
+
+// SwitchBranch makes the branch of the message active, if the message has replies
+// the most recent reply is followed down to a leaf.
+func (l *LLM) SwitchBranch(ctx context.Context, conversationId, messageId string) (Conversation, error) {
+	msg, cov, err := l.messageConversation(ctx, messageId)
+	if err != nil {
+		return Conversation{}, err
+	}
+	if cov.Id != conversationId {
+		return Conversation{}, fmt.Errorf("message %s of conversation %s: %w", messageId, conversationId, ErrNotFound)
+	}
+	messages, err := l.dao.ListMessages(ctx, conversationId, ListOptions{})
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	// messages are ordered by creation, the last child is the most recent one
+	latest := make(map[string]string, len(messages))
+	for _, m := range messages {
+		latest[m.ParentId] = m.Id
+	}
+	leaf := msg.Id
+	seen := make(map[string]bool)
+	for latest[leaf] != "" && !seen[leaf] {
+		seen[leaf] = true
+		leaf = latest[leaf]
+	}
+
+	if leaf != cov.ActiveLeafId {
+		// the native conversations of the web apps follow the old branch, the next message starts new ones
+		cov.ExtraInfo = ""
+	}
+	cov.ActiveLeafId = leaf
+	cov.UpdatedAt = time.Now()
+	cov, err = l.dao.SaveConversation(ctx, cov)
+	slog.InfoContext(ctx, "switch branch", "conversation_id", conversationId, "leaf_id", leaf, "err", err)
+	return cov, err
+}
+
+// messageConversation returns the message and its conversation.
+func (l *LLM) messageConversation(ctx context.Context, messageId string) (Message, Conversation, error) {
+	msg, err := l.dao.GetMessage(ctx, messageId)
+	if err != nil {
+		slog.ErrorContext(ctx, "get message error", "err", err, "message_id", messageId)
+		return Message{}, Conversation{}, err
+	}
+	cov, err := l.dao.GetConversation(ctx, msg.ConversationId)
+	if err != nil {
+		slog.ErrorContext(ctx, "get conversation of message error", "err", err, "message_id", messageId)
+		return Message{}, Conversation{}, err
+	}
+	return msg, cov, nil
+}
+
+// activeLeaf returns the message new messages of the conversation are added after, the active leaf if it still exists
+// and the latest message otherwise, empty for a conversation without messages.
+func (l *LLM) activeLeaf(ctx context.Context, cov Conversation) (string, error) {
+	if cov.ActiveLeafId != "" {
+		msg, err := l.dao.GetMessage(ctx, cov.ActiveLeafId)
+		if err == nil && msg.ConversationId == cov.Id {
+			return msg.Id, nil
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return "", err
+		}
+	}
+	msg, err := l.dao.GetConversationLastMessage(ctx, cov.Id)
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	return msg.Id, err
+}
+
+// setActiveLeaf saves the active leaf of the conversation, it is read again as the history strategy may have saved it.
+func (l *LLM) setActiveLeaf(ctx context.Context, conversationId, leafId string) error {
+	cov, err := l.dao.GetConversation(ctx, conversationId)
+	if err != nil {
+		return err
+	}
+	cov.ActiveLeafId = leafId
+	cov.UpdatedAt = time.Now()
+	_, err = l.dao.SaveConversation(ctx, cov)
+	return err
+}
+
+// messagePath returns the messages from the first message of the branch to the leaf.
+func messagePath(messages []Message, leafId string) []Message {
+	byId := make(map[string]Message, len(messages))
+	for _, m := range messages {
+		byId[m.Id] = m
+	}
+	path := make([]Message, 0)
+	seen := make(map[string]bool)
+	for id := leafId; id != "" && !seen[id]; {
+		m, ok := byId[id]
+		if !ok {
+			break
+		}
+		seen[id] = true
+		path = append(path, m)
+		id = m.ParentId
+	}
+	slices.Reverse(path)
+	return path
+}
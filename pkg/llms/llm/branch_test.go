@@ -0,0 +1,56 @@
+package llm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBranches(t *testing.T) {
+	ctx := context.Background()
+	cli := &echoClient{}
+	l := New(NewMemoryDao(), cli)
+	cov, err := l.CreateConversation(ctx, "")
+	require.NoError(t, err)
+	ask := func(content string) ChatCompletionRequest {
+		return ChatCompletionRequest{Model: "echo", Messages: []ChatCompletionMessage{{Role: ChatMessageRoleUser, Content: content}}}
+	}
+
+	first, err := l.CreateMessage(ctx, cov.Id, ask("one"))
+	require.NoError(t, err)
+	second, err := l.CreateMessage(ctx, cov.Id, ask("two"))
+	require.NoError(t, err)
+	assert.Equal(t, first.Id, second.ParentId)
+
+	// the edit is a sibling of the second message, only the first turn is sent with it
+	edited, err := l.EditMessage(ctx, second.Id, ask("two again"))
+	require.NoError(t, err)
+	assert.Equal(t, first.Id, edited.ParentId)
+	assert.Len(t, cli.requests[len(cli.requests)-1].Messages, 3)
+
+	regenerated, err := l.RegenerateMessage(ctx, first.Id)
+	require.NoError(t, err)
+	assert.Empty(t, regenerated.ParentId)
+	assert.Equal(t, "one", regenerated.Request.Messages[0].Content)
+	assert.Len(t, cli.requests[len(cli.requests)-1].Messages, 1)
+
+	branches, err := l.ListBranches(ctx, cov.Id)
+	require.NoError(t, err)
+	require.Len(t, branches, 3)
+	assert.Equal(t, []string{first.Id, second.Id}, branches[0].MessageIds)
+	assert.Equal(t, []string{first.Id, edited.Id}, branches[1].MessageIds)
+	assert.Equal(t, []string{regenerated.Id}, branches[2].MessageIds)
+	assert.True(t, branches[2].Active)
+
+	// switching to the first message follows its latest reply
+	cov, err = l.SwitchBranch(ctx, cov.Id, first.Id)
+	require.NoError(t, err)
+	assert.Equal(t, edited.Id, cov.ActiveLeafId)
+
+	third, err := l.CreateMessage(ctx, cov.Id, ask("three"))
+	require.NoError(t, err)
+	assert.Equal(t, edited.Id, third.ParentId)
+	assert.Len(t, cli.requests[len(cli.requests)-1].Messages, 5)
+}
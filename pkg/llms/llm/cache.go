@@ -0,0 +1,199 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/patrickmn/go-cache"
+)
+
+// CacheBackend names where the responses are cached.
+type CacheBackend string
+
+const (
+	// CacheBackendNone disables the cache
+	CacheBackendNone CacheBackend = ""
+	// CacheBackendMemory keeps the responses in the memory of the process, they are lost on restart
+	CacheBackendMemory CacheBackend = "memory"
+	// CacheBackendSQLite keeps the responses in the database of the dao, when it implements ResponseCache
+	CacheBackendSQLite CacheBackend = "sqlite"
+
+	// CacheHit and CacheMiss are the values of the X-Cache header
+	CacheHit  = "HIT"
+	CacheMiss = "MISS"
+)
+
+// CacheConfig enables the cache of identical chat completions. Only the requests sent with a temperature of 0
+// are cached unless Force is set, an omitted temperature defaults to 1 at the providers.
+type CacheConfig struct {
+	Backend CacheBackend `json:"backend" yaml:"backend" mapstructure:"backend"`
+	// TTL is how long a response is served from the cache, forever when zero
+	TTL time.Duration `json:"ttl" yaml:"ttl" mapstructure:"ttl"`
+	// Force caches the requests whatever their temperature
+	Force bool `json:"force" yaml:"force" mapstructure:"force"`
+}
+
+// Cacheable reports whether the response of the request is cached.
+func (c CacheConfig) Cacheable(req ChatCompletionRequest) bool {
+	return c.Backend != CacheBackendNone && (c.Force || (req.TemperatureSet && req.Temperature == 0))
+}
+
+// ResponseCache stores the responses of chat completions by the key of their request.
+type ResponseCache interface {
+	// GetResponse returns the response stored for the key, ok is false when there is none or it has expired
+	GetResponse(ctx context.Context, key string) (resp ChatCompletionResponse, ok bool, err error)
+	// SetResponse stores the response for ttl, it does not expire when ttl is zero
+	SetResponse(ctx context.Context, key string, resp ChatCompletionResponse, ttl time.Duration) error
+}
+
+// CacheKey is the hash of the parts of the request which change the response. The provider prefix of the model,
+// the streaming options, the user and the whitespace around the text of the messages are left out.
+func CacheKey(req ChatCompletionRequest) string {
+	req.Model = req.ModelId()
+	req.Stream = false
+	req.StreamOptions = nil
+	req.Template = nil
+	req.User = ""
+	if req.N == 1 {
+		req.N = 0
+	}
+	messages := make([]ChatCompletionMessage, len(req.Messages))
+	for i, m := range req.Messages {
+		m.Content = strings.TrimSpace(m.Content)
+		messages[i] = m
+	}
+	req.Messages = messages
+
+	// the fields are marshalled in a fixed order and the map keys are sorted, so equal requests have equal keys
+	bs, _ := json.Marshal(req)
+	sum := sha256.Sum256(bs)
+	return hex.EncodeToString(sum[:])
+}
+
+// ReplayStream streams a cached response, a chunk per choice, followed by the usage chunk when includeUsage is set.
+// The response gets a new id, as a replayed response is saved like any other.
+func ReplayStream(resp ChatCompletionResponse, includeUsage bool, dataChan chan ChatCompletionStreamResponse) {
+	id := uuid.NewString()
+	created := time.Now().Unix()
+	for _, choice := range resp.Choices {
+		var toolCalls []ToolCall
+		for i, call := range choice.Message.ToolCalls {
+			index := i
+			call.Index = &index
+			toolCalls = append(toolCalls, call)
+		}
+		dataChan <- ChatCompletionStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   resp.Model,
+			Choices: []ChatCompletionStreamChoice{{
+				Index: choice.Index,
+				Delta: ChatCompletionStreamChoiceDelta{
+					Role:         choice.Message.Role,
+					Content:      choice.Message.TextContent(),
+					FunctionCall: choice.Message.FunctionCall,
+					ToolCalls:    toolCalls,
+				},
+				FinishReason: choice.FinishReason,
+			}},
+		}
+	}
+	if includeUsage {
+		usage := resp.Usage
+		dataChan <- ChatCompletionStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   resp.Model,
+			Choices: []ChatCompletionStreamChoice{},
+			Usage:   &usage,
+		}
+	}
+}
+
+// MemoryResponseCache is a ResponseCache in the memory of the process.
+type MemoryResponseCache struct {
+	client *cache.Cache
+}
+
+func NewMemoryResponseCache() *MemoryResponseCache {
+	return &MemoryResponseCache{client: cache.New(cache.NoExpiration, 10*time.Minute)}
+}
+
+func (c *MemoryResponseCache) GetResponse(ctx context.Context, key string) (ChatCompletionResponse, bool, error) {
+	val, ok := c.client.Get(key)
+	if !ok {
+		return ChatCompletionResponse{}, false, nil
+	}
+	return val.(ChatCompletionResponse), true, nil
+}
+
+func (c *MemoryResponseCache) SetResponse(ctx context.Context, key string, resp ChatCompletionResponse, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = cache.NoExpiration
+	}
+	c.client.Set(key, resp, ttl)
+	return nil
+}
+
+type (
+	cacheStatusKey struct{}
+	cacheBypassKey struct{}
+)
+
+// WithCacheBypass returns a context whose requests reach the provider even when their response is cached,
+// the new response replaces the cached one.
+func WithCacheBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheBypassKey{}, true)
+}
+
+// CacheBypassed reports whether the requests of the context skip the cached responses.
+func CacheBypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(cacheBypassKey{}).(bool)
+	return bypass
+}
+
+// CacheStatus tells whether the response of a request was served from the cache.
+type CacheStatus struct {
+	status atomic.Value
+}
+
+// WithCacheStatus returns a context which records the cache status of the requests sent with it.
+func WithCacheStatus(ctx context.Context) (context.Context, *CacheStatus) {
+	status := &CacheStatus{}
+	return context.WithValue(ctx, cacheStatusKey{}, status), status
+}
+
+// withoutCacheStatus returns a context which does not record the cache status, for the requests sent in the background.
+func withoutCacheStatus(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheStatusKey{}, (*CacheStatus)(nil))
+}
+
+// CacheStatusFrom returns the cache status of the context, nil when it does not record one.
+func CacheStatusFrom(ctx context.Context) *CacheStatus {
+	status, _ := ctx.Value(cacheStatusKey{}).(*CacheStatus)
+	return status
+}
+
+// Set records the status of the last cacheable request, it does nothing on a nil status.
+func (s *CacheStatus) Set(status string) {
+	if s != nil {
+		s.status.Store(status)
+	}
+}
+
+// String returns CacheHit or CacheMiss, empty when no request was cacheable.
+func (s *CacheStatus) String() string {
+	if s == nil {
+		return ""
+	}
+	status, _ := s.status.Load().(string)
+	return status
+}
@@ -0,0 +1,125 @@
+package llm
+
+import (
+	"sort"
+)
+
+// Pricing is the price in USD per million tokens.
+type Pricing struct {
+	Prompt     float64 `json:"prompt,omitempty" mapstructure:"prompt"`
+	Completion float64 `json:"completion,omitempty" mapstructure:"completion"`
+}
+
+// Cost returns the price in USD of the usage.
+func (p Pricing) Cost(usage Usage) float64 {
+	return (float64(usage.PromptTokens)*p.Prompt + float64(usage.CompletionTokens)*p.Completion) / 1_000_000
+}
+
+// Capabilities are the features of a model beyond text chat.
+type Capabilities struct {
+	Streaming bool `json:"streaming" mapstructure:"streaming"`
+	Tools     bool `json:"tools" mapstructure:"tools"`
+	Vision    bool `json:"vision" mapstructure:"vision"`
+	// Embeddings is set for the embedding models, they do not chat
+	Embeddings bool `json:"embeddings" mapstructure:"embeddings"`
+}
+
+// DefaultModels is the bundled catalogue of the models known to the providers, with their list prices.
+var DefaultModels = []Model{
+	{ID: OAIModelGPT3Dot5Turbo, Pricing: Pricing{Prompt: 0.5, Completion: 1.5}, ContextLength: 16385},
+	{ID: OAIModelGPT3Dot5Turbo16K, Pricing: Pricing{Prompt: 3, Completion: 4}, ContextLength: 16385},
+	{ID: OAIModelGPT4, Pricing: Pricing{Prompt: 30, Completion: 60}, ContextLength: 8192},
+	{ID: OAIModelGPT4Dot32K, Pricing: Pricing{Prompt: 60, Completion: 120}, ContextLength: 32768},
+	{ID: OAIModelGPT4TurboPreview, Pricing: Pricing{Prompt: 10, Completion: 30}, ContextLength: 128000},
+	{ID: OAIModelGPT4V, Pricing: Pricing{Prompt: 10, Completion: 30}, ContextLength: 128000, Capabilities: Capabilities{Vision: true}},
+	{ID: BedrockModelClaudeV1, Pricing: Pricing{Prompt: 8, Completion: 24}, ContextLength: 100000},
+	{ID: BedrockModelClaudeV2, Pricing: Pricing{Prompt: 8, Completion: 24}, ContextLength: 100000},
+	{ID: BedrockModelClaudeV2Dot1, Pricing: Pricing{Prompt: 8, Completion: 24}, ContextLength: 200000},
+	{ID: BedrockModelClaudeInstantV1, Pricing: Pricing{Prompt: 0.8, Completion: 2.4}, ContextLength: 100000},
+	{ID: BedrockModelClaude3Sonnet, Pricing: Pricing{Prompt: 3, Completion: 15}, ContextLength: 200000, Capabilities: Capabilities{Vision: true}},
+	{ID: BedrockModelClaude3Haiku, Pricing: Pricing{Prompt: 0.25, Completion: 1.25}, ContextLength: 200000, Capabilities: Capabilities{Vision: true}},
+	{ID: BedrockModelLlama2Chat13B, Pricing: Pricing{Prompt: 0.75, Completion: 1}, ContextLength: 4096},
+	{ID: BedrockModelLlama2Chat70B, Pricing: Pricing{Prompt: 1.95, Completion: 2.56}, ContextLength: 4096},
+	{ID: BedrockModelLlama3Instruct8B, Pricing: Pricing{Prompt: 0.4, Completion: 0.6}, ContextLength: 8192},
+	{ID: BedrockModelLlama3Instruct70B, Pricing: Pricing{Prompt: 2.65, Completion: 3.5}, ContextLength: 8192},
+	{ID: BedrockModelMistral7B, Pricing: Pricing{Prompt: 0.15, Completion: 0.2}, ContextLength: 32000},
+	{ID: BedrockModelMixtral8x7B, Pricing: Pricing{Prompt: 0.45, Completion: 0.7}, ContextLength: 32000},
+	{ID: BedrockModelMistralLarge, Pricing: Pricing{Prompt: 8, Completion: 24}, ContextLength: 32000},
+	{ID: BedrockModelTitanTextExpress, Pricing: Pricing{Prompt: 0.8, Completion: 1.6}, ContextLength: 8192},
+	{ID: BedrockModelTitanTextLite, Pricing: Pricing{Prompt: 0.3, Completion: 0.4}, ContextLength: 4096},
+	{ID: BedrockModelCohereCommand, Pricing: Pricing{Prompt: 1.5, Completion: 2}, ContextLength: 4000},
+	{ID: BedrockModelCohereCommandR, Pricing: Pricing{Prompt: 0.5, Completion: 1.5}, ContextLength: 128000},
+	{ID: BedrockModelCohereCommandRPlus, Pricing: Pricing{Prompt: 3, Completion: 15}, ContextLength: 128000},
+	{ID: AnthropicModelClaude3Opus, Pricing: Pricing{Prompt: 15, Completion: 75}, ContextLength: 200000, Capabilities: Capabilities{Vision: true}},
+	{ID: AnthropicModelClaude3Sonnet, Pricing: Pricing{Prompt: 3, Completion: 15}, ContextLength: 200000, Capabilities: Capabilities{Vision: true}},
+	{ID: AnthropicModelClaude3Haiku, Pricing: Pricing{Prompt: 0.25, Completion: 1.25}, ContextLength: 200000, Capabilities: Capabilities{Vision: true}},
+	{ID: GoogleAIModelGeminiPro, Pricing: Pricing{Prompt: 0.5, Completion: 1.5}, ContextLength: 32760},
+	{ID: GoogleAIModelGeminiProV, Pricing: Pricing{Prompt: 0.5, Completion: 1.5}, ContextLength: 16384, Capabilities: Capabilities{Vision: true}},
+	{ID: GoogleAIModelGemini15Pro, Pricing: Pricing{Prompt: 3.5, Completion: 10.5}, ContextLength: 1048576, Capabilities: Capabilities{Vision: true}},
+	{ID: GoogleAIModelGemini15Flash, Pricing: Pricing{Prompt: 0.35, Completion: 1.05}, ContextLength: 1048576, Capabilities: Capabilities{Vision: true}},
+	{ID: OAIModelEmbeddingAda002, Pricing: Pricing{Prompt: 0.1}, ContextLength: 8191, Capabilities: Capabilities{Embeddings: true}},
+	{ID: OAIModel3SmallEmbedding, Pricing: Pricing{Prompt: 0.02}, ContextLength: 8191, Capabilities: Capabilities{Embeddings: true}},
+	{ID: OAIModel3LargeEmbedding, Pricing: Pricing{Prompt: 0.13}, ContextLength: 8191, Capabilities: Capabilities{Embeddings: true}},
+	{ID: BedrockModelTitanEmbedText, Pricing: Pricing{Prompt: 0.1}, ContextLength: 8192, Capabilities: Capabilities{Embeddings: true}},
+	{ID: BedrockModelCohereEmbedEN, Pricing: Pricing{Prompt: 0.1}, ContextLength: 512, Capabilities: Capabilities{Embeddings: true}},
+	{ID: BedrockModelCohereEmbedML, Pricing: Pricing{Prompt: 0.1}, ContextLength: 512, Capabilities: Capabilities{Embeddings: true}},
+	{ID: GoogleAIModelEmbedding001, ContextLength: 2048, Capabilities: Capabilities{Embeddings: true}},
+	{ID: "thenlper/gte-large", Pricing: Pricing{Prompt: 0.05}, ContextLength: 512, Capabilities: Capabilities{Embeddings: true}},
+}
+
+// defaultCatalog is used by clients created without a catalog
+var defaultCatalog = NewCatalog(nil)
+
+// Catalog holds the pricing and context length of the models, per provider.
+type Catalog struct {
+	models map[string]Model
+}
+
+// NewCatalog returns the bundled models overridden by the given ones.
+func NewCatalog(models []Model) *Catalog {
+	c := &Catalog{models: make(map[string]Model)}
+	for _, m := range DefaultModels {
+		c.models[catalogKey(m.Provider, m.ID)] = m
+	}
+	for _, m := range models {
+		c.models[catalogKey(m.Provider, m.ID)] = m
+	}
+	return c
+}
+
+func catalogKey(provider, model string) string {
+	if provider == "" {
+		return model
+	}
+	return provider + "/" + model
+}
+
+// Lookup returns the entry of the model for the provider, or the entry shared by all providers.
+func (c *Catalog) Lookup(provider, model string) (Model, bool) {
+	if m, ok := c.models[catalogKey(provider, model)]; ok {
+		return m, true
+	}
+	m, ok := c.models[model]
+	return m, ok
+}
+
+// Cost returns the price in USD of the usage, it is zero for models without pricing.
+func (c *Catalog) Cost(provider, model string, usage Usage) float64 {
+	m, _ := c.Lookup(provider, model)
+	return m.Pricing.Cost(usage)
+}
+
+// Models returns the entries of the catalog sorted by provider and id.
+func (c *Catalog) Models() []Model {
+	models := make([]Model, 0, len(c.models))
+	for _, m := range c.models {
+		models = append(models, m)
+	}
+	sort.Slice(models, func(i, j int) bool {
+		if models[i].Provider != models[j].Provider {
+			return models[i].Provider < models[j].Provider
+		}
+		return models[i].ID < models[j].ID
+	})
+	return models
+}
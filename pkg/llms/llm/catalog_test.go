@@ -0,0 +1,24 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalogCost(t *testing.T) {
+	c := NewCatalog([]Model{
+		{ID: OAIModelGPT4, Provider: "azure-openai", Pricing: Pricing{Prompt: 20, Completion: 40}},
+		{ID: "llama-2-70b", Pricing: Pricing{Prompt: 1, Completion: 1}},
+	})
+	usage := NewUsage(1000, 500)
+
+	assert.InDelta(t, 0.06, c.Cost("openai", OAIModelGPT4, usage), 1e-9)
+	assert.InDelta(t, 0.04, c.Cost("azure-openai", OAIModelGPT4, usage), 1e-9)
+	assert.InDelta(t, 0.0015, c.Cost("together", "llama-2-70b", usage), 1e-9)
+	assert.Zero(t, c.Cost("openai", "unknown", usage))
+
+	m, ok := c.Lookup("openai", OAIModelGPT4)
+	assert.True(t, ok)
+	assert.Equal(t, 8192, m.ContextLength)
+}
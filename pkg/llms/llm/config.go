@@ -2,6 +2,9 @@ package llm
 
 import (
 	"fmt"
+	"slices"
+	"strings"
+	"time"
 )
 
 type LLMType string
@@ -23,8 +26,21 @@ const (
 	LLMTypeGoogleBard    LLMType = "google-bard"
 	LLMTypeGoogleAI      LLMType = "google-ai"
 	LLMTypeGithubCopilot LLMType = "github-copilot"
+	LLMTypeAnthropic     LLMType = "anthropic"
+	LLMTypeOllama        LLMType = "ollama"
+	LLMTypeLlamaCpp      LLMType = "llama-cpp"
 )
 
+// SupportsTools reports whether the clients of the type support tool calling.
+func (t LLMType) SupportsTools() bool {
+	switch t {
+	case LLMTypeClaudeWeb, LLMTypeGoogleBard, LLMTypeReplicate, LLMTypeOllama, LLMTypeLlamaCpp:
+		return false
+	default:
+		return true
+	}
+}
+
 type AiGatewayProviderType string
 
 func (p AiGatewayProviderType) String() string {
@@ -52,9 +68,9 @@ type Config struct {
 	// Models is a list of valid model ids for this config
 	Models []string `json:"models" yaml:"models" mapstructure:"models"`
 
-	// ApiKey is the API key for the provider, works for OpenAI, HuggingFace, Replicate and Together
+	// ApiKey is the API key for the provider, works for OpenAI, Anthropic, HuggingFace, Replicate and Together
 	ApiKey string `json:"api_key" yaml:"api_key" mapstructure:"api_key"`
-	// BaseUrl is the base url for the provider, works for OpenAI, HuggingFace, Replicate and Together
+	// BaseUrl is the base url for the provider, works for OpenAI, Anthropic, HuggingFace, Replicate and Together
 	BaseUrl string `json:"base_url" yaml:"base_url" mapstructure:"base_url"`
 
 	// AzureOpenAI is the config for Azure OpenAI
@@ -63,6 +79,19 @@ type Config struct {
 	AWSBedrock AWSBedrockConfig `json:"aws_bedrock" yaml:"aws_bedrock" mapstructure:"aws_bedrock"`
 	// AiGateway is the config for Cloudflare AI Gateway
 	AiGateway AiGatewayConfig `json:"aigateway" yaml:"aigateway" mapstructure:"aigateway"`
+	// Ollama is the config for a local Ollama server
+	Ollama OllamaConfig `json:"ollama" yaml:"ollama" mapstructure:"ollama"`
+	// GoogleAI is the config for Google AI Gemini
+	GoogleAI GoogleAIConfig `json:"google_ai" yaml:"google_ai" mapstructure:"google_ai"`
+	// CookieCloud syncs the session cookie of Claude Web and Google Bard from a browser, when the api_key is not set
+	CookieCloud CookieCloudConfig `json:"cookiecloud" yaml:"cookiecloud" mapstructure:"cookiecloud"`
+
+	// Weight is the share of traffic of this config when several configs serve the same model, defaults to 1
+	Weight int `json:"weight" yaml:"weight" mapstructure:"weight"`
+	// RPM is the requests per minute budget of the key, unlimited when zero
+	RPM int `json:"rpm" yaml:"rpm" mapstructure:"rpm"`
+	// TPM is the tokens per minute budget of the key, unlimited when zero
+	TPM int `json:"tpm" yaml:"tpm" mapstructure:"tpm"`
 }
 
 func (c Config) Validate() error {
@@ -71,12 +100,22 @@ func (c Config) Validate() error {
 	}
 
 	switch c.LLMType {
-	case LLMTypeOpenAI, LLMTypeClaudeWeb, LLMTypeGoogleBard,
-		LLMTypeTogether, LLMTypeReplicate, LLMTypeGoogleAI,
-		LLMTypeOpenRouter, LLMTypeAnyScale:
+	case LLMTypeClaudeWeb, LLMTypeGoogleBard:
+		// the api_key is the session cookie of the web app
+		if c.ApiKey == "" && c.CookieCloud.Host == "" {
+			return fmt.Errorf("api_key or cookiecloud is required")
+		}
+	case LLMTypeOpenAI,
+		LLMTypeTogether, LLMTypeReplicate,
+		LLMTypeOpenRouter, LLMTypeAnyScale, LLMTypeAnthropic:
 		if c.ApiKey == "" {
 			return fmt.Errorf("api_key is required")
 		}
+	case LLMTypeGoogleAI:
+		if c.ApiKey == "" {
+			return fmt.Errorf("api_key is required")
+		}
+		return c.GoogleAI.validate()
 	case LLMTypeAzureOpenAI:
 		return c.AzureOpenAI.validate()
 	case LLMTypeAWSBedrock:
@@ -107,6 +146,20 @@ func (c *Config) ID() string {
 	return c.LLMType.String()
 }
 
+// Route is a named fallback chain, a request for Model is sent to the first healthy target,
+// and moves on to the next one when it fails with a retryable error before the first token.
+// A target is a provider id like "openai", or "provider/model" to use another model id on that provider.
+type Route struct {
+	Model   string   `json:"model" yaml:"model" mapstructure:"model"`
+	Targets []string `json:"targets" yaml:"targets" mapstructure:"targets"`
+	// MaxAttempts is the number of attempts per target, defaults to 1
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts" mapstructure:"max_attempts"`
+	// Backoff is the delay before retrying the same target, doubled after each attempt, defaults to 500ms
+	Backoff time.Duration `json:"backoff" yaml:"backoff" mapstructure:"backoff"`
+	// FirstTokenTimeout gives up a target which does not stream the first token in time, disabled when zero
+	FirstTokenTimeout time.Duration `json:"first_token_timeout" yaml:"first_token_timeout" mapstructure:"first_token_timeout"`
+}
+
 type AzureOpenAIConfig struct {
 	ApiKey                 string            `json:"api_key" mapstructure:"api_key" yaml:"api_key"`
 	ResourceName           string            `json:"resource_name" mapstructure:"resource_name" yaml:"resource_name"`
@@ -132,6 +185,60 @@ func (c *AzureOpenAIConfig) ListModels() []string {
 	return models
 }
 
+// GoogleAIConfig is the config of the Gemini api.
+type GoogleAIConfig struct {
+	// SafetySettings is the block threshold of each harm category, like dangerous_content: block_only_high,
+	// the categories which are not set use the default threshold of the api
+	SafetySettings map[string]string `json:"safety_settings" mapstructure:"safety_settings" yaml:"safety_settings"`
+}
+
+var (
+	googleAIHarmCategories = []string{
+		"HARM_CATEGORY_HARASSMENT", "HARM_CATEGORY_HATE_SPEECH",
+		"HARM_CATEGORY_SEXUALLY_EXPLICIT", "HARM_CATEGORY_DANGEROUS_CONTENT",
+	}
+	googleAIBlockThresholds = []string{
+		"BLOCK_NONE", "BLOCK_ONLY_HIGH", "BLOCK_MEDIUM_AND_ABOVE", "BLOCK_LOW_AND_ABOVE",
+	}
+)
+
+func (c *GoogleAIConfig) validate() error {
+	for category, threshold := range c.SafetySettings {
+		if !slices.Contains(googleAIHarmCategories, harmCategory(category)) {
+			return fmt.Errorf("google_ai.safety_settings has an unknown category %s", category)
+		}
+		if !slices.Contains(googleAIBlockThresholds, strings.ToUpper(threshold)) {
+			return fmt.Errorf("google_ai.safety_settings.%s has an unknown threshold %s", category, threshold)
+		}
+	}
+	return nil
+}
+
+// HarmThresholds returns the thresholds of the safety settings by the full name of their category,
+// the keys may leave out the HARM_CATEGORY_ prefix and be in lower case as viper reads them.
+func (c *GoogleAIConfig) HarmThresholds() map[string]string {
+	thresholds := make(map[string]string, len(c.SafetySettings))
+	for category, threshold := range c.SafetySettings {
+		thresholds[harmCategory(category)] = strings.ToUpper(threshold)
+	}
+	return thresholds
+}
+
+func harmCategory(category string) string {
+	category = strings.ToUpper(category)
+	if !strings.HasPrefix(category, "HARM_CATEGORY_") {
+		category = "HARM_CATEGORY_" + category
+	}
+	return category
+}
+
+// CookieCloudConfig is the CookieCloud server the cookies of a browser are synced to.
+type CookieCloudConfig struct {
+	Host string `json:"host" mapstructure:"host" yaml:"host"`
+	UUID string `json:"uuid" mapstructure:"uuid" yaml:"uuid"`
+	Pass string `json:"pass" mapstructure:"pass" yaml:"pass"`
+}
+
 type AWSBedrockConfig struct {
 	// AccessKey is the access key for AWS Bedrock
 	AccessKey string `json:"access_key" mapstructure:"access_key" yaml:"access_key"`
@@ -154,6 +261,14 @@ func (c *AWSBedrockConfig) validate() error {
 	return nil
 }
 
+type OllamaConfig struct {
+	// Pull downloads a model which is not on the server yet on its first request
+	Pull bool `json:"pull" mapstructure:"pull" yaml:"pull"`
+	// KeepAlive is how long the model stays loaded after a request, like 10m or -1 to keep it loaded,
+	// the server default when empty
+	KeepAlive string `json:"keep_alive" mapstructure:"keep_alive" yaml:"keep_alive"`
+}
+
 type AiGatewayProvider struct {
 	Type        AiGatewayProviderType `json:"type" mapstructure:"type" yaml:"type"`
 	ApiKey      string                `json:"api_key" mapstructure:"api_key" yaml:"api_key"`
@@ -240,22 +355,63 @@ const (
 	OAIModelGPT4Dot32K       = "gpt-4-32k"
 	OAIModelGPT4TurboPreview = "gpt-4-1106-preview"
 	OAIModelGPT4V            = "gpt-4-vision-preview"
+	OAIModelEmbeddingAda002  = "text-embedding-ada-002"
+	OAIModel3SmallEmbedding  = "text-embedding-3-small"
+	OAIModel3LargeEmbedding  = "text-embedding-3-large"
 )
 
 const (
-	BedrockModelClaudeV1        = "anthropic.claude-v1"
-	BedrockModelClaudeV2        = "anthropic.claude-v2"
-	BedrockModelClaudeV2Dot1    = "anthropic.claude-v2:1"
-	BedrockModelClaudeInstantV1 = "anthropic.claude-instant-v1"
+	BedrockModelClaudeV1           = "anthropic.claude-v1"
+	BedrockModelClaudeV2           = "anthropic.claude-v2"
+	BedrockModelClaudeV2Dot1       = "anthropic.claude-v2:1"
+	BedrockModelClaudeInstantV1    = "anthropic.claude-instant-v1"
+	BedrockModelClaude3Sonnet      = "anthropic.claude-3-sonnet-20240229-v1:0"
+	BedrockModelClaude3Haiku       = "anthropic.claude-3-haiku-20240307-v1:0"
+	BedrockModelLlama2Chat13B      = "meta.llama2-13b-chat-v1"
+	BedrockModelLlama2Chat70B      = "meta.llama2-70b-chat-v1"
+	BedrockModelLlama3Instruct8B   = "meta.llama3-8b-instruct-v1:0"
+	BedrockModelLlama3Instruct70B  = "meta.llama3-70b-instruct-v1:0"
+	BedrockModelMistral7B          = "mistral.mistral-7b-instruct-v0:2"
+	BedrockModelMixtral8x7B        = "mistral.mixtral-8x7b-instruct-v0:1"
+	BedrockModelMistralLarge       = "mistral.mistral-large-2402-v1:0"
+	BedrockModelTitanTextExpress   = "amazon.titan-text-express-v1"
+	BedrockModelTitanTextLite      = "amazon.titan-text-lite-v1"
+	BedrockModelCohereCommand      = "cohere.command-text-v14"
+	BedrockModelCohereCommandR     = "cohere.command-r-v1:0"
+	BedrockModelCohereCommandRPlus = "cohere.command-r-plus-v1:0"
+	BedrockModelTitanEmbedText     = "amazon.titan-embed-text-v1"
+	BedrockModelCohereEmbedEN      = "cohere.embed-english-v3"
+	BedrockModelCohereEmbedML      = "cohere.embed-multilingual-v3"
 )
 
 var DefaultAwsBedrockModels = []string{
 	BedrockModelClaudeV1, BedrockModelClaudeV2, BedrockModelClaudeV2Dot1, BedrockModelClaudeInstantV1,
+	BedrockModelClaude3Sonnet, BedrockModelClaude3Haiku,
+	BedrockModelLlama2Chat13B, BedrockModelLlama2Chat70B, BedrockModelLlama3Instruct8B, BedrockModelLlama3Instruct70B,
+	BedrockModelMistral7B, BedrockModelMixtral8x7B, BedrockModelMistralLarge,
+	BedrockModelTitanTextExpress, BedrockModelTitanTextLite,
+	BedrockModelCohereCommand, BedrockModelCohereCommandR, BedrockModelCohereCommandRPlus,
 }
 
 const (
-	GoogleAIModelGeminiPro  = "gemini-pro"
-	GoogleAIModelGeminiProV = "gemini-pro-vision"
+	AnthropicModelClaude3Opus   = "claude-3-opus-20240229"
+	AnthropicModelClaude3Sonnet = "claude-3-sonnet-20240229"
+	AnthropicModelClaude3Haiku  = "claude-3-haiku-20240307"
 )
 
-var DefaultGeminiModel = fmt.Sprintf("%s/%s", LLMTypeGoogleAI, GoogleAIModelGeminiPro)
+var DefaultAnthropicModels = []string{AnthropicModelClaude3Opus, AnthropicModelClaude3Sonnet, AnthropicModelClaude3Haiku}
+
+const (
+	GoogleAIModelGeminiPro     = "gemini-pro"
+	GoogleAIModelGeminiProV    = "gemini-pro-vision"
+	GoogleAIModelGemini15Pro   = "gemini-1.5-pro-latest"
+	GoogleAIModelGemini15Flash = "gemini-1.5-flash-latest"
+	GoogleAIModelEmbedding001  = "embedding-001"
+)
+
+var (
+	DefaultGeminiModel       = fmt.Sprintf("%s/%s", LLMTypeGoogleAI, GoogleAIModelGeminiPro)
+	DefaultGeminiVisionModel = fmt.Sprintf("%s/%s", LLMTypeGoogleAI, GoogleAIModelGeminiProV)
+	// DefaultGeminiLongModel reads long inputs and writes up to 8192 tokens
+	DefaultGeminiLongModel = fmt.Sprintf("%s/%s", LLMTypeGoogleAI, GoogleAIModelGemini15Flash)
+)
@@ -3,6 +3,7 @@ package llm
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sort"
 	"strings"
 	"time"
@@ -11,17 +12,33 @@ import (
 	"github.com/patrickmn/go-cache"
 )
 
+var (
+	// ErrNotFound is returned for conversations and messages which do not exist or belong to another user
+	ErrNotFound       = errors.New("not found")
+	ErrCursorNotFound = errors.New("cursor not found")
+)
+
+// ListOptions pages through conversations and messages, they are listed by creation, oldest first.
+// Before and After are ids, only the items created before or after them are listed.
+// The limit keeps the items next to the cursor, so with Before the pages are walked backwards.
+type ListOptions struct {
+	Limit  int    `json:"limit,omitempty"`
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
 type Dao interface {
 	SaveConversation(ctx context.Context, conversation Conversation) (Conversation, error)
 	GetConversation(ctx context.Context, id string) (Conversation, error)
-	ListConversations(ctx context.Context) ([]Conversation, error)
+	ListConversations(ctx context.Context, opts ListOptions) ([]Conversation, error)
 	DeleteConversation(ctx context.Context, id string) error
 
 	SaveMessage(ctx context.Context, message Message) (Message, error)
 	GetMessage(ctx context.Context, id string) (Message, error)
-	ListMessages(ctx context.Context, conversationId string) ([]Message, error)
+	ListMessages(ctx context.Context, conversationId string, opts ListOptions) ([]Message, error)
 	DeleteMessage(ctx context.Context, id string) error
 
+	// GetConversationLastMessage returns the latest message of the conversation
 	GetConversationLastMessage(ctx context.Context, id string) (Message, error)
 }
 
@@ -38,8 +55,16 @@ func messageCacheKey(id string) string {
 	return messageCachePrefix + id
 }
 
+// ContextKeyUserId and ContextKeyAllUsers are the keys of the context values which scope the daos,
+// the id of the current user, and whether an admin asked for the data of all users.
+const (
+	ContextKeyUserId   = "user_id"
+	ContextKeyAllUsers = "all_users"
+)
+
 var DefaultDao = NewMemoryDao()
 
+// MemoryDao keeps the conversations and messages in memory, scoped to the user of ctx like the daos of a database.
 type MemoryDao struct {
 	client *cache.Cache
 }
@@ -50,12 +75,27 @@ func NewMemoryDao() *MemoryDao {
 	}
 }
 
+// owns reports whether the rows of the user are visible to ctx, admins which asked for all users see every row.
+func owns(ctx context.Context, userId string) bool {
+	if all, _ := ctx.Value(ContextKeyAllUsers).(bool); all {
+		return true
+	}
+	current, _ := ctx.Value(ContextKeyUserId).(string)
+	return userId == current
+}
+
 func (d *MemoryDao) SaveConversation(ctx context.Context, conversation Conversation) (Conversation, error) {
+	if conversation.UserId == "" {
+		conversation.UserId, _ = ctx.Value(ContextKeyUserId).(string)
+	}
 	if conversation.Id == "" {
 		conversation.Id = uuid.NewString()
+	} else if existing, ok := d.client.Get(conversationCacheKey(conversation.Id)); ok && !owns(ctx, existing.(Conversation).UserId) {
+		return Conversation{}, fmt.Errorf("conversation %s: %w", conversation.Id, ErrNotFound)
+	}
+	if conversation.CreatedAt.IsZero() {
+		conversation.CreatedAt = time.Now()
 	}
-	conversation.CreatedAt = time.Now()
-
 	conversation.UpdatedAt = time.Now()
 
 	d.client.Set(conversationCacheKey(conversation.Id), conversation, cache.DefaultExpiration)
@@ -64,32 +104,47 @@ func (d *MemoryDao) SaveConversation(ctx context.Context, conversation Conversat
 
 func (d *MemoryDao) GetConversation(ctx context.Context, id string) (Conversation, error) {
 	conversation, ok := d.client.Get(conversationCacheKey(id))
-	if !ok {
-		return Conversation{}, errors.New("conversation not found")
+	if !ok || !owns(ctx, conversation.(Conversation).UserId) {
+		return Conversation{}, fmt.Errorf("conversation %s: %w", id, ErrNotFound)
 	}
 	return conversation.(Conversation), nil
 }
 
-func (d *MemoryDao) ListConversations(ctx context.Context) ([]Conversation, error) {
-	var conversations []Conversation
+func (d *MemoryDao) ListConversations(ctx context.Context, opts ListOptions) ([]Conversation, error) {
+	conversations := make([]Conversation, 0)
 	for key, val := range d.client.Items() {
 		if strings.HasPrefix(key, conversationCachePrefix) {
-			conversations = append(conversations, val.Object.(Conversation))
+			conversation := val.Object.(Conversation)
+			if owns(ctx, conversation.UserId) {
+				conversations = append(conversations, conversation)
+			}
 		}
 	}
-	return conversations, nil
+	return paginate(conversations, func(c Conversation) (time.Time, string) { return c.CreatedAt, c.Id }, opts)
 }
 
 func (d *MemoryDao) DeleteConversation(ctx context.Context, id string) error {
+	if _, err := d.GetConversation(ctx, id); err != nil {
+		return err
+	}
 	d.client.Delete(conversationCacheKey(id))
 	return nil
 }
 
 func (d *MemoryDao) SaveMessage(ctx context.Context, message Message) (Message, error) {
+	// messages can only be added to the conversations of the user
+	if _, err := d.GetConversation(ctx, message.ConversationId); err != nil {
+		return Message{}, err
+	}
+	if message.UserId == "" {
+		message.UserId, _ = ctx.Value(ContextKeyUserId).(string)
+	}
 	if message.Id == "" {
 		message.Id = uuid.NewString()
 	}
-	message.CreatedAt = time.Now()
+	if message.CreatedAt.IsZero() {
+		message.CreatedAt = time.Now()
+	}
 	message.UpdatedAt = time.Now()
 
 	message.Model = message.Request.Model
@@ -99,42 +154,88 @@ func (d *MemoryDao) SaveMessage(ctx context.Context, message Message) (Message,
 
 func (d *MemoryDao) GetMessage(ctx context.Context, id string) (Message, error) {
 	message, ok := d.client.Get(messageCacheKey(id))
-	if !ok {
-		return Message{}, errors.New("message not found")
+	if !ok || !owns(ctx, message.(Message).UserId) {
+		return Message{}, fmt.Errorf("message %s: %w", id, ErrNotFound)
 	}
 	return message.(Message), nil
 }
 
-func (d *MemoryDao) ListMessages(ctx context.Context, conversationId string) ([]Message, error) {
-	var messages []Message
+func (d *MemoryDao) ListMessages(ctx context.Context, conversationId string, opts ListOptions) ([]Message, error) {
+	messages := make([]Message, 0)
 	for key, val := range d.client.Items() {
 		if strings.HasPrefix(key, messageCachePrefix) {
 			message := val.Object.(Message)
-			if message.ConversationId == conversationId {
+			if message.ConversationId == conversationId && owns(ctx, message.UserId) {
 				messages = append(messages, message)
 			}
 		}
 	}
-	return messages, nil
+	return paginate(messages, func(m Message) (time.Time, string) { return m.CreatedAt, m.Id }, opts)
 }
 
 func (d *MemoryDao) DeleteMessage(ctx context.Context, id string) error {
+	if _, err := d.GetMessage(ctx, id); err != nil {
+		return err
+	}
 	d.client.Delete(messageCacheKey(id))
 	return nil
 }
 
 func (d *MemoryDao) GetConversationLastMessage(ctx context.Context, id string) (Message, error) {
-	messages, err := d.ListMessages(ctx, id)
+	messages, err := d.ListMessages(ctx, id, ListOptions{})
 	if err != nil {
 		return Message{}, err
 	}
 	if len(messages) == 0 {
-		return Message{}, errors.New("conversation not found")
+		return Message{}, fmt.Errorf("last message of conversation %s: %w", id, ErrNotFound)
 	}
+	return messages[len(messages)-1], nil
+}
 
-	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].CreatedAt.Before(messages[j].CreatedAt)
+// paginate sorts the items by creation and id, and returns the page of opts.
+func paginate[T any](items []T, key func(T) (time.Time, string), opts ListOptions) ([]T, error) {
+	sort.Slice(items, func(i, j int) bool {
+		ti, idi := key(items[i])
+		tj, idj := key(items[j])
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return idi < idj
 	})
+	index := func(id string) (int, error) {
+		for i, item := range items {
+			if _, itemId := key(item); itemId == id {
+				return i, nil
+			}
+		}
+		return 0, ErrCursorNotFound
+	}
 
-	return messages[0], nil
+	start, end := 0, len(items)
+	if opts.After != "" {
+		i, err := index(opts.After)
+		if err != nil {
+			return nil, err
+		}
+		start = i + 1
+	}
+	if opts.Before != "" {
+		i, err := index(opts.Before)
+		if err != nil {
+			return nil, err
+		}
+		end = i
+	}
+	if end < start {
+		return items[:0], nil
+	}
+
+	page := items[start:end]
+	if opts.Limit > 0 && len(page) > opts.Limit {
+		if opts.Before != "" && opts.After == "" {
+			return page[len(page)-opts.Limit:], nil
+		}
+		return page[:opts.Limit], nil
+	}
+	return page, nil
 }
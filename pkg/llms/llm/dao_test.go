@@ -0,0 +1,15 @@
+package llm_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/Vaayne/aienvoy/pkg/llms/llm/llmtest"
+)
+
+func TestMemoryDao(t *testing.T) {
+	llmtest.TestDao(t, context.Background(), func(t *testing.T) llm.Dao {
+		return llm.NewMemoryDao()
+	})
+}
@@ -0,0 +1,125 @@
+package llm
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+var (
+	ErrEmbeddingsNotSupported = errors.New("embeddings are not supported by the client")
+	ErrInvalidEmbeddingInput  = errors.New("embedding input must be a string or an array of strings")
+)
+
+const (
+	EmbeddingEncodingFormatFloat  = "float"
+	EmbeddingEncodingFormatBase64 = "base64"
+)
+
+// Embedder is implemented by the clients which can create embeddings.
+type Embedder interface {
+	CreateEmbeddings(ctx context.Context, req EmbeddingRequest) (EmbeddingResponse, error)
+}
+
+type EmbeddingRequest struct {
+	// Input is a string or an array of strings
+	Input          any    `json:"input"`
+	Model          string `json:"model"`
+	EncodingFormat string `json:"encoding_format,omitempty"`
+	Dimensions     int    `json:"dimensions,omitempty"`
+	User           string `json:"user,omitempty"`
+}
+
+func (r *EmbeddingRequest) ModelId() string {
+	texts := strings.Split(r.Model, "/")
+	if len(texts) == 1 {
+		return r.Model
+	}
+	return strings.Join(texts[1:], "/")
+}
+
+// Inputs returns the texts to embed.
+func (r *EmbeddingRequest) Inputs() ([]string, error) {
+	switch input := r.Input.(type) {
+	case string:
+		return []string{input}, nil
+	case []string:
+		return input, nil
+	case []any:
+		inputs := make([]string, 0, len(input))
+		for _, v := range input {
+			text, ok := v.(string)
+			if !ok {
+				return nil, ErrInvalidEmbeddingInput
+			}
+			inputs = append(inputs, text)
+		}
+		return inputs, nil
+	default:
+		return nil, ErrInvalidEmbeddingInput
+	}
+}
+
+// EstimateTokens approximates the number of tokens of the inputs.
+func (r *EmbeddingRequest) EstimateTokens() int {
+	inputs, _ := r.Inputs()
+	tokens := 0
+	for _, input := range inputs {
+		tokens += CountTokens(r.Model, input)
+	}
+	return tokens
+}
+
+type Embedding struct {
+	Object    string    `json:"object"`
+	Embedding []float32 `json:"embedding"`
+	Index     int       `json:"index"`
+}
+
+type EmbeddingResponse struct {
+	Object string      `json:"object"`
+	Data   []Embedding `json:"data"`
+	Model  string      `json:"model"`
+	Usage  Usage       `json:"usage"`
+}
+
+// EncodeEmbeddingBase64 encodes the vector as little endian float32, like the base64 encoding format of openai.
+func EncodeEmbeddingBase64(vector []float32) string {
+	buf := make([]byte, 4*len(vector))
+	for i, v := range vector {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// CreateEmbeddingsInBatches splits the inputs of the request in batches of at most size inputs,
+// embeds them one batch after the other and merges the responses, for providers which limit the inputs per call.
+func CreateEmbeddingsInBatches(ctx context.Context, req EmbeddingRequest, size int, embed func(ctx context.Context, req EmbeddingRequest, inputs []string) (EmbeddingResponse, error)) (EmbeddingResponse, error) {
+	inputs, err := req.Inputs()
+	if err != nil {
+		return EmbeddingResponse{}, err
+	}
+	resp := EmbeddingResponse{Object: "list", Model: req.ModelId(), Data: make([]Embedding, 0, len(inputs))}
+	for start := 0; start < len(inputs); start += size {
+		batch := inputs[start:min(start+size, len(inputs))]
+		batchResp, err := embed(ctx, req, batch)
+		if err != nil {
+			return EmbeddingResponse{}, err
+		}
+		if len(batchResp.Data) != len(batch) {
+			return EmbeddingResponse{}, fmt.Errorf("got %d embeddings for %d inputs", len(batchResp.Data), len(batch))
+		}
+		for _, e := range batchResp.Data {
+			e.Object = "embedding"
+			e.Index += start
+			resp.Data = append(resp.Data, e)
+		}
+		resp.Usage.PromptTokens += batchResp.Usage.PromptTokens
+		resp.Usage.TotalTokens += batchResp.Usage.TotalTokens
+	}
+	return resp, nil
+}
@@ -0,0 +1,52 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbeddingRequestInputs(t *testing.T) {
+	var req EmbeddingRequest
+	assert.NoError(t, json.Unmarshal([]byte(`{"model":"openai/text-embedding-3-small","input":["a","b"]}`), &req))
+	inputs, err := req.Inputs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, inputs)
+	assert.Equal(t, "text-embedding-3-small", req.ModelId())
+
+	req.Input = "a"
+	inputs, err = req.Inputs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, inputs)
+
+	req.Input = []any{float64(1)}
+	_, err = req.Inputs()
+	assert.ErrorIs(t, err, ErrInvalidEmbeddingInput)
+}
+
+func TestCreateEmbeddingsInBatches(t *testing.T) {
+	req := EmbeddingRequest{Model: "embed", Input: []string{"a", "b", "c", "d", "e"}}
+	batches := make([][]string, 0)
+	resp, err := CreateEmbeddingsInBatches(context.Background(), req, 2, func(ctx context.Context, req EmbeddingRequest, inputs []string) (EmbeddingResponse, error) {
+		batches = append(batches, inputs)
+		resp := EmbeddingResponse{Usage: NewUsage(len(inputs), 0)}
+		for i, input := range inputs {
+			resp.Data = append(resp.Data, Embedding{Embedding: []float32{float32(input[0])}, Index: i})
+		}
+		return resp, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}, batches)
+	assert.Len(t, resp.Data, 5)
+	for i, e := range resp.Data {
+		assert.Equal(t, i, e.Index)
+		assert.Equal(t, float32('a'+i), e.Embedding[0])
+	}
+	assert.Equal(t, NewUsage(5, 0), resp.Usage)
+}
+
+func TestEncodeEmbeddingBase64(t *testing.T) {
+	assert.Equal(t, "AACAPwAAAMA=", EncodeEmbeddingBase64([]float32{1, -2}))
+}
@@ -0,0 +1,58 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrContentFilter is matched by the errors of the requests which the provider refused to answer because of its safety filters.
+var ErrContentFilter = errors.New("content filter")
+
+// ErrStreamInterrupted is matched by the errors of the streams which ended before the provider finished the response.
+var ErrStreamInterrupted = errors.New("stream interrupted")
+
+// APIError is returned by the clients when the provider responds with an unexpected status code,
+// it lets callers tell throttling and server errors apart from bad requests.
+type APIError struct {
+	StatusCode int
+	Message    string
+	Err        error
+}
+
+func NewAPIError(statusCode int, message string) *APIError {
+	return &APIError{StatusCode: statusCode, Message: message}
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api error, status code: %d, message: %s", e.StatusCode, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether the same request may succeed later or on another provider.
+func (e *APIError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode >= http.StatusInternalServerError
+}
+
+// ContentFilterError is returned when the provider blocked the prompt, Categories are the harm categories which triggered the block.
+type ContentFilterError struct {
+	Reason     string
+	Categories []string
+}
+
+func (e *ContentFilterError) Error() string {
+	if len(e.Categories) == 0 {
+		return fmt.Sprintf("prompt blocked by the content filter, reason: %s", e.Reason)
+	}
+	return fmt.Sprintf("prompt blocked by the content filter, reason: %s, categories: %s", e.Reason, strings.Join(e.Categories, ", "))
+}
+
+func (e *ContentFilterError) Is(target error) bool {
+	return target == ErrContentFilter
+}
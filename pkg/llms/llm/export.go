@@ -0,0 +1,441 @@
+package llm
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ExportFormat is the file format of exported conversations.
+type ExportFormat string
+
+const (
+	// ExportMarkdown renders the active branch of the conversations for reading
+	ExportMarkdown ExportFormat = "markdown"
+	// ExportJSON keeps the conversations with all their messages and branches, it can be imported again
+	ExportJSON ExportFormat = "json"
+	// ExportJSONL is the OpenAI fine-tuning format, one line with the active branch of every conversation
+	ExportJSONL ExportFormat = "jsonl"
+)
+
+// ImportFormat is the file format of imported conversations.
+type ImportFormat string
+
+const (
+	// ImportJSON is the ExportJSON format
+	ImportJSON ImportFormat = "json"
+	// ImportChatGPT is the conversations.json of a ChatGPT data export
+	ImportChatGPT ImportFormat = "chatgpt"
+	// ImportJSONL is the OpenAI fine-tuning format
+	ImportJSONL ImportFormat = "jsonl"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+// ConversationExport is a conversation with its messages, oldest first.
+type ConversationExport struct {
+	Conversation
+	Messages []Message `json:"messages"`
+}
+
+// ContentType returns the media type of the format.
+func (f ExportFormat) ContentType() string {
+	switch f {
+	case ExportMarkdown:
+		return "text/markdown; charset=utf-8"
+	case ExportJSONL:
+		return "application/jsonl"
+	default:
+		return "application/json"
+	}
+}
+
+// Ext returns the file extension of the format.
+func (f ExportFormat) Ext() string {
+	if f == ExportMarkdown {
+		return "md"
+	}
+	return string(f)
+}
+
+// ExportConversation returns the conversation with all its messages.
+func (l *LLM) ExportConversation(ctx context.Context, id string) (ConversationExport, error) {
+	cov, err := l.dao.GetConversation(ctx, id)
+	if err != nil {
+		return ConversationExport{}, err
+	}
+	messages, err := l.dao.ListMessages(ctx, id, ListOptions{})
+	if err != nil {
+		return ConversationExport{}, err
+	}
+	return ConversationExport{Conversation: cov, Messages: messages}, nil
+}
+
+// ExportConversations returns every conversation of the user of ctx with its messages.
+func (l *LLM) ExportConversations(ctx context.Context) ([]ConversationExport, error) {
+	covs, err := l.dao.ListConversations(ctx, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	exports := make([]ConversationExport, 0, len(covs))
+	for _, cov := range covs {
+		export, err := l.ExportConversation(ctx, cov.Id)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, export)
+	}
+	return exports, nil
+}
+
+// ImportConversations saves the conversations for the user of ctx. They get new ids,
+// so importing the same file twice or the export of another user does not overwrite anything.
+func (l *LLM) ImportConversations(ctx context.Context, exports []ConversationExport) ([]Conversation, error) {
+	covs := make([]Conversation, 0, len(exports))
+	for _, export := range exports {
+		ids := make(map[string]string, len(export.Messages))
+		for _, m := range export.Messages {
+			ids[m.Id] = uuid.NewString()
+		}
+
+		cov := export.Conversation
+		cov.Id = uuid.NewString()
+		cov.UserId = ""
+		cov.ActiveLeafId = ids[cov.ActiveLeafId]
+		cov.Summary, cov.SummaryUntil = "", ""
+		if cov.CreatedAt.IsZero() {
+			cov.CreatedAt = time.Now()
+		}
+		if cov.UpdatedAt.IsZero() {
+			cov.UpdatedAt = cov.CreatedAt
+		}
+		cov, err := l.dao.SaveConversation(ctx, cov)
+		if err != nil {
+			return covs, err
+		}
+
+		for i, m := range export.Messages {
+			if m.CreatedAt.IsZero() {
+				// keeps the order of the messages, the time is stored in milliseconds
+				m.CreatedAt = cov.CreatedAt.Add(time.Duration(i) * time.Millisecond)
+			}
+			m.Id = ids[m.Id]
+			m.ParentId = ids[m.ParentId]
+			m.ConversationId = cov.Id
+			m.UserId = ""
+			if _, err := l.dao.SaveMessage(ctx, m); err != nil {
+				return covs, err
+			}
+		}
+		slog.InfoContext(ctx, "import conversation", "conversation_id", cov.Id, "messages", len(export.Messages))
+		covs = append(covs, cov)
+	}
+	return covs, nil
+}
+
+// WriteExport writes the conversations in the format.
+func WriteExport(w io.Writer, format ExportFormat, exports []ConversationExport) error {
+	switch format {
+	case ExportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(exports)
+	case ExportMarkdown:
+		for i, export := range exports {
+			if i > 0 {
+				if _, err := io.WriteString(w, "\n---\n\n"); err != nil {
+					return err
+				}
+			}
+			if _, err := io.WriteString(w, exportMarkdown(export)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ExportJSONL:
+		enc := json.NewEncoder(w)
+		for _, export := range exports {
+			messages := activeMessages(export)
+			if len(messages) == 0 {
+				continue
+			}
+			if err := enc.Encode(fineTuneExample{Messages: messages}); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("export format %s: %w", format, ErrUnsupportedFormat)
+	}
+}
+
+// ReadImport reads the conversations of a file in the format.
+func ReadImport(r io.Reader, format ImportFormat) ([]ConversationExport, error) {
+	switch format {
+	case ImportJSON:
+		var exports []ConversationExport
+		if err := json.NewDecoder(r).Decode(&exports); err != nil {
+			return nil, fmt.Errorf("decode conversations: %w", err)
+		}
+		return exports, nil
+	case ImportChatGPT:
+		return readChatGPT(r)
+	case ImportJSONL:
+		return readFineTune(r)
+	default:
+		return nil, fmt.Errorf("import format %s: %w", format, ErrUnsupportedFormat)
+	}
+}
+
+// activeBranch returns the messages of the active branch of the export, the latest message is the leaf
+// when the active leaf is not set.
+func activeBranch(export ConversationExport) []Message {
+	leaf := export.ActiveLeafId
+	if leaf == "" && len(export.Messages) > 0 {
+		leaf = export.Messages[len(export.Messages)-1].Id
+	}
+	return messagePath(export.Messages, leaf)
+}
+
+// activeMessages flattens the active branch into the chat messages, the request of every message followed by its response.
+func activeMessages(export ConversationExport) []fineTuneMessage {
+	messages := make([]fineTuneMessage, 0)
+	for _, m := range activeBranch(export) {
+		for _, rm := range m.Request.Messages {
+			messages = append(messages, fineTuneMessage{Role: rm.Role, Content: rm.TextContent()})
+		}
+		if len(m.Response.Choices) > 0 {
+			rm := m.Response.Choices[0].Message
+			messages = append(messages, fineTuneMessage{Role: rm.Role, Content: rm.TextContent()})
+		}
+	}
+	return messages
+}
+
+func exportMarkdown(export ConversationExport) string {
+	var sb strings.Builder
+	name := export.Name
+	if name == "" {
+		name = "Conversation " + export.Id
+	}
+	sb.WriteString("# " + name + "\n\n")
+	if !export.CreatedAt.IsZero() {
+		sb.WriteString("_" + export.CreatedAt.Format(time.RFC3339) + "_\n\n")
+	}
+	for _, m := range activeMessages(export) {
+		role := m.Role
+		if role != "" {
+			role = strings.ToUpper(role[:1]) + role[1:]
+		}
+		sb.WriteString("## " + role + "\n\n" + strings.TrimSpace(m.Content) + "\n\n")
+	}
+	return sb.String()
+}
+
+// fineTuneExample is a line of the OpenAI fine-tuning format.
+type fineTuneExample struct {
+	Messages []fineTuneMessage `json:"messages"`
+}
+
+type fineTuneMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// readFineTune reads every line of a fine-tuning file as a linear conversation,
+// the messages up to each assistant message are the request of a turn.
+func readFineTune(r io.Reader) ([]ConversationExport, error) {
+	exports := make([]ConversationExport, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var example fineTuneExample
+		if err := json.Unmarshal([]byte(text), &example); err != nil {
+			return nil, fmt.Errorf("decode line %d: %w", line, err)
+		}
+
+		export := ConversationExport{Conversation: Conversation{
+			Id:   fmt.Sprintf("line-%d", line),
+			Name: fmt.Sprintf("Fine-tuning example %d", line),
+		}}
+		pending := make([]ChatCompletionMessage, 0)
+		for _, m := range example.Messages {
+			msg := ChatCompletionMessage{Role: m.Role, Content: m.Content}
+			if m.Role != ChatMessageRoleAssistant {
+				pending = append(pending, msg)
+				continue
+			}
+			export.Messages = append(export.Messages, turnMessage(export, pending, msg, time.Time{}))
+			pending = make([]ChatCompletionMessage, 0)
+		}
+		if len(export.Messages) > 0 {
+			export.ActiveLeafId = export.Messages[len(export.Messages)-1].Id
+			exports = append(exports, export)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+// turnMessage returns the message answering the request after the last message of the export.
+func turnMessage(export ConversationExport, request []ChatCompletionMessage, response ChatCompletionMessage, createdAt time.Time) Message {
+	parentId := ""
+	if len(export.Messages) > 0 {
+		parentId = export.Messages[len(export.Messages)-1].Id
+	}
+	return Message{
+		Id:             fmt.Sprintf("%s-%d", export.Id, len(export.Messages)),
+		CreatedAt:      createdAt,
+		UpdatedAt:      createdAt,
+		ConversationId: export.Id,
+		ParentId:       parentId,
+		Request:        ChatCompletionRequest{Messages: request},
+		Response: ChatCompletionResponse{Choices: []ChatCompletionChoice{{
+			Message:      response,
+			FinishReason: FinishReasonStop,
+		}}},
+	}
+}
+
+// chatGPTConversation is a conversation of the conversations.json of a ChatGPT data export,
+// the messages are the nodes of a tree and current_node is the leaf shown in ChatGPT.
+type chatGPTConversation struct {
+	Id          string                 `json:"id"`
+	Title       string                 `json:"title"`
+	CreateTime  float64                `json:"create_time"`
+	UpdateTime  float64                `json:"update_time"`
+	CurrentNode string                 `json:"current_node"`
+	Mapping     map[string]chatGPTNode `json:"mapping"`
+}
+
+type chatGPTNode struct {
+	Id      string          `json:"id"`
+	Parent  string          `json:"parent"`
+	Message *chatGPTMessage `json:"message"`
+}
+
+type chatGPTMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime float64 `json:"create_time"`
+	Content    struct {
+		ContentType string            `json:"content_type"`
+		Parts       []json.RawMessage `json:"parts"`
+	} `json:"content"`
+}
+
+// text returns the text parts of the message, images and other attachments are left out.
+func (m *chatGPTMessage) text() string {
+	texts := make([]string, 0, len(m.Content.Parts))
+	for _, part := range m.Content.Parts {
+		var text string
+		if err := json.Unmarshal(part, &text); err == nil && text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func chatGPTTime(seconds float64) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+// readChatGPT converts the ChatGPT tree into messages, every assistant node is the response of a message
+// and the nodes between it and the previous assistant node are its request. Edited prompts and regenerated
+// answers of ChatGPT become branches.
+func readChatGPT(r io.Reader) ([]ConversationExport, error) {
+	var conversations []chatGPTConversation
+	if err := json.NewDecoder(r).Decode(&conversations); err != nil {
+		return nil, fmt.Errorf("decode chatgpt conversations: %w", err)
+	}
+
+	exports := make([]ConversationExport, 0, len(conversations))
+	for _, c := range conversations {
+		export := ConversationExport{Conversation: Conversation{
+			Id:        c.Id,
+			Name:      c.Title,
+			CreatedAt: chatGPTTime(c.CreateTime),
+			UpdatedAt: chatGPTTime(c.UpdateTime),
+		}}
+
+		// answer returns the closest assistant node from the node up, empty at the root
+		answer := func(id string) string {
+			for seen := make(map[string]bool); id != "" && !seen[id]; id = c.Mapping[id].Parent {
+				seen[id] = true
+				if n := c.Mapping[id]; n.Message != nil && n.Message.Author.Role == ChatMessageRoleAssistant && n.Message.text() != "" {
+					return id
+				}
+			}
+			return ""
+		}
+
+		for id, node := range c.Mapping {
+			if node.Message == nil || node.Message.Author.Role != ChatMessageRoleAssistant || node.Message.text() == "" {
+				continue
+			}
+			parentId := answer(node.Parent)
+			request := make([]ChatCompletionMessage, 0)
+			for p := node.Parent; p != "" && p != parentId; p = c.Mapping[p].Parent {
+				n := c.Mapping[p]
+				if n.Message == nil || n.Message.text() == "" {
+					continue
+				}
+				switch n.Message.Author.Role {
+				case ChatMessageRoleUser, ChatMessageRoleSystem:
+					request = append([]ChatCompletionMessage{{Role: n.Message.Author.Role, Content: n.Message.text()}}, request...)
+				}
+			}
+			createdAt := chatGPTTime(node.Message.CreateTime)
+			if createdAt.IsZero() {
+				createdAt = export.CreatedAt
+			}
+			export.Messages = append(export.Messages, Message{
+				Id:             id,
+				CreatedAt:      createdAt,
+				UpdatedAt:      createdAt,
+				ConversationId: c.Id,
+				ParentId:       parentId,
+				Request:        ChatCompletionRequest{Messages: request},
+				Response: ChatCompletionResponse{Choices: []ChatCompletionChoice{{
+					Message:      ChatCompletionMessage{Role: ChatMessageRoleAssistant, Content: node.Message.text()},
+					FinishReason: FinishReasonStop,
+				}}},
+			})
+		}
+		if len(export.Messages) == 0 {
+			continue
+		}
+		sort.SliceStable(export.Messages, func(i, j int) bool {
+			if !export.Messages[i].CreatedAt.Equal(export.Messages[j].CreatedAt) {
+				return export.Messages[i].CreatedAt.Before(export.Messages[j].CreatedAt)
+			}
+			return export.Messages[i].Id < export.Messages[j].Id
+		})
+		export.ActiveLeafId = answer(c.CurrentNode)
+		exports = append(exports, export)
+	}
+	return exports, nil
+}
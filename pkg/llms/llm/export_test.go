@@ -0,0 +1,74 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chatGPTExport has a prompt answered twice, the second answer is the current node.
+const chatGPTExport = `[{
+	"id": "c1", "title": "Greetings", "create_time": 1700000000.5, "update_time": 1700000100, "current_node": "a2",
+	"mapping": {
+		"root": {"id": "root", "parent": null, "message": null},
+		"s": {"id": "s", "parent": "root", "message": {"author": {"role": "system"}, "content": {"content_type": "text", "parts": [""]}}},
+		"u1": {"id": "u1", "parent": "s", "message": {"author": {"role": "user"}, "create_time": 1700000001, "content": {"content_type": "text", "parts": ["hi"]}}},
+		"a1": {"id": "a1", "parent": "u1", "message": {"author": {"role": "assistant"}, "create_time": 1700000002, "content": {"content_type": "text", "parts": ["hello"]}}},
+		"a2": {"id": "a2", "parent": "u1", "message": {"author": {"role": "assistant"}, "create_time": 1700000003, "content": {"content_type": "text", "parts": ["hey"]}}}
+	}
+}]`
+
+func TestImportChatGPT(t *testing.T) {
+	exports, err := ReadImport(strings.NewReader(chatGPTExport), ImportChatGPT)
+	require.NoError(t, err)
+	require.Len(t, exports, 1)
+	export := exports[0]
+	assert.Equal(t, "Greetings", export.Name)
+	assert.Equal(t, "a2", export.ActiveLeafId)
+	require.Len(t, export.Messages, 2)
+	assert.Equal(t, "a1", export.Messages[0].Id)
+	assert.Empty(t, export.Messages[1].ParentId)
+	assert.Equal(t, "hi", export.Messages[1].Request.Messages[0].Content)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteExport(&buf, ExportJSONL, exports))
+	assert.Equal(t, `{"messages":[{"role":"user","content":"hi"},{"role":"assistant","content":"hey"}]}`+"\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, WriteExport(&buf, ExportMarkdown, exports))
+	assert.Contains(t, buf.String(), "# Greetings\n")
+	assert.Contains(t, buf.String(), "## Assistant\n\nhey\n")
+	assert.NotContains(t, buf.String(), "hello")
+}
+
+func TestImportExportConversations(t *testing.T) {
+	ctx := context.Background()
+	l := New(NewMemoryDao(), &echoClient{})
+	jsonl := `{"messages":[{"role":"system","content":"be brief"},{"role":"user","content":"one"},{"role":"assistant","content":"1"},{"role":"user","content":"two"},{"role":"assistant","content":"2"}]}`
+
+	exports, err := ReadImport(strings.NewReader(jsonl+"\n\n"), ImportJSONL)
+	require.NoError(t, err)
+	covs, err := l.ImportConversations(ctx, exports)
+	require.NoError(t, err)
+	require.Len(t, covs, 1)
+
+	// the imported conversation continues from its last message
+	msg, err := l.CreateMessage(ctx, covs[0].Id, ChatCompletionRequest{Model: "echo", Messages: []ChatCompletionMessage{{Role: ChatMessageRoleUser, Content: "three"}}})
+	require.NoError(t, err)
+	assert.NotEmpty(t, msg.ParentId)
+
+	export, err := l.ExportConversation(ctx, covs[0].Id)
+	require.NoError(t, err)
+	assert.Len(t, export.Messages, 3)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteExport(&buf, ExportJSONL, []ConversationExport{export}))
+	assert.Equal(t, strings.TrimSuffix(jsonl, "]}")+`,{"role":"user","content":"three"},{"role":"assistant","content":"three"}]}`+"\n", buf.String())
+
+	_, err = ReadImport(strings.NewReader(""), "csv")
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+}
@@ -0,0 +1,268 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// History names a HistoryStrategy, so it can be set in the configuration.
+type History string
+
+const (
+	// HistorySlidingWindow keeps the latest turns which fit the context of the model
+	HistorySlidingWindow History = "sliding-window"
+	// HistorySummary folds the turns which no longer fit into a rolling summary of the conversation
+	HistorySummary History = "summary"
+	// HistoryFull sends the whole history, like before the strategies existed
+	HistoryFull History = "full"
+)
+
+const (
+	// defaultContextLength is assumed for models missing from the catalog
+	defaultContextLength = 4096
+	// defaultCompletionTokens are kept free for the completion when the request has no max tokens
+	defaultCompletionTokens = 1024
+	// contextMarginPercent of the budget is kept free, the message overhead is approximate and the tokens of
+	// the models without a tokenizer are estimated
+	contextMarginPercent = 10
+)
+
+// Strategy returns the strategy of the name, the sliding window by default.
+func (h History) Strategy() HistoryStrategy {
+	switch h {
+	case HistorySummary:
+		return RollingSummary{}
+	case HistoryFull:
+		return FullHistory{}
+	default:
+		return SlidingWindow{}
+	}
+}
+
+// HistoryStrategy builds the messages sent for a new message of a conversation.
+type HistoryStrategy interface {
+	// BuildMessages returns the history of the conversation followed by the messages of the request,
+	// the history is the active branch oldest first and budget is the number of prompt tokens the model accepts.
+	BuildMessages(ctx context.Context, l *LLM, cov Conversation, history []Message, req ChatCompletionRequest, budget int) ([]ChatCompletionMessage, error)
+}
+
+// historyTurn is a previous message of the conversation, its request messages followed by the response.
+type historyTurn struct {
+	id       string
+	messages []ChatCompletionMessage
+	tokens   int
+}
+
+// splitHistory returns the system messages of the history, which stay pinned to the top of the request,
+// and the other messages grouped by turn. System messages repeated by the new request are left out.
+func splitHistory(history []Message, req ChatCompletionRequest) ([]ChatCompletionMessage, []historyTurn) {
+	seen := make(map[string]bool)
+	for _, m := range req.Messages {
+		if m.Role == ChatMessageRoleSystem {
+			seen[m.TextContent()] = true
+		}
+	}
+
+	pinned := make([]ChatCompletionMessage, 0)
+	turns := make([]historyTurn, 0, len(history))
+	for _, message := range history {
+		t := historyTurn{id: message.Id}
+		for _, m := range message.Request.Messages {
+			if m.Role != ChatMessageRoleSystem {
+				t.messages = append(t.messages, m)
+				continue
+			}
+			if !seen[m.TextContent()] {
+				seen[m.TextContent()] = true
+				pinned = append(pinned, m)
+			}
+		}
+		if len(message.Response.Choices) > 0 {
+			t.messages = append(t.messages, message.Response.Choices[0].Message)
+		}
+		t.tokens = estimateMessagesTokens(req.Model, t.messages)
+		turns = append(turns, t)
+	}
+	return pinned, turns
+}
+
+// fitTurns returns the index of the oldest turn from which all the turns fit the budget.
+func fitTurns(turns []historyTurn, budget int) int {
+	start := len(turns)
+	for start > 0 && turns[start-1].tokens <= budget {
+		budget -= turns[start-1].tokens
+		start--
+	}
+	return start
+}
+
+func joinMessages(pinned []ChatCompletionMessage, turns []historyTurn, messages []ChatCompletionMessage) []ChatCompletionMessage {
+	reqMessages := make([]ChatCompletionMessage, 0, len(pinned)+len(messages)+2*len(turns))
+	reqMessages = append(reqMessages, pinned...)
+	for _, t := range turns {
+		reqMessages = append(reqMessages, t.messages...)
+	}
+	return append(reqMessages, messages...)
+}
+
+// FullHistory sends every previous message, requests fail once the conversation outgrows the context.
+type FullHistory struct{}
+
+func (FullHistory) BuildMessages(ctx context.Context, l *LLM, cov Conversation, history []Message, req ChatCompletionRequest, budget int) ([]ChatCompletionMessage, error) {
+	pinned, turns := splitHistory(history, req)
+	return joinMessages(pinned, turns, req.Messages), nil
+}
+
+// SlidingWindow sends the latest turns which fit the budget, the system prompt is always kept.
+type SlidingWindow struct{}
+
+func (SlidingWindow) BuildMessages(ctx context.Context, l *LLM, cov Conversation, history []Message, req ChatCompletionRequest, budget int) ([]ChatCompletionMessage, error) {
+	pinned, turns := splitHistory(history, req)
+	start := fitTurns(turns, budget-estimateMessagesTokens(req.Model, pinned)-estimateMessagesTokens(req.Model, req.Messages))
+	if start > 0 {
+		slog.InfoContext(ctx, "history exceeds the context, drop the oldest turns", "conversation_id", cov.Id, "dropped", start, "kept", len(turns)-start)
+	}
+	return joinMessages(pinned, turns[start:], req.Messages), nil
+}
+
+// RollingSummary is a sliding window which folds the turns leaving the window into Conversation.Summary,
+// the summary is sent after the system prompt once the history no longer fits. Conversation.SummaryUntil
+// is the last turn in the summary, the window may overlap it when the Annotator keeps the summary up to date.
+// To not summarize on every message once the window is full, turns are folded until half the budget is free.
+type RollingSummary struct{}
+
+const summaryPrompt = `You maintain the summary of a conversation between a user and an assistant.
+Merge the previous summary and the new messages into one concise summary, keep the facts, decisions, names and open questions
+the assistant needs to continue the conversation. Reply with the summary only.`
+
+func (RollingSummary) BuildMessages(ctx context.Context, l *LLM, cov Conversation, history []Message, req ChatCompletionRequest, budget int) ([]ChatCompletionMessage, error) {
+	pinned, turns := splitHistory(history, req)
+	from := -1
+	for i, t := range turns {
+		if t.id == cov.SummaryUntil {
+			from = i + 1
+			break
+		}
+	}
+	if from < 0 {
+		// the summary was made on another branch, it is rebuilt for this one
+		from = 0
+		cov.Summary, cov.SummaryUntil = "", ""
+	}
+
+	available := budget - estimateMessagesTokens(req.Model, pinned) - estimateMessagesTokens(req.Model, req.Messages)
+	if fitTurns(turns, available) == 0 {
+		return joinMessages(pinned, turns, req.Messages), nil
+	}
+	start := fitTurns(turns, available-estimateMessagesTokens(req.Model, summaryMessages(cov.Summary)))
+	if start > from {
+		// turns which are not in the summary leave the window
+		until := from + fitTurns(turns[from:], available/2)
+		summary, last, err := l.summarize(ctx, req.Model, cov.Summary, turns[from:until], budget-CountTokens(req.Model, summaryPrompt))
+		if err != nil {
+			// the turns are dropped for this request, they are summarized with the next one
+			slog.ErrorContext(ctx, "summarize conversation error", "err", err, "conversation_id", cov.Id)
+		} else if last >= 0 {
+			cov.Summary = summary
+			cov.SummaryUntil = turns[from+last].id
+			cov.UpdatedAt = time.Now()
+			if _, err := l.dao.SaveConversation(ctx, cov); err != nil {
+				slog.ErrorContext(ctx, "save conversation summary error", "err", err, "conversation_id", cov.Id)
+			}
+			from += last + 1
+		}
+		start = fitTurns(turns, available-estimateMessagesTokens(req.Model, summaryMessages(cov.Summary)))
+	}
+
+	return joinMessages(append(pinned, summaryMessages(cov.Summary)...), turns[start:], req.Messages), nil
+}
+
+func summaryMessages(summary string) []ChatCompletionMessage {
+	if summary == "" {
+		return nil
+	}
+	return []ChatCompletionMessage{{
+		Role:    ChatMessageRoleSystem,
+		Content: "Summary of the earlier conversation:\n" + summary,
+	}}
+}
+
+// summarize merges the turns into the summary, taking as many turns as fit the budget.
+// It returns the new summary and the index of the last summarized turn, -1 if none fit.
+func (l *LLM) summarize(ctx context.Context, model, summary string, turns []historyTurn, budget int) (string, int, error) {
+	var sb strings.Builder
+	if summary != "" {
+		sb.WriteString("Previous summary:\n" + summary + "\n\nNew messages:\n")
+	}
+	budget -= CountTokens(model, sb.String())
+	last := -1
+	for i, t := range turns {
+		if t.tokens > budget && last >= 0 {
+			break
+		}
+		for _, m := range t.messages {
+			sb.WriteString(fmt.Sprintf("%s: %s\n", m.Role, m.TextContent()))
+		}
+		budget -= t.tokens
+		last = i
+	}
+	if last < 0 {
+		return summary, last, nil
+	}
+
+	resp, err := l.CreateChatCompletion(ctx, ChatCompletionRequest{
+		Model: model,
+		Messages: []ChatCompletionMessage{
+			{Role: ChatMessageRoleSystem, Content: summaryPrompt},
+			{Role: ChatMessageRoleUser, Content: sb.String()},
+		},
+	})
+	if err != nil {
+		return "", -1, err
+	}
+	if len(resp.Choices) == 0 {
+		return "", -1, fmt.Errorf("summarize conversation: empty response")
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), last, nil
+}
+
+// buildMessages adds the history of the conversation to the messages of the request, with the history strategy of the client.
+// The history is the branch ending with the parent message, empty if the parent is empty.
+func (l *LLM) buildMessages(ctx context.Context, cov Conversation, parentId string, req ChatCompletionRequest) ([]ChatCompletionMessage, error) {
+	messages, err := l.ListMessages(ctx, cov.Id, ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	strategy := l.History
+	if strategy == nil {
+		strategy = SlidingWindow{}
+	}
+	return strategy.BuildMessages(ctx, l, cov, messagePath(messages, parentId), req, l.contextBudget(req))
+}
+
+// contextBudget returns the prompt tokens the model of the request accepts, its context length from the catalog
+// less the tokens kept for the completion and a safety margin.
+func (l *LLM) contextBudget(req ChatCompletionRequest) int {
+	catalog := l.Catalog
+	if catalog == nil {
+		catalog = defaultCatalog
+	}
+	provider := ""
+	if p, _, ok := strings.Cut(req.Model, "/"); ok {
+		provider = p
+	}
+	m, _ := catalog.Lookup(provider, req.ModelId())
+	length := m.ContextLength
+	if length <= 0 {
+		length = defaultContextLength
+	}
+	reserve := req.MaxTokens
+	if reserve <= 0 {
+		reserve = min(defaultCompletionTokens, length/4)
+	}
+	budget := max(length-reserve, 0)
+	return budget - budget*contextMarginPercent/100
+}
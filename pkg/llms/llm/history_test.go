@@ -0,0 +1,105 @@
+package llm
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// echoClient replies with the content of the last message, summary and title requests get a fixed answer.
+type echoClient struct {
+	requests []ChatCompletionRequest
+}
+
+func (c *echoClient) ListModels() []string {
+	return []string{"echo"}
+}
+
+func (c *echoClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest, dataChan chan ChatCompletionStreamResponse, errChan chan error) {
+	c.requests = append(c.requests, req)
+	content := req.Messages[len(req.Messages)-1].TextContent()
+	switch req.Messages[0].Content {
+	case summaryPrompt:
+		content = "the summary"
+	case titlePrompt:
+		content = `"The title."`
+	}
+	dataChan <- ChatCompletionStreamResponse{Choices: []ChatCompletionStreamChoice{{Delta: ChatCompletionStreamChoiceDelta{Content: content}}}}
+	errChan <- io.EOF
+}
+
+func newHistoryConversation(t *testing.T, l *LLM, turns int) Conversation {
+	cov, err := l.CreateConversation(context.Background(), "")
+	assert.NoError(t, err)
+	for i := 0; i < turns; i++ {
+		messages := []ChatCompletionMessage{{Role: ChatMessageRoleUser, Content: strings.Repeat("a", 400)}}
+		if i == 0 {
+			messages = append([]ChatCompletionMessage{{Role: ChatMessageRoleSystem, Content: "be brief"}}, messages...)
+		}
+		parentId := ""
+		if i > 0 {
+			parentId = string(rune('a' + i - 1))
+		}
+		_, err := l.dao.SaveMessage(context.Background(), Message{
+			Id:             string(rune('a' + i)),
+			CreatedAt:      time.Unix(int64(i), 0),
+			ConversationId: cov.Id,
+			ParentId:       parentId,
+			Request:        ChatCompletionRequest{Messages: messages},
+			Response:       ChatCompletionResponse{Choices: []ChatCompletionChoice{{Message: ChatCompletionMessage{Role: ChatMessageRoleAssistant, Content: strings.Repeat("b", 400)}}}},
+		})
+		assert.NoError(t, err)
+	}
+	return cov
+}
+
+func TestSlidingWindow(t *testing.T) {
+	l := New(NewMemoryDao(), &echoClient{})
+	cov := newHistoryConversation(t, l, 5)
+	req := ChatCompletionRequest{Model: "echo", Messages: []ChatCompletionMessage{{Role: ChatMessageRoleUser, Content: "hi"}}}
+
+	// every turn is about 208 tokens, the budget fits two of them
+	history, err := l.ListMessages(context.Background(), cov.Id, ListOptions{})
+	assert.NoError(t, err)
+	history = messagePath(history, "e")
+	messages, err := SlidingWindow{}.BuildMessages(context.Background(), l, cov, history, req, 500)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 6)
+	assert.Equal(t, "be brief", messages[0].Content)
+	assert.Equal(t, "hi", messages[5].Content)
+
+	messages, err = FullHistory{}.BuildMessages(context.Background(), l, cov, history, req, 500)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 12)
+}
+
+func TestRollingSummary(t *testing.T) {
+	cli := &echoClient{}
+	l := New(NewMemoryDao(), cli)
+	l.History = RollingSummary{}
+	l.Catalog = NewCatalog([]Model{{ID: "echo", ContextLength: 1100}})
+	cov := newHistoryConversation(t, l, 5)
+
+	// the budget is 90% of 1100-275 tokens, three of the five turns fit, the turns are folded into the summary
+	// until half of the budget is free, but the summary request itself only fits three turns
+	msg, err := l.CreateMessage(context.Background(), cov.Id, ChatCompletionRequest{Model: "echo", Messages: []ChatCompletionMessage{{Role: ChatMessageRoleUser, Content: "hi"}}})
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", msg.Response.Choices[0].Message.Content)
+	assert.Len(t, msg.Request.Messages, 1)
+
+	cov, err = l.GetConversation(context.Background(), cov.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, "the summary", cov.Summary)
+	assert.Equal(t, "c", cov.SummaryUntil)
+
+	assert.Len(t, cli.requests, 2)
+	sent := cli.requests[1].Messages
+	assert.Equal(t, "be brief", sent[0].Content)
+	assert.Equal(t, "Summary of the earlier conversation:\nthe summary", sent[1].Content)
+	// the turns c to e and the new message, the window overlaps the summary
+	assert.Len(t, sent, 9)
+}
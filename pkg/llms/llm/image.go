@@ -0,0 +1,194 @@
+package llm
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxImageSize limits the size of remote images which are downloaded to be inlined.
+	maxImageSize = 20 << 20
+	// imageFetchTimeout bounds the whole download of a remote image, redirects included.
+	imageFetchTimeout = 30 * time.Second
+	maxImageRedirects = 5
+)
+
+var (
+	ErrInvalidDataURL = errors.New("invalid base64 data url")
+	// ErrImageURLNotAllowed is returned for image urls which are not http(s) or point to a non public address.
+	ErrImageURLNotAllowed = errors.New("image url is not allowed")
+)
+
+// sharedAddressSpace is the carrier-grade NAT range, which is used for internal networks too.
+var _, sharedAddressSpace, _ = net.ParseCIDR("100.64.0.0/10")
+
+// imageClient downloads the remote images of the requests. The urls come from the callers of the api,
+// so it only connects to public addresses, which are checked when dialing to cover redirects and dns rebinding.
+var imageClient = newImageClient(isPublicIP)
+
+func newImageClient(allowed func(ip net.IP) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !allowed(ip) {
+				return fmt.Errorf("%w, address %s is not public", ErrImageURLNotAllowed, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: imageFetchTimeout,
+		// no proxy, it would be dialed instead of the image host
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxImageRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxImageRedirects)
+			}
+			return checkImageURL(req.URL)
+		},
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() && !sharedAddressSpace.Contains(ip)
+}
+
+func checkImageURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w, scheme %q is not http(s)", ErrImageURLNotAllowed, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%w, no host", ErrImageURLNotAllowed)
+	}
+	return nil
+}
+
+func NewTextPart(text string) ChatMessagePart {
+	return ChatMessagePart{Type: ChatMessagePartTypeText, Text: text}
+}
+
+// NewImageURLPart creates an image part which references an image by url.
+func NewImageURLPart(url string) ChatMessagePart {
+	return ChatMessagePart{Type: ChatMessagePartTypeImageURL, ImageURL: &ChatMessageImageURL{URL: url}}
+}
+
+// NewImageBase64Part creates an image part which embeds the image as a base64 data url.
+func NewImageBase64Part(mimeType string, data []byte) ChatMessagePart {
+	return NewImageURLPart(ToDataURL(mimeType, data))
+}
+
+func ToDataURL(mimeType string, data []byte) string {
+	return fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(data))
+}
+
+func IsDataURL(url string) bool {
+	return strings.HasPrefix(url, "data:")
+}
+
+// ParseDataURL splits a base64 data url into its mime type and the still base64 encoded data.
+func ParseDataURL(url string) (mimeType string, data string, err error) {
+	if !IsDataURL(url) {
+		return "", "", ErrInvalidDataURL
+	}
+	meta, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !ok {
+		return "", "", ErrInvalidDataURL
+	}
+	mimeType, ok = strings.CutSuffix(meta, ";base64")
+	if !ok || mimeType == "" {
+		return "", "", ErrInvalidDataURL
+	}
+	return mimeType, data, nil
+}
+
+// ImagePart returns the mime type and the base64 encoded data of an image part.
+// Remote images are inlined by the client before the request is built, other urls are skipped with a warning.
+func ImagePart(part ChatMessagePart) (mimeType string, data string, ok bool) {
+	if part.ImageURL == nil {
+		return "", "", false
+	}
+	mimeType, data, err := ParseDataURL(part.ImageURL.URL)
+	if err != nil {
+		slog.Warn("skip image which is not a data url", "url", part.ImageURL.URL)
+		return "", "", false
+	}
+	return mimeType, data, true
+}
+
+// FetchImage downloads a remote image from a public http(s) url and returns it as a base64 data url.
+func FetchImage(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("create image request error: %w", err)
+	}
+	if err := checkImageURL(req.URL); err != nil {
+		return "", err
+	}
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("download image error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download image error, status: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return "", fmt.Errorf("read image error: %w", err)
+	}
+	if len(data) > maxImageSize {
+		return "", fmt.Errorf("image %s is larger than %d bytes", url, maxImageSize)
+	}
+	mimeType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = http.DetectContentType(data)
+	}
+	return ToDataURL(mimeType, data), nil
+}
+
+// InlineImages replaces the remote image urls of the request by data urls, for providers
+// which only accept embedded images. The messages of the request are copied, not modified.
+func InlineImages(ctx context.Context, req ChatCompletionRequest) (ChatCompletionRequest, error) {
+	messages := make([]ChatCompletionMessage, len(req.Messages))
+	for i, message := range req.Messages {
+		messages[i] = message
+		if !message.HasImage() {
+			continue
+		}
+		parts := make([]ChatMessagePart, len(message.MultiContent))
+		for j, part := range message.MultiContent {
+			parts[j] = part
+			if part.ImageURL == nil || IsDataURL(part.ImageURL.URL) {
+				continue
+			}
+			url, err := FetchImage(ctx, part.ImageURL.URL)
+			if err != nil {
+				return req, err
+			}
+			parts[j].ImageURL = &ChatMessageImageURL{URL: url, Detail: part.ImageURL.Detail}
+		}
+		messages[i].MultiContent = parts
+	}
+	req.Messages = messages
+	return req, nil
+}
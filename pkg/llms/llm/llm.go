@@ -5,7 +5,6 @@ import (
 	"errors"
 	"io"
 	"log/slog"
-	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,9 +18,21 @@ type Client interface {
 	CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest, respChan chan ChatCompletionStreamResponse, errChan chan error)
 }
 
+// ModelDiscoverer is implemented by the clients which list their models from the provider, like a local server.
+// The models of a config which lists none are discovered when the router is built.
+type ModelDiscoverer interface {
+	DiscoverModels(ctx context.Context) ([]string, error)
+}
+
 type LLM struct {
 	Client
 	dao Dao
+	// History builds the history sent with the messages of a conversation, defaults to a sliding window
+	History HistoryStrategy
+	// Catalog provides the context length of the models, defaults to the bundled catalog
+	Catalog *Catalog
+	// Annotator titles and summarizes the conversations after new messages, nothing is done when it is nil
+	Annotator *Annotator
 }
 
 func New(dao Dao, c Client) *LLM {
@@ -31,6 +42,32 @@ func New(dao Dao, c Client) *LLM {
 	}
 }
 
+// WithDao returns a copy of the client which reads and saves with dao, like the dao of a transaction.
+// The requests it sends carry the dao in their context, see DaoFrom.
+func (l *LLM) WithDao(dao Dao) *LLM {
+	c := *l
+	c.dao = dao
+	return &c
+}
+
+type daoKey struct{}
+
+// withDao returns a context which carries the dao of the client sending the request. Clients wrapping
+// other clients keep the dao of the outermost one, the dao of the caller.
+func withDao(ctx context.Context, dao Dao) context.Context {
+	if dao == nil || DaoFrom(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, daoKey{}, dao)
+}
+
+// DaoFrom returns the dao of the client which sent the request of ctx, nil when there is none.
+// The router wrappers use it to record the usage and cache the responses with the dao of the caller.
+func DaoFrom(ctx context.Context) Dao {
+	dao, _ := ctx.Value(daoKey{}).(Dao)
+	return dao
+}
+
 func (l *LLM) CreateConversation(ctx context.Context, name string) (Conversation, error) {
 	cov, err := l.dao.SaveConversation(ctx, Conversation{
 		Id:        uuid.NewString(),
@@ -42,8 +79,8 @@ func (l *LLM) CreateConversation(ctx context.Context, name string) (Conversation
 	return cov, err
 }
 
-func (l *LLM) ListConversations(ctx context.Context) ([]Conversation, error) {
-	conversations, err := l.dao.ListConversations(ctx)
+func (l *LLM) ListConversations(ctx context.Context, opts ListOptions) ([]Conversation, error) {
+	conversations, err := l.dao.ListConversations(ctx, opts)
 	slog.InfoContext(ctx, "list conversations", "conversations", conversations, "err", err)
 	return conversations, err
 }
@@ -60,6 +97,7 @@ func (l *LLM) DeleteConversation(ctx context.Context, id string) error {
 	return err
 }
 
+// CreateMessage adds a message to the conversation after its active leaf.
 func (l *LLM) CreateMessage(ctx context.Context, conversationId string, req ChatCompletionRequest) (Message, error) {
 	if conversationId == "" {
 		slog.ErrorContext(ctx, "conversation id is empty")
@@ -70,117 +108,164 @@ func (l *LLM) CreateMessage(ctx context.Context, conversationId string, req Chat
 		slog.ErrorContext(ctx, "get conversation for create message error", "err", err, "conversation_id", conversationId)
 		return Message{}, err
 	}
-
-	messages, err := l.ListMessages(ctx, cov.Id)
+	parentId, err := l.activeLeaf(ctx, cov)
 	if err != nil {
-		slog.ErrorContext(ctx, "list messages for create message error", "err", err, "conversation_id", conversationId)
+		slog.ErrorContext(ctx, "get active leaf for create message error", "err", err, "conversation_id", conversationId)
 		return Message{}, err
 	}
+	return l.createMessage(ctx, cov, parentId, req)
+}
+
+// createMessage adds a message after the parent, the history sent to the model is the path to the parent.
+func (l *LLM) createMessage(ctx context.Context, cov Conversation, parentId string, req ChatCompletionRequest) (Message, error) {
+	var err error
+	ctx, native := withBranchNativeConversations(ctx, cov, parentId)
 	originReqMessages := req.Messages
-	reqMessages := make([]ChatCompletionMessage, 0)
 	// add history message to request
-	for _, message := range messages {
-		// latest request message as prompt
-		reqMessages = append(reqMessages, message.Request.Messages...)
-		// add response message as prompt
-		reqMessages = append(reqMessages, message.Response.Choices[0].Message)
-	}
-	reqMessages = append(reqMessages, originReqMessages...)
-	req.Messages = reqMessages
+	req.Messages, err = l.buildMessages(ctx, cov, parentId, req)
+	if err != nil {
+		slog.ErrorContext(ctx, "list messages for create message error", "err", err, "conversation_id", cov.Id)
+		return Message{}, err
+	}
 	resp, err := l.CreateChatCompletion(ctx, req)
 	if err != nil {
-		slog.ErrorContext(ctx, "create message error", "err", err, "conversation_id", conversationId, "model", req.ModelId())
+		slog.ErrorContext(ctx, "create message error", "err", err, "conversation_id", cov.Id, "model", req.ModelId())
 		return Message{}, err
 	}
 	req.Messages = originReqMessages
 	message, err := l.dao.SaveMessage(ctx, Message{
-		CreatedAt:      time.Now(),
-		UpdatedAt:      time.Now(),
-		ConversationId: conversationId,
-		Model:          req.ModelId(),
-		Request:        req,
-		Response:       resp,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+		ConversationId:  cov.Id,
+		ParentId:        parentId,
+		Model:           req.ModelId(),
+		PromptToken:     resp.Usage.PromptTokens,
+		CompletionToken: resp.Usage.CompletionTokens,
+		Request:         req,
+		Response:        resp,
 	})
 	slog.InfoContext(ctx, "create message", "message", message, "err", err)
-	return message, err
+	if err != nil {
+		return message, err
+	}
+	if err := l.setActiveLeaf(ctx, cov.Id, message.Id); err != nil {
+		return message, err
+	}
+	if err := native.save(ctx, l.dao, cov.Id); err != nil {
+		return message, err
+	}
+	l.annotate(ctx, cov.Id)
+	return message, nil
 }
 
+// CreateMessageStream is like CreateMessage, the response is streamed.
 func (l *LLM) CreateMessageStream(ctx context.Context, conversationId string, req ChatCompletionRequest, respChan chan ChatCompletionStreamResponse, errChan chan error) {
 	if conversationId == "" {
 		slog.ErrorContext(ctx, "conversation id is empty")
 		errChan <- errors.New("conversation id is empty")
 		return
 	}
-	_, err := l.dao.GetConversation(ctx, conversationId)
+	cov, err := l.dao.GetConversation(ctx, conversationId)
 	if err != nil {
 		slog.ErrorContext(ctx, "get conversation for create message error", "err", err, "conversation_id", conversationId)
 		errChan <- err
 		return
 	}
-
-	messages, err := l.ListMessages(ctx, conversationId)
+	parentId, err := l.activeLeaf(ctx, cov)
 	if err != nil {
-		slog.ErrorContext(ctx, "list messages for create message error", "err", err, "conversation_id", conversationId)
+		slog.ErrorContext(ctx, "get active leaf for create message error", "err", err, "conversation_id", conversationId)
 		errChan <- err
 		return
 	}
+	l.createMessageStream(ctx, cov, parentId, req, respChan, errChan)
+}
+
+func (l *LLM) createMessageStream(ctx context.Context, cov Conversation, parentId string, req ChatCompletionRequest, respChan chan ChatCompletionStreamResponse, errChan chan error) {
+	var err error
+	ctx, native := withBranchNativeConversations(ctx, cov, parentId)
 	originReqMessages := req.Messages
-	reqMessages := make([]ChatCompletionMessage, 0)
 	// add history message to request
-	for _, message := range messages {
-		// latest request message as prompt
-		reqMessages = append(reqMessages, message.Request.Messages...)
-		// add response message as prompt
-		reqMessages = append(reqMessages, message.Response.Choices[0].Message)
+	req.Messages, err = l.buildMessages(ctx, cov, parentId, req)
+	if err != nil {
+		slog.ErrorContext(ctx, "list messages for create message error", "err", err, "conversation_id", cov.Id)
+		errChan <- err
+		return
 	}
-	reqMessages = append(reqMessages, originReqMessages...)
-	req.Messages = reqMessages
 
 	slog.InfoContext(ctx, "create message stream", "req", req)
 
 	innerDataChan := make(chan ChatCompletionStreamResponse)
 	innerErrChan := make(chan error)
 
-	go l.Client.CreateChatCompletionStream(ctx, req, innerDataChan, innerErrChan)
+	// the usage is always requested, so it can be saved with the message
+	includeUsage := req.IncludeUsage()
+	innerReq := req
+	innerReq.StreamOptions = &StreamOptions{IncludeUsage: true}
+	go l.Client.CreateChatCompletionStream(withDao(ctx, l.dao), innerReq, innerDataChan, innerErrChan)
 
-	sb := strings.Builder{}
-
-	var resp ChatCompletionStreamResponse
+	acc := NewStreamAccumulator()
 
 	for {
 		select {
-		case resp = <-innerDataChan:
-			sb.WriteString(resp.Choices[0].Delta.Content)
-			respChan <- resp
+		case resp := <-innerDataChan:
+			acc.Add(resp)
+			if len(resp.Choices) > 0 || includeUsage {
+				respChan <- resp
+			}
 		case err := <-innerErrChan:
 			if errors.Is(err, io.EOF) {
 				req.Messages = originReqMessages
-				chatCompletionResponse := resp.ToChatCompletionResponse()
-				chatCompletionResponse.Choices[0].Message.Content = sb.String()
-				if _, err := l.dao.SaveMessage(ctx, Message{
-					Id:             resp.ID,
-					CreatedAt:      time.Now(),
-					UpdatedAt:      time.Now(),
-					ConversationId: conversationId,
-					Model:          req.ModelId(),
-					Request:        req,
-					Response:       chatCompletionResponse,
-				}); err != nil {
+				chatCompletionResponse := acc.Response()
+				if chatCompletionResponse.Usage.TotalTokens == 0 {
+					chatCompletionResponse.Usage = EstimateUsage(innerReq, chatCompletionResponse)
+				}
+				message, err := l.dao.SaveMessage(ctx, Message{
+					Id:              chatCompletionResponse.ID,
+					CreatedAt:       time.Now(),
+					UpdatedAt:       time.Now(),
+					ConversationId:  cov.Id,
+					ParentId:        parentId,
+					Model:           req.ModelId(),
+					PromptToken:     chatCompletionResponse.Usage.PromptTokens,
+					CompletionToken: chatCompletionResponse.Usage.CompletionTokens,
+					Request:         req,
+					Response:        chatCompletionResponse,
+				})
+				if err == nil {
+					err = l.setActiveLeaf(ctx, cov.Id, message.Id)
+				}
+				if err == nil {
+					err = native.save(ctx, l.dao, cov.Id)
+				}
+				if err != nil {
 					slog.ErrorContext(ctx, "save message error", "err", err)
+				} else {
+					l.annotate(ctx, cov.Id)
 				}
 			} else {
-				slog.ErrorContext(ctx, "create message error", "err", err, "conversation_id", conversationId)
+				slog.ErrorContext(ctx, "create message error", "err", err, "conversation_id", cov.Id)
 			}
 			errChan <- err
 			return
 		case <-ctx.Done():
+			// keep reading until the provider gives up, so it is not blocked on a send forever
+			go func() {
+				for {
+					select {
+					case <-innerDataChan:
+					case <-innerErrChan:
+						return
+					}
+				}
+			}()
 			errChan <- ctx.Err()
+			return
 		}
 	}
 }
 
-func (l *LLM) ListMessages(ctx context.Context, conversationId string) ([]Message, error) {
-	messages, err := l.dao.ListMessages(ctx, conversationId)
+func (l *LLM) ListMessages(ctx context.Context, conversationId string, opts ListOptions) ([]Message, error) {
+	messages, err := l.dao.ListMessages(ctx, conversationId, opts)
 	slog.InfoContext(ctx, "list messages", "conversation_id", conversationId, "err", err)
 	return messages, err
 }
@@ -203,21 +288,21 @@ func (l *LLM) CreateChatCompletion(ctx context.Context, req ChatCompletionReques
 	errChan := make(chan error)
 	defer close(errChan)
 
+	req.StreamOptions = &StreamOptions{IncludeUsage: true}
 	go l.CreateChatCompletionStream(ctx, req, dataChan, errChan)
-	sb := strings.Builder{}
-	resp := ChatCompletionResponse{}
+	// rebuild the complete response, including tool calls, from the stream deltas
+	acc := NewStreamAccumulator()
 
 	for {
 		select {
 		case data := <-dataChan:
-			if len(data.Choices) == 0 {
-				continue
-			}
-			sb.WriteString(data.Choices[0].Delta.Content)
-			resp = data.ToChatCompletionResponse()
+			acc.Add(data)
 		case err := <-errChan:
 			if errors.Is(err, io.EOF) {
-				resp.Choices[0].Message.Content = sb.String()
+				resp := acc.Response()
+				if resp.Usage.TotalTokens == 0 {
+					resp.Usage = EstimateUsage(req, resp)
+				}
 				return resp, nil
 			}
 			slog.Error("\nerr", "err", err)
@@ -231,5 +316,22 @@ func (l *LLM) ListModels() []string {
 }
 
 func (l *LLM) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest, respChan chan ChatCompletionStreamResponse, errChan chan error) {
-	l.Client.CreateChatCompletionStream(ctx, req, respChan, errChan)
+	l.Client.CreateChatCompletionStream(withDao(ctx, l.dao), req, respChan, errChan)
+}
+
+// CreateEmbeddings creates the embeddings of the inputs, when the client implements Embedder.
+func (l *LLM) CreateEmbeddings(ctx context.Context, req EmbeddingRequest) (EmbeddingResponse, error) {
+	embedder, ok := l.Client.(Embedder)
+	if !ok {
+		return EmbeddingResponse{}, ErrEmbeddingsNotSupported
+	}
+	resp, err := embedder.CreateEmbeddings(withDao(ctx, l.dao), req)
+	if err != nil {
+		slog.ErrorContext(ctx, "create embeddings error", "err", err, "model", req.ModelId())
+		return EmbeddingResponse{}, err
+	}
+	if resp.Usage.TotalTokens == 0 {
+		resp.Usage = NewUsage(req.EstimateTokens(), 0)
+	}
+	return resp, nil
 }
@@ -0,0 +1,216 @@
+// Package llmtest provides a conformance suite for the implementations of llm.Dao.
+package llmtest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDao runs the conformance suite against the daos created by newDao, every test gets a new dao.
+// ctx is passed to the dao, it carries what the implementation needs like the current user.
+// The rows of another user are looked up with ctx and another llm.ContextKeyUserId.
+func TestDao(t *testing.T, ctx context.Context, newDao func(t *testing.T) llm.Dao) {
+	t.Run("conversation", func(t *testing.T) { testConversation(t, ctx, newDao(t)) })
+	t.Run("list conversations", func(t *testing.T) { testListConversations(t, ctx, newDao(t)) })
+	t.Run("list messages", func(t *testing.T) { testListMessages(t, ctx, newDao(t)) })
+	t.Run("last message", func(t *testing.T) { testLastMessage(t, ctx, newDao(t)) })
+	t.Run("user scope", func(t *testing.T) { testUserScope(t, ctx, newDao(t)) })
+	t.Run("delete missing", func(t *testing.T) { testDeleteMissing(t, ctx, newDao(t)) })
+}
+
+// base is the creation time of the fixtures, they are one second apart so the order does not depend on the clock.
+var base = time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)
+
+func saveConversations(t *testing.T, ctx context.Context, dao llm.Dao, n int) []string {
+	ids := make([]string, 0, n)
+	// saved in reverse, so the order of insertion differs from the order of creation
+	for i := n - 1; i >= 0; i-- {
+		cov, err := dao.SaveConversation(ctx, llm.Conversation{
+			Id:        fmt.Sprintf("conversation%04d", i),
+			CreatedAt: base.Add(time.Duration(i) * time.Second),
+			UpdatedAt: base.Add(time.Duration(i) * time.Second),
+			Name:      fmt.Sprintf("conversation %d", i),
+			Model:     "gpt-3.5-turbo",
+		})
+		require.NoError(t, err)
+		ids = append([]string{cov.Id}, ids...)
+	}
+	return ids
+}
+
+func saveMessages(t *testing.T, ctx context.Context, dao llm.Dao, conversationId string, n int) []string {
+	ids := make([]string, 0, n)
+	for i := n - 1; i >= 0; i-- {
+		parentId := ""
+		if i > 0 {
+			parentId = fmt.Sprintf("%s-message%04d", conversationId, i-1)
+		}
+		msg, err := dao.SaveMessage(ctx, llm.Message{
+			Id:             fmt.Sprintf("%s-message%04d", conversationId, i),
+			ParentId:       parentId,
+			CreatedAt:      base.Add(time.Duration(i) * time.Second),
+			UpdatedAt:      base.Add(time.Duration(i) * time.Second),
+			ConversationId: conversationId,
+			Model:          "gpt-3.5-turbo",
+			Request: llm.ChatCompletionRequest{
+				Model:    "gpt-3.5-turbo",
+				Messages: []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: fmt.Sprintf("question %d", i)}},
+			},
+			Response: llm.ChatCompletionResponse{
+				Choices: []llm.ChatCompletionChoice{{Message: llm.ChatCompletionMessage{Role: llm.ChatMessageRoleAssistant, Content: fmt.Sprintf("answer %d", i)}}},
+			},
+		})
+		require.NoError(t, err)
+		ids = append([]string{msg.Id}, ids...)
+	}
+	return ids
+}
+
+func conversationIds(covs []llm.Conversation) []string {
+	ids := make([]string, 0, len(covs))
+	for _, cov := range covs {
+		ids = append(ids, cov.Id)
+	}
+	return ids
+}
+
+func messageIds(msgs []llm.Message) []string {
+	ids := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		ids = append(ids, msg.Id)
+	}
+	return ids
+}
+
+func testConversation(t *testing.T, ctx context.Context, dao llm.Dao) {
+	ids := saveConversations(t, ctx, dao, 1)
+	cov, err := dao.GetConversation(ctx, ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, "conversation 0", cov.Name)
+
+	// saving an existing conversation updates it
+	cov.Summary = "a summary"
+	cov.ActiveLeafId = "a leaf"
+	_, err = dao.SaveConversation(ctx, cov)
+	require.NoError(t, err)
+	cov, err = dao.GetConversation(ctx, ids[0])
+	require.NoError(t, err)
+	assert.Equal(t, "a summary", cov.Summary)
+	assert.Equal(t, "a leaf", cov.ActiveLeafId)
+
+	require.NoError(t, dao.DeleteConversation(ctx, ids[0]))
+	_, err = dao.GetConversation(ctx, ids[0])
+	assert.ErrorIs(t, err, llm.ErrNotFound)
+}
+
+func testListConversations(t *testing.T, ctx context.Context, dao llm.Dao) {
+	ids := saveConversations(t, ctx, dao, 5)
+
+	covs, err := dao.ListConversations(ctx, llm.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, ids, conversationIds(covs))
+
+	covs, err = dao.ListConversations(ctx, llm.ListOptions{Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, ids[:2], conversationIds(covs))
+
+	covs, err = dao.ListConversations(ctx, llm.ListOptions{Limit: 2, After: ids[1]})
+	require.NoError(t, err)
+	assert.Equal(t, ids[2:4], conversationIds(covs))
+
+	covs, err = dao.ListConversations(ctx, llm.ListOptions{Limit: 2, Before: ids[4]})
+	require.NoError(t, err)
+	assert.Equal(t, ids[2:4], conversationIds(covs))
+
+	covs, err = dao.ListConversations(ctx, llm.ListOptions{After: ids[0], Before: ids[3]})
+	require.NoError(t, err)
+	assert.Equal(t, ids[1:3], conversationIds(covs))
+
+	_, err = dao.ListConversations(ctx, llm.ListOptions{After: "missing"})
+	assert.ErrorIs(t, err, llm.ErrCursorNotFound)
+}
+
+func testListMessages(t *testing.T, ctx context.Context, dao llm.Dao) {
+	covIds := saveConversations(t, ctx, dao, 2)
+	ids := saveMessages(t, ctx, dao, covIds[0], 6)
+	saveMessages(t, ctx, dao, covIds[1], 2)
+
+	msgs, err := dao.ListMessages(ctx, covIds[0], llm.ListOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, ids, messageIds(msgs))
+	assert.Equal(t, "question 0", msgs[0].Request.Messages[0].Content)
+	assert.Equal(t, "answer 5", msgs[5].Response.Choices[0].Message.Content)
+	assert.Empty(t, msgs[0].ParentId)
+	assert.Equal(t, ids[4], msgs[5].ParentId)
+
+	msgs, err = dao.ListMessages(ctx, covIds[0], llm.ListOptions{Limit: 4, After: ids[3]})
+	require.NoError(t, err)
+	assert.Equal(t, ids[4:], messageIds(msgs))
+
+	// walk backwards from the latest messages
+	msgs, err = dao.ListMessages(ctx, covIds[0], llm.ListOptions{Limit: 2, Before: ids[2]})
+	require.NoError(t, err)
+	assert.Equal(t, ids[:2], messageIds(msgs))
+
+	msgs, err = dao.ListMessages(ctx, covIds[0], llm.ListOptions{Before: ids[0]})
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	msgs, err = dao.ListMessages(ctx, "missing", llm.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	_, err = dao.ListMessages(ctx, covIds[0], llm.ListOptions{Before: "missing"})
+	assert.ErrorIs(t, err, llm.ErrCursorNotFound)
+
+	require.NoError(t, dao.DeleteMessage(ctx, ids[5]))
+	_, err = dao.GetMessage(ctx, ids[5])
+	assert.ErrorIs(t, err, llm.ErrNotFound)
+}
+
+func testLastMessage(t *testing.T, ctx context.Context, dao llm.Dao) {
+	covIds := saveConversations(t, ctx, dao, 1)
+	ids := saveMessages(t, ctx, dao, covIds[0], 3)
+
+	msg, err := dao.GetConversationLastMessage(ctx, covIds[0])
+	require.NoError(t, err)
+	assert.Equal(t, ids[2], msg.Id)
+}
+
+func testUserScope(t *testing.T, ctx context.Context, dao llm.Dao) {
+	covIds := saveConversations(t, ctx, dao, 1)
+	ids := saveMessages(t, ctx, dao, covIds[0], 1)
+	other := context.WithValue(ctx, llm.ContextKeyUserId, "llmtest-other-user")
+
+	_, err := dao.GetConversation(other, covIds[0])
+	assert.ErrorIs(t, err, llm.ErrNotFound)
+	_, err = dao.GetMessage(other, ids[0])
+	assert.ErrorIs(t, err, llm.ErrNotFound)
+	_, err = dao.SaveMessage(other, llm.Message{ConversationId: covIds[0]})
+	assert.ErrorIs(t, err, llm.ErrNotFound)
+	covs, err := dao.ListConversations(other, llm.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, covs)
+	msgs, err := dao.ListMessages(other, covIds[0], llm.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, msgs)
+	assert.ErrorIs(t, dao.DeleteMessage(other, ids[0]), llm.ErrNotFound)
+	assert.ErrorIs(t, dao.DeleteConversation(other, covIds[0]), llm.ErrNotFound)
+
+	// the rows are still there for their user
+	_, err = dao.GetMessage(ctx, ids[0])
+	assert.NoError(t, err)
+	_, err = dao.GetConversation(ctx, covIds[0])
+	assert.NoError(t, err)
+}
+
+func testDeleteMissing(t *testing.T, ctx context.Context, dao llm.Dao) {
+	assert.ErrorIs(t, dao.DeleteConversation(ctx, "missing"), llm.ErrNotFound)
+	assert.ErrorIs(t, dao.DeleteMessage(ctx, "missing"), llm.ErrNotFound)
+}
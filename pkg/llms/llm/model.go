@@ -1,17 +1,23 @@
 package llm
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 )
 
+var ErrContentFieldsMisused = errors.New("can't use both Content and MultiContent properties simultaneously")
+
 // Chat message role defined by the OpenAI API.
 const (
 	ChatMessageRoleSystem    = "system"
 	ChatMessageRoleUser      = "user"
 	ChatMessageRoleAssistant = "assistant"
 	ChatMessageRoleFunction  = "function"
+	ChatMessageRoleTool      = "tool"
 )
 
 type Hate struct {
@@ -43,9 +49,39 @@ type PromptAnnotation struct {
 	ContentFilterResults ContentFilterResults `json:"content_filter_results,omitempty"`
 }
 
+type ChatMessagePartType string
+
+const (
+	ChatMessagePartTypeText     ChatMessagePartType = "text"
+	ChatMessagePartTypeImageURL ChatMessagePartType = "image_url"
+)
+
+type ImageURLDetail string
+
+const (
+	ImageURLDetailHigh ImageURLDetail = "high"
+	ImageURLDetailLow  ImageURLDetail = "low"
+	ImageURLDetailAuto ImageURLDetail = "auto"
+)
+
+type ChatMessageImageURL struct {
+	// URL is either a http(s) url or a base64 data url, like data:image/jpeg;base64,...
+	URL    string         `json:"url,omitempty"`
+	Detail ImageURLDetail `json:"detail,omitempty"`
+}
+
+type ChatMessagePart struct {
+	Type     ChatMessagePartType  `json:"type,omitempty"`
+	Text     string               `json:"text,omitempty"`
+	ImageURL *ChatMessageImageURL `json:"image_url,omitempty"`
+}
+
 type ChatCompletionMessage struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// MultiContent is the array form of content, used to send images along with text.
+	// Only one of Content and MultiContent can be set.
+	MultiContent []ChatMessagePart `json:"-"`
 
 	// This property isn't in the official documentation, but it's in
 	// the documentation for the official library for python:
@@ -54,6 +90,130 @@ type ChatCompletionMessage struct {
 	Name string `json:"name,omitempty"`
 
 	FunctionCall *FunctionCall `json:"function_call,omitempty"`
+
+	// For Role=assistant prompts this may be set to the tool calls generated by the model, such as function calls.
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+
+	// For Role=tool prompts this should be set to the ID given in the assistant's prior request to call a tool.
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+func (m ChatCompletionMessage) MarshalJSON() ([]byte, error) {
+	if m.Content != "" && m.MultiContent != nil {
+		return nil, ErrContentFieldsMisused
+	}
+	if len(m.MultiContent) > 0 {
+		msg := struct {
+			Role         string            `json:"role"`
+			Content      string            `json:"-"`
+			MultiContent []ChatMessagePart `json:"content,omitempty"`
+			Name         string            `json:"name,omitempty"`
+			FunctionCall *FunctionCall     `json:"function_call,omitempty"`
+			ToolCalls    []ToolCall        `json:"tool_calls,omitempty"`
+			ToolCallID   string            `json:"tool_call_id,omitempty"`
+		}(m)
+		return json.Marshal(msg)
+	}
+	msg := struct {
+		Role         string            `json:"role"`
+		Content      string            `json:"content"`
+		MultiContent []ChatMessagePart `json:"-"`
+		Name         string            `json:"name,omitempty"`
+		FunctionCall *FunctionCall     `json:"function_call,omitempty"`
+		ToolCalls    []ToolCall        `json:"tool_calls,omitempty"`
+		ToolCallID   string            `json:"tool_call_id,omitempty"`
+	}(m)
+	return json.Marshal(msg)
+}
+
+// UnmarshalJSON accepts content both as a string and as an array of parts.
+func (m *ChatCompletionMessage) UnmarshalJSON(bs []byte) error {
+	msg := struct {
+		Role         string          `json:"role"`
+		Content      json.RawMessage `json:"content"`
+		Name         string          `json:"name,omitempty"`
+		FunctionCall *FunctionCall   `json:"function_call,omitempty"`
+		ToolCalls    []ToolCall      `json:"tool_calls,omitempty"`
+		ToolCallID   string          `json:"tool_call_id,omitempty"`
+	}{}
+	if err := json.Unmarshal(bs, &msg); err != nil {
+		return err
+	}
+	*m = ChatCompletionMessage{
+		Role:         msg.Role,
+		Name:         msg.Name,
+		FunctionCall: msg.FunctionCall,
+		ToolCalls:    msg.ToolCalls,
+		ToolCallID:   msg.ToolCallID,
+	}
+	content := bytes.TrimSpace(msg.Content)
+	switch {
+	case len(content) == 0 || bytes.Equal(content, []byte("null")):
+		return nil
+	case content[0] == '[':
+		return json.Unmarshal(content, &m.MultiContent)
+	default:
+		return json.Unmarshal(content, &m.Content)
+	}
+}
+
+// TextContent returns the text of the message, the text parts are joined when the content is multi-part.
+func (m ChatCompletionMessage) TextContent() string {
+	if len(m.MultiContent) == 0 {
+		return m.Content
+	}
+	texts := make([]string, 0, len(m.MultiContent))
+	for _, part := range m.MultiContent {
+		if part.Type == ChatMessagePartTypeText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// HasImage reports whether the message contains at least one image part.
+func (m ChatCompletionMessage) HasImage() bool {
+	for _, part := range m.MultiContent {
+		if part.Type == ChatMessagePartTypeImageURL && part.ImageURL != nil {
+			return true
+		}
+	}
+	return false
+}
+
+type ToolType string
+
+const (
+	ToolTypeFunction ToolType = "function"
+)
+
+type Tool struct {
+	Type     ToolType            `json:"type"`
+	Function *FunctionDefinition `json:"function,omitempty"`
+}
+
+// Tool choice modes, a ToolChoice object forces the model to call the named function.
+const (
+	ToolChoiceNone     = "none"
+	ToolChoiceAuto     = "auto"
+	ToolChoiceRequired = "required"
+)
+
+type ToolChoice struct {
+	Type     ToolType     `json:"type"`
+	Function ToolFunction `json:"function,omitempty"`
+}
+
+type ToolFunction struct {
+	Name string `json:"name"`
+}
+
+type ToolCall struct {
+	// Index is not nil only in chat completion chunk object
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Type     ToolType     `json:"type"`
+	Function FunctionCall `json:"function"`
 }
 
 type FunctionCall struct {
@@ -77,10 +237,60 @@ type ChatCompletionRequest struct {
 	// LogitBias is must be a token id string (specified by their token ID in the tokenizer), not a word string.
 	// incorrect: `"logit_bias":{"You": 6}`, correct: `"logit_bias":{"1639": 6}`
 	// refs: https://platform.openai.com/docs/api-reference/chat/create#chat/create-logit_bias
-	LogitBias    map[string]int       `json:"logit_bias,omitempty"`
-	User         string               `json:"user,omitempty"`
-	Functions    []FunctionDefinition `json:"functions,omitempty"`
-	FunctionCall any                  `json:"function_call,omitempty"`
+	LogitBias map[string]int `json:"logit_bias,omitempty"`
+	User      string         `json:"user,omitempty"`
+	// Deprecated: use Tools instead.
+	Functions []FunctionDefinition `json:"functions,omitempty"`
+	// Deprecated: use ToolChoice instead.
+	FunctionCall any    `json:"function_call,omitempty"`
+	Tools        []Tool `json:"tools,omitempty"`
+	// This can be either a string or a ToolChoice object.
+	ToolChoice    any            `json:"tool_choice,omitempty"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	// Template is rendered before the messages, it is resolved by the server and never sent to the providers
+	Template *TemplateRef `json:"template,omitempty"`
+	// TemperatureSet is true when the temperature was sent, it tells an explicit 0 from an omitted temperature,
+	// which the providers default to 1. It is set by UnmarshalJSON.
+	TemperatureSet bool `json:"-"`
+}
+
+// UnmarshalJSON decodes the request and records whether the temperature was sent, see TemperatureSet.
+func (r *ChatCompletionRequest) UnmarshalJSON(bs []byte) error {
+	type plain ChatCompletionRequest
+	req := struct {
+		*plain
+		// the temperature is decoded here as a pointer, it shadows the field of the request
+		Temperature *float32 `json:"temperature"`
+	}{plain: (*plain)(r)}
+	if err := json.Unmarshal(bs, &req); err != nil {
+		return err
+	}
+	r.Temperature, r.TemperatureSet = 0, req.Temperature != nil
+	if req.Temperature != nil {
+		r.Temperature = *req.Temperature
+	}
+	return nil
+}
+
+// TemperatureParam returns the temperature to send to the providers whose temperature is omitted when empty,
+// nil when the request leaves it to the default of the provider. An explicit 0 is kept, see TemperatureSet.
+func (r ChatCompletionRequest) TemperatureParam() *float32 {
+	if !r.TemperatureSet && r.Temperature == 0 {
+		return nil
+	}
+	temperature := r.Temperature
+	return &temperature
+}
+
+type StreamOptions struct {
+	// IncludeUsage adds a last chunk to the stream, its choices are empty and its usage
+	// holds the token usage of the whole request.
+	IncludeUsage bool `json:"include_usage,omitempty"`
+}
+
+// IncludeUsage reports whether the caller asked for the usage chunk at the end of the stream.
+func (r *ChatCompletionRequest) IncludeUsage() bool {
+	return r.StreamOptions != nil && r.StreamOptions.IncludeUsage
 }
 
 func (r *ChatCompletionRequest) ToPrompt() string {
@@ -97,7 +307,7 @@ func (r *ChatCompletionRequest) toPrompt(withRole bool) string {
 		if withRole {
 			sb.WriteString(fmt.Sprintf("\n\n%s: ", message.Role))
 		}
-		sb.WriteString(message.Content)
+		sb.WriteString(message.TextContent())
 	}
 
 	return sb.String()
@@ -113,6 +323,54 @@ func (r *ChatCompletionRequest) FromPrompt(model, prompt string) {
 	}
 }
 
+// GetTools returns the tools of the request, the deprecated Functions are
+// converted to function tools so that providers only need to handle one shape.
+func (r *ChatCompletionRequest) GetTools() []Tool {
+	tools := make([]Tool, 0, len(r.Tools)+len(r.Functions))
+	tools = append(tools, r.Tools...)
+	for i := range r.Functions {
+		tools = append(tools, Tool{Type: ToolTypeFunction, Function: &r.Functions[i]})
+	}
+	return tools
+}
+
+// GetToolChoice normalizes ToolChoice, or the deprecated FunctionCall, into a mode and an optional function name.
+// The mode is one of "none", "auto" and "required", the name is only set when the model is forced to call
+// one specific function.
+func (r *ChatCompletionRequest) GetToolChoice() (mode string, name string) {
+	choice := r.ToolChoice
+	if choice == nil {
+		choice = r.FunctionCall
+	}
+
+	switch v := choice.(type) {
+	case nil:
+		return ToolChoiceAuto, ""
+	case string:
+		if v == "" {
+			return ToolChoiceAuto, ""
+		}
+		return v, ""
+	default:
+		// ToolChoice object, legacy {"name": "..."} object or a decoded map of either of them
+		var obj struct {
+			Name     string       `json:"name"`
+			Function ToolFunction `json:"function"`
+		}
+		data, _ := json.Marshal(v)
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return ToolChoiceAuto, ""
+		}
+		if obj.Function.Name != "" {
+			return ToolChoiceRequired, obj.Function.Name
+		}
+		if obj.Name != "" {
+			return ToolChoiceRequired, obj.Name
+		}
+		return ToolChoiceAuto, ""
+	}
+}
+
 func (r *ChatCompletionRequest) ModelId() string {
 	texts := strings.Split(r.Model, "/")
 	if len(texts) == 1 {
@@ -141,6 +399,7 @@ const (
 	FinishReasonStop          FinishReason = "stop"
 	FinishReasonLength        FinishReason = "length"
 	FinishReasonFunctionCall  FinishReason = "function_call"
+	FinishReasonToolCalls     FinishReason = "tool_calls"
 	FinishReasonContentFilter FinishReason = "content_filter"
 	FinishReasonNull          FinishReason = "null"
 )
@@ -160,6 +419,7 @@ type ChatCompletionChoice struct {
 	// or a message terminated by one of the stop sequences provided via the stop parameter
 	// length: Incomplete model output due to max_tokens parameter or token limit
 	// function_call: The model decided to call a function
+	// tool_calls: The model decided to call one or more tools
 	// content_filter: Omitted content due to a flag from our content filters
 	// null: API response still in progress or incomplete
 	FinishReason FinishReason `json:"finish_reason"`
@@ -185,6 +445,7 @@ type ChatCompletionStreamChoiceDelta struct {
 	Content      string        `json:"content,omitempty"`
 	Role         string        `json:"role,omitempty"`
 	FunctionCall *FunctionCall `json:"function_call,omitempty"`
+	ToolCalls    []ToolCall    `json:"tool_calls,omitempty"`
 }
 
 type ChatCompletionStreamChoice struct {
@@ -201,6 +462,8 @@ type ChatCompletionStreamResponse struct {
 	Model             string                       `json:"model"`
 	Choices           []ChatCompletionStreamChoice `json:"choices"`
 	PromptAnnotations []PromptAnnotation           `json:"prompt_annotations,omitempty"`
+	// Usage is only set on the last chunk, when the request asks for it with StreamOptions
+	Usage *Usage `json:"usage,omitempty"`
 }
 
 func (r *ChatCompletionStreamResponse) ToChatCompletionResponse() ChatCompletionResponse {
@@ -209,19 +472,25 @@ func (r *ChatCompletionStreamResponse) ToChatCompletionResponse() ChatCompletion
 		choices[i] = ChatCompletionChoice{
 			Index: choice.Index,
 			Message: ChatCompletionMessage{
-				Content: choice.Delta.Content,
-				Role:    ChatMessageRoleAssistant,
+				Content:      choice.Delta.Content,
+				Role:         ChatMessageRoleAssistant,
+				FunctionCall: choice.Delta.FunctionCall,
+				ToolCalls:    choice.Delta.ToolCalls,
 			},
 			FinishReason: choice.FinishReason,
 		}
 	}
-	return ChatCompletionResponse{
+	resp := ChatCompletionResponse{
 		ID:      r.ID,
 		Object:  r.Object,
 		Created: r.Created,
 		Model:   r.Model,
 		Choices: choices,
 	}
+	if r.Usage != nil {
+		resp.Usage = *r.Usage
+	}
+	return resp
 }
 
 type Conversation struct {
@@ -233,16 +502,22 @@ type Conversation struct {
 	Name      string    `json:"name"`
 	Model     string    `json:"model"`
 	Summary   string    `json:"summary"`
-	ExtraInfo string    `json:"extra_info"`
+	// SummaryUntil is the id of the last message folded into the summary
+	SummaryUntil string `json:"summary_until,omitempty"`
+	// ActiveLeafId is the last message of the active branch, new messages are added after it
+	ActiveLeafId string `json:"active_leaf_id,omitempty"`
+	ExtraInfo    string `json:"extra_info"`
 }
 
 type Message struct {
-	Id              string                 `json:"id"`
-	CreatedAt       time.Time              `json:"created_at"`
-	UpdatedAt       time.Time              `json:"updated_at"`
-	Deleted         bool                   `json:"deleted"`
-	UserId          string                 `json:"user_id"`
-	ConversationId  string                 `json:"conversation_id"`
+	Id             string    `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	Deleted        bool      `json:"deleted"`
+	UserId         string    `json:"user_id"`
+	ConversationId string    `json:"conversation_id"`
+	// ParentId is the previous message in the branch, empty for the first message
+	ParentId        string                 `json:"parent_id,omitempty"`
 	Model           string                 `json:"model"`
 	PromptToken     int                    `json:"prompt_token"`
 	CompletionToken int                    `json:"completion_token"`
@@ -253,14 +528,14 @@ type Message struct {
 }
 
 type Model struct {
-	ID          string `json:"id"`
-	Name        string `json:"name,omitempty"`
-	Description string `json:"description,omitempty"`
-	Pricing     struct {
-		Prompt     float64 `json:"prompt,omitempty"`
-		Completion float64 `json:"completion,omitempty"`
-	} `json:"pricing,omitempty"`
-	ContextLength   int `json:"context_length,omitempty"`
+	ID string `json:"id" mapstructure:"id"`
+	// Provider is the config id the entry applies to, an entry without provider applies to all of them
+	Provider        string       `json:"provider,omitempty" mapstructure:"provider"`
+	Name            string       `json:"name,omitempty" mapstructure:"name"`
+	Description     string       `json:"description,omitempty" mapstructure:"description"`
+	Pricing         Pricing      `json:"pricing,omitempty" mapstructure:"pricing"`
+	ContextLength   int          `json:"context_length,omitempty" mapstructure:"context_length"`
+	Capabilities    Capabilities `json:"capabilities" mapstructure:"capabilities"`
 	PreRequestLimit struct {
 		Prompt     int `json:"prompt_tokens,omitempty"`
 		Completion int `json:"completion_tokens,omitempty"`
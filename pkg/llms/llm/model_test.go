@@ -0,0 +1,119 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChatCompletionMessageJSON(t *testing.T) {
+	var msg ChatCompletionMessage
+	err := json.Unmarshal([]byte(`{"role":"user","content":"hello"}`), &msg)
+	assert.NoError(t, err)
+	assert.Equal(t, ChatCompletionMessage{Role: ChatMessageRoleUser, Content: "hello"}, msg)
+
+	data := `{"role":"user","content":[{"type":"text","text":"what is it?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,aGVsbG8=","detail":"low"}}]}`
+	msg = ChatCompletionMessage{}
+	err = json.Unmarshal([]byte(data), &msg)
+	assert.NoError(t, err)
+	assert.Equal(t, "", msg.Content)
+	assert.Equal(t, []ChatMessagePart{
+		NewTextPart("what is it?"),
+		{Type: ChatMessagePartTypeImageURL, ImageURL: &ChatMessageImageURL{URL: "data:image/png;base64,aGVsbG8=", Detail: ImageURLDetailLow}},
+	}, msg.MultiContent)
+	assert.True(t, msg.HasImage())
+	assert.Equal(t, "what is it?", msg.TextContent())
+
+	out, err := json.Marshal(msg)
+	assert.NoError(t, err)
+	assert.JSONEq(t, data, string(out))
+
+	out, err = json.Marshal(ChatCompletionMessage{Role: ChatMessageRoleAssistant})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"role":"assistant","content":""}`, string(out))
+
+	_, err = json.Marshal(ChatCompletionMessage{Content: "a", MultiContent: []ChatMessagePart{NewTextPart("b")}})
+	assert.ErrorIs(t, err, ErrContentFieldsMisused)
+}
+
+func TestChatCompletionRequestJSON(t *testing.T) {
+	var req ChatCompletionRequest
+	err := json.Unmarshal([]byte(`{"model":"gpt-4","messages":[{"role":"user","content":"hi"}],"temperature":0}`), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, "gpt-4", req.Model)
+	assert.Len(t, req.Messages, 1)
+	assert.True(t, req.TemperatureSet)
+	assert.Zero(t, req.Temperature)
+
+	req = ChatCompletionRequest{}
+	err = json.Unmarshal([]byte(`{"model":"gpt-4","temperature":0.5}`), &req)
+	assert.NoError(t, err)
+	assert.True(t, req.TemperatureSet)
+	assert.Equal(t, float32(0.5), req.Temperature)
+
+	req = ChatCompletionRequest{}
+	err = json.Unmarshal([]byte(`{"model":"gpt-4","max_tokens":10}`), &req)
+	assert.NoError(t, err)
+	assert.False(t, req.TemperatureSet)
+	assert.Equal(t, 10, req.MaxTokens)
+}
+
+func TestChatCompletionRequestTemperatureParam(t *testing.T) {
+	assert.Nil(t, ChatCompletionRequest{}.TemperatureParam())
+	assert.Equal(t, float32(0), *ChatCompletionRequest{TemperatureSet: true}.TemperatureParam())
+	assert.Equal(t, float32(0.5), *ChatCompletionRequest{Temperature: 0.5}.TemperatureParam())
+}
+
+func TestParseDataURL(t *testing.T) {
+	mimeType, data, err := ParseDataURL(ToDataURL("image/jpeg", []byte("hello")))
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", mimeType)
+	assert.Equal(t, "aGVsbG8=", data)
+
+	_, _, err = ParseDataURL("https://example.com/a.png")
+	assert.ErrorIs(t, err, ErrInvalidDataURL)
+	_, _, err = ParseDataURL("data:image/png,hello")
+	assert.ErrorIs(t, err, ErrInvalidDataURL)
+}
+
+func TestFetchImage(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large.png":
+			_, _ = w.Write(bytes.Repeat([]byte{0}, maxImageSize+1))
+		case "/internal":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+		default:
+			_, _ = w.Write(png)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	// only public http(s) addresses are fetched, the test server listens on loopback
+	for _, url := range []string{server.URL + "/a.png", "file:///etc/passwd", "http://[::1]/a.png"} {
+		_, err := FetchImage(ctx, url)
+		assert.ErrorIs(t, err, ErrImageURLNotAllowed, url)
+	}
+
+	defer func(cli *http.Client) { imageClient = cli }(imageClient)
+	imageClient = newImageClient(func(ip net.IP) bool { return ip.IsLoopback() })
+
+	url, err := FetchImage(ctx, server.URL+"/a.png")
+	assert.NoError(t, err)
+	assert.Equal(t, ToDataURL("image/png", png), url)
+
+	_, err = FetchImage(ctx, server.URL+"/large.png")
+	assert.ErrorContains(t, err, "larger than")
+
+	// redirects are dialed through the same check
+	_, err = FetchImage(ctx, server.URL+"/internal")
+	assert.ErrorIs(t, err, ErrImageURLNotAllowed)
+}
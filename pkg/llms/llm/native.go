@@ -0,0 +1,110 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// NativeConversations are the ids of a conversation on the web apps, like Claude Web and Bard, which keep the history
+// of their conversations themselves. They are passed with the context of the messages of a conversation, a web client
+// sends the new turn in its native conversation, or starts one and sets its id. The ids are stored by client in the
+// ExtraInfo of the conversation, as a json object.
+type NativeConversations struct {
+	mu      sync.Mutex
+	ids     map[string]string
+	changed bool
+}
+
+type nativeConversationsKey struct{}
+
+// WithNativeConversations returns a context which carries the native conversations of the conversation.
+func WithNativeConversations(ctx context.Context, cov Conversation) (context.Context, *NativeConversations) {
+	native := &NativeConversations{ids: make(map[string]string)}
+	if cov.ExtraInfo != "" {
+		if err := json.Unmarshal([]byte(cov.ExtraInfo), &native.ids); err != nil {
+			slog.WarnContext(ctx, "unmarshal native conversations error, start new ones", "err", err, "conversation_id", cov.Id)
+			native.ids = make(map[string]string)
+		}
+	}
+	return context.WithValue(ctx, nativeConversationsKey{}, native), native
+}
+
+// withBranchNativeConversations returns the context of a message after the parent. The native conversations only go on
+// from the active leaf, a message on another branch starts new ones, which get the history of the branch.
+func withBranchNativeConversations(ctx context.Context, cov Conversation, parentId string) (context.Context, *NativeConversations) {
+	if parentId == cov.ActiveLeafId || cov.ExtraInfo == "" {
+		return WithNativeConversations(ctx, cov)
+	}
+	cov.ExtraInfo = ""
+	ctx, native := WithNativeConversations(ctx, cov)
+	// the ids of the other branch are dropped, even when no web client takes part in the new one
+	native.changed = true
+	return ctx, native
+}
+
+// NativeConversationsFrom returns the native conversations of the context, nil when the request is not part of a conversation.
+func NativeConversationsFrom(ctx context.Context) *NativeConversations {
+	native, _ := ctx.Value(nativeConversationsKey{}).(*NativeConversations)
+	return native
+}
+
+// Get returns the id of the native conversation of the client, empty when it has none yet.
+func (c *NativeConversations) Get(client string) string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ids[client]
+}
+
+// Set records the id of the native conversation of the client, it does nothing on nil native conversations.
+func (c *NativeConversations) Set(client, id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ids[client] != id {
+		c.ids[client] = id
+		c.changed = true
+	}
+}
+
+// save stores the native conversations in the conversation when a client has set an id.
+func (c *NativeConversations) save(ctx context.Context, dao Dao, conversationId string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.changed {
+		return nil
+	}
+	extraInfo, err := json.Marshal(c.ids)
+	if err != nil {
+		return err
+	}
+	cov, err := dao.GetConversation(ctx, conversationId)
+	if err != nil {
+		return err
+	}
+	cov.ExtraInfo = string(extraInfo)
+	cov.UpdatedAt = time.Now()
+	if _, err := dao.SaveConversation(ctx, cov); err != nil {
+		return err
+	}
+	c.changed = false
+	return nil
+}
+
+// NewTurn returns the messages after the last answer of the assistant, they are the part of the request
+// which a native conversation has not seen yet.
+func NewTurn(messages []ChatCompletionMessage) []ChatCompletionMessage {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == ChatMessageRoleAssistant {
+			return messages[i+1:]
+		}
+	}
+	return messages
+}
@@ -0,0 +1,68 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webClient is a stand-in of a web app which keeps the history of its conversations, it records the turns it was sent.
+type webClient struct {
+	conversations map[string][]string
+}
+
+func (c *webClient) ListModels() []string {
+	return []string{"web"}
+}
+
+func (c *webClient) CreateChatCompletionStream(ctx context.Context, req ChatCompletionRequest, dataChan chan ChatCompletionStreamResponse, errChan chan error) {
+	native := NativeConversationsFrom(ctx)
+	id := native.Get("web")
+	messages := NewTurn(req.Messages)
+	if id == "" {
+		id = fmt.Sprintf("web-%d", len(c.conversations)+1)
+		messages = req.Messages
+	}
+	for _, m := range messages {
+		c.conversations[id] = append(c.conversations[id], m.Content)
+	}
+	native.Set("web", id)
+	dataChan <- ChatCompletionStreamResponse{Choices: []ChatCompletionStreamChoice{{Delta: ChatCompletionStreamChoiceDelta{Content: "ok"}}}}
+	errChan <- io.EOF
+}
+
+func TestNativeConversations(t *testing.T) {
+	ctx := context.Background()
+	cli := &webClient{conversations: make(map[string][]string)}
+	l := New(NewMemoryDao(), cli)
+	cov, err := l.CreateConversation(ctx, "")
+	require.NoError(t, err)
+	ask := func(content string) ChatCompletionRequest {
+		return ChatCompletionRequest{Model: "web", Messages: []ChatCompletionMessage{{Role: ChatMessageRoleUser, Content: content}}}
+	}
+
+	_, err = l.CreateMessage(ctx, cov.Id, ask("one"))
+	require.NoError(t, err)
+	second, err := l.CreateMessage(ctx, cov.Id, ask("two"))
+	require.NoError(t, err)
+
+	// the second turn goes on in the native conversation, which is stored with the conversation
+	assert.Equal(t, map[string][]string{"web-1": {"one", "two"}}, cli.conversations)
+	cov, err = l.GetConversation(ctx, cov.Id)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"web":"web-1"}`, cov.ExtraInfo)
+
+	// an edit is on another branch, it starts a native conversation with the history of its branch
+	_, err = l.EditMessage(ctx, second.Id, ask("two again"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"one", "ok", "two again"}, cli.conversations["web-2"])
+
+	// the messages of a request outside of a conversation have no native conversations
+	_, err = l.CreateChatCompletion(ctx, ask("alone"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alone"}, cli.conversations["web-3"])
+}
@@ -0,0 +1,87 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var ErrInvalidTemplate = errors.New("invalid prompt template")
+
+// PromptTemplate is a named prompt with a system and a user part, both are Go templates rendered with the variables.
+// Saving a template creates a new version, the older versions are kept.
+type PromptTemplate struct {
+	Id          string    `json:"id" yaml:"-" mapstructure:"-"`
+	Name        string    `json:"name" yaml:"name" mapstructure:"name"`
+	Version     int       `json:"version" yaml:"version" mapstructure:"version"`
+	Description string    `json:"description,omitempty" yaml:"description" mapstructure:"description"`
+	System      string    `json:"system,omitempty" yaml:"system" mapstructure:"system"`
+	User        string    `json:"user,omitempty" yaml:"user" mapstructure:"user"`
+	CreatedAt   time.Time `json:"created_at" yaml:"-" mapstructure:"-"`
+}
+
+// TemplateRef references a prompt template from a chat request, the version is the latest when it is zero.
+type TemplateRef struct {
+	Name      string         `json:"name"`
+	Version   int            `json:"version,omitempty"`
+	Variables map[string]any `json:"variables,omitempty"`
+}
+
+// Validate checks the template has a name and its parts parse.
+func (t PromptTemplate) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidTemplate)
+	}
+	if t.System == "" && t.User == "" {
+		return fmt.Errorf("%w: system or user is required", ErrInvalidTemplate)
+	}
+	for part, text := range map[string]string{"system": t.System, "user": t.User} {
+		if _, err := template.New(part).Parse(text); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidTemplate, part, err)
+		}
+	}
+	return nil
+}
+
+// Render renders the parts of the template into a system and a user message, empty parts are left out.
+// Variables missing from vars are an error, so a typo does not send an incomplete prompt.
+func (t PromptTemplate) Render(vars map[string]any) ([]ChatCompletionMessage, error) {
+	messages := make([]ChatCompletionMessage, 0, 2)
+	for _, part := range []struct{ role, text string }{
+		{ChatMessageRoleSystem, t.System},
+		{ChatMessageRoleUser, t.User},
+	} {
+		if part.text == "" {
+			continue
+		}
+		tmpl, err := template.New(t.Name + "." + part.role).Option("missingkey=error").Parse(part.text)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidTemplate, part.role, err)
+		}
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, vars); err != nil {
+			return nil, fmt.Errorf("%w: render %s: %v", ErrInvalidTemplate, part.role, err)
+		}
+		if content := strings.TrimSpace(sb.String()); content != "" {
+			messages = append(messages, ChatCompletionMessage{Role: part.role, Content: content})
+		}
+	}
+	return messages, nil
+}
+
+// ApplyTemplate renders the template of the request and puts its messages before the messages of the request.
+func (r *ChatCompletionRequest) ApplyTemplate(t PromptTemplate) error {
+	var vars map[string]any
+	if r.Template != nil {
+		vars = r.Template.Variables
+	}
+	messages, err := t.Render(vars)
+	if err != nil {
+		return err
+	}
+	r.Messages = append(messages, r.Messages...)
+	r.Template = nil
+	return nil
+}
@@ -0,0 +1,35 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPromptTemplate(t *testing.T) {
+	tmpl := PromptTemplate{
+		Name:   "translate",
+		System: "You translate to {{.Language}}.",
+		User:   "{{if .Formal}}Use a formal tone.{{end}}",
+	}
+	require.NoError(t, tmpl.Validate())
+
+	req := ChatCompletionRequest{
+		Messages: []ChatCompletionMessage{{Role: ChatMessageRoleUser, Content: "bonjour"}},
+		Template: &TemplateRef{Name: "translate", Variables: map[string]any{"Language": "English", "Formal": false}},
+	}
+	require.NoError(t, req.ApplyTemplate(tmpl))
+	assert.Nil(t, req.Template)
+	// the empty user part is left out
+	assert.Equal(t, []ChatCompletionMessage{
+		{Role: ChatMessageRoleSystem, Content: "You translate to English."},
+		{Role: ChatMessageRoleUser, Content: "bonjour"},
+	}, req.Messages)
+
+	_, err := tmpl.Render(map[string]any{"Formal": true})
+	assert.ErrorIs(t, err, ErrInvalidTemplate)
+
+	assert.ErrorIs(t, PromptTemplate{Name: "broken", User: "{{.Name"}.Validate(), ErrInvalidTemplate)
+	assert.ErrorIs(t, PromptTemplate{User: "hi"}.Validate(), ErrInvalidTemplate)
+}
@@ -0,0 +1,157 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var ErrSearchNotSupported = errors.New("search is not supported by the dao")
+
+const (
+	// HighlightStart and HighlightEnd surround the matched terms in the snippets of search results
+	HighlightStart = "<mark>"
+	HighlightEnd   = "</mark>"
+
+	defaultSearchLimit = 20
+	// snippetRunes is about the length of the snippets of the memory dao
+	snippetRunes = 120
+)
+
+// SearchResult is a message matching a search, the snippet is the matching text with the terms highlighted.
+type SearchResult struct {
+	ConversationId   string    `json:"conversation_id"`
+	ConversationName string    `json:"conversation_name"`
+	MessageId        string    `json:"message_id"`
+	Snippet          string    `json:"snippet"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// Searcher is implemented by the daos which can search the text of the messages.
+type Searcher interface {
+	// Search returns the messages of the user of ctx matching all the terms of the query, best matches first
+	Search(ctx context.Context, query string, limit int) ([]SearchResult, error)
+}
+
+// Search searches the messages of the conversations, it fails with ErrSearchNotSupported when the dao can not search.
+func (l *LLM) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	searcher, ok := l.dao.(Searcher)
+	if !ok {
+		return nil, ErrSearchNotSupported
+	}
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	results, err := searcher.Search(ctx, query, limit)
+	slog.InfoContext(ctx, "search messages", "query", query, "results", len(results), "err", err)
+	return results, err
+}
+
+// MessageText is the plain text of a message which is searched, the text of the request followed by the response.
+func MessageText(m Message) string {
+	texts := make([]string, 0, len(m.Request.Messages)+1)
+	for _, rm := range m.Request.Messages {
+		if rm.Role == ChatMessageRoleSystem {
+			continue
+		}
+		if text := rm.TextContent(); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	for _, choice := range m.Response.Choices {
+		if text := choice.Message.TextContent(); text != "" {
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// Search matches the messages containing every term of the query, newest first, ignoring the case.
+func (d *MemoryDao) Search(ctx context.Context, query string, limit int) ([]SearchResult, error) {
+	terms := strings.Fields(strings.ToLower(query))
+	if len(terms) == 0 {
+		return []SearchResult{}, nil
+	}
+
+	results := make([]SearchResult, 0)
+	for key, val := range d.client.Items() {
+		if !strings.HasPrefix(key, messageCachePrefix) {
+			continue
+		}
+		message := val.Object.(Message)
+		text := MessageText(message)
+		lower := strings.ToLower(text)
+		matched := true
+		for _, term := range terms {
+			if !strings.Contains(lower, term) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		result := SearchResult{
+			ConversationId: message.ConversationId,
+			MessageId:      message.Id,
+			Snippet:        snippet(text, terms),
+			CreatedAt:      message.CreatedAt,
+		}
+		if cov, err := d.GetConversation(ctx, message.ConversationId); err == nil {
+			result.ConversationName = cov.Name
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].CreatedAt.After(results[j].CreatedAt) })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// snippet returns the text around the first term with the terms highlighted, the terms are lower case.
+func snippet(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	// lowering may change the byte length of some runes, the text is only cut and highlighted when it does not
+	if len(lower) != len(text) {
+		return text
+	}
+
+	first := strings.Index(lower, terms[0])
+	start := max(first-snippetRunes/2, 0)
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	end := min(start+snippetRunes, len(text))
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	var sb strings.Builder
+	if start > 0 {
+		sb.WriteString("…")
+	}
+	for i := start; i < end; {
+		matched := ""
+		for _, term := range terms {
+			if strings.HasPrefix(lower[i:], term) && len(term) > len(matched) {
+				matched = term
+			}
+		}
+		if matched == "" {
+			sb.WriteByte(text[i])
+			i++
+			continue
+		}
+		sb.WriteString(HighlightStart + text[i:i+len(matched)] + HighlightEnd)
+		i += len(matched)
+	}
+	if end < len(text) {
+		sb.WriteString("…")
+	}
+	return sb.String()
+}
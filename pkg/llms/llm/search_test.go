@@ -0,0 +1,43 @@
+package llm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryDaoSearch(t *testing.T) {
+	ctx := context.Background()
+	l := New(NewMemoryDao(), &echoClient{})
+	cov, err := l.CreateConversation(ctx, "travel")
+	require.NoError(t, err)
+	for _, content := range []string{"What is the capital of France?", "Is Paris expensive?"} {
+		_, err := l.CreateMessage(ctx, cov.Id, ChatCompletionRequest{Model: "echo", Messages: []ChatCompletionMessage{{Role: ChatMessageRoleUser, Content: content}}})
+		require.NoError(t, err)
+	}
+
+	results, err := l.Search(ctx, "paris", 0)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "travel", results[0].ConversationName)
+	assert.Equal(t, "Is <mark>Paris</mark> expensive?\nIs <mark>Paris</mark> expensive?", results[0].Snippet)
+
+	results, err = l.Search(ctx, "capital FRANCE", 0)
+	require.NoError(t, err)
+	assert.Len(t, results, 1)
+
+	results, err = l.Search(ctx, "capital paris", 0)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+}
+
+func TestSnippet(t *testing.T) {
+	text := strings.Repeat("a ", 100) + "needle" + strings.Repeat(" b", 100)
+	s := snippet(text, []string{"needle"})
+	assert.True(t, strings.HasPrefix(s, "…"))
+	assert.True(t, strings.HasSuffix(s, "…"))
+	assert.Contains(t, s, "<mark>needle</mark>")
+}
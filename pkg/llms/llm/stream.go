@@ -0,0 +1,126 @@
+package llm
+
+import (
+	"strings"
+)
+
+// StreamAccumulator merges the chunks of a chat completion stream into one ChatCompletionResponse.
+// Content is concatenated per choice, and tool call fragments are stitched together by their index,
+// so the arguments of every call end up as one complete JSON document.
+type StreamAccumulator struct {
+	resp     ChatCompletionResponse
+	contents []*strings.Builder
+	// toolCallIndexes maps the tool call index of a chunk to its position in the choice message, per choice
+	toolCallIndexes []map[int]int
+}
+
+func NewStreamAccumulator() *StreamAccumulator {
+	return &StreamAccumulator{}
+}
+
+// Add merges one stream chunk into the accumulated response.
+func (a *StreamAccumulator) Add(chunk ChatCompletionStreamResponse) {
+	if chunk.ID != "" {
+		a.resp.ID = chunk.ID
+	}
+	if chunk.Object != "" {
+		a.resp.Object = chunk.Object
+	}
+	if chunk.Created != 0 {
+		a.resp.Created = chunk.Created
+	}
+	if chunk.Model != "" {
+		a.resp.Model = chunk.Model
+	}
+	if chunk.Usage != nil {
+		a.resp.Usage = *chunk.Usage
+	}
+
+	for _, choice := range chunk.Choices {
+		i := a.choice(choice.Index)
+		message := &a.resp.Choices[i].Message
+		delta := choice.Delta
+
+		if delta.Role != "" {
+			message.Role = delta.Role
+		}
+		a.contents[i].WriteString(delta.Content)
+
+		if delta.FunctionCall != nil {
+			if message.FunctionCall == nil {
+				message.FunctionCall = &FunctionCall{}
+			}
+			if delta.FunctionCall.Name != "" {
+				message.FunctionCall.Name = delta.FunctionCall.Name
+			}
+			message.FunctionCall.Arguments += delta.FunctionCall.Arguments
+		}
+
+		for j, toolCall := range delta.ToolCalls {
+			index := j
+			if toolCall.Index != nil {
+				index = *toolCall.Index
+			}
+			pos, ok := a.toolCallIndexes[i][index]
+			if !ok {
+				a.toolCallIndexes[i][index] = len(message.ToolCalls)
+				toolCall.Index = nil
+				if toolCall.Type == "" {
+					toolCall.Type = ToolTypeFunction
+				}
+				message.ToolCalls = append(message.ToolCalls, toolCall)
+				continue
+			}
+			call := &message.ToolCalls[pos]
+			if toolCall.ID != "" {
+				call.ID = toolCall.ID
+			}
+			if toolCall.Function.Name != "" {
+				call.Function.Name = toolCall.Function.Name
+			}
+			call.Function.Arguments += toolCall.Function.Arguments
+		}
+
+		if choice.FinishReason != "" && choice.FinishReason != FinishReasonNull {
+			a.resp.Choices[i].FinishReason = choice.FinishReason
+		}
+	}
+}
+
+// choice returns the position of the choice with the given index, creating it if needed.
+func (a *StreamAccumulator) choice(index int) int {
+	for i, choice := range a.resp.Choices {
+		if choice.Index == index {
+			return i
+		}
+	}
+	a.resp.Choices = append(a.resp.Choices, ChatCompletionChoice{
+		Index:   index,
+		Message: ChatCompletionMessage{Role: ChatMessageRoleAssistant},
+	})
+	a.contents = append(a.contents, &strings.Builder{})
+	a.toolCallIndexes = append(a.toolCallIndexes, make(map[int]int))
+	return len(a.resp.Choices) - 1
+}
+
+// Content returns the content accumulated so far for the first choice.
+func (a *StreamAccumulator) Content() string {
+	if len(a.contents) == 0 {
+		return ""
+	}
+	return a.contents[0].String()
+}
+
+// Response returns the accumulated response, it always contains at least one choice.
+func (a *StreamAccumulator) Response() ChatCompletionResponse {
+	if len(a.resp.Choices) == 0 {
+		a.choice(0)
+	}
+	resp := a.resp
+	resp.Choices = make([]ChatCompletionChoice, len(a.resp.Choices))
+	copy(resp.Choices, a.resp.Choices)
+	for i := range resp.Choices {
+		resp.Choices[i].Message.Content = a.contents[i].String()
+	}
+	return resp
+}
@@ -0,0 +1,49 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestStreamAccumulator(t *testing.T) {
+	chunks := []ChatCompletionStreamResponse{
+		{ID: "chatcmpl-1", Model: "gpt-4", Choices: []ChatCompletionStreamChoice{{Delta: ChatCompletionStreamChoiceDelta{Role: ChatMessageRoleAssistant, Content: "Let me "}}}},
+		{Choices: []ChatCompletionStreamChoice{{Delta: ChatCompletionStreamChoiceDelta{Content: "check."}}}},
+		{Choices: []ChatCompletionStreamChoice{{Delta: ChatCompletionStreamChoiceDelta{ToolCalls: []ToolCall{
+			{Index: intPtr(0), ID: "call_1", Type: ToolTypeFunction, Function: FunctionCall{Name: "get_weather", Arguments: `{"city":`}},
+		}}}}},
+		{Choices: []ChatCompletionStreamChoice{{Delta: ChatCompletionStreamChoiceDelta{ToolCalls: []ToolCall{
+			{Index: intPtr(1), ID: "call_2", Function: FunctionCall{Name: "get_time", Arguments: `{}`}},
+			{Index: intPtr(0), Function: FunctionCall{Arguments: `"Paris"}`}},
+		}}}}},
+		{Choices: []ChatCompletionStreamChoice{{FinishReason: FinishReasonToolCalls}}},
+	}
+
+	acc := NewStreamAccumulator()
+	for _, chunk := range chunks {
+		acc.Add(chunk)
+	}
+	resp := acc.Response()
+
+	assert.Equal(t, "chatcmpl-1", resp.ID)
+	assert.Equal(t, "gpt-4", resp.Model)
+	assert.Len(t, resp.Choices, 1)
+	assert.Equal(t, FinishReasonToolCalls, resp.Choices[0].FinishReason)
+	message := resp.Choices[0].Message
+	assert.Equal(t, "Let me check.", message.Content)
+	assert.Equal(t, []ToolCall{
+		{ID: "call_1", Type: ToolTypeFunction, Function: FunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		{ID: "call_2", Type: ToolTypeFunction, Function: FunctionCall{Name: "get_time", Arguments: `{}`}},
+	}, message.ToolCalls)
+}
+
+func TestStreamAccumulatorEmpty(t *testing.T) {
+	resp := NewStreamAccumulator().Response()
+	assert.Len(t, resp.Choices, 1)
+	assert.Equal(t, ChatMessageRoleAssistant, resp.Choices[0].Message.Role)
+}
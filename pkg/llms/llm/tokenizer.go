@@ -0,0 +1,176 @@
+package llm
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// bpeFetchTimeout bounds the download of a tiktoken encoding, the tokens are estimated when it fails
+const bpeFetchTimeout = 30 * time.Second
+
+// encodingRetryInterval is the time to wait before loading an encoding again after a failed load
+const encodingRetryInterval = time.Minute
+
+var (
+	encodingsMu sync.Mutex
+	// encodings are the tiktoken encodings by name, loaded or being loaded
+	encodings = make(map[string]*encodingState)
+	// getEncoding loads an encoding, it is replaced in tests
+	getEncoding = tiktoken.GetEncoding
+)
+
+// encodingState is the load state of a tiktoken encoding.
+type encodingState struct {
+	enc      *tiktoken.Tiktoken
+	loading  bool
+	failedAt time.Time
+}
+
+func init() {
+	tiktoken.SetBpeLoader(bpeLoader{client: &http.Client{Timeout: bpeFetchTimeout}})
+}
+
+// CountTokens counts the tokens of text for the model. The OpenAI models are counted with their tiktoken
+// encoding, the other models, and the OpenAI models while their encoding is not loaded, are estimated.
+func CountTokens(model, text string) int {
+	if enc := encodingForModel(model); enc != nil {
+		return len(enc.EncodeOrdinary(text))
+	}
+	return EstimateTokens(text)
+}
+
+// encodingForModel returns the tiktoken encoding of the model, with or without its provider, nil for the other models.
+// An encoding is loaded in the background on first use, nil is returned until it is loaded. A failed load is
+// retried after encodingRetryInterval.
+func encodingForModel(model string) *tiktoken.Tiktoken {
+	if _, id, ok := strings.Cut(model, "/"); ok {
+		model = id
+	}
+	name, ok := tiktoken.MODEL_TO_ENCODING[model]
+	for prefix, encoding := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+		if !ok && strings.HasPrefix(model, prefix) {
+			name, ok = encoding, true
+		}
+	}
+	if !ok {
+		return nil
+	}
+
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	state, ok := encodings[name]
+	if !ok {
+		state = &encodingState{}
+		encodings[name] = state
+	}
+	if state.enc == nil && !state.loading && time.Since(state.failedAt) >= encodingRetryInterval {
+		state.loading = true
+		go loadEncoding(name, state)
+	}
+	return state.enc
+}
+
+// loadEncoding loads the encoding into its state, the download is done without holding encodingsMu.
+func loadEncoding(name string, state *encodingState) {
+	enc, err := getEncoding(name)
+
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	state.loading = false
+	if err != nil {
+		slog.Warn("load tiktoken encoding error, estimate the tokens instead", "encoding", name, "err", err)
+		state.failedAt = time.Now()
+		return
+	}
+	state.enc = enc
+}
+
+// bpeLoader loads the tiktoken encodings like the default loader of tiktoken-go, from the same cache
+// directory, TIKTOKEN_CACHE_DIR, but the download has a timeout so that counting tokens can not hang.
+type bpeLoader struct {
+	client *http.Client
+}
+
+func (l bpeLoader) LoadTiktokenBpe(url string) (map[string]int, error) {
+	contents, err := l.read(url)
+	if err != nil {
+		return nil, err
+	}
+	ranks := make(map[string]int)
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line == "" {
+			continue
+		}
+		encoded, rank, _ := strings.Cut(line, " ")
+		token, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("parse tiktoken encoding error: %w", err)
+		}
+		if ranks[string(token)], err = strconv.Atoi(rank); err != nil {
+			return nil, fmt.Errorf("parse tiktoken encoding error: %w", err)
+		}
+	}
+	return ranks, nil
+}
+
+// read returns the file of the url from the cache, it is downloaded and cached when missing.
+func (l bpeLoader) read(url string) ([]byte, error) {
+	dir := strings.TrimSpace(os.Getenv("TIKTOKEN_CACHE_DIR"))
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "data-gym-cache")
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%x", sha1.Sum([]byte(url))))
+	if contents, err := os.ReadFile(path); err == nil {
+		return contents, nil
+	}
+
+	resp, err := l.client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("download tiktoken encoding error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download tiktoken encoding error: %s", resp.Status)
+	}
+	contents, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("download tiktoken encoding error: %w", err)
+	}
+
+	if err := writeCache(path, contents); err != nil {
+		slog.Warn("cache tiktoken encoding error", "path", path, "err", err)
+	}
+	return contents, nil
+}
+
+// writeCache renames the file into place, so that concurrent processes never read it half written.
+func writeCache(path string, contents []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
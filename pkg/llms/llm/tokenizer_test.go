@@ -0,0 +1,73 @@
+package llm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBpeLoader(t *testing.T) {
+	t.Setenv("TIKTOKEN_CACHE_DIR", t.TempDir())
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprint(w, "IQ== 0\nIg== 1\n")
+	}))
+	defer server.Close()
+
+	loader := bpeLoader{client: server.Client()}
+	ranks, err := loader.LoadTiktokenBpe(server.URL + "/test.tiktoken")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"!": 0, `"`: 1}, ranks)
+
+	// the second load reads the cache
+	ranks, err = loader.LoadTiktokenBpe(server.URL + "/test.tiktoken")
+	assert.NoError(t, err)
+	assert.Len(t, ranks, 2)
+	assert.Equal(t, 1, calls)
+}
+
+func TestCountTokens(t *testing.T) {
+	// the models without a tiktoken encoding are estimated
+	assert.Equal(t, EstimateTokens("hello world"), CountTokens("anthropic/claude-2", "hello world"))
+	assert.Nil(t, encodingForModel("llama2"))
+}
+
+func TestEncodingForModelRetry(t *testing.T) {
+	var loads atomic.Int32
+	getEncoding = func(string) (*tiktoken.Tiktoken, error) {
+		loads.Add(1)
+		return nil, errors.New("offline")
+	}
+	t.Cleanup(func() {
+		getEncoding = tiktoken.GetEncoding
+		encodingsMu.Lock()
+		delete(encodings, tiktoken.MODEL_P50K_EDIT)
+		encodingsMu.Unlock()
+	})
+
+	// the encoding is loaded in the background, the tokens are estimated meanwhile
+	assert.Nil(t, encodingForModel("text-davinci-edit-001"))
+	assert.Eventually(t, func() bool {
+		encodingsMu.Lock()
+		defer encodingsMu.Unlock()
+		return !encodings[tiktoken.MODEL_P50K_EDIT].loading
+	}, time.Second, time.Millisecond)
+
+	// a failed load is not retried before the retry interval
+	assert.Nil(t, encodingForModel("text-davinci-edit-001"))
+	assert.Equal(t, int32(1), loads.Load())
+
+	encodingsMu.Lock()
+	encodings[tiktoken.MODEL_P50K_EDIT].failedAt = time.Now().Add(-encodingRetryInterval)
+	encodingsMu.Unlock()
+	encodingForModel("text-davinci-edit-001")
+	assert.Eventually(t, func() bool { return loads.Load() == 2 }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,71 @@
+package llm
+
+// The counts below are used when a provider does not report usage and to check token budgets before
+// a request is sent. The text is counted with CountTokens, the message overhead is estimated.
+const (
+	// tokensPerMessage is the overhead of the role and separators of every message
+	tokensPerMessage = 4
+	// tokensPerImage is the cost of a low detail image on openai
+	tokensPerImage = 85
+)
+
+// EstimateTokens approximates the number of tokens of text, about four characters
+// per token for latin text and one token per character for other scripts like CJK.
+// It is the fallback of CountTokens, for the models without a tokenizer.
+func EstimateTokens(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < 128 {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// EstimatePromptTokens approximates the number of prompt tokens of the request.
+func (r *ChatCompletionRequest) EstimatePromptTokens() int {
+	return estimateMessagesTokens(r.Model, r.Messages)
+}
+
+func estimateMessagesTokens(model string, messages []ChatCompletionMessage) int {
+	tokens := 0
+	for _, message := range messages {
+		tokens += tokensPerMessage + CountTokens(model, message.TextContent())
+		for _, part := range message.MultiContent {
+			if part.Type == ChatMessagePartTypeImageURL {
+				tokens += tokensPerImage
+			}
+		}
+		for _, call := range message.ToolCalls {
+			tokens += CountTokens(model, call.Function.Name) + CountTokens(model, call.Function.Arguments)
+		}
+	}
+	return tokens
+}
+
+// EstimateCompletionTokens approximates the number of completion tokens of the response.
+func (r *ChatCompletionResponse) EstimateCompletionTokens() int {
+	tokens := 0
+	for _, choice := range r.Choices {
+		tokens += CountTokens(r.Model, choice.Message.Content)
+		for _, call := range choice.Message.ToolCalls {
+			tokens += CountTokens(r.Model, call.Function.Name) + CountTokens(r.Model, call.Function.Arguments)
+		}
+	}
+	return tokens
+}
+
+// EstimateUsage approximates the usage of a request and its response, for providers which do not report it.
+func EstimateUsage(req ChatCompletionRequest, resp ChatCompletionResponse) Usage {
+	return NewUsage(req.EstimatePromptTokens(), resp.EstimateCompletionTokens())
+}
+
+func NewUsage(promptTokens, completionTokens int) Usage {
+	return Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
@@ -2,29 +2,25 @@ package llms
 
 import (
 	"fmt"
-	"log/slog"
-	"strings"
-	"sync"
 
 	"github.com/Vaayne/aienvoy/pkg/llms/aigateway"
+	"github.com/Vaayne/aienvoy/pkg/llms/anthropic"
 	"github.com/Vaayne/aienvoy/pkg/llms/anyscale"
 	"github.com/Vaayne/aienvoy/pkg/llms/awsbedrock"
+	"github.com/Vaayne/aienvoy/pkg/llms/bard"
+	"github.com/Vaayne/aienvoy/pkg/llms/claudeweb"
 	"github.com/Vaayne/aienvoy/pkg/llms/llm"
 
 	"github.com/Vaayne/aienvoy/pkg/llms/githubcopilot"
 	"github.com/Vaayne/aienvoy/pkg/llms/googleai"
+	"github.com/Vaayne/aienvoy/pkg/llms/ollama"
 	"github.com/Vaayne/aienvoy/pkg/llms/openai"
 	"github.com/Vaayne/aienvoy/pkg/llms/together"
 )
 
-var (
-	modelLlmMapping map[string]*llm.LLM
-	once            sync.Once
-)
-
 func getClient(cfg llm.Config, dao llm.Dao) (*llm.LLM, error) {
 	switch cfg.LLMType {
-	case llm.LLMTypeOpenAI, llm.LLMTypeAzureOpenAI, llm.LLMTypeOpenRouter:
+	case llm.LLMTypeOpenAI, llm.LLMTypeAzureOpenAI, llm.LLMTypeOpenRouter, llm.LLMTypeLlamaCpp:
 		return openai.New(cfg, dao)
 	case llm.LLMTypeTogether:
 		return together.New(cfg, dao)
@@ -38,75 +34,47 @@ func getClient(cfg llm.Config, dao llm.Dao) (*llm.LLM, error) {
 		return aigateway.New(cfg, dao)
 	case llm.LLMTypeGithubCopilot:
 		return githubcopilot.New(cfg, dao)
+	case llm.LLMTypeAnthropic:
+		return anthropic.New(cfg, dao)
+	case llm.LLMTypeOllama:
+		return ollama.New(cfg, dao)
+	case llm.LLMTypeClaudeWeb:
+		return claudeweb.New(cfg, dao)
+	case llm.LLMTypeGoogleBard:
+		return bard.New(cfg, dao)
 	default:
 		return nil, fmt.Errorf("client for type %s not found", cfg.LLMType)
 	}
 }
 
-// initModelMapping initializes the modelLlmMapping map with the provided configurations.
-// It creates a client for each configuration and maps it to the LLMType and Models in the configuration.
-// If there's an error while creating a client, it logs the error and continues with the next configuration.
-//
-// Parameters:
-// dao: An instance of llm.Dao which will be used to create the client.
-// cfgs: A slice of llm.Config instances which contain the configurations for each client.
-//
-// Returns:
-// This function doesn't return a value.
-func initModelMapping(dao llm.Dao, cfgs []llm.Config) {
-	// Initialize the modelLlmMapping map
-	modelLlmMapping = make(map[string]*llm.LLM)
-
-	// Iterate over the provided configurations
-	for _, cfg := range cfgs {
-		// Create a client for the current configuration
-		cli, err := getClient(cfg, dao)
-		if err != nil {
-			// Log the error and continue with the next configuration if there's an error
-			slog.Error("init client error", "err", err, "config", cfg)
-			continue
-		}
-
-		// Map the client to the LLMType in the configuration
-		modelLlmMapping[cfg.ID()] = cli
-
-		// Map the client to each Model in the
-		for _, model := range cfg.ListModels() {
-			modelLlmMapping[model] = cli
-		}
-	}
+// Options configures the router beyond the provider configs.
+type Options struct {
+	// Routes map a model to a fallback chain of providers
+	Routes []llm.Route
+	// Strategy balances the configs which serve the same model, defaults to weighted round-robin
+	Strategy Strategy
+	// Models override and extend the bundled model catalogue, for pricing and context lengths
+	Models []llm.Model
+	// History is the strategy for the history of conversations, defaults to a sliding window
+	History llm.History
+	// AnnotationModel titles and summarizes the conversations in the background, they are not annotated when empty
+	AnnotationModel string
+	// Cache serves identical chat completions from a cache, it is disabled without a backend
+	Cache llm.CacheConfig
 }
 
-func splitModel(model string) (string, string) {
-	texts := strings.Split(model, "/")
-	if len(texts) == 1 {
-		return "", model
-	}
-	provider := texts[0]
-	_, ok := modelLlmMapping[provider]
-	if !ok {
-		return "", ""
-	}
-	modelId := strings.Join(texts[1:], "/")
-	return provider, modelId
+func NewWithDao(model string, cfgs []llm.Config, dao llm.Dao) (*llm.LLM, error) {
+	return NewWithOptions(model, cfgs, Options{}, dao)
 }
 
-func NewWithDao(model string, cfgs []llm.Config, dao llm.Dao) (*llm.LLM, error) {
-	once.Do(func() {
-		initModelMapping(dao, cfgs)
-	})
-	provider, modelId := splitModel(model)
-	if modelId == "" {
-		return nil, fmt.Errorf("model %s is not supported", model)
-	}
-	if provider != "" {
-		return modelLlmMapping[provider], nil
-	}
-	cli, ok := modelLlmMapping[modelId]
-	if ok {
-		return cli, nil
+// NewWithOptions is like NewWithDao, models with a route are served by the fallback chain of the route.
+// It builds a registry of the configurations for the call, long-running services should keep a Registry instead.
+func NewWithOptions(model string, cfgs []llm.Config, opts Options, dao llm.Dao) (*llm.LLM, error) {
+	registry := NewRegistry(dao)
+	if err := registry.Reload(cfgs, opts); err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("model %s is not supported", model)
+	return registry.Get(model)
 }
 
 func New(model string, cfgs []llm.Config) (*llm.LLM, error) {
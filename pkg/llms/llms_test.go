@@ -8,9 +8,9 @@ import (
 )
 
 func TestSplitModel(t *testing.T) {
-	modelLlmMapping = map[string]*llm.LLM{
+	state := &registryState{models: map[string]*llm.LLM{
 		llm.LLMTypeOpenAI.String(): nil,
-	}
+	}}
 
 	tests := []struct {
 		name  string
@@ -36,7 +36,7 @@ func TestSplitModel(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if _, got := splitModel(tt.model); got != tt.want {
+			if _, got := state.splitModel(tt.model); got != tt.want {
 				t.Errorf("splitModel() = %v, want %v", got, tt.want)
 			}
 		})
@@ -0,0 +1,202 @@
+package ollama
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+const (
+	defaultBaseUrl = "http://localhost:11434"
+	// discoverTimeout bounds the request listing the models, the server may not be running
+	discoverTimeout = 5 * time.Second
+	// maxLineSize bounds a line of the chat stream
+	maxLineSize = 1 << 20
+)
+
+type Client struct {
+	sess    *http.Client
+	config  llm.Config
+	baseUrl string
+}
+
+func NewClient(cfg llm.Config) (*Client, error) {
+	if cfg.LLMType != llm.LLMTypeOllama {
+		return nil, fmt.Errorf("invalid config for ollama, llmtype: %s", cfg.LLMType)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	baseUrl := defaultBaseUrl
+	if cfg.BaseUrl != "" {
+		baseUrl = strings.TrimSuffix(cfg.BaseUrl, "/")
+	}
+	return &Client{
+		sess:    http.DefaultClient,
+		config:  cfg,
+		baseUrl: baseUrl,
+	}, nil
+}
+
+// ListModels returns the models of the config, or the models on the server when the config lists none.
+func (c *Client) ListModels() []string {
+	if models := c.config.ListModels(); len(models) > 0 {
+		return models
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), discoverTimeout)
+	defer cancel()
+	models, err := c.DiscoverModels(ctx)
+	if err != nil {
+		slog.Warn("list ollama models error", "err", err, "base_url", c.baseUrl)
+	}
+	return models
+}
+
+// DiscoverModels lists the models pulled on the server, by their name and tag like llama2:latest.
+func (c *Client) DiscoverModels(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseUrl+"/api/tags", nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request error: %w", err)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tags TagsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, fmt.Errorf("decode response error: %w", err)
+	}
+	models := make([]string, 0, len(tags.Models))
+	for _, m := range tags.Models {
+		models = append(models, m.Name)
+	}
+	return models, nil
+}
+
+func (c *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+	slog.DebugContext(ctx, "chat start", "model", req.ModelId(), "is_stream", true)
+	req, err := llm.InlineImages(ctx, req)
+	if err != nil {
+		errChan <- fmt.Errorf("inline images error: %w", err)
+		return
+	}
+	body := &ChatRequest{}
+	body.FromChatCompletionRequest(req, c.config.Ollama.KeepAlive)
+
+	resp, err := c.chat(ctx, body)
+	var apiErr *llm.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound && c.config.Ollama.Pull {
+		// the model is not on the server yet, it is pulled and the request sent again
+		if err = c.pull(ctx, body.Model); err == nil {
+			resp, err = c.chat(ctx, body)
+		}
+	}
+	if err != nil {
+		slog.InfoContext(ctx, "chat error", "model", req.ModelId(), "is_stream", true, "err", err)
+		errChan <- err
+		return
+	}
+	defer resp.Body.Close()
+
+	decoder := NewStreamDecoder()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var chatResp ChatResponse
+		if err := json.Unmarshal(line, &chatResp); err != nil {
+			errChan <- fmt.Errorf("unmarshal ollama response error: %w, data: %s", err, line)
+			return
+		}
+		if chatResp.Error != "" {
+			errChan <- llm.NewAPIError(http.StatusInternalServerError, chatResp.Error)
+			return
+		}
+		dataChan <- decoder.Decode(chatResp)
+		if chatResp.Done {
+			if req.IncludeUsage() {
+				dataChan <- decoder.Usage(chatResp.Model)
+			}
+			slog.DebugContext(ctx, "chat success", "model", req.ModelId(), "is_stream", true)
+			errChan <- io.EOF
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errChan <- fmt.Errorf("read ollama stream error: %w", err)
+		return
+	}
+	errChan <- fmt.Errorf("%w: ollama stream ended before done", llm.ErrStreamInterrupted)
+}
+
+// chat sends the request to the chat api, the response is a stream of JSON lines.
+func (c *Client) chat(ctx context.Context, body *ChatRequest) (*http.Response, error) {
+	return c.post(ctx, "/api/chat", body)
+}
+
+// pull downloads the model to the server, it returns once the model is ready.
+func (c *Client) pull(ctx context.Context, model string) error {
+	slog.InfoContext(ctx, "pull ollama model", "model", model)
+	resp, err := c.post(ctx, "/api/pull", PullRequest{Name: model})
+	if err != nil {
+		return fmt.Errorf("pull model %s error: %w", model, err)
+	}
+	defer resp.Body.Close()
+	var status ErrorResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return fmt.Errorf("decode response error: %w", err)
+	}
+	if status.Error != "" {
+		return llm.NewAPIError(http.StatusNotFound, fmt.Sprintf("pull model %s error: %s", model, status.Error))
+	}
+	return nil
+}
+
+func (c *Client) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("marshal request body error: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseUrl+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("create request error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req)
+}
+
+// do sends the request, a response with an unexpected status code is an APIError.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.config.ApiKey != "" {
+		// for a server behind a proxy which checks a bearer token
+		req.Header.Set("Authorization", "Bearer "+c.config.ApiKey)
+	}
+	resp, err := c.sess.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request error: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		var errResp ErrorResponse
+		if err := json.Unmarshal(data, &errResp); err == nil && errResp.Error != "" {
+			return nil, llm.NewAPIError(resp.StatusCode, errResp.Error)
+		}
+		return nil, llm.NewAPIError(resp.StatusCode, string(data))
+	}
+	return resp, nil
+}
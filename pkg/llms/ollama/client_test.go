@@ -0,0 +1,125 @@
+package ollama
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer is a stand-in of an ollama server with one pulled model, it can pull llava.
+func newTestServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	var pulls atomic.Int32
+	models := map[string]bool{"llama2:latest": true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/tags", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"models":[{"name":"llama2:latest","model":"llama2:latest","size":3825819519}]}`)
+	})
+	mux.HandleFunc("/api/pull", func(w http.ResponseWriter, r *http.Request) {
+		var req PullRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.False(t, req.Stream)
+		pulls.Add(1)
+		models[req.Name] = true
+		fmt.Fprint(w, `{"status":"success"}`)
+	})
+	mux.HandleFunc("/api/chat", func(w http.ResponseWriter, r *http.Request) {
+		var req ChatRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		if !models[req.Model] {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"error":"model '%s' not found, try pulling it first"}`, req.Model)
+			return
+		}
+		assert.True(t, req.Stream)
+		assert.Equal(t, "10m", req.KeepAlive)
+		last := req.Messages[len(req.Messages)-1]
+		fmt.Fprintf(w, `{"model":"%s","message":{"role":"assistant","content":"you said "},"done":false}`+"\n", req.Model)
+		fmt.Fprintf(w, `{"model":"%s","message":{"role":"assistant","content":"%s %d"},"done":false}`+"\n", req.Model, last.Content, len(last.Images))
+		fmt.Fprintf(w, `{"model":"%s","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":7,"eval_count":4}`+"\n", req.Model)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &pulls
+}
+
+func newTestClient(t *testing.T, baseUrl string, pull bool) *Client {
+	client, err := NewClient(llm.Config{
+		LLMType: llm.LLMTypeOllama,
+		BaseUrl: baseUrl,
+		Ollama:  llm.OllamaConfig{Pull: pull, KeepAlive: "10m"},
+	})
+	require.NoError(t, err)
+	return client
+}
+
+func TestCreateChatCompletion(t *testing.T) {
+	server, _ := newTestServer(t)
+	client := newTestClient(t, server.URL, false)
+
+	resp, err := llm.New(llm.NewMemoryDao(), client).CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{
+		Model: "ollama/llama2:latest",
+		Messages: []llm.ChatCompletionMessage{
+			{Role: llm.ChatMessageRoleSystem, Content: "Be brief."},
+			{Role: llm.ChatMessageRoleUser, MultiContent: []llm.ChatMessagePart{
+				{Type: llm.ChatMessagePartTypeText, Text: "hello"},
+				{Type: llm.ChatMessagePartTypeImageURL, ImageURL: &llm.ChatMessageImageURL{URL: "data:image/png;base64,aGVsbG8="}},
+			}},
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "you said hello 1", resp.Choices[0].Message.Content)
+	assert.Equal(t, llm.FinishReasonStop, resp.Choices[0].FinishReason)
+	assert.Equal(t, llm.NewUsage(7, 4), resp.Usage)
+}
+
+func TestChatRequestTemperature(t *testing.T) {
+	var r ChatRequest
+	r.FromChatCompletionRequest(llm.ChatCompletionRequest{Model: "llama2", TemperatureSet: true}, "")
+	require.NotNil(t, r.Options)
+	assert.Equal(t, float32(0), *r.Options.Temperature)
+
+	r = ChatRequest{}
+	r.FromChatCompletionRequest(llm.ChatCompletionRequest{Model: "llama2"}, "")
+	assert.Nil(t, r.Options)
+}
+
+func TestPullOnDemand(t *testing.T) {
+	server, pulls := newTestServer(t)
+	req := llm.ChatCompletionRequest{
+		Model:    "llava:latest",
+		Messages: []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: "hi"}},
+	}
+
+	_, err := llm.New(llm.NewMemoryDao(), newTestClient(t, server.URL, false)).CreateChatCompletion(context.Background(), req)
+	var apiErr *llm.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	assert.Equal(t, int32(0), pulls.Load())
+
+	resp, err := llm.New(llm.NewMemoryDao(), newTestClient(t, server.URL, true)).CreateChatCompletion(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "you said hi 0", resp.Choices[0].Message.Content)
+	assert.Equal(t, int32(1), pulls.Load())
+}
+
+func TestListModels(t *testing.T) {
+	server, _ := newTestServer(t)
+	assert.Equal(t, []string{"llama2:latest"}, newTestClient(t, server.URL, false).ListModels())
+
+	// the models of the config are not discovered
+	client, err := NewClient(llm.Config{LLMType: llm.LLMTypeOllama, BaseUrl: server.URL, Models: []string{"mistral"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mistral"}, client.ListModels())
+
+	// a server which is down has no models
+	server.Close()
+	assert.Empty(t, newTestClient(t, server.URL, false).ListModels())
+}
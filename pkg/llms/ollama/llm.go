@@ -0,0 +1,15 @@
+package ollama
+
+import (
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+type Ollama *llm.LLM
+
+func New(config llm.Config, dao llm.Dao) (Ollama, error) {
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return llm.New(dao, client), nil
+}
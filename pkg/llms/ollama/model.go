@@ -0,0 +1,148 @@
+package ollama
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/google/uuid"
+)
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Images are base64 encoded, for the multimodal models like llava
+	Images []string `json:"images,omitempty"`
+}
+
+type Options struct {
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        float32  `json:"top_p,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+type ChatRequest struct {
+	Model     string    `json:"model"`
+	Messages  []Message `json:"messages"`
+	Stream    bool      `json:"stream"`
+	Options   *Options  `json:"options,omitempty"`
+	KeepAlive string    `json:"keep_alive,omitempty"`
+}
+
+func (r *ChatRequest) FromChatCompletionRequest(req llm.ChatCompletionRequest, keepAlive string) {
+	r.Model = req.ModelId()
+	r.Stream = true
+	r.KeepAlive = keepAlive
+	temperature := req.TemperatureParam()
+	if temperature != nil || req.TopP != 0 || req.MaxTokens != 0 || len(req.Stop) > 0 {
+		r.Options = &Options{Temperature: temperature, TopP: req.TopP, NumPredict: req.MaxTokens, Stop: req.Stop}
+	}
+
+	r.Messages = make([]Message, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		role := m.Role
+		// the models have no tools, their results are sent as user text
+		if role == llm.ChatMessageRoleTool || role == llm.ChatMessageRoleFunction {
+			role = llm.ChatMessageRoleUser
+		}
+		message := Message{Role: role, Content: m.TextContent()}
+		for _, part := range m.MultiContent {
+			if part.Type != llm.ChatMessagePartTypeImageURL {
+				continue
+			}
+			_, data, ok := llm.ImagePart(part)
+			if !ok {
+				continue
+			}
+			message.Images = append(message.Images, data)
+		}
+		r.Messages = append(r.Messages, message)
+	}
+}
+
+// ChatResponse is a line of the chat stream, the last one is done and has the counts of tokens.
+type ChatResponse struct {
+	Model           string  `json:"model"`
+	CreatedAt       string  `json:"created_at"`
+	Message         Message `json:"message"`
+	Done            bool    `json:"done"`
+	DoneReason      string  `json:"done_reason,omitempty"`
+	PromptEvalCount int     `json:"prompt_eval_count,omitempty"`
+	EvalCount       int     `json:"eval_count,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// StreamDecoder converts the lines of a chat stream into chat completion chunks.
+type StreamDecoder struct {
+	id      string
+	created int64
+	usage   llm.Usage
+}
+
+func NewStreamDecoder() *StreamDecoder {
+	return &StreamDecoder{
+		id:      fmt.Sprintf("chatcmpl-%s", uuid.NewString()),
+		created: time.Now().Unix(),
+	}
+}
+
+func (d *StreamDecoder) Decode(resp ChatResponse) llm.ChatCompletionStreamResponse {
+	var finishReason llm.FinishReason
+	if resp.Done {
+		finishReason = llm.FinishReasonStop
+		if resp.DoneReason == "length" {
+			finishReason = llm.FinishReasonLength
+		}
+		d.usage = llm.NewUsage(resp.PromptEvalCount, resp.EvalCount)
+	}
+	return llm.ChatCompletionStreamResponse{
+		ID:      d.id,
+		Object:  "chat.completion.chunk",
+		Created: d.created,
+		Model:   resp.Model,
+		Choices: []llm.ChatCompletionStreamChoice{
+			{
+				Index: 0,
+				Delta: llm.ChatCompletionStreamChoiceDelta{
+					Role:    llm.ChatMessageRoleAssistant,
+					Content: resp.Message.Content,
+				},
+				FinishReason: finishReason,
+			},
+		},
+	}
+}
+
+// Usage returns the chunk with the usage of the whole request, to be sent after the last line.
+func (d *StreamDecoder) Usage(model string) llm.ChatCompletionStreamResponse {
+	usage := d.usage
+	return llm.ChatCompletionStreamResponse{
+		ID:      d.id,
+		Object:  "chat.completion.chunk",
+		Created: d.created,
+		Model:   model,
+		Choices: []llm.ChatCompletionStreamChoice{},
+		Usage:   &usage,
+	}
+}
+
+type Model struct {
+	Name  string `json:"name"`
+	Model string `json:"model"`
+	Size  int64  `json:"size"`
+}
+
+// TagsResponse lists the models on the server.
+type TagsResponse struct {
+	Models []Model `json:"models"`
+}
+
+type PullRequest struct {
+	Name   string `json:"name"`
+	Stream bool   `json:"stream"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
@@ -24,8 +24,25 @@ var validLLMTypes = map[llm.LLMType]struct{}{
 	llm.LLMTypeOpenRouter:  {},
 	llm.LLMTypeTogether:    {},
 	llm.LLMTypeAnyScale:    {},
+	llm.LLMTypeLlamaCpp:    {},
 }
 
+// usageLLMTypes report the token usage of a stream when asked with stream_options,
+// the others reject the option and fall back on the estimate.
+var usageLLMTypes = map[llm.LLMType]struct{}{
+	llm.LLMTypeOpenAI:     {},
+	llm.LLMTypeOpenRouter: {},
+}
+
+// discoverLLMTypes list their models from the server when the config lists none, they are local servers
+// which serve the models they were started with.
+var discoverLLMTypes = map[llm.LLMType]struct{}{
+	llm.LLMTypeLlamaCpp: {},
+}
+
+// defaultLlamaCppBaseUrl is the OpenAI compatible api of a llama.cpp server started with its default port
+const defaultLlamaCppBaseUrl = "http://localhost:8080/v1"
+
 func NewClient(cfg llm.Config) (*Client, error) {
 	// make sure cfg.LLMType == llm.LLMTypeOpenAI
 	// make sure cfg.ApiKey is not empty
@@ -48,6 +65,8 @@ func NewClient(cfg llm.Config) (*Client, error) {
 		oaiConfig = openai.DefaultConfig(cfg.ApiKey)
 		if cfg.BaseUrl != "" {
 			oaiConfig.BaseURL = cfg.BaseUrl
+		} else if cfg.LLMType == llm.LLMTypeLlamaCpp {
+			oaiConfig.BaseURL = defaultLlamaCppBaseUrl
 		}
 	}
 
@@ -61,13 +80,33 @@ func (s *Client) ListModels() []string {
 	return s.config.ListModels()
 }
 
+// DiscoverModels lists the models of the server, only for the local servers, the others have none.
+func (s *Client) DiscoverModels(ctx context.Context) ([]string, error) {
+	if _, ok := discoverLLMTypes[s.config.LLMType]; !ok {
+		return nil, nil
+	}
+	list, err := s.Client.ListModels(ctx)
+	if err != nil {
+		return nil, toLLMError(err)
+	}
+	models := make([]string, 0, len(list.Models))
+	for _, m := range list.Models {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
+
 func (s *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
 	openaiReq := toOpenAIChatCompletionRequest(req)
+	openaiReq.StreamOptions = nil
+	if _, ok := usageLLMTypes[s.config.LLMType]; ok {
+		openaiReq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
 	slog.DebugContext(ctx, "chat start", "llm", openaiReq.Model, "is_stream", openaiReq.Stream)
 	stream, err := s.Client.CreateChatCompletionStream(ctx, openaiReq)
 	if err != nil {
 		slog.InfoContext(ctx, "chat error", "llm", openaiReq.Model, "is_stream", openaiReq.Stream, "err", err)
-		errChan <- err
+		errChan <- toLLMError(err)
 		return
 	}
 
@@ -82,12 +121,33 @@ func (s *Client) CreateChatCompletionStream(ctx context.Context, req llm.ChatCom
 				return
 			}
 			slog.InfoContext(ctx, "chat error", "llm", openaiReq.Model, "is_stream", openaiReq.Stream, "err", err)
-			errChan <- err
+			errChan <- toLLMError(err)
 			return
 		}
 		if len(resp.Choices) > 0 {
 			sb.WriteString(resp.Choices[0].Delta.Content)
 			dataChan <- toLLMChatCompletionStreamResponse(resp)
+		} else if resp.Usage != nil && req.IncludeUsage() {
+			dataChan <- toLLMChatCompletionStreamResponse(resp)
 		}
 	}
 }
+
+// maxEmbeddingInputs is the limit of inputs of one embeddings request of openai
+const maxEmbeddingInputs = 2048
+
+func (s *Client) CreateEmbeddings(ctx context.Context, req llm.EmbeddingRequest) (llm.EmbeddingResponse, error) {
+	return llm.CreateEmbeddingsInBatches(ctx, req, maxEmbeddingInputs, func(ctx context.Context, req llm.EmbeddingRequest, inputs []string) (llm.EmbeddingResponse, error) {
+		resp, err := s.Client.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+			Input:      inputs,
+			Model:      openai.EmbeddingModel(req.ModelId()),
+			User:       req.User,
+			Dimensions: req.Dimensions,
+		})
+		if err != nil {
+			slog.InfoContext(ctx, "embeddings error", "llm", req.ModelId(), "err", err)
+			return llm.EmbeddingResponse{}, toLLMError(err)
+		}
+		return toLLMEmbeddingResponse(resp), nil
+	})
+}
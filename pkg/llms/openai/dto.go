@@ -1,6 +1,8 @@
 package openai
 
 import (
+	"errors"
+
 	"github.com/Vaayne/aienvoy/pkg/llms/llm"
 	"github.com/mitchellh/mapstructure"
 	"github.com/sashabaranov/go-openai"
@@ -18,3 +20,29 @@ func toLLMChatCompletionStreamResponse(resp openai.ChatCompletionStreamResponse)
 	_ = mapstructure.Decode(resp, &llmResp)
 	return llmResp
 }
+
+// toLLMError converts the api errors of go-openai into llm.APIError, other errors are returned as is.
+func toLLMError(err error) error {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return &llm.APIError{StatusCode: apiErr.HTTPStatusCode, Message: apiErr.Message, Err: err}
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return &llm.APIError{StatusCode: reqErr.HTTPStatusCode, Message: reqErr.Error(), Err: err}
+	}
+	return err
+}
+
+func toLLMEmbeddingResponse(resp openai.EmbeddingResponse) llm.EmbeddingResponse {
+	llmResp := llm.EmbeddingResponse{
+		Object: resp.Object,
+		Model:  string(resp.Model),
+		Data:   make([]llm.Embedding, 0, len(resp.Data)),
+		Usage:  llm.NewUsage(resp.Usage.PromptTokens, 0),
+	}
+	for _, e := range resp.Data {
+		llmResp.Data = append(llmResp.Data, llm.Embedding{Object: e.Object, Embedding: e.Embedding, Index: e.Index})
+	}
+	return llmResp
+}
@@ -0,0 +1,525 @@
+package llms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+const (
+	// drainCheckInterval is how often replaced clients are checked for in-flight streams
+	drainCheckInterval = 100 * time.Millisecond
+	// defaultDrainTimeout bounds how long replaced clients are kept for their in-flight streams
+	defaultDrainTimeout = 10 * time.Minute
+	// discoverTimeout bounds the discovery of the models of a config, the provider may be a local server which is down
+	discoverTimeout = 5 * time.Second
+)
+
+var ErrNoClient = errors.New("no llm client could be created from the configs")
+
+// Registry resolves models to clients. It is rebuilt atomically by Reload, so configs can be
+// added or keys rotated while requests are served: requests already running keep the clients
+// they started with, new requests get the new ones.
+// The clients it returns save with the dao of the registry, callers with a dao of their own,
+// like a transaction, bind it with llm.LLM.WithDao.
+type Registry struct {
+	dao llm.Dao
+	// mu serializes reloads
+	mu           sync.Mutex
+	state        atomic.Pointer[registryState]
+	DrainTimeout time.Duration
+	// Recorder gets the usage of every request sent to a provider, it is taken into account on reload.
+	// When it is nil, the usage is recorded with the dao of the request if it implements UsageRecorder.
+	Recorder UsageRecorder
+	// memoryCache is the memory backend of the response cache, it is kept across reloads
+	memoryCache *llm.MemoryResponseCache
+}
+
+// registryState is one immutable generation of the registry.
+type registryState struct {
+	cfgs []llm.Config
+	// cfgModels are the models of each config, discovered from the provider when the config lists none
+	cfgModels [][]string
+	opts      Options
+	models    map[string]*llm.LLM
+	balancers []*balancer
+	catalog   *llm.Catalog
+	// clients are the provider clients of this generation, the ones implementing io.Closer are closed once it is drained
+	clients []llm.Client
+	// streams counts the streams in flight on the clients of this generation
+	streams atomic.Int64
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry(dao llm.Dao) *Registry {
+	r := &Registry{
+		dao:          dao,
+		DrainTimeout: defaultDrainTimeout,
+	}
+	r.state.Store(&registryState{models: make(map[string]*llm.LLM), catalog: llm.NewCatalog(nil)})
+	return r
+}
+
+// Reload builds the clients of the configs and swaps them in. The replaced clients are drained
+// in the background, they are closed once their in-flight streams have finished.
+// When none of the configs yields a client, the registry is left unchanged and an error is returned.
+func (r *Registry) Reload(cfgs []llm.Config, opts Options) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reload(cfgs, opts)
+}
+
+func (r *Registry) reload(cfgs []llm.Config, opts Options) error {
+	state := newRegistryState(r.dao, r.Recorder, r.responseCache(opts.Cache), cfgs, opts)
+	if len(cfgs) > 0 && len(state.models) == 0 {
+		state.close()
+		return ErrNoClient
+	}
+	old := r.state.Swap(state)
+	slog.Info("llm registry reloaded", "configs", len(cfgs), "routes", len(opts.Routes), "models", len(state.models))
+	go old.drain(r.DrainTimeout)
+	return nil
+}
+
+// Close closes the clients of the registry after their in-flight streams, it serves no model afterwards.
+func (r *Registry) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.state.Swap(&registryState{models: make(map[string]*llm.LLM), catalog: llm.NewCatalog(nil)})
+	old.drain(r.DrainTimeout)
+}
+
+// responseCache returns the store of the cache backend, nil when the cache is disabled.
+// The sqlite backend is the dao of each request, the memory backend is used when it can not cache responses.
+func (r *Registry) responseCache(cfg llm.CacheConfig) llm.ResponseCache {
+	if cfg.Backend == llm.CacheBackendNone {
+		return nil
+	}
+	if r.memoryCache == nil {
+		r.memoryCache = llm.NewMemoryResponseCache()
+	}
+	switch cfg.Backend {
+	case llm.CacheBackendSQLite:
+		return daoResponseCache{fallback: r.memoryCache}
+	case llm.CacheBackendMemory:
+	default:
+		slog.Warn("unknown cache backend, use the memory cache", "backend", cfg.Backend)
+	}
+	return r.memoryCache
+}
+
+// daoResponseCache stores the responses with the dao of each request, so that a request in a transaction
+// caches with the transaction. The requests whose dao can not cache responses use the fallback.
+type daoResponseCache struct {
+	fallback llm.ResponseCache
+}
+
+func (c daoResponseCache) cache(ctx context.Context) llm.ResponseCache {
+	if cache, ok := llm.DaoFrom(ctx).(llm.ResponseCache); ok {
+		return cache
+	}
+	return c.fallback
+}
+
+func (c daoResponseCache) GetResponse(ctx context.Context, key string) (llm.ChatCompletionResponse, bool, error) {
+	return c.cache(ctx).GetResponse(ctx, key)
+}
+
+func (c daoResponseCache) SetResponse(ctx context.Context, key string, resp llm.ChatCompletionResponse, ttl time.Duration) error {
+	return c.cache(ctx).SetResponse(ctx, key, resp, ttl)
+}
+
+// Get returns the client for a model, the model can be prefixed with a provider id like openai/gpt-4.
+func (r *Registry) Get(model string) (*llm.LLM, error) {
+	return r.state.Load().get(model)
+}
+
+// Catalog returns the pricing and context lengths of the models.
+func (r *Registry) Catalog() *llm.Catalog {
+	return r.state.Load().catalog
+}
+
+// Models lists the models served by the registry. Every model of a config is listed as provider/model
+// and as a bare id, the bare id of a route is owned by its first target.
+func (r *Registry) Models() []llm.Model {
+	return r.state.Load().listModels()
+}
+
+// Health returns the state of every key of the models served by several configs.
+func (r *Registry) Health() []KeyHealth {
+	healths := make([]KeyHealth, 0)
+	for _, b := range r.state.Load().balancers {
+		healths = append(healths, b.health()...)
+	}
+	return healths
+}
+
+// newRegistryState creates a client for each configuration and maps it to the LLMType and Models in the configuration.
+// When several configurations share an id or a model, they are put behind a balancer.
+// If there's an error while creating a client, it logs the error and continues with the next configuration.
+//
+// Parameters:
+// dao: An instance of llm.Dao which will be used to create the client.
+// recorder: Records the usage of the requests, it may be nil.
+// cache: Stores the responses of the cacheable requests, they are not cached when it is nil.
+// cfgs: A slice of llm.Config instances which contain the configurations for each client.
+// opts: The routes, the balancing strategy and the model catalogue.
+//
+// Returns:
+// The new generation of the registry.
+func newRegistryState(dao llm.Dao, recorder UsageRecorder, cache llm.ResponseCache, cfgs []llm.Config, opts Options) *registryState {
+	s := &registryState{
+		cfgs:      cfgs,
+		cfgModels: make([][]string, len(cfgs)),
+		opts:      opts,
+		models:    make(map[string]*llm.LLM),
+		catalog:   llm.NewCatalog(opts.Models),
+	}
+
+	// Group the members by config id and by model, keeping the order of the configurations
+	idMembers := make(map[string][]*member)
+	modelMembers := make(map[string][]*member)
+	keys := make([]string, 0)
+	for i, cfg := range cfgs {
+		// Create a client for the current configuration
+		cli, err := getClient(cfg, dao)
+		if err != nil {
+			// Log the error and continue with the next configuration if there's an error
+			slog.Error("init client error", "err", err, "config", cfg.ID())
+			continue
+		}
+		id := cfg.ID()
+		s.clients = append(s.clients, cli.Client)
+		s.cfgModels[i] = discoverModels(cfg, cli.Client)
+		// count the streams of this generation, so it can be drained when replaced
+		var client llm.Client = &trackedClient{Client: cli.Client, provider: id, streams: &s.streams, recorder: recorder, catalog: s.catalog}
+		// identical requests are answered from the cache before they reach the provider
+		if cache != nil {
+			client = &cachedClient{Client: client, cache: cache, cfg: opts.Cache}
+		}
+		cli = s.newLLM(dao, client)
+
+		name := id
+		if n := len(idMembers[id]); n > 0 {
+			name = fmt.Sprintf("%s#%d", id, n+1)
+		}
+		m := newMember(name, cfg, cli)
+		idMembers[id] = append(idMembers[id], m)
+		for _, model := range s.cfgModels[i] {
+			if len(modelMembers[model]) == 0 {
+				keys = append(keys, model)
+			}
+			modelMembers[model] = append(modelMembers[model], m)
+		}
+	}
+
+	// providers keeps the clients by config id, they are the targets of the routes
+	providers := make(map[string]*llm.LLM)
+	breakers := make(map[string]*circuitBreaker)
+	for id, members := range idMembers {
+		cli := s.balance(dao, id, opts.Strategy, members)
+		// Map the client to the LLMType in the configuration
+		s.models[id] = cli
+		providers[id] = cli
+		breakers[id] = newCircuitBreaker()
+	}
+	// Map the client to each Model in the configurations
+	for _, model := range keys {
+		if _, ok := s.models[model]; ok {
+			// a model named like a provider id would shadow the provider
+			continue
+		}
+		s.models[model] = s.balance(dao, model, opts.Strategy, modelMembers[model])
+	}
+
+	// Routes take precedence over the plain model mapping
+	for _, route := range opts.Routes {
+		cli, err := newFallbackClient(route, providers, breakers)
+		if err != nil {
+			slog.Error("init route error", "err", err, "route", route)
+			continue
+		}
+		s.models[route.Model] = s.newLLM(dao, cli)
+	}
+
+	if opts.AnnotationModel != "" {
+		s.annotate(opts.AnnotationModel)
+	}
+	return s
+}
+
+// discoverModels returns the models of the config, or the models listed by the client when the config lists none.
+func discoverModels(cfg llm.Config, client llm.Client) []string {
+	models := cfg.ListModels()
+	discoverer, ok := client.(llm.ModelDiscoverer)
+	if len(models) > 0 || !ok {
+		return models
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), discoverTimeout)
+	defer cancel()
+	models, err := discoverer.DiscoverModels(ctx)
+	if err != nil {
+		slog.Error("discover models error", "err", err, "config", cfg.ID())
+		return nil
+	}
+	slog.Info("discover models", "config", cfg.ID(), "models", models)
+	return models
+}
+
+// annotate sets the annotator of the model on every client of the generation.
+func (s *registryState) annotate(model string) {
+	cli, err := s.get(model)
+	if err != nil {
+		slog.Error("init annotator error, conversations are not annotated", "err", err, "model", model)
+		return
+	}
+	_, modelId := s.splitModel(model)
+	annotator := &llm.Annotator{LLM: cli, Model: modelId}
+	for _, l := range s.models {
+		l.Annotator = annotator
+	}
+}
+
+// balance returns the client of a single member as is, several members get a balancer.
+func (s *registryState) balance(dao llm.Dao, model string, strategy Strategy, members []*member) *llm.LLM {
+	if len(members) == 1 {
+		return members[0].llm
+	}
+	b := newBalancer(model, strategy, members)
+	s.balancers = append(s.balancers, b)
+	return s.newLLM(dao, b)
+}
+
+// newLLM wraps the client with the history strategy and the catalogue of the generation.
+func (s *registryState) newLLM(dao llm.Dao, cli llm.Client) *llm.LLM {
+	l := llm.New(dao, cli)
+	l.History = s.opts.History.Strategy()
+	l.Catalog = s.catalog
+	return l
+}
+
+func (s *registryState) splitModel(model string) (string, string) {
+	texts := strings.Split(model, "/")
+	if len(texts) == 1 {
+		return "", model
+	}
+	provider := texts[0]
+	_, ok := s.models[provider]
+	if !ok {
+		return "", ""
+	}
+	modelId := strings.Join(texts[1:], "/")
+	return provider, modelId
+}
+
+func (s *registryState) get(model string) (*llm.LLM, error) {
+	provider, modelId := s.splitModel(model)
+	if modelId == "" {
+		return nil, fmt.Errorf("model %s is not supported", model)
+	}
+	if provider != "" {
+		return s.models[provider], nil
+	}
+	cli, ok := s.models[modelId]
+	if ok {
+		return cli, nil
+	}
+	return nil, fmt.Errorf("model %s is not supported", model)
+}
+
+func (s *registryState) listModels() []llm.Model {
+	types := make(map[string]llm.LLMType)
+	for _, cfg := range s.cfgs {
+		types[cfg.ID()] = cfg.LLMType
+	}
+
+	models := make([]llm.Model, 0)
+	seen := make(map[string]bool)
+	add := func(id, provider, modelId string) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		m, _ := s.catalog.Lookup(provider, modelId)
+		m.ID = id
+		m.Provider = provider
+		if !m.Capabilities.Embeddings {
+			m.Capabilities.Streaming = true
+			m.Capabilities.Tools = m.Capabilities.Tools || types[provider].SupportsTools()
+		}
+		models = append(models, m)
+	}
+
+	for i, cfg := range s.cfgs {
+		if _, ok := s.models[cfg.ID()]; !ok {
+			continue
+		}
+		for _, model := range s.cfgModels[i] {
+			add(cfg.ID()+"/"+model, cfg.ID(), model)
+		}
+	}
+	for _, route := range s.opts.Routes {
+		if _, ok := s.models[route.Model]; !ok || len(route.Targets) == 0 {
+			continue
+		}
+		provider, model, ok := strings.Cut(route.Targets[0], "/")
+		if !ok {
+			model = route.Model
+		}
+		add(route.Model, provider, model)
+	}
+	for i, cfg := range s.cfgs {
+		for _, model := range s.cfgModels[i] {
+			if _, ok := s.models[model]; ok {
+				add(model, cfg.ID(), model)
+			}
+		}
+	}
+	return models
+}
+
+// drain waits until the streams on this generation have finished, or the timeout has passed,
+// and closes its clients. The streams still running after the timeout may fail.
+func (s *registryState) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for s.streams.Load() > 0 {
+		if time.Now().After(deadline) {
+			slog.Warn("replaced llm clients not drained before timeout, close them anyway", "streams", s.streams.Load())
+			break
+		}
+		time.Sleep(drainCheckInterval)
+	}
+	s.close()
+	slog.Debug("replaced llm clients closed", "models", len(s.models))
+}
+
+// close closes the provider clients of the generation which hold resources, like the connections of their sessions.
+func (s *registryState) close() {
+	for _, cli := range s.clients {
+		closer, ok := cli.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			slog.Error("close llm client error", "err", err)
+		}
+	}
+}
+
+// trackedClient counts the streams in flight on a provider client and meters the usage of its requests.
+// The usage is always requested from the provider, it is estimated when the provider does not report it,
+// and sent to the caller in a last chunk without choices when the request asks for it.
+type trackedClient struct {
+	llm.Client
+	provider string
+	streams  *atomic.Int64
+	recorder UsageRecorder
+	catalog  *llm.Catalog
+}
+
+func (c *trackedClient) CreateChatCompletionStream(ctx context.Context, req llm.ChatCompletionRequest, dataChan chan llm.ChatCompletionStreamResponse, errChan chan error) {
+	c.streams.Add(1)
+	defer c.streams.Add(-1)
+
+	start := time.Now()
+	innerReq := req
+	innerReq.StreamOptions = &llm.StreamOptions{IncludeUsage: true}
+	innerDataChan := make(chan llm.ChatCompletionStreamResponse)
+	// buffered so the provider can always hand over its final error
+	innerErrChan := make(chan error, 1)
+	go c.Client.CreateChatCompletionStream(ctx, innerReq, innerDataChan, innerErrChan)
+
+	acc := llm.NewStreamAccumulator()
+	var usage *llm.Usage
+	started := false
+	for {
+		select {
+		case data := <-innerDataChan:
+			acc.Add(data)
+			if data.Usage != nil {
+				usage = data.Usage
+			}
+			if len(data.Choices) == 0 {
+				continue
+			}
+			started = true
+			data.Usage = nil
+			dataChan <- data
+		case err := <-innerErrChan:
+			success := errors.Is(err, io.EOF)
+			if !success && !started {
+				errChan <- err
+				return
+			}
+			resp := acc.Response()
+			estimated := usage == nil
+			if estimated {
+				u := llm.EstimateUsage(innerReq, resp)
+				usage = &u
+			}
+			c.record(ctx, req.ModelId(), *usage, estimated, start)
+			if success && req.IncludeUsage() {
+				dataChan <- llm.ChatCompletionStreamResponse{
+					ID:      resp.ID,
+					Object:  "chat.completion.chunk",
+					Created: resp.Created,
+					Model:   resp.Model,
+					Choices: []llm.ChatCompletionStreamChoice{},
+					Usage:   usage,
+				}
+			}
+			errChan <- err
+			return
+		}
+	}
+}
+
+func (c *trackedClient) CreateEmbeddings(ctx context.Context, req llm.EmbeddingRequest) (llm.EmbeddingResponse, error) {
+	embedder, ok := c.Client.(llm.Embedder)
+	if !ok {
+		return llm.EmbeddingResponse{}, llm.ErrEmbeddingsNotSupported
+	}
+	c.streams.Add(1)
+	defer c.streams.Add(-1)
+
+	start := time.Now()
+	resp, err := embedder.CreateEmbeddings(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+	estimated := resp.Usage.TotalTokens == 0
+	if estimated {
+		resp.Usage = llm.NewUsage(req.EstimateTokens(), 0)
+	}
+	c.record(ctx, req.ModelId(), resp.Usage, estimated, start)
+	return resp, nil
+}
+
+// record hands the usage of a request to the recorder, priced with the catalogue.
+func (c *trackedClient) record(ctx context.Context, model string, usage llm.Usage, estimated bool, start time.Time) {
+	recorder := c.recorder
+	if recorder == nil {
+		if recorder, _ = llm.DaoFrom(ctx).(UsageRecorder); recorder == nil {
+			return
+		}
+	}
+	record := UsageRecord{
+		Provider:  c.provider,
+		Model:     model,
+		Usage:     usage,
+		Estimated: estimated,
+		Latency:   time.Since(start),
+	}
+	if c.catalog != nil {
+		record.Cost = c.catalog.Cost(record.Provider, record.Model, record.Usage)
+	}
+	recorder.RecordUsage(ctx, record)
+}
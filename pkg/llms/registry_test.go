@@ -0,0 +1,215 @@
+package llms
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryReload(t *testing.T) {
+	r := NewRegistry(llm.NewMemoryDao())
+	err := r.Reload([]llm.Config{{LLMType: llm.LLMTypeOpenAI, ApiKey: "key1", Models: []string{"gpt-4"}}}, Options{})
+	assert.NoError(t, err)
+	cli, err := r.Get("gpt-4")
+	assert.NoError(t, err)
+	assert.NotNil(t, cli)
+	_, err = r.Get("openai/gpt-4-turbo")
+	assert.NoError(t, err)
+
+	err = r.Reload([]llm.Config{{LLMType: llm.LLMTypeOpenAI, ApiKey: "key2", Models: []string{"gpt-4-turbo"}}}, Options{})
+	assert.NoError(t, err)
+	_, err = r.Get("gpt-4")
+	assert.Error(t, err)
+	_, err = r.Get("gpt-4-turbo")
+	assert.NoError(t, err)
+
+	// an unusable config keeps the current clients
+	err = r.Reload([]llm.Config{{LLMType: llm.LLMTypeOpenAI}}, Options{})
+	assert.ErrorIs(t, err, ErrNoClient)
+	_, err = r.Get("gpt-4-turbo")
+	assert.NoError(t, err)
+}
+
+func TestRegistryDiscoverModels(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/tags", r.URL.Path)
+		fmt.Fprint(w, `{"models":[{"name":"llama2:latest"},{"name":"mistral:7b"}]}`)
+	}))
+	defer server.Close()
+
+	r := NewRegistry(llm.NewMemoryDao())
+	err := r.Reload([]llm.Config{{LLMType: llm.LLMTypeOllama, BaseUrl: server.URL}}, Options{})
+	assert.NoError(t, err)
+	_, err = r.Get("mistral:7b")
+	assert.NoError(t, err)
+	_, err = r.Get("ollama/llama2:latest")
+	assert.NoError(t, err)
+	assert.Len(t, r.Models(), 4)
+}
+
+type closingClient struct {
+	fakeClient
+	closed atomic.Bool
+}
+
+func (c *closingClient) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestRegistryStateDrain(t *testing.T) {
+	provider := &closingClient{fakeClient: fakeClient{content: "a"}}
+	state := &registryState{clients: []llm.Client{provider}}
+	cli := &trackedClient{Client: provider, streams: &state.streams}
+	state.streams.Add(1)
+
+	var drained atomic.Bool
+	go func() {
+		state.drain(time.Minute)
+		drained.Store(true)
+	}()
+	time.Sleep(2 * drainCheckInterval)
+	assert.False(t, drained.Load())
+	assert.False(t, provider.closed.Load())
+
+	state.streams.Add(-1)
+	_, err := llm.New(llm.NewMemoryDao(), cli).CreateChatCompletion(context.Background(), llm.ChatCompletionRequest{})
+	assert.NoError(t, err)
+	assert.Eventually(t, drained.Load, time.Second, drainCheckInterval)
+	assert.True(t, provider.closed.Load())
+}
+
+type fakeRecorder struct {
+	records []UsageRecord
+}
+
+func (r *fakeRecorder) RecordUsage(ctx context.Context, record UsageRecord) {
+	r.records = append(r.records, record)
+}
+
+func TestTrackedClientUsage(t *testing.T) {
+	var streams atomic.Int64
+	recorder := &fakeRecorder{}
+	cli := &trackedClient{Client: &fakeClient{content: "hello world"}, provider: "openai", streams: &streams, recorder: recorder, catalog: llm.NewCatalog(nil)}
+	req := llm.ChatCompletionRequest{
+		Model:    "openai/gpt-4",
+		Messages: []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: "hi"}},
+	}
+
+	// gpt-4 is counted with tiktoken when its encoding can be downloaded, estimated otherwise
+	usage := llm.NewUsage(4+llm.CountTokens("gpt-4", "hi"), llm.CountTokens("gpt-4", "hello world"))
+	resp, err := llm.New(llm.NewMemoryDao(), cli).CreateChatCompletion(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, usage, resp.Usage)
+	assert.Len(t, recorder.records, 1)
+	record := recorder.records[0]
+	assert.Equal(t, "openai", record.Provider)
+	assert.Equal(t, "gpt-4", record.Model)
+	assert.True(t, record.Estimated)
+	assert.Equal(t, resp.Usage, record.Usage)
+	assert.InDelta(t, float64(usage.PromptTokens*30+usage.CompletionTokens*60)/1e6, record.Cost, 1e-12)
+
+	// the usage chunk is only streamed to callers asking for it
+	dataChan := make(chan llm.ChatCompletionStreamResponse)
+	errChan := make(chan error)
+	go cli.CreateChatCompletionStream(context.Background(), req, dataChan, errChan)
+	chunks := 0
+	for done := false; !done; {
+		select {
+		case data := <-dataChan:
+			assert.Nil(t, data.Usage)
+			chunks++
+		case err := <-errChan:
+			assert.ErrorIs(t, err, io.EOF)
+			done = true
+		}
+	}
+	assert.Equal(t, 1, chunks)
+	assert.Len(t, recorder.records, 2)
+}
+
+// recordingDao records the usage of the requests sent with it, like the dao of a transaction
+type recordingDao struct {
+	llm.Dao
+	fakeRecorder
+}
+
+func TestTrackedClientUsageWithDao(t *testing.T) {
+	var streams atomic.Int64
+	cli := &trackedClient{Client: &fakeClient{content: "hello world"}, provider: "openai", streams: &streams, catalog: llm.NewCatalog(nil)}
+	req := llm.ChatCompletionRequest{
+		Model:    "openai/gpt-4",
+		Messages: []llm.ChatCompletionMessage{{Role: llm.ChatMessageRoleUser, Content: "hi"}},
+	}
+
+	base := &recordingDao{Dao: llm.NewMemoryDao()}
+	tx := &recordingDao{Dao: llm.NewMemoryDao()}
+	_, err := llm.New(base, cli).WithDao(tx).CreateChatCompletion(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Empty(t, base.records)
+	assert.Len(t, tx.records, 1)
+}
+
+func TestRegistryModels(t *testing.T) {
+	r := NewRegistry(llm.NewMemoryDao())
+	err := r.Reload([]llm.Config{
+		{LLMType: llm.LLMTypeOpenAI, ApiKey: "key", Models: []string{llm.OAIModelGPT4, llm.OAIModelGPT4V}},
+		{LLMType: llm.LLMTypeOpenRouter, ApiKey: "key", Models: []string{llm.OAIModelGPT4}},
+	}, Options{Routes: []llm.Route{{Model: "smart", Targets: []string{"open-router/" + llm.OAIModelGPT4, "openai"}}}})
+	assert.NoError(t, err)
+
+	models := r.Models()
+	ids := make([]string, 0, len(models))
+	for _, m := range models {
+		ids = append(ids, m.ID)
+		assert.True(t, m.Capabilities.Streaming)
+		assert.True(t, m.Capabilities.Tools)
+	}
+	assert.Equal(t, []string{"openai/gpt-4", "openai/gpt-4-vision-preview", "open-router/gpt-4", "smart", "gpt-4", "gpt-4-vision-preview"}, ids)
+
+	smart := models[3]
+	assert.Equal(t, "open-router", smart.Provider)
+	assert.Equal(t, 8192, smart.ContextLength)
+	assert.True(t, models[1].Capabilities.Vision)
+	assert.False(t, models[0].Capabilities.Vision)
+}
+
+type fakeEmbedder struct {
+	fakeClient
+}
+
+func (c *fakeEmbedder) CreateEmbeddings(ctx context.Context, req llm.EmbeddingRequest) (llm.EmbeddingResponse, error) {
+	c.calls++
+	c.models = append(c.models, req.Model)
+	if c.err != nil {
+		return llm.EmbeddingResponse{}, c.err
+	}
+	return llm.EmbeddingResponse{Data: []llm.Embedding{{Embedding: []float32{1}}}}, nil
+}
+
+func TestTrackedClientEmbeddings(t *testing.T) {
+	var streams atomic.Int64
+	recorder := &fakeRecorder{}
+	cli := &trackedClient{Client: &fakeEmbedder{}, provider: "openai", streams: &streams, recorder: recorder, catalog: llm.NewCatalog(nil)}
+
+	resp, err := llm.New(llm.NewMemoryDao(), cli).CreateEmbeddings(context.Background(), llm.EmbeddingRequest{Model: llm.OAIModel3SmallEmbedding, Input: "hello world"})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Data, 1)
+	tokens := llm.CountTokens(llm.OAIModel3SmallEmbedding, "hello world")
+	assert.Equal(t, llm.NewUsage(tokens, 0), resp.Usage)
+	assert.Len(t, recorder.records, 1)
+	assert.True(t, recorder.records[0].Estimated)
+	assert.InDelta(t, float64(tokens)*0.02/1e6, recorder.records[0].Cost, 1e-15)
+
+	cli = &trackedClient{Client: &fakeClient{}, streams: &streams}
+	_, err = llm.New(llm.NewMemoryDao(), cli).CreateEmbeddings(context.Background(), llm.EmbeddingRequest{Input: "a"})
+	assert.ErrorIs(t, err, llm.ErrEmbeddingsNotSupported)
+}
@@ -0,0 +1,27 @@
+package llms
+
+import (
+	"context"
+	"time"
+
+	"github.com/Vaayne/aienvoy/pkg/llms/llm"
+)
+
+// UsageRecord is the usage of one request sent to a provider.
+type UsageRecord struct {
+	// Provider is the id of the config which served the request
+	Provider string
+	// Model is the model sent to the provider, routes may have changed the requested one
+	Model string
+	Usage llm.Usage
+	// Estimated is set when the provider did not report the usage and it has been estimated
+	Estimated bool
+	// Cost is the price in USD of the usage, zero for models without pricing in the catalogue
+	Cost    float64
+	Latency time.Duration
+}
+
+// UsageRecorder stores the usage of the requests, the caller of the request can be read from ctx.
+type UsageRecorder interface {
+	RecordUsage(ctx context.Context, record UsageRecord)
+}
@@ -23,6 +23,12 @@ func New(opts ...Option) *Session {
 	return session
 }
 
+// Close closes the idle connections of the session, the ones in use are closed once their response is read.
+func (s *Session) Close() error {
+	s.Client.CloseIdleConnections()
+	return nil
+}
+
 type Option func(*Session)
 
 // WithClientHelloID is used to set tls config